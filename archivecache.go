@@ -0,0 +1,183 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/charmrepo/v7/csclient"
+)
+
+// archiveCache holds charm and bundle archives in a directory so that
+// retrieving the same archive again does not transfer it from the
+// charm store. Entries are keyed by the fully qualified id of the
+// entity and the hash of its archive, so an entry is only used when the
+// charm store reports exactly the same archive.
+//
+// Entries are written to a temporary file that is renamed into place,
+// so that concurrent users of the directory, including other
+// processes, never see a partially written entry. Entries are checked
+// against the expected hash when they are read.
+//
+// The cache may be limited by an ArchiveCachePolicy. Entries are
+// touched when they are used, and when an entry is added, the least
+// recently used entries are removed as needed to satisfy the policy.
+//
+// The directory lock (see lockDir) is held only while entries are
+// being removed. It makes processes prune the directory one at a
+// time, so that each one sees the entries that remain after the
+// others have removed theirs and the cache is not pruned below its
+// maximum size. Reading and adding entries do not need the lock: an
+// entry is added by renaming a complete file into place, and is
+// checked against its hash when it is read, so an entry that is
+// removed or replaced by another process is simply not used.
+type archiveCache struct {
+	dir    string
+	policy ArchiveCachePolicy
+	now    func() time.Time
+}
+
+// ArchiveCachePolicy limits the archives held in an archive cache
+// directory. See NewCharmStoreParams.ArchiveCacheDir.
+//
+// Archives are keyed by their hash, so they never become stale and are
+// not given a time to live. Resolving a charm URL gives results that
+// do change, and these can be cached for a limited time with
+// NewCharmStoreParams.ResolveCacheTTL.
+type ArchiveCachePolicy struct {
+	// MaxSize, if positive, holds the maximum total size in bytes
+	// of the archives in the cache. When it is exceeded, the least
+	// recently used archives are removed.
+	MaxSize int64
+}
+
+// newArchiveCache returns a cache that holds archives in the given
+// directory according to the given policy, or nil if the directory
+// is empty.
+func newArchiveCache(dir string, policy ArchiveCachePolicy) *archiveCache {
+	if dir == "" {
+		return nil
+	}
+	return &archiveCache{
+		dir:    dir,
+		policy: policy,
+		now:    time.Now,
+	}
+}
+
+// idReplacer is used to turn an entity id into a file name.
+var idReplacer = strings.NewReplacer("/", "_", ":", "_")
+
+// path returns the path of the cache entry for the given archive.
+func (c *archiveCache) path(data *csclient.ArchiveData) string {
+	alg := data.HashAlgorithm
+	if alg == "" {
+		alg = csclient.SHA384
+	}
+	return filepath.Join(c.dir, idReplacer.Replace(data.Id.String())+"."+string(alg)+"."+data.Hash)
+}
+
+// open returns the cache entry for the given archive, or nil if there
+// is no such entry. An entry that does not match the expected hash and
+// size is removed. It is OK to call open on a nil cache.
+func (c *archiveCache) open(data *csclient.ArchiveData) *os.File {
+	if c == nil || data.Hash == "" {
+		return nil
+	}
+	path := c.path(data)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	check := *data
+	check.ReadCloser = f
+	if _, err := check.CopyVerified(ioutil.Discard); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil
+	}
+	// Record the use of the entry for eviction.
+	now := c.now()
+	os.Chtimes(path, now, now)
+	return f
+}
+
+// copy copies the given archive data to w, checking that it matches
+// the expected hash and size, and adds it to the cache once it has been
+// verified, as the entry for the archive described by the given
+// information. Failure to add the entry does not cause copy to fail.
+// It is OK to call copy on a nil cache.
+func (c *archiveCache) copy(data, info *csclient.ArchiveData, w io.Writer) error {
+	if c == nil || info.Hash == "" {
+		return copyArchiveData(data, w)
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return copyArchiveData(data, w)
+	}
+	f, err := ioutil.TempFile(c.dir, ".tmp")
+	if err != nil {
+		return copyArchiveData(data, w)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := copyArchiveData(data, io.MultiWriter(w, f)); err != nil {
+		return err
+	}
+	if err := f.Close(); err == nil {
+		os.Rename(f.Name(), c.path(info))
+		c.prune()
+	}
+	return nil
+}
+
+// prune removes the entries that must be removed to keep the cache
+// within its maximum size, least recently used first. The directory
+// is locked while entries are removed, so that several processes
+// pruning the cache at once do not remove more entries than needed.
+func (c *archiveCache) prune() {
+	if c.policy.MaxSize <= 0 {
+		return
+	}
+	unlock, err := lockDir(c.dir)
+	if err != nil {
+		logger.Warningf("cannot lock archive cache: %v", err)
+		return
+	}
+	defer unlock()
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var entries []os.FileInfo
+	var size int64
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		entries = append(entries, info)
+		size += info.Size()
+	}
+	// Remove the most recently used entries last.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, info := range entries {
+		if size <= c.policy.MaxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err == nil || os.IsNotExist(err) {
+			size -= info.Size()
+		}
+	}
+}
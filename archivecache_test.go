@@ -0,0 +1,120 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7"
+)
+
+type archiveCacheSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&archiveCacheSuite{})
+
+func (s *archiveCacheSuite) TestGetUsesArchiveCache(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/xenial/wordpress-1")
+
+	cacheDir := filepath.Join(c.MkDir(), "cache")
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL:             store.URL,
+		ArchiveCacheDir: cacheDir,
+	})
+	dir := c.MkDir()
+	_, err := repo.Get(charm.MustParseURL("cs:~bob/wordpress"), filepath.Join(dir, "first"))
+	c.Assert(err, gc.IsNil)
+	entries, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+
+	// The archive is read from the cache without
+	// being downloaded again.
+	path := filepath.Join(dir, "second")
+	_, err = repo.Get(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), path)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, e.archive)
+	c.Assert(store.downloads, gc.HasLen, 1)
+
+	// Streamed archives are read from the cache too.
+	r, _, err := repo.GetStream(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	data, err = ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, e.archive)
+	c.Assert(store.downloads, gc.HasLen, 1)
+
+	// A corrupted entry is not used, and is replaced.
+	err = ioutil.WriteFile(entries[0], []byte("bad"), 0644)
+	c.Assert(err, gc.IsNil)
+	path = filepath.Join(dir, "third")
+	_, err = repo.Get(charm.MustParseURL("cs:~bob/wordpress"), path)
+	c.Assert(err, gc.IsNil)
+	data, err = ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, e.archive)
+	data, err = ioutil.ReadFile(entries[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, e.archive)
+}
+
+func (s *archiveCacheSuite) TestArchiveCachePolicy(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	mysql := store.addCharm("cs:~bob/xenial/mysql-1")
+	wordpress := store.addCharm("cs:~bob/xenial/wordpress-1")
+
+	cacheDir := filepath.Join(c.MkDir(), "cache")
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL:             store.URL,
+		ArchiveCacheDir: cacheDir,
+		ArchiveCachePolicy: charmrepo.ArchiveCachePolicy{
+			MaxSize: int64(len(mysql.archive) + len(wordpress.archive) - 1),
+		},
+	})
+	dir := c.MkDir()
+	_, err := repo.Get(charm.MustParseURL("cs:~bob/xenial/mysql-1"), filepath.Join(dir, "mysql"))
+	c.Assert(err, gc.IsNil)
+	entries, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+	// Make the mysql entry the least recently used.
+	lastUsed := time.Now().Add(-time.Minute)
+	err = os.Chtimes(entries[0], lastUsed, lastUsed)
+	c.Assert(err, gc.IsNil)
+
+	// Both archives do not fit in the cache,
+	// so the mysql archive is removed.
+	_, err = repo.Get(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), filepath.Join(dir, "wordpress"))
+	c.Assert(err, gc.IsNil)
+	entries, err = filepath.Glob(filepath.Join(cacheDir, "*"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+	c.Assert(filepath.Base(entries[0]), jc.HasPrefix, "cs_~bob_xenial_wordpress-1.")
+
+	// The remaining entry is used however long ago it was last used.
+	lastUsed = time.Now().Add(-24 * time.Hour)
+	err = os.Chtimes(entries[0], lastUsed, lastUsed)
+	c.Assert(err, gc.IsNil)
+	_, err = repo.Get(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), filepath.Join(dir, "wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.downloads, gc.HasLen, 2)
+	info, err := os.Stat(entries[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(time.Since(info.ModTime()) < time.Hour, jc.IsTrue)
+}
@@ -0,0 +1,725 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// ArchiveIndexFile holds the name of the index file
+// in an ArchiveDir directory.
+const ArchiveIndexFile = "index.yaml"
+
+// ArchiveDir is a repository Interface that serves charms and bundles
+// from archives held in a local directory, for use where no charm
+// store is reachable. The directory holds the archives and an index
+// file, named by ArchiveIndexFile, that records the URL of each
+// archive. URLs are resolved in the same way as by the charm store.
+//
+// The directory is typically populated with Add on a machine with
+// access to a charm store, and then copied to where it is needed.
+// The index file may also be written by hand. Archives need not be
+// arranged by series: when the entry for a charm gives neither a series
+// nor the supported series, they are read from the charm's metadata.
+// Changes to the index file, including those made by Add in other
+// processes, are picked up when the index is next used.
+//
+// An index entry may name a charm or bundle directory rather than an
+// archive. The directory is packed into an archive (see Pack) each time
+// it is read, so that a charm being developed can be served without
+// adding it again after every change. Changes to such a directory are
+// not reported by Watch, and it cannot be served by a StaticRepo.
+//
+// An ArchiveDir may be used concurrently. Archives are read while
+// holding a lock on the index, so that Add on the same ArchiveDir
+// cannot replace an archive while it is being read.
+//
+// An ArchiveDir created with NewArchiveFS serves archives from a file
+// system other than the operating system's, such as an embed.FS,
+// and cannot be added to.
+type ArchiveDir struct {
+	// dir holds the directory, or is empty if
+	// the archives are not in the OS file system.
+	dir string
+
+	// fsys holds the file system that the
+	// index and archives are read from.
+	fsys fs.FS
+
+	// mu guards the fields below and serializes changes to the
+	// directory. It is held for reading while archives are read
+	// so that they are not replaced by Add while being read.
+	mu    sync.RWMutex
+	index archiveIndex
+
+	// indexInfo holds information on the index file
+	// that index was read from, or nil if there was none.
+	indexInfo os.FileInfo
+}
+
+var _ Interface = (*ArchiveDir)(nil)
+
+// archiveIndex holds the contents of an index file.
+type archiveIndex struct {
+	Entries []archiveIndexEntry `yaml:"entries" json:"entries"`
+}
+
+// archiveIndexEntry holds the index entry for an archive.
+type archiveIndexEntry struct {
+	// URL holds the fully qualified URL of the entity.
+	URL string `yaml:"url" json:"url"`
+
+	// File holds the name of the archive file, or of a charm
+	// or bundle directory, relative to the directory.
+	File string `yaml:"file" json:"file"`
+
+	// Hash holds the hex-encoded SHA384 hash of the archive.
+	// If it is empty, the archive is not verified.
+	Hash string `yaml:"hash,omitempty" json:"hash,omitempty"`
+
+	// SupportedSeries holds the series supported by a charm
+	// whose URL has no series.
+	SupportedSeries []string `yaml:"supported-series,omitempty" json:"supported-series,omitempty"`
+
+	// id holds URL parsed.
+	id *charm.URL
+}
+
+// NewArchiveDir returns a repository that serves archives from the
+// given directory, reading the index file if there is one. If the
+// directory does not exist, it is created.
+func NewArchiveDir(dir string) (*ArchiveDir, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	d := &ArchiveDir{
+		dir:  dir,
+		fsys: os.DirFS(dir),
+	}
+	if err := d.refresh(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return d, nil
+}
+
+// NewArchiveFS returns a read-only repository that serves archives
+// from the root of the given file system, which is laid out in the
+// same way as the directory of an ArchiveDir.
+func NewArchiveFS(fsys fs.FS) (*ArchiveDir, error) {
+	d := &ArchiveDir{
+		fsys: fsys,
+	}
+	if err := d.refresh(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return d, nil
+}
+
+// refresh reads the index file again if it has changed
+// since it was last read. It must be called with d.mu held.
+func (d *ArchiveDir) refresh() error {
+	info, err := fs.Stat(d.fsys, ArchiveIndexFile)
+	if os.IsNotExist(err) {
+		d.index, d.indexInfo = archiveIndex{}, nil
+		return nil
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if d.indexInfo != nil && info.ModTime().Equal(d.indexInfo.ModTime()) && info.Size() == d.indexInfo.Size() {
+		return nil
+	}
+	data, err := fs.ReadFile(d.fsys, ArchiveIndexFile)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var index archiveIndex
+	if err := index.parse(data, yaml.Unmarshal); err != nil {
+		return errgo.Mask(err)
+	}
+	for i := range index.Entries {
+		e := &index.Entries[i]
+		if e.id.Series != "" || len(e.SupportedSeries) > 0 {
+			continue
+		}
+		series, err := d.charmSeries(e.File)
+		if err != nil {
+			logger.Warningf("cannot read supported series of %q: %v", e.id, err)
+			continue
+		}
+		e.SupportedSeries = series
+	}
+	d.index, d.indexInfo = index, info
+	return nil
+}
+
+// charmSeries returns the series declared in the
+// metadata of the charm archive in the given file.
+func (d *ArchiveDir) charmSeries(file string) ([]string, error) {
+	meta, err := d.charmMeta(file)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return meta.Series, nil
+}
+
+// charmMeta returns the metadata of the
+// charm archive in the given file.
+func (d *ArchiveDir) charmMeta(file string) (*charm.Meta, error) {
+	data, err := d.readArchive(file)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ch, err := charm.ReadCharmArchiveBytes(data)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return ch.Meta(), nil
+}
+
+// parse parses the index file contents in data into index,
+// decoding them with the given function.
+func (index *archiveIndex) parse(data []byte, unmarshal func([]byte, interface{}) error) error {
+	if err := unmarshal(data, index); err != nil {
+		return errgo.Notef(err, "cannot parse archive index")
+	}
+	for i := range index.Entries {
+		e := &index.Entries[i]
+		id, err := charm.ParseURL(e.URL)
+		if err != nil {
+			return errgo.Notef(err, "bad URL in archive index")
+		}
+		if id.Revision < 0 {
+			return errgo.Newf("no revision in archive index URL %q", e.URL)
+		}
+		e.id = id
+	}
+	return nil
+}
+
+// Dir returns the directory holding the archives, or the empty
+// string if the repository was created with NewArchiveFS.
+func (d *ArchiveDir) Dir() string {
+	return d.dir
+}
+
+// Add copies the charm or bundle archive at the given path into the
+// directory and records it in the index with the given URL, which
+// must be fully qualified apart from its series, which may be empty
+// for a charm that supports several series. Any existing entry with
+// the same URL is replaced.
+func (d *ArchiveDir) Add(id *charm.URL, archivePath string) error {
+	if d.dir == "" {
+		return errgo.New("cannot add to read-only archive file system")
+	}
+	if id.Revision < 0 {
+		return errgo.Newf("no revision specified in %q", id)
+	}
+	unlock, err := d.lock()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer unlock()
+	return errgo.Mask(d.add(id, archivePath))
+}
+
+// Put adds the given charm to the directory with the given URL, which
+// must be fully qualified apart from its series and revision, and
+// returns the URL it was added with. The charm must be a
+// *charm.CharmArchive or a *charm.CharmDir. If the URL has no revision,
+// the charm is given one greater than the latest revision of the charm
+// in the directory with the same name and user, or the revision of the
+// charm itself if that is greater.
+func (d *ArchiveDir) Put(ref *charm.URL, ch charm.Charm) (*charm.URL, error) {
+	if d.dir == "" {
+		return nil, errgo.New("cannot add to read-only archive file system")
+	}
+	if ref.Series == "bundle" {
+		return nil, errgo.Newf("expected a charm URL, got bundle URL %q", ref)
+	}
+	var archivePath string
+	switch ch := ch.(type) {
+	case *charm.CharmArchive:
+		archivePath = ch.Path
+	case *charm.CharmDir:
+		f, err := ioutil.TempFile("", "charmrepo-put")
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer os.Remove(f.Name())
+		err = ch.ArchiveTo(f)
+		f.Close()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot archive charm")
+		}
+		archivePath = f.Name()
+	default:
+		return nil, errgo.Newf("cannot add charm of type %T", ch)
+	}
+	unlock, err := d.lock()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer unlock()
+	id := ref
+	if id.Revision < 0 {
+		if err := d.refresh(); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rev := ch.Revision()
+		for _, e := range d.index.Entries {
+			if e.id.Name == ref.Name && e.id.User == ref.User && e.id.Revision >= rev {
+				rev = e.id.Revision + 1
+			}
+		}
+		id = ref.WithRevision(rev)
+	}
+	if err := d.add(id, archivePath); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return id, nil
+}
+
+// lock acquires d.mu and locks the directory so that entries
+// added by other processes are not lost. It returns a function
+// that releases both locks.
+func (d *ArchiveDir) lock() (unlock func(), err error) {
+	d.mu.Lock()
+	unlockDir, err := lockDir(d.dir)
+	if err != nil {
+		d.mu.Unlock()
+		return nil, errgo.Mask(err)
+	}
+	return func() {
+		unlockDir()
+		d.mu.Unlock()
+	}, nil
+}
+
+// add implements Add. It must be called with
+// the locks acquired by d.lock held.
+func (d *ArchiveDir) add(id *charm.URL, archivePath string) error {
+	e := archiveIndexEntry{
+		URL: id.String(),
+		id:  id,
+	}
+	if id.Series == "bundle" {
+		if _, err := charm.ReadBundleArchive(archivePath); err != nil {
+			return errgo.Notef(err, "cannot read bundle archive")
+		}
+		e.File = fmt.Sprintf("%s-%d.bundle", id.Name, id.Revision)
+	} else {
+		ch, err := charm.ReadCharmArchive(archivePath)
+		if err != nil {
+			return errgo.Notef(err, "cannot read charm archive")
+		}
+		if id.Series == "" {
+			e.SupportedSeries = ch.Meta().Series
+		}
+		e.File = fmt.Sprintf("%s-%d.charm", id.Name, id.Revision)
+	}
+	e.File = archiveFilePrefix(id) + e.File
+	if err := d.refresh(); err != nil {
+		return errgo.Mask(err)
+	}
+	// Archive files in directories written by hand, or by earlier
+	// versions, may be named differently, so make sure that the
+	// file does not hold the archive of another entity.
+	for _, old := range d.index.Entries {
+		if old.File == e.File && old.URL != e.URL {
+			return errgo.Newf("archive file %q is already used by %q", e.File, old.URL)
+		}
+	}
+	hash, err := copyArchiveFile(archivePath, filepath.Join(d.dir, e.File))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	e.Hash = hash
+
+	entries := make([]archiveIndexEntry, 0, len(d.index.Entries)+1)
+	for _, old := range d.index.Entries {
+		if old.URL != e.URL {
+			entries = append(entries, old)
+		}
+	}
+	index := archiveIndex{
+		Entries: append(entries, e),
+	}
+	if err := writeArchiveIndex(d.dir, index); err != nil {
+		return errgo.Mask(err)
+	}
+	// Use the index just written rather than reading it again, as
+	// a rewritten index may have the same size and modification time
+	// as the one it replaces.
+	info, err := fs.Stat(d.fsys, ArchiveIndexFile)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	d.index, d.indexInfo = index, info
+	return nil
+}
+
+// archiveFilePrefix returns the prefix of the name of the archive file
+// of the entity with the given id, which identifies its series and
+// user. The parts are separated by underscores and the user is marked
+// with a tilde, neither of which can appear in a series, user or name,
+// so that different ids never share an archive file.
+func archiveFilePrefix(id *charm.URL) string {
+	prefix := ""
+	if id.Series != "" && id.Series != "bundle" {
+		prefix += id.Series + "_"
+	}
+	if id.User != "" {
+		prefix += "~" + id.User + "_"
+	}
+	return prefix
+}
+
+// WriteStaticIndex writes the index of the directory as a JSON index
+// file, named by StaticIndexFile, so that the directory can be served
+// by a web server as a static repository for use with StaticRepo.
+// The JSON index is not kept up to date by Add, so WriteStaticIndex
+// should be called again after adding archives.
+func (d *ArchiveDir) WriteStaticIndex() error {
+	if d.dir == "" {
+		return errgo.New("cannot write to read-only archive file system")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.refresh(); err != nil {
+		return errgo.Mask(err)
+	}
+	index := d.index
+	if index.Entries == nil {
+		index.Entries = []archiveIndexEntry{}
+	}
+	for _, e := range index.Entries {
+		if d.isEntityDir(e.File) {
+			return errgo.Newf("cannot serve directory %q for %q from a static index", e.File, e.id)
+		}
+	}
+	data, err := json.MarshalIndent(index, "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(writeIndexFile(filepath.Join(d.dir, StaticIndexFile), data))
+}
+
+// Resolve implements Interface.Resolve.
+func (d *ArchiveDir) Resolve(ref *charm.URL) (*charm.URL, []string, error) {
+	e, err := d.resolve(ref)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return e.id, e.supportedSeries(), nil
+}
+
+// Get implements Interface.Get.
+func (d *ArchiveDir) Get(curl *charm.URL, archivePath string) (*charm.CharmArchive, error) {
+	if curl.Series == "bundle" {
+		return nil, errgo.Newf("expected a charm URL, got bundle URL %q", curl)
+	}
+	if err := d.getToFile(curl, archivePath); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return charm.ReadCharmArchive(archivePath)
+}
+
+// GetBundle implements Interface.GetBundle.
+func (d *ArchiveDir) GetBundle(curl *charm.URL, archivePath string) (charm.Bundle, error) {
+	if curl.Series != "bundle" {
+		return nil, errgo.Newf("expected a bundle URL, got charm URL %q", curl)
+	}
+	if err := d.getToFile(curl, archivePath); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return charm.ReadBundleArchive(archivePath)
+}
+
+// ArchiveEntry describes an archive held in an ArchiveDir.
+type ArchiveEntry struct {
+	// URL holds the URL of the charm or bundle.
+	URL *charm.URL
+
+	// Path holds the path of the archive, or of the charm
+	// or bundle directory (see ArchiveDir). For a repository
+	// created with NewArchiveFS, it is relative to the root
+	// of the file system.
+	Path string
+
+	// SupportedSeries holds the series supported by a charm.
+	SupportedSeries []string
+}
+
+// Find returns all the archives in the directory of charms or bundles
+// with the given name that support the given series, ordered by name,
+// user, series and revision. If name or series is empty, it matches
+// any name or series.
+func (d *ArchiveDir) Find(name, series string) ([]ArchiveEntry, error) {
+	unlock, err := d.rlock()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer unlock()
+	var found []ArchiveEntry
+	for _, e := range d.index.Entries {
+		supported := e.supportedSeries()
+		if name != "" && e.id.Name != name {
+			continue
+		}
+		if series != "" && e.id.Series != series && !containsString(supported, series) {
+			continue
+		}
+		path := e.File
+		if d.dir != "" {
+			path = filepath.Join(d.dir, e.File)
+		}
+		found = append(found, ArchiveEntry{
+			URL:             e.id,
+			Path:            path,
+			SupportedSeries: supported,
+		})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		u0, u1 := found[i].URL, found[j].URL
+		switch {
+		case u0.Name != u1.Name:
+			return u0.Name < u1.Name
+		case u0.User != u1.User:
+			return u0.User < u1.User
+		case u0.Series != u1.Series:
+			return u0.Series < u1.Series
+		}
+		return u0.Revision < u1.Revision
+	})
+	return found, nil
+}
+
+// rlock reads the index again if it has changed and acquires d.mu
+// for reading. It returns a function that releases the lock.
+func (d *ArchiveDir) rlock() (unlock func(), err error) {
+	d.mu.Lock()
+	err = d.refresh()
+	d.mu.Unlock()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	d.mu.RLock()
+	return d.mu.RUnlock, nil
+}
+
+// entries returns a copy of the entries in the index.
+func (d *ArchiveDir) entries() ([]archiveIndexEntry, error) {
+	unlock, err := d.rlock()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer unlock()
+	return append([]archiveIndexEntry(nil), d.index.Entries...), nil
+}
+
+// resolve returns the index entry that ref refers to.
+func (d *ArchiveDir) resolve(ref *charm.URL) (archiveIndexEntry, error) {
+	unlock, err := d.rlock()
+	if err != nil {
+		return archiveIndexEntry{}, errgo.Mask(err)
+	}
+	defer unlock()
+	return d.index.resolve(ref)
+}
+
+// resolve returns the entry that ref refers to. As in the charm store,
+// a URL without a revision refers to the latest revision, and a charm
+// URL with a series matches a charm supporting that series.
+func (index *archiveIndex) resolve(ref *charm.URL) (archiveIndexEntry, error) {
+	var found *archiveIndexEntry
+	for i, e := range index.Entries {
+		switch {
+		case e.id.Name != ref.Name || e.id.User != ref.User:
+		case ref.Revision >= 0 && e.id.Revision != ref.Revision:
+		case ref.Series != "" && e.id.Series != ref.Series && !containsString(e.SupportedSeries, ref.Series):
+		default:
+			if found == nil || e.id.Revision > found.id.Revision {
+				found = &index.Entries[i]
+			}
+		}
+	}
+	if found == nil {
+		return archiveIndexEntry{}, resolveNotFoundError(ref)
+	}
+	return *found, nil
+}
+
+// supportedSeries returns the series supported by
+// the entity with the entry.
+func (e archiveIndexEntry) supportedSeries() []string {
+	if e.id.Series != "" {
+		return []string{e.id.Series}
+	}
+	return append([]string(nil), e.SupportedSeries...)
+}
+
+// getToFile copies the archive of the charm or bundle
+// referenced by curl into the given file.
+func (d *ArchiveDir) getToFile(curl *charm.URL, archivePath string) error {
+	unlock, err := d.rlock()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer unlock()
+	e, err := d.index.resolve(curl)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	f, err := d.openArchive(e.File)
+	if err != nil {
+		return errgo.Notef(err, "cannot open archive for %q", e.id)
+	}
+	defer f.Close()
+	return errgo.Mask(writeIndexedArchive(e, f, -1, archivePath), errgo.Any)
+}
+
+// openArchive opens the archive in the given file, relative to the
+// directory, packing it first if the file is a directory.
+func (d *ArchiveDir) openArchive(file string) (io.ReadCloser, error) {
+	if !d.isEntityDir(file) {
+		return d.fsys.Open(file)
+	}
+	data, err := d.packEntityDir(file)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// readArchive returns the contents of the archive in the given file,
+// relative to the directory, packing it first if the file is a
+// directory.
+func (d *ArchiveDir) readArchive(file string) ([]byte, error) {
+	if !d.isEntityDir(file) {
+		return fs.ReadFile(d.fsys, file)
+	}
+	return d.packEntityDir(file)
+}
+
+// isEntityDir reports whether the given file, relative
+// to the directory, is a charm or bundle directory.
+func (d *ArchiveDir) isEntityDir(file string) bool {
+	info, err := fs.Stat(d.fsys, file)
+	return err == nil && info.IsDir()
+}
+
+// packEntityDir returns an archive of the charm or bundle
+// directory with the given name, relative to the directory.
+func (d *ArchiveDir) packEntityDir(file string) ([]byte, error) {
+	if d.dir == "" {
+		// Pack reads the directory from the OS file system.
+		return nil, errgo.Newf("cannot pack directory %q in read-only archive file system", file)
+	}
+	var buf bytes.Buffer
+	if _, err := Pack(filepath.Join(d.dir, file), FormatZip, &buf); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeIndexedArchive writes the archive with the given index entry,
+// read from r, to the given file, checking that it matches the hash
+// in the entry, if any, and the given size, if it is not negative.
+func writeIndexedArchive(e archiveIndexEntry, r io.ReadCloser, size int64, archivePath string) error {
+	sink, err := NewFileArchiveSink(archivePath)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	w := &offsetWriter{w: sink}
+	if e.Hash == "" {
+		_, err = io.Copy(w, r)
+	} else {
+		_, err = (&csclient.ArchiveData{
+			ReadCloser: r,
+			Id:         e.id,
+			Hash:       e.Hash,
+			Size:       size,
+		}).CopyVerified(w)
+	}
+	if err != nil {
+		sink.Abort()
+		if _, ok := errgo.Cause(err).(*csclient.HashMismatchError); ok {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return errgo.Notef(err, "cannot read archive for %q", e.id)
+	}
+	if err := sink.Commit(); err != nil {
+		return errgo.Notef(err, "cannot commit archive")
+	}
+	return nil
+}
+
+// copyArchiveFile copies the file at src to dst, which is never
+// seen partially written, returning the hex-encoded SHA384 hash
+// of its contents.
+func copyArchiveFile(src, dst string) (string, error) {
+	r, err := os.Open(src)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	defer r.Close()
+	sink, err := NewFileArchiveSink(dst)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	h := sha512.New384()
+	if _, err := io.Copy(io.MultiWriter(h, &offsetWriter{w: sink}), r); err != nil {
+		sink.Abort()
+		return "", errgo.Notef(err, "cannot copy archive")
+	}
+	if err := sink.Commit(); err != nil {
+		return "", errgo.Notef(err, "cannot commit archive")
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// writeArchiveIndex writes the given index to the index
+// file in the given directory.
+func writeArchiveIndex(dir string, index archiveIndex) error {
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(writeIndexFile(filepath.Join(dir, ArchiveIndexFile), data))
+}
+
+// writeIndexFile writes data to the file at the given
+// path, which is never seen partially written.
+func writeIndexFile(path string, data []byte) error {
+	sink, err := NewFileArchiveSink(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := sink.WriteAt(data, 0); err != nil {
+		sink.Abort()
+		return errgo.Notef(err, "cannot write archive index")
+	}
+	if err := sink.Commit(); err != nil {
+		return errgo.Notef(err, "cannot write archive index")
+	}
+	return nil
+}
@@ -0,0 +1,689 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
+)
+
+type archiveDirSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&archiveDirSuite{})
+
+func (s *archiveDirSuite) TestAddAndGet(c *gc.C) {
+	srcDir := c.MkDir()
+	ch := charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "test charm",
+		Series:  []string{"xenial", "bionic"},
+	})
+	charmPath := filepath.Join(srcDir, "wordpress.charm")
+	err := ioutil.WriteFile(charmPath, ch.ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	bundlePath := filepath.Join(srcDir, "wordpress-simple.bundle")
+	writeArchive(c, bundlePath, TestCharms.BundleDir("wordpress-simple"))
+
+	dir := filepath.Join(c.MkDir(), "archives")
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	for _, id := range []string{"cs:~bob/wordpress-1", "cs:~bob/wordpress-2"} {
+		err = repo.Add(charm.MustParseURL(id), charmPath)
+		c.Assert(err, gc.IsNil)
+	}
+	err = repo.Add(charm.MustParseURL("cs:bundle/wordpress-simple-3"), bundlePath)
+	c.Assert(err, gc.IsNil)
+	err = repo.Add(charm.MustParseURL("cs:~bob/wordpress"), charmPath)
+	c.Assert(err, gc.ErrorMatches, `no revision specified in "cs:~bob/wordpress"`)
+
+	// A new repository reads the index written by Add.
+	repo, err = charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	id, series, err := repo.Resolve(charm.MustParseURL("cs:~bob/bionic/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/wordpress-2")
+	c.Assert(series, jc.DeepEquals, []string{"xenial", "bionic"})
+
+	id, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/wordpress-1"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/wordpress-1")
+
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/trusty/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot resolve URL "cs:~bob/trusty/wordpress": charm not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	path := filepath.Join(c.MkDir(), "wordpress.charm")
+	archive, err := repo.Get(charm.MustParseURL("cs:~bob/wordpress"), path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(archive.Meta().Name, gc.Equals, "wordpress")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, ch.ArchiveBytes())
+
+	b, err := repo.GetBundle(charm.MustParseURL("cs:bundle/wordpress-simple"), filepath.Join(c.MkDir(), "bundle"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(b.Data().Applications, gc.HasLen, 2)
+
+	// A corrupted archive is detected.
+	err = ioutil.WriteFile(filepath.Join(dir, "~bob_wordpress-2.charm"), []byte("bad"), 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = repo.Get(charm.MustParseURL("cs:~bob/wordpress"), path)
+	_, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, jc.IsTrue, gc.Commentf("error %v", err))
+}
+
+func (s *archiveDirSuite) TestPut(c *gc.C) {
+	repo, err := charmrepo.NewArchiveDir(c.MkDir())
+	c.Assert(err, gc.IsNil)
+
+	// A charm directory is archived, and given its own
+	// revision when there are no earlier revisions.
+	dir := TestCharms.ClonedDir(c.MkDir(), "dummy")
+	dir.SetRevision(5)
+	id, err := repo.Put(charm.MustParseURL("cs:~bob/dummy"), dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/dummy-5")
+
+	// Later charms are given the next revision.
+	archive := TestCharms.CharmArchive(c.MkDir(), "dummy")
+	id, err = repo.Put(charm.MustParseURL("cs:~bob/xenial/dummy"), archive)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/xenial/dummy-6")
+
+	// An explicit revision is used as given.
+	id, err = repo.Put(charm.MustParseURL("cs:~bob/dummy-2"), archive)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/dummy-2")
+
+	id, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/xenial/dummy"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/xenial/dummy-6")
+	ch, err := repo.Get(charm.MustParseURL("cs:~bob/dummy-5"), filepath.Join(c.MkDir(), "dummy.charm"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ch.Meta().Name, gc.Equals, "dummy")
+
+	_, err = repo.Put(charm.MustParseURL("cs:bundle/dummy"), archive)
+	c.Assert(err, gc.ErrorMatches, `expected a charm URL, got bundle URL "cs:bundle/dummy"`)
+}
+
+func (s *archiveDirSuite) TestFind(c *gc.C) {
+	dir := c.MkDir()
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	charmPath := filepath.Join(c.MkDir(), "dummy.charm")
+	err = ioutil.WriteFile(charmPath, charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "dummy",
+		Summary: "test charm",
+		Series:  []string{"xenial", "bionic"},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	for _, id := range []string{"cs:~bob/dummy-10", "cs:~bob/dummy-9", "cs:xenial/dummy-1", "cs:bionic/dummy-2"} {
+		err := repo.Add(charm.MustParseURL(id), charmPath)
+		c.Assert(err, gc.IsNil)
+	}
+	err = repo.Add(charm.MustParseURL("cs:bundle/wordpress-simple-3"), TestCharms.BundleArchivePath(c.MkDir(), "wordpress-simple"))
+	c.Assert(err, gc.IsNil)
+
+	entries, err := repo.Find("dummy", "xenial")
+	c.Assert(err, gc.IsNil)
+	var urls []string
+	for _, e := range entries {
+		urls = append(urls, e.URL.String())
+	}
+	c.Assert(urls, jc.DeepEquals, []string{"cs:xenial/dummy-1", "cs:~bob/dummy-9", "cs:~bob/dummy-10"})
+	c.Assert(entries[0].Path, gc.Equals, filepath.Join(dir, "xenial_dummy-1.charm"))
+	c.Assert(entries[0].SupportedSeries, jc.DeepEquals, []string{"xenial"})
+
+	entries, err = repo.Find("", "bundle")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+	c.Assert(entries[0].URL.String(), gc.Equals, "cs:bundle/wordpress-simple-3")
+
+	entries, err = repo.Find("dummy", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 4)
+
+	entries, err = repo.Find("mysql", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 0)
+}
+
+func (s *archiveDirSuite) TestResources(c *gc.C) {
+	srcDir := c.MkDir()
+	charmPath := filepath.Join(srcDir, "wordpress.charm")
+	err := ioutil.WriteFile(charmPath, charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "test charm",
+		Series:  []string{"focal"},
+		Resources: map[string]resource.Meta{
+			"data": {
+				Name: "data",
+				Type: resource.TypeFile,
+				Path: "data.tgz",
+			},
+			"theme": {
+				Name: "theme",
+				Type: resource.TypeFile,
+				Path: "theme.zip",
+			},
+		},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	contentPath := func(content string) string {
+		path := filepath.Join(c.MkDir(), "content")
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		c.Assert(err, gc.IsNil)
+		return path
+	}
+
+	dir := c.MkDir()
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	id := charm.MustParseURL("cs:~bob/wordpress-2")
+	err = repo.Add(id, charmPath)
+	c.Assert(err, gc.IsNil)
+	err = repo.AddResource(id, "data", 1, contentPath("data 1"))
+	c.Assert(err, gc.IsNil)
+	err = repo.AddResource(id, "data", 3, contentPath("data 3"))
+	c.Assert(err, gc.IsNil)
+	err = repo.AddResource(id, "other", 1, contentPath("other"))
+	c.Assert(err, gc.ErrorMatches, `charm "cs:~bob/wordpress-2" has no resource "other"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "~bob_wordpress-2.resources", "data", "3"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "data 3")
+
+	// Only resources with content are listed.
+	resources, err := repo.ListResources(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 1)
+	c.Assert(resources[0].Name, gc.Equals, "data")
+	c.Assert(resources[0].Revision, gc.Equals, 3)
+	c.Assert(resources[0].Size, gc.Equals, int64(len("data 3")))
+	fp, err := resource.GenerateFingerprint(strings.NewReader("data 3"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources[0].Fingerprint.String(), gc.Equals, fp.String())
+
+	res, r, err := repo.GetResource(id, "data", 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Revision, gc.Equals, 1)
+	data, err = ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "data 1")
+
+	res, r, err = repo.GetResource(id, "data", -1)
+	c.Assert(err, gc.IsNil)
+	r.Close()
+	c.Assert(res.Revision, gc.Equals, 3)
+
+	_, _, err = repo.GetResource(id, "theme", -1)
+	c.Assert(err, gc.ErrorMatches, `no revisions of resource "theme" of "cs:~bob/wordpress-2"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, _, err = repo.GetResource(id, "data", 2)
+	c.Assert(err, gc.ErrorMatches, `revision 2 of resource "data" of "cs:~bob/wordpress-2" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *archiveDirSuite) TestSymlinks(c *gc.C) {
+	if runtime.GOOS == "windows" {
+		c.Skip("symbolic links require special privileges on Windows")
+	}
+	// A shared directory of charms, such as one on a network mount.
+	shared := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(shared, "mysql.charm"), charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "mysql",
+		Summary: "test charm",
+		Series:  []string{"focal"},
+		Resources: map[string]resource.Meta{
+			"data": {
+				Name: "data",
+				Type: resource.TypeFile,
+				Path: "data.tgz",
+			},
+		},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(shared, "data"), []byte("data"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	// The repository directory is itself a symbolic link and refers
+	// to archives and resources through symbolic links.
+	realDir := c.MkDir()
+	err = os.Symlink(shared, filepath.Join(realDir, "focal"))
+	c.Assert(err, gc.IsNil)
+	err = os.MkdirAll(filepath.Join(shared, "mysql.resources", "data"), 0755)
+	c.Assert(err, gc.IsNil)
+	err = os.Symlink(filepath.Join(shared, "data"), filepath.Join(shared, "mysql.resources", "data", "2"))
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(realDir, charmrepo.ArchiveIndexFile), []byte(`
+entries:
+- url: cs:focal/mysql-1
+  file: focal/mysql.charm
+`), 0644)
+	c.Assert(err, gc.IsNil)
+	dir := filepath.Join(c.MkDir(), "repo")
+	err = os.Symlink(realDir, dir)
+	c.Assert(err, gc.IsNil)
+
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	ch, err := repo.Get(charm.MustParseURL("cs:focal/mysql"), filepath.Join(c.MkDir(), "mysql.charm"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ch.Meta().Name, gc.Equals, "mysql")
+	resources, err := repo.ListResources(charm.MustParseURL("cs:focal/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 1)
+	c.Assert(resources[0].Revision, gc.Equals, 2)
+
+	// Archives can be added through the link.
+	err = repo.Add(charm.MustParseURL("cs:focal/mysql-2"), filepath.Join(shared, "mysql.charm"))
+	c.Assert(err, gc.IsNil)
+	_, err = os.Stat(filepath.Join(realDir, "focal_mysql-2.charm"))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *archiveDirSuite) TestHandWrittenIndex(c *gc.C) {
+	dir := c.MkDir()
+	ch := charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "mysql",
+		Summary: "test charm",
+	})
+	err := ioutil.WriteFile(filepath.Join(dir, "mysql.charm"), ch.ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, charmrepo.ArchiveIndexFile), []byte(`
+entries:
+- url: cs:xenial/mysql-7
+  file: mysql.charm
+`), 0644)
+	c.Assert(err, gc.IsNil)
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	id, series, err := repo.Resolve(charm.MustParseURL("cs:mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:xenial/mysql-7")
+	c.Assert(series, jc.DeepEquals, []string{"xenial"})
+	_, err = repo.Get(id, filepath.Join(c.MkDir(), "mysql.charm"))
+	c.Assert(err, gc.IsNil)
+
+	err = ioutil.WriteFile(filepath.Join(dir, charmrepo.ArchiveIndexFile), []byte(`
+entries:
+- url: cs:xenial/mysql
+  file: mysql.charm
+`), 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.ErrorMatches, `no revision in archive index URL "cs:xenial/mysql"`)
+}
+
+func (s *archiveDirSuite) TestArchiveFilesAreNotShared(c *gc.C) {
+	dir := c.MkDir()
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+
+	// Ids that differ only in where the user, series and name
+	// are split are stored in different files.
+	archives := make(map[string][]byte)
+	for _, id := range []string{"cs:~foo/bar-baz-1", "cs:foo-bar-baz-1", "cs:xenial/foo-1", "cs:~xenial/foo-1"} {
+		ch := charmtesting.NewCharmMeta(&charm.Meta{
+			Name:    charm.MustParseURL(id).Name,
+			Summary: id,
+		})
+		charmPath := filepath.Join(c.MkDir(), "charm")
+		err := ioutil.WriteFile(charmPath, ch.ArchiveBytes(), 0644)
+		c.Assert(err, gc.IsNil)
+		err = repo.Add(charm.MustParseURL(id), charmPath)
+		c.Assert(err, gc.IsNil)
+		archives[id] = ch.ArchiveBytes()
+	}
+	for id, archive := range archives {
+		path := filepath.Join(c.MkDir(), "charm")
+		_, err := repo.Get(charm.MustParseURL(id), path)
+		c.Assert(err, gc.IsNil)
+		data, err := ioutil.ReadFile(path)
+		c.Assert(err, gc.IsNil)
+		c.Assert(data, jc.DeepEquals, archive, gc.Commentf("id %s", id))
+	}
+
+	// A file used by an entry written by hand is not overwritten.
+	err = ioutil.WriteFile(filepath.Join(dir, charmrepo.ArchiveIndexFile), []byte(`
+entries:
+- url: cs:xenial/mysql-7
+  file: xenial_mysql-8.charm
+`), 0644)
+	c.Assert(err, gc.IsNil)
+	err = repo.Add(charm.MustParseURL("cs:xenial/mysql-8"), filepath.Join(dir, "xenial_foo-1.charm"))
+	c.Assert(err, gc.ErrorMatches, `archive file "xenial_mysql-8.charm" is already used by "cs:xenial/mysql-7"`)
+}
+
+func (s *archiveDirSuite) TestEntityDirectories(c *gc.C) {
+	dir := c.MkDir()
+	ch := TestCharms.ClonedDir(dir, "dummy")
+	TestCharms.ClonedBundleDirPath(dir, "wordpress-simple")
+	err := ioutil.WriteFile(filepath.Join(dir, charmrepo.ArchiveIndexFile), []byte(`
+entries:
+- url: cs:xenial/dummy-1
+  file: dummy
+- url: cs:bundle/wordpress-simple-2
+  file: wordpress-simple
+`), 0644)
+	c.Assert(err, gc.IsNil)
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+
+	// Directories are packed into archives when they are read.
+	path := filepath.Join(c.MkDir(), "dummy.charm")
+	archive, err := repo.Get(charm.MustParseURL("cs:xenial/dummy"), path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(archive.Meta().Name, gc.Equals, "dummy")
+	b, err := repo.GetBundle(charm.MustParseURL("cs:bundle/wordpress-simple"), filepath.Join(c.MkDir(), "bundle"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(b.Data().Applications, gc.HasLen, 2)
+	report, err := repo.Validate()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Problems, gc.HasLen, 0)
+
+	// Changes to a directory are seen the next time it is read.
+	err = ch.SetDiskRevision(42)
+	c.Assert(err, gc.IsNil)
+	archive, err = repo.Get(charm.MustParseURL("cs:xenial/dummy"), path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(archive.Revision(), gc.Equals, 42)
+
+	// Directories cannot be served from a static index.
+	err = repo.WriteStaticIndex()
+	c.Assert(err, gc.ErrorMatches, `cannot serve directory "dummy" for "cs:xenial/dummy-1" from a static index`)
+}
+
+func (s *archiveDirSuite) TestSeriesFromCharmMetadata(c *gc.C) {
+	dir := c.MkDir()
+	err := os.Mkdir(filepath.Join(dir, "charms"), 0755)
+	c.Assert(err, gc.IsNil)
+	ch := charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "mysql",
+		Summary: "test charm",
+		Series:  []string{"focal", "jammy"},
+	})
+	err = ioutil.WriteFile(filepath.Join(dir, "charms", "mysql"), ch.ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, charmrepo.ArchiveIndexFile), []byte(`
+entries:
+- url: cs:mysql-3
+  file: charms/mysql
+`), 0644)
+	c.Assert(err, gc.IsNil)
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	id, series, err := repo.Resolve(charm.MustParseURL("cs:jammy/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:mysql-3")
+	c.Assert(series, jc.DeepEquals, []string{"focal", "jammy"})
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:bionic/mysql"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *archiveDirSuite) TestValidate(c *gc.C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "mysql.charm"), charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "mysql",
+		Summary: "test charm",
+		Series:  []string{"focal"},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "bad.charm"), []byte("bad"), 0644)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, charmrepo.ArchiveIndexFile), []byte(`
+entries:
+- url: cs:focal/mysql-1
+  file: mysql.charm
+- url: cs:focal/mysql-1
+  file: mysql.charm
+- url: cs:trusty/mysql-2
+  file: mysql.charm
+- url: cs:focal/postgresql-1
+  file: mysql.charm
+- url: cs:focal/mysql-3
+  file: missing.charm
+- url: cs:focal/mysql-4
+  file: bad.charm
+- url: cs:focal/mysql-5
+  file: mysql.charm
+  hash: 1234
+`), 0644)
+	c.Assert(err, gc.IsNil)
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	report, err := repo.Validate()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.OK(), jc.IsFalse)
+	c.Assert(report.Checked, gc.Equals, 7)
+	type problem struct {
+		kind charmrepo.ArchiveProblemKind
+		url  string
+	}
+	var problems []problem
+	for _, p := range report.Problems {
+		problems = append(problems, problem{p.Kind, p.URL.String()})
+	}
+	c.Assert(problems, jc.DeepEquals, []problem{
+		{charmrepo.ArchiveDuplicateRevision, "cs:focal/mysql-1"},
+		{charmrepo.ArchiveBadMetadata, "cs:trusty/mysql-2"},
+		{charmrepo.ArchiveNameMismatch, "cs:focal/postgresql-1"},
+		{charmrepo.ArchiveUnreadable, "cs:focal/mysql-3"},
+		{charmrepo.ArchiveUnreadable, "cs:focal/mysql-4"},
+		{charmrepo.ArchiveHashMismatch, "cs:focal/mysql-5"},
+	})
+	c.Assert(report.Problems[2].String(), gc.Equals, `cs:focal/postgresql-1 (mysql.charm): name mismatch: charm is named "mysql"`)
+
+	// A directory populated by Add is valid.
+	repo, err = charmrepo.NewArchiveDir(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	err = repo.Add(charm.MustParseURL("cs:focal/mysql-1"), filepath.Join(dir, "mysql.charm"))
+	c.Assert(err, gc.IsNil)
+	err = repo.Add(charm.MustParseURL("cs:bundle/wordpress-simple-3"), TestCharms.BundleArchivePath(c.MkDir(), "wordpress-simple"))
+	c.Assert(err, gc.IsNil)
+	report, err = repo.Validate()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.OK(), jc.IsTrue, gc.Commentf("%v", report))
+	c.Assert(report.String(), gc.Equals, "2 archives checked, 0 problems found")
+}
+
+func (s *archiveDirSuite) TestIndexChangesArePickedUp(c *gc.C) {
+	charmPath := filepath.Join(c.MkDir(), "wordpress.charm")
+	err := ioutil.WriteFile(charmPath, charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "test charm",
+		Series:  []string{"focal"},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+
+	// Two repositories using the same directory, as
+	// if from different processes, see each other's
+	// changes and do not lose them.
+	dir := c.MkDir()
+	repo1, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	repo2, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	err = repo1.Add(charm.MustParseURL("cs:~bob/wordpress-1"), charmPath)
+	c.Assert(err, gc.IsNil)
+	id, _, err := repo2.Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/wordpress-1")
+
+	err = repo2.Add(charm.MustParseURL("cs:~alice/wordpress-2"), charmPath)
+	c.Assert(err, gc.IsNil)
+	for _, repo := range []*charmrepo.ArchiveDir{repo1, repo2} {
+		for _, ref := range []string{"cs:~bob/wordpress", "cs:~alice/wordpress"} {
+			_, _, err := repo.Resolve(charm.MustParseURL(ref))
+			c.Assert(err, gc.IsNil)
+		}
+	}
+}
+
+func (s *archiveDirSuite) TestConcurrentGetAndAdd(c *gc.C) {
+	srcDir := c.MkDir()
+	var charmPaths []string
+	for i, summary := range []string{"first charm", "second charm"} {
+		path := filepath.Join(srcDir, fmt.Sprintf("wordpress%d.charm", i))
+		err := ioutil.WriteFile(path, charmtesting.NewCharmMeta(&charm.Meta{
+			Name:    "wordpress",
+			Summary: summary,
+			Series:  []string{"focal"},
+		}).ArchiveBytes(), 0644)
+		c.Assert(err, gc.IsNil)
+		charmPaths = append(charmPaths, path)
+	}
+	repo, err := charmrepo.NewArchiveDir(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	id := charm.MustParseURL("cs:wordpress-1")
+	err = repo.Add(id, charmPaths[0])
+	c.Assert(err, gc.IsNil)
+
+	// The archive is replaced repeatedly while it is being
+	// read, and every read sees one archive or the other.
+	errs := make(chan error, 40)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- repo.Add(id, charmPaths[i%2])
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := repo.Get(id, filepath.Join(srcDir, fmt.Sprintf("get%d.charm", i)))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (s *archiveDirSuite) TestArchiveFS(c *gc.C) {
+	archive := charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "mysql",
+		Summary: "test charm",
+		Series:  []string{"focal", "jammy"},
+	}).ArchiveBytes()
+	fsys := fstest.MapFS{
+		charmrepo.ArchiveIndexFile: &fstest.MapFile{
+			Data: []byte(fmt.Sprintf(`
+entries:
+- url: cs:mysql-3
+  file: charms/mysql-3.charm
+  hash: %x
+  supported-series: [focal, jammy]
+`, sha512.Sum384(archive))),
+		},
+		"charms/mysql-3.charm": &fstest.MapFile{
+			Data: archive,
+		},
+	}
+	repo, err := charmrepo.NewArchiveFS(fsys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(repo.Dir(), gc.Equals, "")
+	id, series, err := repo.Resolve(charm.MustParseURL("cs:jammy/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:mysql-3")
+	c.Assert(series, jc.DeepEquals, []string{"focal", "jammy"})
+	ch, err := repo.Get(id, filepath.Join(c.MkDir(), "mysql.charm"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ch.Meta().Name, gc.Equals, "mysql")
+
+	err = repo.Add(charm.MustParseURL("cs:mysql-4"), filepath.Join(c.MkDir(), "mysql.charm"))
+	c.Assert(err, gc.ErrorMatches, `cannot add to read-only archive file system`)
+}
+
+func (s *archiveDirSuite) TestWatch(c *gc.C) {
+	ch := charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "test charm",
+		Series:  []string{"focal"},
+	})
+	charmPath := filepath.Join(c.MkDir(), "wordpress.charm")
+	err := ioutil.WriteFile(charmPath, ch.ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	otherPath := filepath.Join(c.MkDir(), "other.charm")
+	err = ioutil.WriteFile(otherPath, charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "another test charm",
+		Series:  []string{"focal"},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+
+	dir := c.MkDir()
+	repo, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	err = repo.Add(charm.MustParseURL("cs:~bob/wordpress-1"), charmPath)
+	c.Assert(err, gc.IsNil)
+
+	stop := make(chan struct{})
+	changes := repo.Watch(stop, 10*time.Millisecond)
+
+	// Changes made through another repository are seen.
+	other, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	err = other.Add(charm.MustParseURL("cs:~bob/wordpress-2"), charmPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(nextArchiveChange(c, changes), jc.DeepEquals, charmrepo.ArchiveChange{
+		Kind: charmrepo.ArchiveAdded,
+		URL:  charm.MustParseURL("cs:~bob/wordpress-2"),
+	})
+	err = other.Add(charm.MustParseURL("cs:~bob/wordpress-1"), otherPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(nextArchiveChange(c, changes), jc.DeepEquals, charmrepo.ArchiveChange{
+		Kind: charmrepo.ArchiveUpdated,
+		URL:  charm.MustParseURL("cs:~bob/wordpress-1"),
+	})
+
+	close(stop)
+	for range changes {
+	}
+
+	// The default interval is used when none is given.
+	stop = make(chan struct{})
+	changes = repo.Watch(stop, 0)
+	close(stop)
+	for range changes {
+	}
+}
+
+func nextArchiveChange(c *gc.C, changes <-chan charmrepo.ArchiveChange) charmrepo.ArchiveChange {
+	select {
+	case change, ok := <-changes:
+		c.Assert(ok, jc.IsTrue)
+		return change
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for archive change")
+	}
+	panic("unreachable")
+}
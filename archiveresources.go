@@ -0,0 +1,218 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// The resources of a charm in an ArchiveDir are held alongside its
+// archive, in a directory named after the archive file without its
+// extension and with a ".resources" suffix. That directory holds a
+// directory for each resource, named after the resource, which holds
+// a file for each revision of the resource, named after the revision.
+// For example, revision 3 of the "data" resource of the charm with
+// the archive "~bob_wordpress-2.charm" is held in the file
+// "~bob_wordpress-2.resources/data/3".
+
+// AddResource copies the content of the file at the given path into
+// the directory as the given revision of the named resource of the
+// given charm. Any existing content of the revision is replaced.
+func (d *ArchiveDir) AddResource(curl *charm.URL, name string, revision int, contentPath string) error {
+	if d.dir == "" {
+		return errgo.New("cannot add to read-only archive file system")
+	}
+	if revision < 0 {
+		return errgo.Newf("no revision specified for resource %q", name)
+	}
+	e, meta, err := d.resourceCharm(curl, name)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	dst := filepath.Join(d.dir, filepath.FromSlash(resourcePath(e, name, revision)))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := copyArchiveFile(contentPath, dst); err != nil {
+		return errgo.Notef(err, "cannot add resource %q of %q", name, meta.Name)
+	}
+	return nil
+}
+
+// ListResources returns the latest revision held in the directory of
+// each resource of the given charm. Resources without any revisions
+// in the directory are omitted.
+func (d *ArchiveDir) ListResources(curl *charm.URL) ([]resource.Resource, error) {
+	e, err := d.resolve(curl)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	meta, err := d.charmMeta(e.File)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read charm %q", e.id)
+	}
+	names := make([]string, 0, len(meta.Resources))
+	for name := range meta.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var resources []resource.Resource
+	for _, name := range names {
+		revision, err := d.latestResourceRevision(e, name)
+		if errgo.Cause(err) == params.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		res, err := d.resourceInfo(e, meta.Resources[name], revision)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		resources = append(resources, res)
+	}
+	return resources, nil
+}
+
+// GetResource returns the metadata for the given revision of the named
+// resource of the given charm, and a reader for its content, which
+// must be closed after use. If the revision is negative, the latest
+// revision in the directory is returned.
+func (d *ArchiveDir) GetResource(curl *charm.URL, name string, revision int) (resource.Resource, io.ReadCloser, error) {
+	e, meta, err := d.resourceCharm(curl, name)
+	if err != nil {
+		return resource.Resource{}, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if revision < 0 {
+		revision, err = d.latestResourceRevision(e, name)
+		if err != nil {
+			return resource.Resource{}, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+	}
+	res, err := d.resourceInfo(e, meta.Resources[name], revision)
+	if err != nil {
+		return resource.Resource{}, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	f, err := d.fsys.Open(resourcePath(e, name, revision))
+	if err != nil {
+		return resource.Resource{}, nil, errgo.Mask(err)
+	}
+	return res, f, nil
+}
+
+// resourceCharm returns the index entry and metadata of the
+// charm that curl refers to, which must have the named resource.
+func (d *ArchiveDir) resourceCharm(curl *charm.URL, name string) (archiveIndexEntry, *charm.Meta, error) {
+	e, err := d.resolve(curl)
+	if err != nil {
+		return archiveIndexEntry{}, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if e.id.Series == "bundle" {
+		return archiveIndexEntry{}, nil, errgo.Newf("bundle %q cannot have resources", e.id)
+	}
+	meta, err := d.charmMeta(e.File)
+	if err != nil {
+		return archiveIndexEntry{}, nil, errgo.Notef(err, "cannot read charm %q", e.id)
+	}
+	if _, ok := meta.Resources[name]; !ok {
+		return archiveIndexEntry{}, nil, errgo.WithCausef(nil, params.ErrNotFound, "charm %q has no resource %q", e.id, name)
+	}
+	return e, meta, nil
+}
+
+// latestResourceRevision returns the latest revision of the named
+// resource of the charm with the given index entry.
+func (d *ArchiveDir) latestResourceRevision(e archiveIndexEntry, name string) (int, error) {
+	dir := path.Dir(resourcePath(e, name, 0))
+	files, err := fs.ReadDir(d.fsys, dir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, errgo.Mask(err)
+	}
+	latest := -1
+	for _, f := range files {
+		revision, err := strconv.Atoi(f.Name())
+		if err != nil || revision <= latest {
+			continue
+		}
+		// The entry type does not say whether a symbolic link refers
+		// to a regular file, and some network file systems do not
+		// report it at all, so check the file itself in those cases.
+		if !f.Type().IsRegular() {
+			info, err := fs.Stat(d.fsys, path.Join(dir, f.Name()))
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+		}
+		latest = revision
+	}
+	if latest < 0 {
+		return 0, errgo.WithCausef(nil, params.ErrNotFound, "no revisions of resource %q of %q", name, e.id)
+	}
+	return latest, nil
+}
+
+// resourceInfo returns the metadata for the given revision of the
+// resource with the given metadata, computing its fingerprint
+// from its content.
+func (d *ArchiveDir) resourceInfo(e archiveIndexEntry, meta resource.Meta, revision int) (resource.Resource, error) {
+	f, err := d.fsys.Open(resourcePath(e, meta.Name, revision))
+	if os.IsNotExist(err) {
+		return resource.Resource{}, errgo.WithCausef(nil, params.ErrNotFound, "revision %d of resource %q of %q not found", revision, meta.Name, e.id)
+	}
+	if err != nil {
+		return resource.Resource{}, errgo.Mask(err)
+	}
+	defer f.Close()
+	counter := &byteCounter{r: f}
+	fp, err := resource.GenerateFingerprint(counter)
+	if err != nil {
+		return resource.Resource{}, errgo.Notef(err, "cannot read resource %q of %q", meta.Name, e.id)
+	}
+	res := resource.Resource{
+		Meta:        meta,
+		Origin:      resource.OriginStore,
+		Revision:    revision,
+		Fingerprint: fp,
+		Size:        counter.n,
+	}
+	if err := res.Validate(); err != nil {
+		return resource.Resource{}, errgo.Mask(err)
+	}
+	return res, nil
+}
+
+// resourcePath returns the path, relative to the directory, of the
+// given revision of the named resource of the charm with the given
+// index entry.
+func resourcePath(e archiveIndexEntry, name string, revision int) string {
+	file := path.Clean(filepath.ToSlash(e.File))
+	stem := file[:len(file)-len(path.Ext(file))]
+	return path.Join(stem+".resources", name, strconv.Itoa(revision))
+}
+
+// byteCounter implements io.Reader by reading from
+// another reader and counting the bytes read.
+type byteCounter struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader.Read.
+func (c *byteCounter) Read(buf []byte) (int, error) {
+	n, err := c.r.Read(buf)
+	c.n += int64(n)
+	return n, err
+}
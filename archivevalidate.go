@@ -0,0 +1,154 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// ArchiveProblemKind identifies a kind of problem
+// found by ArchiveDir.Validate.
+type ArchiveProblemKind string
+
+const (
+	// ArchiveUnreadable is reported for an archive that
+	// is missing or cannot be read as a charm or bundle.
+	ArchiveUnreadable ArchiveProblemKind = "unreadable"
+
+	// ArchiveHashMismatch is reported for an archive that
+	// does not match the hash recorded in the index.
+	ArchiveHashMismatch ArchiveProblemKind = "hash mismatch"
+
+	// ArchiveBadMetadata is reported for a charm whose metadata
+	// does not support the series in its URL, or a bundle that
+	// fails verification.
+	ArchiveBadMetadata ArchiveProblemKind = "bad metadata"
+
+	// ArchiveDuplicateRevision is reported for an index
+	// entry with the same URL as an earlier one.
+	ArchiveDuplicateRevision ArchiveProblemKind = "duplicate revision"
+
+	// ArchiveNameMismatch is reported for a charm whose
+	// name differs from the name in its URL.
+	ArchiveNameMismatch ArchiveProblemKind = "name mismatch"
+)
+
+// ArchiveProblem describes a problem with an archive in an ArchiveDir.
+type ArchiveProblem struct {
+	// Kind holds the kind of problem.
+	Kind ArchiveProblemKind
+
+	// URL holds the URL of the archive in the index.
+	URL *charm.URL
+
+	// File holds the name of the archive file,
+	// relative to the directory.
+	File string
+
+	// Err describes the problem.
+	Err error
+}
+
+// String returns a human readable description of the problem.
+func (p ArchiveProblem) String() string {
+	return fmt.Sprintf("%s (%s): %s: %v", p.URL, p.File, p.Kind, p.Err)
+}
+
+// ArchiveValidationReport holds the results of ArchiveDir.Validate.
+type ArchiveValidationReport struct {
+	// Checked holds the number of index entries checked.
+	Checked int
+
+	// Problems holds the problems found,
+	// in the order of the index entries.
+	Problems []ArchiveProblem
+}
+
+// OK reports whether no problems were found.
+func (r *ArchiveValidationReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// String returns a summary of the report, with
+// one line for each problem found.
+func (r *ArchiveValidationReport) String() string {
+	lines := []string{
+		fmt.Sprintf("%d archives checked, %d problems found", r.Checked, len(r.Problems)),
+	}
+	for _, p := range r.Problems {
+		lines = append(lines, p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate reads every archive in the directory and returns a report
+// of the problems found, such as archives that cannot be read or that
+// do not match their index entries. Problems are otherwise only found
+// when the archives are retrieved. An error is returned only if the
+// index cannot be read.
+func (d *ArchiveDir) Validate() (*ArchiveValidationReport, error) {
+	entries, err := d.entries()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	report := &ArchiveValidationReport{
+		Checked: len(entries),
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		problem := func(kind ArchiveProblemKind, err error) {
+			report.Problems = append(report.Problems, ArchiveProblem{
+				Kind: kind,
+				URL:  e.id,
+				File: e.File,
+				Err:  err,
+			})
+		}
+		url := e.id.String()
+		if seen[url] {
+			problem(ArchiveDuplicateRevision, errgo.Newf("%q is already in the index", url))
+		}
+		seen[url] = true
+		data, err := d.readArchive(e.File)
+		if err != nil {
+			problem(ArchiveUnreadable, err)
+			continue
+		}
+		if e.Hash != "" {
+			if hash := fmt.Sprintf("%x", sha512.Sum384(data)); hash != e.Hash {
+				problem(ArchiveHashMismatch, errgo.Newf("hash mismatch; want %s got %s", e.Hash, hash))
+				continue
+			}
+		}
+		if e.id.Series == "bundle" {
+			b, err := charm.ReadBundleArchiveBytes(data)
+			if err != nil {
+				problem(ArchiveUnreadable, err)
+				continue
+			}
+			if err := b.Data().Verify(nil, nil, nil); err != nil {
+				problem(ArchiveBadMetadata, err)
+			}
+			continue
+		}
+		ch, err := charm.ReadCharmArchiveBytes(data)
+		if err != nil {
+			problem(ArchiveUnreadable, err)
+			continue
+		}
+		meta := ch.Meta()
+		if meta.Name != e.id.Name {
+			problem(ArchiveNameMismatch, errgo.Newf("charm is named %q", meta.Name))
+		}
+		if e.id.Series != "" && len(meta.Series) > 0 && !containsString(meta.Series, e.id.Series) {
+			problem(ArchiveBadMetadata, errgo.Newf("charm does not support series %q", e.id.Series))
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/charm/v9"
+)
+
+// ArchiveChangeKind identifies a kind of change to an ArchiveDir.
+type ArchiveChangeKind string
+
+const (
+	// ArchiveAdded is sent when an archive has been added.
+	ArchiveAdded ArchiveChangeKind = "added"
+
+	// ArchiveUpdated is sent when the archive
+	// for an existing URL has been replaced.
+	ArchiveUpdated ArchiveChangeKind = "updated"
+
+	// ArchiveRemoved is sent when an archive has been removed.
+	ArchiveRemoved ArchiveChangeKind = "removed"
+)
+
+// ArchiveChange describes a change to an ArchiveDir.
+type ArchiveChange struct {
+	// Kind holds the kind of change.
+	Kind ArchiveChangeKind
+
+	// URL holds the URL of the archive that changed.
+	URL *charm.URL
+}
+
+// defaultWatchInterval holds the interval used by
+// ArchiveDir.Watch when none is given.
+const defaultWatchInterval = 5 * time.Second
+
+// Watch returns a channel that receives the changes made to the
+// archives in the repository, whether by Add or by other processes,
+// until the given stop channel is closed, when the returned channel is
+// closed. The index file is checked for changes at the given interval,
+// or every five seconds if the interval is not positive. Changes are
+// sent in order of URL; changes made while earlier changes have not
+// been received are coalesced.
+//
+// Only the index is checked, not the archive files themselves, so a
+// change is seen only when the index entry for an archive changes, as
+// it does when the archive is replaced by Add. An archive file or
+// charm directory changed in place without a change to the index is
+// not reported.
+func (d *ArchiveDir) Watch(stop <-chan struct{}, interval time.Duration) <-chan ArchiveChange {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	changes := make(chan ArchiveChange)
+	d.mu.Lock()
+	old := d.indexEntries()
+	d.mu.Unlock()
+	go func() {
+		defer close(changes)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			d.mu.Lock()
+			err := d.refresh()
+			current := d.indexEntries()
+			d.mu.Unlock()
+			if err != nil {
+				logger.Warningf("cannot read archive index: %v", err)
+				continue
+			}
+			for _, change := range diffIndexEntries(old, current) {
+				select {
+				case changes <- change:
+				case <-stop:
+					return
+				}
+			}
+			old = current
+		}
+	}()
+	return changes
+}
+
+// indexEntries returns the entries in the index keyed by URL.
+// It must be called with d.mu held.
+func (d *ArchiveDir) indexEntries() map[string]archiveIndexEntry {
+	entries := make(map[string]archiveIndexEntry, len(d.index.Entries))
+	for _, e := range d.index.Entries {
+		entries[e.URL] = e
+	}
+	return entries
+}
+
+// diffIndexEntries returns the changes between the given
+// index entries, in order of URL.
+func diffIndexEntries(old, current map[string]archiveIndexEntry) []ArchiveChange {
+	var changes []ArchiveChange
+	for url, e := range current {
+		oldEntry, ok := old[url]
+		switch {
+		case !ok:
+			changes = append(changes, ArchiveChange{ArchiveAdded, e.id})
+		case oldEntry.File != e.File || oldEntry.Hash != e.Hash:
+			changes = append(changes, ArchiveChange{ArchiveUpdated, e.id})
+		}
+	}
+	for url, e := range old {
+		if _, ok := current[url]; !ok {
+			changes = append(changes, ArchiveChange{ArchiveRemoved, e.id})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].URL.String() < changes[j].URL.String()
+	})
+	return changes
+}
@@ -0,0 +1,416 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// defaultImportConcurrency holds the default number of
+// archives uploaded at once by CharmStore.BulkImport.
+const defaultImportConcurrency = 4
+
+// BulkImportParams holds the parameters for CharmStore.BulkImport.
+type BulkImportParams struct {
+	// Dir holds the directory to scan for archives. All files
+	// with a .charm or .zip extension in the directory or its
+	// subdirectories are imported.
+	Dir string
+
+	// User holds the user that the archives are uploaded as.
+	User string
+
+	// Series holds the series to upload charms that do not
+	// declare any supported series with.
+	Series string
+
+	// Concurrency holds the maximum number of archives
+	// uploaded at once. If it is zero, a default is used.
+	Concurrency int
+}
+
+// BulkImportResult holds the result of importing a single archive.
+type BulkImportResult struct {
+	// Path holds the path of the archive.
+	Path string
+
+	// Id holds the id that the charm or bundle
+	// was given in the charm store.
+	Id *charm.URL
+
+	// Err holds any error encountered when validating
+	// or uploading the archive.
+	Err error
+}
+
+// BulkImportReport summarizes the results of a bulk import.
+type BulkImportReport struct {
+	// Results holds the result of importing each archive,
+	// in order of path.
+	Results []BulkImportResult
+}
+
+// Imported returns the number of archives imported successfully.
+func (r *BulkImportReport) Imported() int {
+	n := 0
+	for _, result := range r.Results {
+		if result.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns the results of the archives that
+// could not be imported.
+func (r *BulkImportReport) Failed() []BulkImportResult {
+	var failed []BulkImportResult
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// String returns a one line summary of the report.
+func (r *BulkImportReport) String() string {
+	return fmt.Sprintf("%d archives imported, %d failed", r.Imported(), len(r.Failed()))
+}
+
+// BulkImport uploads all the charm and bundle archives found in
+// p.Dir to the charm store. Each archive is validated by reading it
+// before it is uploaded; archives that cannot be read are reported
+// as failures and not uploaded. An error is returned only if the
+// directory cannot be scanned.
+//
+// To upload the archives held in an ArchiveDir,
+// use ImportArchiveDir instead.
+func (s *CharmStore) BulkImport(p BulkImportParams) (*BulkImportReport, error) {
+	if p.User == "" {
+		return nil, errgo.New("no user specified for bulk import")
+	}
+	if p.Concurrency <= 0 {
+		p.Concurrency = defaultImportConcurrency
+	}
+	var paths []string
+	err := filepath.Walk(p.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && (strings.HasSuffix(path, ".charm") || strings.HasSuffix(path, ".zip")) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot scan %q", p.Dir)
+	}
+	sort.Strings(paths)
+
+	report := &BulkImportReport{
+		Results: make([]BulkImportResult, len(paths)),
+	}
+	toImport := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < p.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range toImport {
+				result := &report.Results[i]
+				result.Path = paths[i]
+				result.Id, result.Err = s.importArchive(paths[i], p)
+			}
+		}()
+	}
+	for i := range paths {
+		toImport <- i
+	}
+	close(toImport)
+	wg.Wait()
+	return report, nil
+}
+
+// importArchive validates and uploads the archive at the given path.
+func (s *CharmStore) importArchive(path string, p BulkImportParams) (*charm.URL, error) {
+	id, err := archiveUploadId(path, p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer f.Close()
+	hash := sha512.New384()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	uploadedId, err := s.client.UploadArchive(id, f, fmt.Sprintf("%x", hash.Sum(nil)), size, -1, nil)
+	if err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot upload %q", id), errgo.Any)
+	}
+	return uploadedId, nil
+}
+
+// archiveUploadId validates the charm or bundle archive at the given
+// path and returns the id that it should be uploaded to.
+func archiveUploadId(path string, p BulkImportParams) (*charm.URL, error) {
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".charm"), ".zip")
+	ch, charmErr := charm.ReadCharmArchive(path)
+	if charmErr == nil {
+		id := &charm.URL{
+			Schema:   "cs",
+			User:     p.User,
+			Name:     ch.Meta().Name,
+			Revision: -1,
+		}
+		if len(ch.Meta().Series) == 0 {
+			if p.Series == "" {
+				return nil, errgo.Newf("charm %q does not declare any series and no default series specified", id.Name)
+			}
+			id.Series = p.Series
+		}
+		return id, nil
+	}
+	if _, err := charm.ReadBundleArchive(path); err != nil {
+		return nil, errgo.Notef(charmErr, "invalid charm or bundle archive")
+	}
+	return &charm.URL{
+		Schema:   "cs",
+		User:     p.User,
+		Name:     name,
+		Series:   "bundle",
+		Revision: -1,
+	}, nil
+}
+
+// ImportArchiveDirParams holds the parameters
+// for CharmStore.ImportArchiveDir.
+type ImportArchiveDirParams struct {
+	// Dir holds the repository to import archives from.
+	Dir *ArchiveDir
+
+	// User holds the user that archives whose URLs have no
+	// user are uploaded as. Archives whose URLs have a user
+	// are uploaded as that user.
+	User string
+
+	// Resources specifies whether the latest revision of each
+	// resource held in the directory for each charm is also
+	// uploaded.
+	Resources bool
+
+	// Concurrency holds the maximum number of archives
+	// uploaded at once. If it is zero, a default is used.
+	Concurrency int
+}
+
+// ImportArchiveDir uploads all the charm and bundle archives held in
+// p.Dir to the charm store, which is useful for seeding a private
+// charm store. Each archive is uploaded with the revision it has in
+// the directory if the charm store allows it, and with the next
+// revision otherwise. An archive or resource that the charm store
+// already holds with the same revision and contents is treated as
+// imported, so an import can be repeated against the same charm
+// store.
+//
+// All the charms are uploaded before any of the bundles, because the
+// charm store checks that the charms used by a bundle exist when the
+// bundle is uploaded. Note that the charm URLs in a bundle are not
+// changed, so a bundle that refers to charms without a user can only
+// be uploaded if those charms can be found in the charm store without
+// one; charms uploaded as p.User because their URLs have no user are
+// not found that way.
+//
+// The returned report holds a result for each archive, in the order
+// of the archives' URLs; the Path of each result holds the archive's
+// path as returned by ArchiveDir.Find. An error is returned only if
+// the index of the directory cannot be read.
+func (s *CharmStore) ImportArchiveDir(p ImportArchiveDirParams) (*BulkImportReport, error) {
+	if p.Concurrency <= 0 {
+		p.Concurrency = defaultImportConcurrency
+	}
+	entries, err := p.Dir.entries()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].URL < entries[j].URL
+	})
+	report := &BulkImportReport{
+		Results: make([]BulkImportResult, len(entries)),
+	}
+	var charms, bundles []int
+	for i, e := range entries {
+		if e.id.Series == "bundle" {
+			bundles = append(bundles, i)
+		} else {
+			charms = append(charms, i)
+		}
+	}
+	for _, indexes := range [][]int{charms, bundles} {
+		toImport := make(chan int)
+		var wg sync.WaitGroup
+		for i := 0; i < p.Concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range toImport {
+					result := &report.Results[i]
+					result.Path = entries[i].File
+					if p.Dir.dir != "" {
+						result.Path = filepath.Join(p.Dir.dir, entries[i].File)
+					}
+					result.Id, result.Err = s.importIndexEntry(entries[i], p)
+				}
+			}()
+		}
+		for _, i := range indexes {
+			toImport <- i
+		}
+		close(toImport)
+		wg.Wait()
+	}
+	return report, nil
+}
+
+// importIndexEntry uploads the archive with the given index entry,
+// and its resources if p.Resources is true, returning the id
+// that it was uploaded with.
+func (s *CharmStore) importIndexEntry(e archiveIndexEntry, p ImportArchiveDirParams) (*charm.URL, error) {
+	id := *e.id
+	if id.User == "" {
+		if p.User == "" {
+			return nil, errgo.Newf("no user specified for %q", e.id)
+		}
+		id.User = p.User
+	}
+	data, err := p.Dir.readArchive(e.File)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive")
+	}
+	hash := fmt.Sprintf("%x", sha512.Sum384(data))
+	if e.Hash != "" && e.Hash != hash {
+		return nil, errgo.Newf("archive does not match the hash in the index")
+	}
+	uploadedId, err := s.client.UploadArchive(&id, bytesBody{bytes.NewReader(data)}, hash, int64(len(data)), -1, nil)
+	switch {
+	case errgo.Cause(err) == params.ErrDuplicateUpload:
+		// The revision has already been uploaded, perhaps by an
+		// earlier import, which is fine if it holds the same archive.
+		uploadedId, err = s.uploadedArchive(&id, hash)
+	case revisionRefused(err):
+		logger.Infof("cannot upload %q with its revision, uploading as the next revision: %v", &id, err)
+		id.Revision = -1
+		uploadedId, err = s.client.UploadArchive(&id, bytesBody{bytes.NewReader(data)}, hash, int64(len(data)), -1, nil)
+	}
+	if err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot upload %q", &id), errgo.Any)
+	}
+	if !p.Resources || e.id.Series == "bundle" {
+		return uploadedId, nil
+	}
+	resources, err := p.Dir.ListResources(e.id)
+	if err != nil {
+		return uploadedId, errgo.Notef(err, "cannot list resources")
+	}
+	for _, res := range resources {
+		if err := s.importResource(p.Dir, e.id, uploadedId, res); err != nil {
+			return uploadedId, errgo.Notef(err, "cannot upload resource %q", res.Name)
+		}
+	}
+	return uploadedId, nil
+}
+
+// importResource uploads the given resource of the charm with the
+// given id in the directory to the charm with the given uploaded id.
+func (s *CharmStore) importResource(d *ArchiveDir, id, uploadedId *charm.URL, res resource.Resource) error {
+	_, r, err := d.GetResource(id, res.Name, res.Revision)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = s.client.UploadResourceWithRevision(uploadedId, res.Name, res.Revision, res.Path, bytes.NewReader(data), int64(len(data)), nil)
+	switch {
+	case errgo.Cause(err) == params.ErrDuplicateUpload:
+		existing, err := s.client.ResourceMeta(uploadedId, res.Name, res.Revision)
+		if err != nil {
+			return errgo.Notef(err, "cannot check existing resource")
+		}
+		if !bytes.Equal(existing.Fingerprint, res.Fingerprint.Bytes()) {
+			return errgo.Newf("revision %d already holds different content", res.Revision)
+		}
+		return nil
+	case revisionRefused(err):
+		logger.Infof("cannot upload resource %q of %q with its revision, uploading as the next revision: %v", res.Name, uploadedId, err)
+		_, err = s.client.UploadResource(uploadedId, res.Name, res.Path, bytes.NewReader(data), int64(len(data)), nil)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// uploadedArchive returns the id of the entity with the given
+// id, which has already been uploaded, if it holds the archive with
+// the given hash.
+func (s *CharmStore) uploadedArchive(id *charm.URL, hash string) (*charm.URL, error) {
+	var result struct {
+		Hash params.HashResponse
+	}
+	existingId, err := s.client.MetaWithChannel(id, &result, params.UnpublishedChannel)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot check existing archive")
+	}
+	if result.Hash.Sum != hash {
+		return nil, errgo.Newf("revision %d already holds a different archive", id.Revision)
+	}
+	return existingId, nil
+}
+
+// bytesBody is a request body that implements io.Seeker,
+// so that the request can be retried.
+type bytesBody struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer.Close.
+func (bytesBody) Close() error {
+	return nil
+}
+
+// revisionRefused reports whether the given error from an upload with
+// a specific revision shows that the charm store does not allow
+// revisions to be chosen by the uploader, so that the upload should be
+// made with the next revision instead. Authorization failures are not
+// included, as an upload with the next revision would fail too.
+func revisionRefused(err error) bool {
+	switch errgo.Cause(err) {
+	case params.ErrMethodNotAllowed, params.ErrEntityIdNotAllowed:
+		return true
+	}
+	return false
+}
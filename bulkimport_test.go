@@ -0,0 +1,390 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient/params"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
+)
+
+type bulkImportSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&bulkImportSuite{})
+
+const bulkImportManifest = `
+charms:
+- name: wordpress
+  series: [xenial]
+bundles:
+- name: wordpress-simple
+  applications:
+    wordpress:
+      charm: cs:xenial/wordpress
+      num_units: 1
+`
+
+func (s *bulkImportSuite) TestBulkImport(c *gc.C) {
+	repo, err := charmtesting.GenerateRepo(c.MkDir(), strings.NewReader(bulkImportManifest), "xenial")
+	c.Assert(err, gc.IsNil)
+
+	dir := c.MkDir()
+	writeArchive(c, filepath.Join(dir, "wordpress.charm"), repo.CharmDir("wordpress"))
+	err = os.Mkdir(filepath.Join(dir, "bundles"), 0755)
+	c.Assert(err, gc.IsNil)
+	writeArchive(c, filepath.Join(dir, "bundles", "wordpress-simple.zip"), repo.BundleDir("wordpress-simple"))
+	err = ioutil.WriteFile(filepath.Join(dir, "broken.zip"), []byte("not a zip"), 0644)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	var mu sync.Mutex
+	uploads := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, gc.Equals, "POST")
+		data, err := ioutil.ReadAll(req.Body)
+		c.Check(err, gc.IsNil)
+		c.Check(req.URL.Query().Get("hash"), gc.Equals, fmt.Sprintf("%x", sha512.Sum384(data)))
+		path := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v5/"), "/archive")
+		mu.Lock()
+		uploads[path] = true
+		mu.Unlock()
+		writeJSON(w, params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("cs:" + path + "-1"),
+		})
+	}))
+	defer srv.Close()
+
+	store := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL:      srv.URL,
+		User:     "bob",
+		Password: "secret",
+	})
+	report, err := store.BulkImport(charmrepo.BulkImportParams{
+		Dir:    dir,
+		User:   "bob",
+		Series: "xenial",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Results, gc.HasLen, 3)
+	c.Assert(report.Imported(), gc.Equals, 2)
+	c.Assert(report.String(), gc.Equals, "2 archives imported, 1 failed")
+
+	c.Assert(report.Results[0].Path, gc.Equals, filepath.Join(dir, "broken.zip"))
+	c.Assert(report.Results[0].Err, gc.ErrorMatches, `invalid charm or bundle archive: .*`)
+	c.Assert(report.Failed(), jc.DeepEquals, report.Results[:1])
+	c.Assert(report.Results[1].Path, gc.Equals, filepath.Join(dir, "bundles", "wordpress-simple.zip"))
+	c.Assert(report.Results[1].Err, gc.IsNil)
+	c.Assert(report.Results[1].Id.String(), gc.Equals, "cs:~bob/bundle/wordpress-simple-1")
+	c.Assert(report.Results[2].Path, gc.Equals, filepath.Join(dir, "wordpress.charm"))
+	c.Assert(report.Results[2].Err, gc.IsNil)
+	c.Assert(report.Results[2].Id.String(), gc.Equals, "cs:~bob/xenial/wordpress-1")
+
+	c.Assert(uploads, jc.DeepEquals, map[string]bool{
+		"~bob/bundle/wordpress-simple": true,
+		"~bob/xenial/wordpress":        true,
+	})
+}
+
+func (s *bulkImportSuite) TestImportArchiveDir(c *gc.C) {
+	srcDir := c.MkDir()
+	charmPath := filepath.Join(srcDir, "mysql.charm")
+	err := ioutil.WriteFile(charmPath, charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "mysql",
+		Summary: "test charm",
+		Series:  []string{"focal"},
+		Resources: map[string]resource.Meta{
+			"data": {
+				Name: "data",
+				Type: resource.TypeFile,
+				Path: "data.tgz",
+			},
+		},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	dataPath := filepath.Join(srcDir, "data")
+	err = ioutil.WriteFile(dataPath, []byte("data"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	dir := c.MkDir()
+	archives, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	for _, id := range []string{"cs:focal/mysql-3", "cs:~alice/mysql-7", "cs:~bob/bundle/wordpress-simple-2"} {
+		path := charmPath
+		if strings.Contains(id, "bundle") {
+			path = TestCharms.BundleArchivePath(c.MkDir(), "wordpress-simple")
+		}
+		err := archives.Add(charm.MustParseURL(id), path)
+		c.Assert(err, gc.IsNil)
+	}
+	err = archives.AddResource(charm.MustParseURL("cs:focal/mysql-3"), "data", 2, dataPath)
+	c.Assert(err, gc.IsNil)
+
+	// The store does not allow archives of alice's
+	// charm to be uploaded with a specific revision.
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := io.Copy(ioutil.Discard, req.Body)
+		c.Check(err, gc.IsNil)
+		path := strings.TrimPrefix(req.URL.Path, "/v5/")
+		mu.Lock()
+		requests = append(requests, req.Method+" "+path)
+		mu.Unlock()
+		switch {
+		case strings.Contains(path, "/resource/"):
+			writeJSON(w, params.ResourceUploadResponse{
+				Revision: 2,
+			})
+		case req.Method == "PUT" && strings.HasPrefix(path, "~alice/"):
+			writeError(w, http.StatusMethodNotAllowed, params.ErrMethodNotAllowed, "PUT not allowed")
+		case req.Method == "PUT":
+			writeJSON(w, params.ArchiveUploadResponse{
+				Id: charm.MustParseURL("cs:" + strings.TrimSuffix(path, "/archive")),
+			})
+		default:
+			writeJSON(w, params.ArchiveUploadResponse{
+				Id: charm.MustParseURL("cs:" + strings.TrimSuffix(path, "/archive") + "-8"),
+			})
+		}
+	}))
+	defer srv.Close()
+
+	store := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: srv.URL,
+	})
+	report, err := store.ImportArchiveDir(charmrepo.ImportArchiveDirParams{
+		Dir:       archives,
+		User:      "bob",
+		Resources: true,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "3 archives imported, 0 failed", gc.Commentf("%v", report.Failed()))
+	var ids []string
+	for _, result := range report.Results {
+		ids = append(ids, result.Id.String())
+	}
+	c.Assert(ids, jc.DeepEquals, []string{
+		"cs:~bob/focal/mysql-3",
+		"cs:~alice/mysql-8",
+		"cs:~bob/bundle/wordpress-simple-2",
+	})
+	c.Assert(report.Results[0].Path, gc.Equals, filepath.Join(dir, "focal_mysql-3.charm"))
+
+	sort.Strings(requests)
+	c.Assert(requests, jc.DeepEquals, []string{
+		"POST ~alice/mysql/archive",
+		"PUT ~alice/mysql-7/archive",
+		"PUT ~bob/bundle/wordpress-simple-2/archive",
+		"PUT ~bob/focal/mysql-3/archive",
+		"PUT ~bob/focal/mysql-3/resource/data/2",
+	})
+
+	// Archives without a user cannot be imported without one.
+	report, err = store.ImportArchiveDir(charmrepo.ImportArchiveDirParams{
+		Dir: archives,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Imported(), gc.Equals, 2)
+	c.Assert(report.Results[0].Err, gc.ErrorMatches, `no user specified for "cs:focal/mysql-3"`)
+}
+
+func (s *bulkImportSuite) TestImportArchiveDirUploadsCharmsBeforeBundles(c *gc.C) {
+	dir := c.MkDir()
+	archives, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	for _, name := range []string{"mysql", "wordpress"} {
+		path := filepath.Join(c.MkDir(), name+".charm")
+		err := ioutil.WriteFile(path, charmtesting.NewCharmMeta(&charm.Meta{
+			Name:    name,
+			Summary: "test charm",
+			Series:  []string{"focal"},
+		}).ArchiveBytes(), 0644)
+		c.Assert(err, gc.IsNil)
+		err = archives.Add(charm.MustParseURL("cs:~bob/"+name+"-1"), path)
+		c.Assert(err, gc.IsNil)
+	}
+	err = archives.Add(charm.MustParseURL("cs:~bob/bundle/wordpress-simple-1"), TestCharms.BundleArchivePath(c.MkDir(), "wordpress-simple"))
+	c.Assert(err, gc.IsNil)
+
+	// The store refuses bundles whose charms have not been
+	// uploaded, as the charm store does.
+	var mu sync.Mutex
+	uploaded := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := io.Copy(ioutil.Discard, req.Body)
+		c.Check(err, gc.IsNil)
+		id := charm.MustParseURL("cs:" + strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v5/"), "/archive"))
+		mu.Lock()
+		defer mu.Unlock()
+		if id.Series == "bundle" && (!uploaded["mysql"] || !uploaded["wordpress"]) {
+			writeError(w, http.StatusBadRequest, params.ErrInvalidEntity, "bundle verification failed: charm not found")
+			return
+		}
+		// Delay charm uploads so that any bundle
+		// uploaded at the same time would get in first.
+		if id.Series != "bundle" {
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+		}
+		uploaded[id.Name] = true
+		writeJSON(w, params.ArchiveUploadResponse{
+			Id: id,
+		})
+	}))
+	defer srv.Close()
+
+	store := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: srv.URL,
+	})
+	report, err := store.ImportArchiveDir(charmrepo.ImportArchiveDirParams{
+		Dir: archives,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "3 archives imported, 0 failed", gc.Commentf("%v", report.Failed()))
+}
+
+func (s *bulkImportSuite) TestImportArchiveDirDuplicates(c *gc.C) {
+	srcDir := c.MkDir()
+	charmPath := filepath.Join(srcDir, "mysql.charm")
+	archive := charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "mysql",
+		Summary: "test charm",
+		Series:  []string{"focal"},
+		Resources: map[string]resource.Meta{
+			"data": {
+				Name: "data",
+				Type: resource.TypeFile,
+				Path: "data.tgz",
+			},
+		},
+	}).ArchiveBytes()
+	err := ioutil.WriteFile(charmPath, archive, 0644)
+	c.Assert(err, gc.IsNil)
+	dataPath := filepath.Join(srcDir, "data")
+	err = ioutil.WriteFile(dataPath, []byte("data"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	dir := c.MkDir()
+	archives, err := charmrepo.NewArchiveDir(dir)
+	c.Assert(err, gc.IsNil)
+	for _, id := range []string{"cs:~alice/mysql-1", "cs:~bob/mysql-1", "cs:~carol/mysql-1"} {
+		err := archives.Add(charm.MustParseURL(id), charmPath)
+		c.Assert(err, gc.IsNil)
+	}
+	err = archives.AddResource(charm.MustParseURL("cs:~alice/mysql-1"), "data", 2, dataPath)
+	c.Assert(err, gc.IsNil)
+	fingerprint, err := resource.GenerateFingerprint(strings.NewReader("data"))
+	c.Assert(err, gc.IsNil)
+
+	// Every revision has already been uploaded. Alice's charm holds
+	// the same archive, bob's holds a different one, and carol
+	// cannot upload at all.
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := io.Copy(ioutil.Discard, req.Body)
+		c.Check(err, gc.IsNil)
+		path := strings.TrimPrefix(req.URL.Path, "/v5/")
+		mu.Lock()
+		requests = append(requests, req.Method+" "+path)
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(path, "~carol/"):
+			writeError(w, http.StatusForbidden, params.ErrForbidden, "access denied")
+		case req.Method == "PUT":
+			writeError(w, http.StatusInternalServerError, params.ErrDuplicateUpload, "duplicate upload")
+		case path == "~alice/mysql-1/meta/resources/data/2":
+			writeJSON(w, params.Resource{
+				Name:        "data",
+				Revision:    2,
+				Fingerprint: fingerprint.Bytes(),
+			})
+		case strings.HasSuffix(path, "/meta/any"):
+			c.Check(req.URL.Query().Get("channel"), gc.Equals, string(params.UnpublishedChannel))
+			hash := fmt.Sprintf("%x", sha512.Sum384(archive))
+			if strings.HasPrefix(path, "~bob/") {
+				hash = "other"
+			}
+			writeJSON(w, params.MetaAnyResponse{
+				Id: charm.MustParseURL("cs:" + strings.TrimSuffix(path, "/meta/any")),
+				Meta: map[string]interface{}{
+					"hash": params.HashResponse{Sum: hash},
+				},
+			})
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, path)
+			writeError(w, http.StatusNotFound, params.ErrNotFound, "not found")
+		}
+	}))
+	defer srv.Close()
+
+	store := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: srv.URL,
+	})
+	report, err := store.ImportArchiveDir(charmrepo.ImportArchiveDirParams{
+		Dir:       archives,
+		Resources: true,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Imported(), gc.Equals, 1)
+	c.Assert(report.Results[0].Id.String(), gc.Equals, "cs:~alice/mysql-1")
+	c.Assert(report.Results[0].Err, gc.IsNil)
+	c.Assert(report.Results[1].Err, gc.ErrorMatches, `cannot upload "cs:~bob/mysql-1": revision 1 already holds a different archive`)
+	c.Assert(report.Results[2].Err, gc.ErrorMatches, `cannot upload "cs:~carol/mysql-1": cannot post archive: access denied`)
+
+	// No archive or resource is uploaded as a new revision.
+	sort.Strings(requests)
+	c.Assert(requests, jc.DeepEquals, []string{
+		"GET ~alice/mysql-1/meta/any",
+		"GET ~alice/mysql-1/meta/resources/data/2",
+		"GET ~bob/mysql-1/meta/any",
+		"PUT ~alice/mysql-1/archive",
+		"PUT ~alice/mysql-1/resource/data/2",
+		"PUT ~bob/mysql-1/archive",
+		"PUT ~carol/mysql-1/archive",
+	})
+}
+
+func (s *bulkImportSuite) TestBulkImportNoUser(c *gc.C) {
+	store := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{})
+	_, err := store.BulkImport(charmrepo.BulkImportParams{
+		Dir: c.MkDir(),
+	})
+	c.Assert(err, gc.ErrorMatches, `no user specified for bulk import`)
+}
+
+type archiver interface {
+	ArchiveTo(w io.Writer) error
+}
+
+func writeArchive(c *gc.C, path string, a archiver) {
+	f, err := os.Create(path)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	err = a.ArchiveTo(f)
+	c.Assert(err, gc.IsNil)
+}
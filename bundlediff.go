@@ -0,0 +1,218 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// BundleLock records the charm and resource revisions
+// that the applications in a bundle resolve to.
+type BundleLock struct {
+	Applications map[string]LockedApplication `yaml:"applications" json:"applications"`
+}
+
+// LockedApplication holds the resolved charm
+// and resource revisions of an application.
+type LockedApplication struct {
+	// Charm holds the fully qualified URL of the charm.
+	Charm *charm.URL `yaml:"charm" json:"charm"`
+
+	// Resources maps resource names to the revisions specified
+	// in the bundle. Resources without a revision are omitted.
+	Resources map[string]int `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+// channelResolver is implemented by repositories that can
+// resolve charm URLs in a preferred channel.
+type channelResolver interface {
+	ResolveWithPreferredChannel(ref *charm.URL, channel params.Channel) (*charm.URL, params.Channel, []string, error)
+}
+
+// LockBundle resolves the charms used by the applications in the
+// given bundle using repo, and returns a lock recording the results.
+// If repo supports it, charms are resolved in the channels specified
+// for their applications.
+func LockBundle(repo Interface, data *charm.BundleData) (*BundleLock, error) {
+	lock := &BundleLock{
+		Applications: make(map[string]LockedApplication),
+	}
+	resolved := make(map[string]*charm.URL)
+	for name, app := range data.Applications {
+		ref, err := charm.ParseURL(app.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm URL of application %q", name)
+		}
+		if ref.Revision == -1 && app.Revision != nil {
+			ref = ref.WithRevision(*app.Revision)
+		}
+		key := ref.String() + " " + app.Channel
+		id, ok := resolved[key]
+		if !ok {
+			if r, ok := repo.(channelResolver); ok && app.Channel != "" {
+				id, _, _, err = r.ResolveWithPreferredChannel(ref, params.Channel(app.Channel))
+			} else {
+				id, _, err = repo.Resolve(ref)
+			}
+			if err != nil {
+				return nil, errgo.NoteMask(err, fmt.Sprintf("cannot resolve charm of application %q", name), errgo.Any)
+			}
+			resolved[key] = id
+		}
+		locked := LockedApplication{
+			Charm: id,
+		}
+		for resName, res := range app.Resources {
+			// Other values refer to local files, which
+			// have no revision.
+			if rev, ok := res.(int); ok {
+				if locked.Resources == nil {
+					locked.Resources = make(map[string]int)
+				}
+				locked.Resources[resName] = rev
+			}
+		}
+		lock.Applications[name] = locked
+	}
+	return lock, nil
+}
+
+// BundleDiff describes the differences between two bundles.
+type BundleDiff struct {
+	// Added and Removed hold the names of the applications
+	// that were added and removed, in alphabetical order.
+	Added   []string
+	Removed []string
+
+	// Changed holds the applications present in both bundles
+	// whose charm or resource revisions differ, in alphabetical
+	// order of name.
+	Changed []ApplicationDiff
+}
+
+// Empty reports whether there are no differences.
+func (d *BundleDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// ApplicationDiff describes the changes to an application.
+type ApplicationDiff struct {
+	// Name holds the name of the application.
+	Name string
+
+	// OldCharm and NewCharm hold the resolved charm URLs
+	// of the application.
+	OldCharm *charm.URL
+	NewCharm *charm.URL
+
+	// Resources holds the resources whose revisions
+	// differ, in alphabetical order of name.
+	Resources []ResourceDiff
+}
+
+// CharmChanged reports whether the charm of the application changed.
+func (d ApplicationDiff) CharmChanged() bool {
+	return d.OldCharm.String() != d.NewCharm.String()
+}
+
+// ResourceDiff describes a change to the revision of a resource.
+type ResourceDiff struct {
+	// Name holds the name of the resource.
+	Name string
+
+	// OldRevision and NewRevision hold the revisions of
+	// the resource, or -1 if no revision was specified.
+	OldRevision int
+	NewRevision int
+}
+
+// Diff returns the differences between the lock and newLock.
+func (l *BundleLock) Diff(newLock *BundleLock) *BundleDiff {
+	var diff BundleDiff
+	for name, oldApp := range l.Applications {
+		newApp, ok := newLock.Applications[name]
+		if !ok {
+			diff.Removed = append(diff.Removed, name)
+			continue
+		}
+		appDiff := ApplicationDiff{
+			Name:      name,
+			OldCharm:  oldApp.Charm,
+			NewCharm:  newApp.Charm,
+			Resources: diffResources(oldApp.Resources, newApp.Resources),
+		}
+		if appDiff.CharmChanged() || len(appDiff.Resources) > 0 {
+			diff.Changed = append(diff.Changed, appDiff)
+		}
+	}
+	for name := range newLock.Applications {
+		if _, ok := l.Applications[name]; !ok {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Name < diff.Changed[j].Name
+	})
+	return &diff
+}
+
+func diffResources(oldResources, newResources map[string]int) []ResourceDiff {
+	revision := func(resources map[string]int, name string) int {
+		if rev, ok := resources[name]; ok {
+			return rev
+		}
+		return -1
+	}
+	var diffs []ResourceDiff
+	add := func(name string) {
+		oldRev, newRev := revision(oldResources, name), revision(newResources, name)
+		if oldRev != newRev {
+			diffs = append(diffs, ResourceDiff{
+				Name:        name,
+				OldRevision: oldRev,
+				NewRevision: newRev,
+			})
+		}
+	}
+	for name := range oldResources {
+		add(name)
+	}
+	for name := range newResources {
+		if _, ok := oldResources[name]; !ok {
+			add(name)
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Name < diffs[j].Name
+	})
+	return diffs
+}
+
+// DiffBundles returns the differences between two bundles,
+// resolving their charms using repo.
+func DiffBundles(repo Interface, oldData, newData *charm.BundleData) (*BundleDiff, error) {
+	oldLock, err := LockBundle(repo, oldData)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return DiffBundleWithLock(repo, oldLock, newData)
+}
+
+// DiffBundleWithLock returns the differences between a previously
+// recorded lock and a bundle, resolving the bundle's charms using repo.
+func DiffBundleWithLock(repo Interface, lock *BundleLock, data *charm.BundleData) (*BundleDiff, error) {
+	newLock, err := LockBundle(repo, data)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return lock.Diff(newLock), nil
+}
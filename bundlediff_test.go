@@ -0,0 +1,161 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"strings"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7"
+)
+
+type bundleDiffSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&bundleDiffSuite{})
+
+var oldDiffBundle = `
+applications:
+  wordpress:
+    charm: cs:~bob/xenial/wordpress
+    revision: 1
+    num_units: 1
+    resources:
+      data: 3
+      theme: 1
+  mysql:
+    charm: cs:~bob/mysql-5
+    series: xenial
+    num_units: 1
+  haproxy:
+    charm: cs:~bob/xenial/haproxy
+    num_units: 1
+`
+
+var newDiffBundle = `
+applications:
+  wordpress:
+    charm: cs:~bob/xenial/wordpress
+    num_units: 1
+    resources:
+      data: 4
+      theme: 1
+      config: ./config.yaml
+      logo: 2
+  mysql:
+    charm: cs:~bob/mysql-5
+    series: xenial
+    num_units: 2
+  memcached:
+    charm: cs:~bob/xenial/memcached
+    num_units: 1
+`
+
+func (s *bundleDiffSuite) TestDiffBundles(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/xenial/wordpress-1")
+	store.addCharm("cs:~bob/xenial/wordpress-3")
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+	store.addCharm("cs:~bob/xenial/haproxy-2")
+	store.addCharm("cs:~bob/xenial/memcached-7")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	diff, err := charmrepo.DiffBundles(repo, readBundleData(c, oldDiffBundle), readBundleData(c, newDiffBundle))
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff.Empty(), jc.IsFalse)
+	c.Assert(diff, jc.DeepEquals, &charmrepo.BundleDiff{
+		Added:   []string{"memcached"},
+		Removed: []string{"haproxy"},
+		Changed: []charmrepo.ApplicationDiff{{
+			Name:     "wordpress",
+			OldCharm: charm.MustParseURL("cs:~bob/xenial/wordpress-1"),
+			NewCharm: charm.MustParseURL("cs:~bob/xenial/wordpress-3"),
+			Resources: []charmrepo.ResourceDiff{{
+				Name:        "data",
+				OldRevision: 3,
+				NewRevision: 4,
+			}, {
+				Name:        "logo",
+				OldRevision: -1,
+				NewRevision: 2,
+			}},
+		}},
+	})
+	c.Assert(diff.Changed[0].CharmChanged(), jc.IsTrue)
+}
+
+func (s *bundleDiffSuite) TestDiffBundleWithLock(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/xenial/wordpress-1")
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+	store.addCharm("cs:~bob/xenial/haproxy-2")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	data := readBundleData(c, oldDiffBundle)
+	lock, err := charmrepo.LockBundle(repo, data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock, jc.DeepEquals, &charmrepo.BundleLock{
+		Applications: map[string]charmrepo.LockedApplication{
+			"wordpress": {
+				Charm:     charm.MustParseURL("cs:~bob/xenial/wordpress-1"),
+				Resources: map[string]int{"data": 3, "theme": 1},
+			},
+			"mysql": {
+				Charm: charm.MustParseURL("cs:~bob/mysql-5"),
+			},
+			"haproxy": {
+				Charm: charm.MustParseURL("cs:~bob/xenial/haproxy-2"),
+			},
+		},
+	})
+
+	// Nothing has changed yet.
+	diff, err := charmrepo.DiffBundleWithLock(repo, lock, data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff.Empty(), jc.IsTrue)
+
+	// A new revision of haproxy is picked up.
+	store.addCharm("cs:~bob/xenial/haproxy-3")
+	diff, err = charmrepo.DiffBundleWithLock(repo, lock, data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff, jc.DeepEquals, &charmrepo.BundleDiff{
+		Changed: []charmrepo.ApplicationDiff{{
+			Name:     "haproxy",
+			OldCharm: charm.MustParseURL("cs:~bob/xenial/haproxy-2"),
+			NewCharm: charm.MustParseURL("cs:~bob/xenial/haproxy-3"),
+		}},
+	})
+}
+
+func (s *bundleDiffSuite) TestLockBundleResolveError(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	_, err := charmrepo.LockBundle(repo, readBundleData(c, `
+applications:
+  haproxy:
+    charm: cs:~bob/xenial/haproxy
+`))
+	c.Assert(err, gc.ErrorMatches, `cannot resolve charm of application "haproxy": cannot resolve URL "cs:~bob/xenial/haproxy": charm not found`)
+}
+
+func readBundleData(c *gc.C, data string) *charm.BundleData {
+	bd, err := charm.ReadBundleData(strings.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	return bd
+}
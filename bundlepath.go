@@ -4,15 +4,20 @@
 package charmrepo // import "github.com/juju/charmrepo/v7"
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/juju/charm/v9"
 	"gopkg.in/errgo.v1"
 )
 
 // NewBundleAtPath creates and returns a bundle at a given path,
-// and a URL that describes it.
+// and a URL that describes it. The path may refer to a bundle
+// directory or to a bundle archive, whose ".bundle" or ".zip"
+// extension is not included in the URL.
 func NewBundleAtPath(path string) (charm.Bundle, *charm.URL, error) {
 	if path == "" {
 		return nil, nil, errgo.New("path to bundle not specified")
@@ -35,15 +40,57 @@ func NewBundleAtPath(path string) (charm.Bundle, *charm.URL, error) {
 		return nil, nil, err
 	}
 	_, name := filepath.Split(absPath)
+	// Bundle archives are named after the
+	// bundle, with an extension.
+	for _, ext := range []string{".bundle", ".zip"} {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	revision, err := readBundleRevision(path)
+	if err != nil {
+		return nil, nil, err
+	}
 	url := &charm.URL{
 		Schema:   "local",
 		Name:     name,
 		Series:   "bundle",
-		Revision: 0,
+		Revision: revision,
 	}
 	return b, url, nil
 }
 
+// bundleRevisionFile holds the name of the file in a bundle
+// directory that holds the revision of the bundle.
+const bundleRevisionFile = "revision"
+
+// readBundleRevision returns the revision recorded in the revision
+// file of the bundle directory at the given path, as in a charm
+// directory, or 0 if the path is a bundle archive or there is no
+// such file.
+func readBundleRevision(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, errgo.Mask(err, os.IsNotExist)
+	}
+	if !info.IsDir() {
+		return 0, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, bundleRevisionFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot read revision file in bundle %q", path)
+	}
+	revision, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || revision < 0 {
+		return 0, errgo.Newf("invalid revision file in bundle %q", path)
+	}
+	return revision, nil
+}
+
 // ReadBundleFile attempts to read the file at path
 // and interpret it as a bundle.
 func ReadBundleFile(path string) (*charm.BundleData, error) {
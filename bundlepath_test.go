@@ -110,3 +110,37 @@ func (s *bundlePathSuite) TestGetBundleLocalFileNotExists(c *gc.C) {
 	_, err := charmrepo.ReadBundleFile(bundlePath)
 	c.Assert(err, gc.ErrorMatches, `bundle not found:.*`)
 }
+
+func (s *bundlePathSuite) TestGetBundleRevision(c *gc.C) {
+	bundleDir := TestCharms.ClonedBundleDirPath(c.MkDir(), "wordpress-simple")
+	err := ioutil.WriteFile(filepath.Join(bundleDir, "revision"), []byte("7\n"), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	_, url, err := charmrepo.NewBundleAtPath(bundleDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(url, gc.DeepEquals, charm.MustParseURL("local:bundle/wordpress-simple-7"))
+
+	err = ioutil.WriteFile(filepath.Join(bundleDir, "revision"), []byte("latest"), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = charmrepo.NewBundleAtPath(bundleDir)
+	c.Assert(err, gc.ErrorMatches, `invalid revision file in bundle ".*"`)
+
+	// A revision file that cannot be read is an error.
+	err = os.Remove(filepath.Join(bundleDir, "revision"))
+	c.Assert(err, jc.ErrorIsNil)
+	err = os.Mkdir(filepath.Join(bundleDir, "revision"), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = charmrepo.NewBundleAtPath(bundleDir)
+	c.Assert(err, gc.ErrorMatches, `cannot read revision file in bundle ".*": .*`)
+}
+
+func (s *bundlePathSuite) TestGetBundleArchive(c *gc.C) {
+	dir := c.MkDir()
+	for _, file := range []string{"wordpress-simple.bundle", "wordpress-simple.zip"} {
+		path := filepath.Join(dir, file)
+		writeArchive(c, path, TestCharms.BundleDir("wordpress-simple"))
+		b, url, err := charmrepo.NewBundleAtPath(path)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(b.Data(), jc.DeepEquals, TestCharms.BundleDir("wordpress-simple").Data())
+		c.Assert(url, gc.DeepEquals, charm.MustParseURL("local:bundle/wordpress-simple-0"))
+	}
+}
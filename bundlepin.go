@@ -0,0 +1,114 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// PinBundle returns a copy of the given bundle data in which every
+// application is pinned to specific revisions: its charm URL is
+// replaced by the fully qualified URL that it resolves to, its channel
+// by the channel that the charm was resolved in, and each resource of
+// the charm that the bundle does not already specify is given the
+// revision published in that channel. Charms are resolved in the
+// channel specified for their application or, if there is none, in the
+// given channel.
+//
+// Applications with local charms, and resources that refer to local
+// files, are left unchanged. The given bundle data is not modified.
+func (s *CharmStore) PinBundle(data *charm.BundleData, channel params.Channel) (*charm.BundleData, error) {
+	pinned := *data
+	pinned.Applications = make(map[string]*charm.ApplicationSpec, len(data.Applications))
+	type resolvedCharm struct {
+		id        *charm.URL
+		channel   params.Channel
+		resources map[string]int
+	}
+	resolved := make(map[string]resolvedCharm)
+	for name, app := range data.Applications {
+		if app == nil {
+			pinned.Applications[name] = nil
+			continue
+		}
+		pinnedApp := *app
+		pinned.Applications[name] = &pinnedApp
+		if isLocalCharm(app.Charm) {
+			continue
+		}
+		ref, err := charm.ParseURL(app.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm URL of application %q", name)
+		}
+		if ref.Revision == -1 && app.Revision != nil {
+			ref = ref.WithRevision(*app.Revision)
+		}
+		appChannel := channel
+		if app.Channel != "" {
+			appChannel = params.Channel(app.Channel)
+		}
+		key := ref.String() + " " + string(appChannel)
+		r, ok := resolved[key]
+		if !ok {
+			r.id, r.channel, _, err = s.ResolveWithPreferredChannel(ref, appChannel)
+			if err != nil {
+				return nil, errgo.NoteMask(err, fmt.Sprintf("cannot resolve charm of application %q", name), errgo.Any)
+			}
+			if r.id.Series != "bundle" {
+				r.resources, err = s.publishedResources(r.id, r.channel)
+				if err != nil {
+					return nil, errgo.Notef(err, "cannot list resources of application %q", name)
+				}
+			}
+			resolved[key] = r
+		}
+		pinnedApp.Charm = r.id.String()
+		pinnedApp.Revision = nil
+		pinnedApp.Channel = string(r.channel)
+		if len(r.resources) == 0 {
+			continue
+		}
+		pinnedApp.Resources = make(map[string]interface{}, len(r.resources))
+		for resName, rev := range r.resources {
+			pinnedApp.Resources[resName] = rev
+		}
+		for resName, res := range app.Resources {
+			pinnedApp.Resources[resName] = res
+		}
+	}
+	return &pinned, nil
+}
+
+// publishedResources returns the revisions of the resources of the
+// charm with the given id that are published in the given channel,
+// keyed by resource name.
+func (s *CharmStore) publishedResources(id *charm.URL, channel params.Channel) (map[string]int, error) {
+	resources, err := s.client.WithChannel(channel).ListResources(id)
+	if errgo.Cause(err) == csclient.ErrNotSupported {
+		// The charm store predates resources,
+		// so the charm can have none.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	revisions := make(map[string]int, len(resources))
+	for _, res := range resources {
+		revisions[res.Name] = res.Revision
+	}
+	return revisions, nil
+}
+
+// isLocalCharm reports whether the charm of a bundle
+// application refers to a charm on the local file system.
+func isLocalCharm(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "/")
+}
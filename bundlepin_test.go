@@ -0,0 +1,89 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+type pinBundleSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&pinBundleSuite{})
+
+var pinBundle = `
+applications:
+  wordpress:
+    charm: cs:~bob/xenial/wordpress
+    num_units: 1
+    resources:
+      theme: 1
+      config: ./config.yaml
+  mysql:
+    charm: cs:~bob/mysql
+    revision: 5
+    series: xenial
+    channel: edge
+    num_units: 1
+  local:
+    charm: ./charms/local
+    num_units: 1
+`
+
+func (s *pinBundleSuite) TestPinBundle(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/xenial/wordpress-2")
+	e := store.addCharm("cs:~bob/xenial/wordpress-3")
+	for _, name := range []string{"data", "theme", "config"} {
+		store.addResource(e, name, []byte(name))
+	}
+	e.resources[0].Revision = 4
+	e.resources[1].Revision = 2
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+	store.addCharm("cs:~bob/mysql-6", "xenial", "bionic")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	data := readBundleData(c, pinBundle)
+	pinned, err := repo.PinBundle(data, params.StableChannel)
+	c.Assert(err, gc.IsNil)
+
+	wordpress := pinned.Applications["wordpress"]
+	c.Assert(wordpress.Charm, gc.Equals, "cs:~bob/xenial/wordpress-3")
+	c.Assert(wordpress.Channel, gc.Equals, "stable")
+	c.Assert(wordpress.NumUnits, gc.Equals, 1)
+	c.Assert(wordpress.Resources, jc.DeepEquals, map[string]interface{}{
+		"data":   4,
+		"theme":  1,
+		"config": "./config.yaml",
+	})
+
+	mysql := pinned.Applications["mysql"]
+	c.Assert(mysql.Charm, gc.Equals, "cs:~bob/mysql-5")
+	c.Assert(mysql.Revision, gc.IsNil)
+	c.Assert(mysql.Channel, gc.Equals, "edge")
+	c.Assert(mysql.Series, gc.Equals, "xenial")
+	c.Assert(mysql.Resources, gc.IsNil)
+
+	c.Assert(pinned.Applications["local"].Charm, gc.Equals, "./charms/local")
+
+	// The original bundle data is unchanged.
+	c.Assert(data.Applications["wordpress"].Charm, gc.Equals, "cs:~bob/xenial/wordpress")
+	c.Assert(data.Applications["wordpress"].Resources, gc.HasLen, 2)
+	c.Assert(*data.Applications["mysql"].Revision, gc.Equals, 5)
+
+	data.Applications["wordpress"].Charm = "cs:~bob/nothere"
+	_, err = repo.PinBundle(data, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `cannot resolve charm of application "wordpress": cannot resolve URL "cs:~bob/nothere": charm or bundle not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
@@ -0,0 +1,617 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// DefaultCharmHubURL holds the URL of the public Charmhub API.
+const DefaultCharmHubURL = "https://api.charmhub.io"
+
+// NewCharmHubParams holds parameters for instantiating a new CharmHub.
+type NewCharmHubParams struct {
+	// URL holds the root endpoint URL of the Charmhub API,
+	// with no trailing slash. If it is empty,
+	// DefaultCharmHubURL is used.
+	URL string
+
+	// HTTPClient holds the client used to make requests.
+	// If it is nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Channel holds the channel that charms and bundles are
+	// resolved in, in "[track/]risk" form. If it is empty,
+	// "stable" is used.
+	Channel string
+
+	// Architecture holds the architecture that charms are resolved
+	// for when the URL does not specify one. If it is empty,
+	// "amd64" is used.
+	Architecture string
+}
+
+// CharmHub is a repository Interface that provides access to Charmhub.
+// It provides the same semantics as CharmStore, so that consumers can
+// move from the legacy charm store by changing the repository they
+// use. The URLs it returns have the "ch" schema.
+//
+// Charmhub resolves charms per channel, so a charm URL with a revision
+// is only resolved if the revision is current in the repository's
+// channel, unless the URL also specifies a series.
+type CharmHub struct {
+	url     string
+	client  *http.Client
+	channel charmHubChannel
+	arch    string
+}
+
+var _ Interface = (*CharmHub)(nil)
+
+// charmHubChannel holds a channel parsed into its parts.
+type charmHubChannel struct {
+	track string
+	risk  string
+}
+
+// String returns the channel in "track/risk" form.
+func (c charmHubChannel) String() string {
+	return c.track + "/" + c.risk
+}
+
+// NewCharmHub creates and returns a Charmhub repository.
+func NewCharmHub(p NewCharmHubParams) *CharmHub {
+	if p.URL == "" {
+		p.URL = DefaultCharmHubURL
+	}
+	if p.HTTPClient == nil {
+		p.HTTPClient = http.DefaultClient
+	}
+	if p.Channel == "" {
+		p.Channel = "stable"
+	}
+	if p.Architecture == "" {
+		p.Architecture = "amd64"
+	}
+	return &CharmHub{
+		url:     p.URL,
+		client:  p.HTTPClient,
+		channel: parseCharmHubChannel(p.Channel),
+		arch:    p.Architecture,
+	}
+}
+
+// parseCharmHubChannel parses a channel in "[track/]risk[/branch]"
+// form. Any branch is ignored.
+func parseCharmHubChannel(s string) charmHubChannel {
+	parts := strings.Split(s, "/")
+	if len(parts) == 1 {
+		return charmHubChannel{track: "latest", risk: parts[0]}
+	}
+	return charmHubChannel{track: parts[0], risk: parts[1]}
+}
+
+// CharmHubInfo holds information on a charm or bundle
+// as returned by the Charmhub info endpoint.
+type CharmHubInfo struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// DefaultRelease holds the release that is
+	// used when no channel is specified.
+	DefaultRelease CharmHubRelease `json:"default-release"`
+
+	// ChannelMap holds the current release in each
+	// channel for each base.
+	ChannelMap []CharmHubRelease `json:"channel-map"`
+}
+
+// CharmHubRelease holds a revision released to a channel.
+type CharmHubRelease struct {
+	Channel  CharmHubChannel  `json:"channel"`
+	Revision CharmHubRevision `json:"revision"`
+}
+
+// CharmHubChannel holds a Charmhub channel.
+type CharmHubChannel struct {
+	Name       string        `json:"name"`
+	Track      string        `json:"track"`
+	Risk       string        `json:"risk"`
+	Base       *CharmHubBase `json:"base,omitempty"`
+	ReleasedAt string        `json:"released-at,omitempty"`
+}
+
+// CharmHubRevision holds a revision of a charm or bundle.
+type CharmHubRevision struct {
+	Revision int              `json:"revision"`
+	Version  string           `json:"version,omitempty"`
+	Bases    []CharmHubBase   `json:"bases"`
+	Download CharmHubDownload `json:"download"`
+
+	// Resources holds the resources of the revision. It is
+	// only filled out for revisions returned by the refresh
+	// endpoint.
+	Resources []CharmHubResource `json:"resources,omitempty"`
+}
+
+// CharmHubResource holds a resource of a charm revision.
+type CharmHubResource struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Path        string `json:"path"`
+	Description string `json:"description"`
+	Revision    int    `json:"revision"`
+	Download    struct {
+		HashSHA384 string `json:"hash-sha-384"`
+		Size       int64  `json:"size"`
+		URL        string `json:"url"`
+	} `json:"download"`
+}
+
+// CharmHubBase holds a base that a revision runs on.
+type CharmHubBase struct {
+	Name         string `json:"name"`
+	Channel      string `json:"channel"`
+	Architecture string `json:"architecture"`
+}
+
+// CharmHubDownload holds the location and hash
+// of the archive of a revision.
+type CharmHubDownload struct {
+	HashSHA256 string `json:"hash-sha-256"`
+	Size       int64  `json:"size"`
+	URL        string `json:"url"`
+}
+
+// CharmHubFindResult holds a charm or bundle
+// found by the Charmhub find endpoint.
+type CharmHubFindResult struct {
+	Type           string
+	ID             string
+	Name           string
+	Summary        string
+	DefaultRelease CharmHubRelease
+}
+
+// charmHubError holds an error returned by the Charmhub API.
+type charmHubError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// charmHubFields holds the fields requested from the info endpoint.
+var charmHubFields = strings.Join([]string{
+	"id",
+	"name",
+	"type",
+	"default-release.channel",
+	"default-release.revision.revision",
+	"default-release.revision.version",
+	"default-release.revision.bases",
+	"default-release.revision.download",
+	"channel-map.channel",
+	"channel-map.revision.revision",
+	"channel-map.revision.version",
+	"channel-map.revision.bases",
+	"channel-map.revision.download",
+}, ",")
+
+// Info returns information on the charm or bundle with the given name,
+// including the current revision in each channel. If there is no such
+// entity, an error with a params.ErrNotFound cause is returned.
+func (h *CharmHub) Info(name string) (*CharmHubInfo, error) {
+	var info CharmHubInfo
+	query := url.Values{"fields": {charmHubFields}}
+	if err := h.do("GET", "/v2/charms/info/"+url.PathEscape(name)+"?"+query.Encode(), nil, &info); err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get info for %q", name), errgo.Is(params.ErrNotFound))
+	}
+	return &info, nil
+}
+
+// Find returns the charms and bundles matching the given query.
+func (h *CharmHub) Find(query string) ([]CharmHubFindResult, error) {
+	var resp struct {
+		Results []struct {
+			Type   string `json:"type"`
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			Result struct {
+				Summary string `json:"summary"`
+			} `json:"result"`
+			DefaultRelease CharmHubRelease `json:"default-release"`
+		} `json:"results"`
+	}
+	values := url.Values{
+		"q":      {query},
+		"fields": {"result.summary,default-release.channel,default-release.revision.revision,default-release.revision.bases"},
+	}
+	if err := h.do("GET", "/v2/charms/find?"+values.Encode(), nil, &resp); err != nil {
+		return nil, errgo.Notef(err, "cannot find %q", query)
+	}
+	results := make([]CharmHubFindResult, len(resp.Results))
+	for i, r := range resp.Results {
+		results[i] = CharmHubFindResult{
+			Type:           r.Type,
+			ID:             r.ID,
+			Name:           r.Name,
+			Summary:        r.Result.Summary,
+			DefaultRelease: r.DefaultRelease,
+		}
+	}
+	return results, nil
+}
+
+// Resolve implements Interface.Resolve.
+func (h *CharmHub) Resolve(ref *charm.URL) (*charm.URL, []string, error) {
+	rev, isBundle, err := h.resolve(ref)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if isBundle {
+		return &charm.URL{
+			Schema:   string(charm.CharmHub),
+			Name:     ref.Name,
+			Revision: rev.Revision,
+			Series:   "bundle",
+		}, nil, nil
+	}
+	arch := h.archOf(ref)
+	supportedSeries := charmHubSeries(rev.Bases, arch)
+	id := &charm.URL{
+		Schema:       string(charm.CharmHub),
+		Name:         ref.Name,
+		Revision:     rev.Revision,
+		Series:       ref.Series,
+		Architecture: arch,
+	}
+	if id.Series == "" && len(supportedSeries) == 1 {
+		id.Series = supportedSeries[0]
+	}
+	return id, supportedSeries, nil
+}
+
+// Get implements Interface.Get.
+func (h *CharmHub) Get(curl *charm.URL, archivePath string) (*charm.CharmArchive, error) {
+	if curl.Series == "bundle" {
+		return nil, errgo.Newf("expected a charm URL, got bundle URL %q", curl)
+	}
+	if err := h.getToFile(curl, archivePath); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return charm.ReadCharmArchive(archivePath)
+}
+
+// GetBundle implements Interface.GetBundle.
+func (h *CharmHub) GetBundle(curl *charm.URL, archivePath string) (charm.Bundle, error) {
+	if curl.Series != "bundle" {
+		return nil, errgo.Newf("expected a bundle URL, got charm URL %q", curl)
+	}
+	if err := h.getToFile(curl, archivePath); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return charm.ReadBundleArchive(archivePath)
+}
+
+// resolve returns the revision that ref refers to, and
+// reports whether it is the revision of a bundle.
+func (h *CharmHub) resolve(ref *charm.URL) (rev CharmHubRevision, isBundle bool, err error) {
+	if ref.Revision >= 0 && ref.Series != "" && ref.Series != "bundle" {
+		rev, err := h.refresh(ref)
+		return rev, false, err
+	}
+	info, err := h.Info(ref.Name)
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return CharmHubRevision{}, false, charmHubNotFoundError(ref)
+		}
+		return CharmHubRevision{}, false, errgo.Notef(err, "cannot resolve URL %q", ref)
+	}
+	isBundle = info.Type == "bundle"
+	if ref.Series != "" && (ref.Series == "bundle") != isBundle {
+		return CharmHubRevision{}, false, charmHubNotFoundError(ref)
+	}
+	arch := h.archOf(ref)
+	var found *CharmHubRevision
+	for i, release := range info.ChannelMap {
+		rev := &info.ChannelMap[i].Revision
+		switch {
+		case release.Channel.Risk != h.channel.risk:
+		case release.Channel.Track != h.channel.track && (release.Channel.Track != "" || h.channel.track != "latest"):
+		case ref.Revision >= 0 && rev.Revision != ref.Revision:
+		// Bundles are not specific to any base.
+		case !isBundle && ref.Series != "" && !containsString(charmHubSeries(rev.Bases, arch), ref.Series):
+		case !isBundle && len(charmHubSeries(rev.Bases, arch)) == 0:
+		default:
+			if found == nil || rev.Revision > found.Revision {
+				found = rev
+			}
+		}
+	}
+	if found == nil {
+		return CharmHubRevision{}, false, charmHubNotFoundError(ref)
+	}
+	return *found, isBundle, nil
+}
+
+// refresh uses the Charmhub refresh endpoint to return the given
+// revision of the charm, which must specify a revision and series.
+func (h *CharmHub) refresh(ref *charm.URL) (CharmHubRevision, error) {
+	base, ok := charmHubBase(ref.Series, h.archOf(ref))
+	if !ok {
+		return CharmHubRevision{}, errgo.Newf("cannot resolve URL %q: unknown series %q", ref, ref.Series)
+	}
+	revision := ref.Revision
+	req := charmHubRefreshRequest{
+		Context: []interface{}{},
+		Actions: []charmHubRefreshAction{{
+			Action:      "download",
+			InstanceKey: "charmrepo",
+			Name:        ref.Name,
+			Revision:    &revision,
+			Base:        &base,
+		}},
+		Fields: charmHubRefreshFields,
+	}
+	var resp charmHubRefreshResponse
+	if err := h.do("POST", "/v2/charms/refresh", req, &resp); err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return CharmHubRevision{}, charmHubNotFoundError(ref)
+		}
+		return CharmHubRevision{}, errgo.Notef(err, "cannot resolve URL %q", ref)
+	}
+	if len(resp.ErrorList) > 0 {
+		return CharmHubRevision{}, errgo.Notef(resp.ErrorList[0].err(), "cannot resolve URL %q", ref)
+	}
+	if len(resp.Results) != 1 {
+		return CharmHubRevision{}, errgo.Newf("cannot resolve URL %q: unexpected result count %d", ref, len(resp.Results))
+	}
+	if r := resp.Results[0]; r.Error != nil {
+		if r.Error.isNotFound() {
+			return CharmHubRevision{}, charmHubNotFoundError(ref)
+		}
+		return CharmHubRevision{}, errgo.Notef(r.Error.err(), "cannot resolve URL %q", ref)
+	}
+	return resp.Results[0].Entity, nil
+}
+
+// charmHubRefreshFields holds the fields requested from the
+// refresh endpoint.
+var charmHubRefreshFields = []string{"bases", "download", "id", "name", "resources", "revision", "type", "version"}
+
+// charmHubRefreshRequest holds the body of a refresh request.
+type charmHubRefreshRequest struct {
+	Context []interface{}           `json:"context"`
+	Actions []charmHubRefreshAction `json:"actions"`
+	Fields  []string                `json:"fields,omitempty"`
+}
+
+// charmHubRefreshAction holds an action in a refresh request.
+type charmHubRefreshAction struct {
+	Action      string        `json:"action"`
+	InstanceKey string        `json:"instance-key"`
+	Name        string        `json:"name,omitempty"`
+	Channel     string        `json:"channel,omitempty"`
+	Revision    *int          `json:"revision,omitempty"`
+	Base        *CharmHubBase `json:"base,omitempty"`
+}
+
+// charmHubRefreshResponse holds the response to a refresh request.
+type charmHubRefreshResponse struct {
+	Results []struct {
+		Result      string           `json:"result"`
+		InstanceKey string           `json:"instance-key"`
+		Name        string           `json:"name"`
+		Entity      CharmHubRevision `json:"charm"`
+		Error       *charmHubError   `json:"error,omitempty"`
+	} `json:"results"`
+	ErrorList []charmHubError `json:"error-list"`
+}
+
+// getToFile retrieves the archive of the charm or
+// bundle referenced by curl into the given file.
+func (h *CharmHub) getToFile(curl *charm.URL, archivePath string) error {
+	etype := "charm"
+	if curl.Series == "bundle" {
+		etype = "bundle"
+	}
+	rev, _, err := h.resolve(curl)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	sink, err := NewFileArchiveSink(archivePath)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := h.download(curl, rev, &offsetWriter{w: sink}); err != nil {
+		sink.Abort()
+		if _, ok := errgo.Cause(err).(*csclient.HashMismatchError); ok {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return errgo.Notef(err, "cannot retrieve %s %q", etype, curl)
+	}
+	if err := sink.Commit(); err != nil {
+		return errgo.Notef(err, "cannot commit archive")
+	}
+	return nil
+}
+
+// download writes the archive of the given revision
+// to w, checking its hash and size.
+func (h *CharmHub) download(curl *charm.URL, rev CharmHubRevision, w io.Writer) error {
+	if rev.Download.URL == "" {
+		return errgo.Newf("no download URL")
+	}
+	resp, err := h.client.Get(rev.Download.URL)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errgo.Newf("unexpected response status %q", resp.Status)
+	}
+	data := csclient.ArchiveData{
+		ReadCloser:    resp.Body,
+		Id:            curl.WithRevision(rev.Revision),
+		Hash:          rev.Download.HashSHA256,
+		HashAlgorithm: csclient.SHA256,
+		Size:          rev.Download.Size,
+	}
+	return copyArchiveData(&data, w)
+}
+
+// do sends a request with the given method to the given path
+// and unmarshals the JSON response into result. If body is not
+// nil, it is sent as the JSON request body.
+func (h *CharmHub) do(method, path string, body, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, h.url+path, r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errgo.Notef(err, "cannot read response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			ErrorList []charmHubError `json:"error-list"`
+		}
+		if err := json.Unmarshal(data, &errResp); err != nil || len(errResp.ErrorList) == 0 {
+			return errgo.Newf("unexpected response status %q", resp.Status)
+		}
+		return errgo.Mask(errResp.ErrorList[0].err(), errgo.Is(params.ErrNotFound))
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return errgo.Notef(err, "cannot unmarshal response")
+	}
+	return nil
+}
+
+// isNotFound reports whether the error reports
+// that an entity or revision does not exist.
+func (e *charmHubError) isNotFound() bool {
+	return strings.HasSuffix(e.Code, "not-found")
+}
+
+// err returns the error as a Go error. Errors reporting
+// that an entity does not exist have a params.ErrNotFound
+// cause.
+func (e *charmHubError) err() error {
+	if e.isNotFound() {
+		return errgo.WithCausef(nil, params.ErrNotFound, "%s", e.Message)
+	}
+	return errgo.Newf("%s (code %q)", e.Message, e.Code)
+}
+
+// charmHubNotFoundError returns the error returned
+// when no entity matching ref can be found.
+func charmHubNotFoundError(ref *charm.URL) error {
+	etype := "charm"
+	if ref.Series == "bundle" {
+		etype = "bundle"
+	}
+	return errgo.WithCausef(nil, params.ErrNotFound, "cannot resolve URL %q: %s not found", ref, etype)
+}
+
+// archOf returns the architecture to resolve ref for.
+func (h *CharmHub) archOf(ref *charm.URL) string {
+	if ref.Architecture != "" {
+		return ref.Architecture
+	}
+	return h.arch
+}
+
+// ubuntuSeries maps Ubuntu versions to series names.
+var ubuntuSeries = map[string]string{
+	"12.04": "precise",
+	"14.04": "trusty",
+	"16.04": "xenial",
+	"18.04": "bionic",
+	"20.04": "focal",
+	"20.10": "groovy",
+	"21.04": "hirsute",
+	"21.10": "impish",
+	"22.04": "jammy",
+	"22.10": "kinetic",
+}
+
+// charmHubSeries returns the series of the given
+// bases that run on the given architecture.
+func charmHubSeries(bases []CharmHubBase, arch string) []string {
+	var series []string
+	for _, b := range bases {
+		if b.Architecture != arch && b.Architecture != "all" {
+			continue
+		}
+		if s := baseSeries(b.Name, b.Channel); s != "" && !containsString(series, s) {
+			series = append(series, s)
+		}
+	}
+	return series
+}
+
+// charmHubBase returns the base for the given series and
+// architecture, and reports whether the series is known.
+func charmHubBase(series, arch string) (CharmHubBase, bool) {
+	name, channel, ok := seriesBase(series)
+	if !ok {
+		return CharmHubBase{}, false
+	}
+	return CharmHubBase{Name: name, Channel: channel, Architecture: arch}, true
+}
+
+// baseSeries returns the series for the operating system with the
+// given name and version, or the empty string if it is not known.
+func baseSeries(name, channel string) string {
+	switch name {
+	case "ubuntu":
+		return ubuntuSeries[channel]
+	case "centos":
+		return "centos" + channel
+	}
+	return ""
+}
+
+// seriesBase returns the name and version of the operating system
+// for the given series, and reports whether the series is known.
+func seriesBase(series string) (name, channel string, ok bool) {
+	if strings.HasPrefix(series, "centos") {
+		return "centos", strings.TrimPrefix(series, "centos"), true
+	}
+	for version, s := range ubuntuSeries {
+		if s == series {
+			return "ubuntu", version, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,311 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
+)
+
+type charmHubSuite struct {
+	jujutesting.IsolationSuite
+	server  *httptest.Server
+	archive []byte
+
+	// bundleArchive holds the archive of the bundle.
+	bundleArchive []byte
+
+	// hash holds the hash reported for the archive.
+	hash string
+
+	// refreshes records the bodies of refresh requests.
+	refreshes []map[string]interface{}
+}
+
+var _ = gc.Suite(&charmHubSuite{})
+
+func (s *charmHubSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.archive = charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "test charm",
+		Series:  []string{"focal", "jammy"},
+	}).ArchiveBytes()
+	s.hash = fmt.Sprintf("%x", sha256.Sum256(s.archive))
+	s.refreshes = nil
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+}
+
+func (s *charmHubSuite) TearDownTest(c *gc.C) {
+	s.server.Close()
+	s.IsolationSuite.TearDownTest(c)
+}
+
+func (s *charmHubSuite) revision(rev int, bases ...string) map[string]interface{} {
+	var baseList []map[string]string
+	for _, b := range bases {
+		baseList = append(baseList, map[string]string{
+			"name":         "ubuntu",
+			"channel":      b,
+			"architecture": "amd64",
+		})
+	}
+	return map[string]interface{}{
+		"revision": rev,
+		"bases":    baseList,
+		"download": map[string]interface{}{
+			"hash-sha-256": s.hash,
+			"size":         len(s.archive),
+			"url":          s.server.URL + "/download/wordpress.charm",
+		},
+	}
+}
+
+// refreshRevision returns the revision returned by the refresh endpoint.
+func (s *charmHubSuite) refreshRevision() map[string]interface{} {
+	rev := s.revision(1, "18.04")
+	rev["resources"] = []map[string]interface{}{{
+		"name":     "data",
+		"type":     "file",
+		"path":     "data.txt",
+		"revision": 2,
+		"download": map[string]interface{}{
+			"hash-sha-384": fmt.Sprintf("%x", sha512.Sum384([]byte("some data"))),
+			"size":         9,
+		},
+	}}
+	return rev
+}
+
+func (s *charmHubSuite) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/v2/charms/info/wordpress":
+		writeJSON(w, map[string]interface{}{
+			"type": "charm",
+			"id":   "wordpress-id",
+			"name": "wordpress",
+			"channel-map": []map[string]interface{}{{
+				"channel":  map[string]string{"name": "latest/stable", "track": "latest", "risk": "stable"},
+				"revision": s.revision(3, "20.04", "22.04"),
+			}, {
+				"channel":  map[string]string{"name": "latest/edge", "track": "latest", "risk": "edge"},
+				"revision": s.revision(5, "22.04"),
+			}},
+		})
+	case "/v2/charms/find":
+		writeJSON(w, map[string]interface{}{
+			"results": []map[string]interface{}{{
+				"type":   "charm",
+				"id":     "wordpress-id",
+				"name":   "wordpress",
+				"result": map[string]string{"summary": "blog"},
+			}},
+		})
+	case "/v2/charms/refresh":
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		s.refreshes = append(s.refreshes, body)
+		writeJSON(w, map[string]interface{}{
+			"results": []map[string]interface{}{{
+				"result":       "download",
+				"instance-key": "charmrepo",
+				"name":         "wordpress",
+				"charm":        s.refreshRevision(),
+			}},
+		})
+	case "/v2/charms/info/wordpress-simple":
+		writeJSON(w, map[string]interface{}{
+			"type": "bundle",
+			"id":   "wordpress-simple-id",
+			"name": "wordpress-simple",
+			"channel-map": []map[string]interface{}{{
+				"channel": map[string]string{"name": "latest/stable", "track": "latest", "risk": "stable"},
+				"revision": map[string]interface{}{
+					"revision": 7,
+					"download": map[string]interface{}{
+						"hash-sha-256": fmt.Sprintf("%x", sha256.Sum256(s.bundleArchive)),
+						"size":         len(s.bundleArchive),
+						"url":          s.server.URL + "/download/wordpress-simple.bundle",
+					},
+				},
+			}},
+		})
+	case "/download/wordpress.charm":
+		w.Write(s.archive)
+	case "/download/wordpress-simple.bundle":
+		w.Write(s.bundleArchive)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error-list": []map[string]string{{
+				"code":    "not-found",
+				"message": "No charm or bundle with name 'nothere'.",
+			}},
+		})
+	}
+}
+
+func (s *charmHubSuite) TestResolve(c *gc.C) {
+	repo := charmrepo.NewCharmHub(charmrepo.NewCharmHubParams{
+		URL: s.server.URL,
+	})
+	id, series, err := repo.Resolve(charm.MustParseURL("ch:wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "ch:amd64/wordpress-3")
+	c.Assert(series, jc.DeepEquals, []string{"focal", "jammy"})
+
+	id, series, err = repo.Resolve(charm.MustParseURL("ch:amd64/jammy/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "ch:amd64/jammy/wordpress-3")
+	c.Assert(series, jc.DeepEquals, []string{"focal", "jammy"})
+
+	_, _, err = repo.Resolve(charm.MustParseURL("ch:amd64/bionic/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot resolve URL "ch:amd64/bionic/wordpress": charm not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, _, err = repo.Resolve(charm.MustParseURL("ch:nothere"))
+	c.Assert(err, gc.ErrorMatches, `cannot resolve URL "ch:nothere": charm not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(s.refreshes, gc.HasLen, 0)
+}
+
+func (s *charmHubSuite) TestResolveChannel(c *gc.C) {
+	repo := charmrepo.NewCharmHub(charmrepo.NewCharmHubParams{
+		URL:     s.server.URL,
+		Channel: "edge",
+	})
+	id, series, err := repo.Resolve(charm.MustParseURL("ch:wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "ch:amd64/jammy/wordpress-5")
+	c.Assert(series, jc.DeepEquals, []string{"jammy"})
+}
+
+func (s *charmHubSuite) TestResolveRevisionUsesRefresh(c *gc.C) {
+	repo := charmrepo.NewCharmHub(charmrepo.NewCharmHubParams{
+		URL: s.server.URL,
+	})
+	id, series, err := repo.Resolve(charm.MustParseURL("ch:amd64/bionic/wordpress-1"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "ch:amd64/bionic/wordpress-1")
+	c.Assert(series, jc.DeepEquals, []string{"bionic"})
+	c.Assert(s.refreshes, jc.DeepEquals, []map[string]interface{}{{
+		"context": []interface{}{},
+		"actions": []interface{}{map[string]interface{}{
+			"action":       "download",
+			"instance-key": "charmrepo",
+			"name":         "wordpress",
+			"revision":     1.0,
+			"base": map[string]interface{}{
+				"name":         "ubuntu",
+				"channel":      "18.04",
+				"architecture": "amd64",
+			},
+		}},
+		"fields": []interface{}{"bases", "download", "id", "name", "resources", "revision", "type", "version"},
+	}})
+}
+
+func (s *charmHubSuite) TestGet(c *gc.C) {
+	repo := charmrepo.NewCharmHub(charmrepo.NewCharmHubParams{
+		URL: s.server.URL,
+	})
+	path := filepath.Join(c.MkDir(), "wordpress.charm")
+	ch, err := repo.Get(charm.MustParseURL("ch:wordpress"), path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ch.Meta().Name, gc.Equals, "wordpress")
+	c.Assert(ch.Path, gc.Equals, path)
+
+	s.hash = fmt.Sprintf("%x", sha256.Sum256([]byte("other")))
+	_, err = repo.Get(charm.MustParseURL("ch:wordpress"), filepath.Join(c.MkDir(), "bad.charm"))
+	_, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, jc.IsTrue, gc.Commentf("error %v", err))
+}
+
+func (s *charmHubSuite) TestBundle(c *gc.C) {
+	data, err := ioutil.ReadFile(TestCharms.BundleArchivePath(c.MkDir(), "wordpress-simple"))
+	c.Assert(err, gc.IsNil)
+	s.bundleArchive = data
+	repo := charmrepo.NewCharmHub(charmrepo.NewCharmHubParams{
+		URL: s.server.URL,
+	})
+	id, series, err := repo.Resolve(charm.MustParseURL("ch:wordpress-simple"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "ch:bundle/wordpress-simple-7")
+	c.Assert(series, gc.HasLen, 0)
+
+	b, err := repo.GetBundle(id, filepath.Join(c.MkDir(), "bundle"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(b.Data().Applications, gc.HasLen, 2)
+
+	_, _, err = repo.Resolve(charm.MustParseURL("ch:amd64/focal/wordpress-simple"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *charmHubSuite) TestFind(c *gc.C) {
+	repo := charmrepo.NewCharmHub(charmrepo.NewCharmHubParams{
+		URL: s.server.URL,
+	})
+	results, err := repo.Find("wordpress")
+	c.Assert(err, gc.IsNil)
+	c.Assert(results, jc.DeepEquals, []charmrepo.CharmHubFindResult{{
+		Type:    "charm",
+		ID:      "wordpress-id",
+		Name:    "wordpress",
+		Summary: "blog",
+	}})
+}
+
+func (s *charmHubSuite) TestRepository(c *gc.C) {
+	repo := charmrepo.NewCharmHubRepository(charmrepo.NewCharmHub(charmrepo.NewCharmHubParams{
+		URL: s.server.URL,
+	}))
+	entity, err := repo.Resolve("wordpress", "latest/edge", charmrepo.Base{
+		Name:         "ubuntu",
+		Channel:      "22.04",
+		Architecture: "amd64",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.URL.String(), gc.Equals, "ch:amd64/jammy/wordpress-5")
+	c.Assert(entity.Channel, gc.Equals, "latest/edge")
+	c.Assert(entity.Bases, jc.DeepEquals, []charmrepo.Base{{
+		Name:         "ubuntu",
+		Channel:      "22.04",
+		Architecture: "amd64",
+	}})
+
+	path := filepath.Join(c.MkDir(), "wordpress.charm")
+	err = repo.Download(entity.URL, path)
+	c.Assert(err, gc.IsNil)
+	ch, err := charm.ReadCharmArchive(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ch.Meta().Name, gc.Equals, "wordpress")
+
+	resources, err := repo.ListResources(charm.MustParseURL("ch:amd64/bionic/wordpress-1"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 1)
+	c.Assert(resources[0].Name, gc.Equals, "data")
+	c.Assert(resources[0].Revision, gc.Equals, 2)
+	c.Assert(resources[0].Size, gc.Equals, int64(9))
+
+	_, err = repo.Resolve("nothere", "", charmrepo.Base{})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
@@ -4,13 +4,13 @@
 package charmrepo // import "github.com/juju/charmrepo/v7"
 
 import (
-	"crypto/sha512"
 	"fmt"
 	"io"
-	"os"
 	"sort"
+	"time"
 
 	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery"
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery/agent"
 	"github.com/juju/charm/v9"
 	"gopkg.in/errgo.v1"
 
@@ -21,7 +21,26 @@ import (
 // CharmStore is a repository Interface that provides access to the public Juju
 // charm store.
 type CharmStore struct {
-	client *csclient.Client
+	client      *csclient.Client
+	seriesCache *SeriesCache
+
+	// downloads is used to share archive transfers
+	// between concurrent calls to Get and GetBundle.
+	downloads *downloadGroup
+
+	// archives, if non-nil, holds archives that
+	// have previously been retrieved.
+	archives *archiveCache
+
+	// notFound records the URLs that recently failed to
+	// resolve, and bypassNotFound specifies that it should
+	// not be consulted.
+	notFound       *notFoundCache
+	bypassNotFound bool
+
+	// eventHandler, if non-nil, is called
+	// with progress events.
+	eventHandler func(Event)
 }
 
 var _ Interface = (*CharmStore)(nil)
@@ -39,6 +58,10 @@ type NewCharmStoreParams struct {
 	// HTTPClient.
 	BakeryClient *httpbakery.Client
 
+	// AgentAuthInfo, if non-nil, holds agent credentials to log in
+	// with when BakeryClient is nil. See csclient.Params.AgentAuthInfo.
+	AgentAuthInfo *agent.AuthInfo
+
 	// User holds the name to authenticate as for the client. If User is empty,
 	// no credentials will be sent.
 	User string
@@ -46,6 +69,42 @@ type NewCharmStoreParams struct {
 	// Password holds the password for the given user, for authenticating the
 	// client.
 	Password string
+
+	// BearerToken holds a token to send in an "Authorization: Bearer"
+	// header with each request. See csclient.Params.BearerToken.
+	BearerToken string
+
+	// CircuitBreaker, if non-nil, is used to fail fast while the
+	// charm store is unavailable. It may be shared between
+	// several repositories.
+	CircuitBreaker *csclient.CircuitBreaker
+
+	// NotFoundCacheTTL, if positive, specifies that when a charm URL
+	// cannot be resolved because no matching charm or bundle exists,
+	// resolving it again should fail without asking the charm store
+	// until this much time has passed. This avoids repeated requests
+	// for misspelled charms, for example in a bundle. See also
+	// CharmStore.BypassNotFoundCache.
+	NotFoundCacheTTL time.Duration
+
+	// ArchiveCacheDir, if non-empty, specifies a directory in which
+	// to keep the archives retrieved by Get and GetBundle. When the
+	// charm store reports that an archive has the same id and hash
+	// as one in the directory, the archive is read from the directory
+	// instead of being transferred again. The directory is created
+	// if needed, and may be shared between repositories and processes.
+	ArchiveCacheDir string
+
+	// ArchiveCachePolicy limits the archives held in ArchiveCacheDir.
+	// By default, archives are kept indefinitely.
+	ArchiveCachePolicy ArchiveCachePolicy
+
+	// ResolveCacheTTL, if positive, specifies that the repository
+	// should have a SeriesCache that holds the results of resolving
+	// charm URLs, and the series supported by the resolved charms,
+	// for this long. Unlike archives, these results change as charms
+	// are published, so they are only cached for a limited time.
+	ResolveCacheTTL time.Duration
 }
 
 // NewCharmStore creates and returns a charm store repository.
@@ -56,19 +115,29 @@ type NewCharmStoreParams struct {
 // methods.
 func NewCharmStore(p NewCharmStoreParams) *CharmStore {
 	client := csclient.New(csclient.Params{
-		URL:          p.URL,
-		BakeryClient: p.BakeryClient,
-		User:         p.User,
-		Password:     p.Password,
+		URL:            p.URL,
+		BakeryClient:   p.BakeryClient,
+		AgentAuthInfo:  p.AgentAuthInfo,
+		User:           p.User,
+		Password:       p.Password,
+		BearerToken:    p.BearerToken,
+		CircuitBreaker: p.CircuitBreaker,
 	})
-	return NewCharmStoreFromClient(client)
+	s := NewCharmStoreFromClient(client)
+	s.notFound = newNotFoundCache(p.NotFoundCacheTTL)
+	s.archives = newArchiveCache(p.ArchiveCacheDir, p.ArchiveCachePolicy)
+	if p.ResolveCacheTTL > 0 {
+		s.seriesCache = NewSeriesCache(p.ResolveCacheTTL)
+	}
+	return s
 }
 
 // NewCharmStoreFromClient creates and returns a charm store repository.
 // The provided client is used for charm store requests.
 func NewCharmStoreFromClient(client *csclient.Client) *CharmStore {
 	return &CharmStore{
-		client: client,
+		client:    client,
+		downloads: newDownloadGroup(),
 	}
 }
 
@@ -78,17 +147,13 @@ func (s *CharmStore) Client() *csclient.Client {
 	return s.client
 }
 
-// Get implements Interface.Get.
+// Get implements Interface.Get. Concurrent calls that retrieve the
+// same archive share a single transfer from the charm store.
 func (s *CharmStore) Get(curl *charm.URL, archivePath string) (*charm.CharmArchive, error) {
 	if curl.Series == "bundle" {
 		return nil, errgo.Newf("expected a charm URL, got bundle URL %q", curl)
 	}
-	f, err := os.Create(archivePath)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	defer f.Close()
-	if err := s.getArchive(curl, f); err != nil {
+	if err := s.getToFile(curl, archivePath); err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
 	return charm.ReadCharmArchive(archivePath)
@@ -99,12 +164,7 @@ func (s *CharmStore) GetBundle(curl *charm.URL, archivePath string) (charm.Bundl
 	if curl.Series != "bundle" {
 		return nil, errgo.Newf("expected a bundle URL, got charm URL %q", curl)
 	}
-	f, err := os.Create(archivePath)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	defer f.Close()
-	if err := s.getArchive(curl, f); err != nil {
+	if err := s.getToFile(curl, archivePath); err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
 	return charm.ReadBundleArchive(archivePath)
@@ -113,32 +173,125 @@ func (s *CharmStore) GetBundle(curl *charm.URL, archivePath string) (charm.Bundl
 // getArchive reads the archive from the given charm or bundle URL
 // and writes it to the given writer.
 func (s *CharmStore) getArchive(curl *charm.URL, w io.Writer) error {
-	etype := "charm"
-	if curl.Series == "bundle" {
-		etype = "bundle"
+	id, err := s.downloads.writeArchive(s.client, s.archives, curl, w, func(id *charm.URL) {
+		s.sendEvent(Event{
+			Kind: EventDownloading,
+			URL:  curl,
+			Id:   id,
+		})
+	})
+	if err != nil {
+		return s.retrieveFailed(curl, err)
 	}
-	r, _, expectHash, expectSize, err := s.client.GetArchive(curl)
+	s.sendEvent(Event{
+		Kind: EventVerified,
+		URL:  curl,
+		Id:   id,
+	})
+	return nil
+}
+
+// GetStream returns a reader for the archive of the charm or bundle
+// with the given URL, and the fully qualified id of the entity, without
+// writing the archive to a file. This suits callers that unpack the
+// archive or store it elsewhere as it is read. The data is checked
+// against the hash and size reported by the charm store as it is read:
+// if it does not match, reading returns an error with a
+// *csclient.HashMismatchError cause instead of io.EOF, so the data
+// should not be used until the reader has returned io.EOF.
+//
+// If the archive is held in the archive cache, it is read from the
+// cache without being transferred from the charm store. Streamed
+// archives are not added to the cache. The reader must be closed
+// after use.
+func (s *CharmStore) GetStream(curl *charm.URL) (io.ReadCloser, *charm.URL, error) {
+	data, err := s.getStreamData(curl)
 	if err != nil {
-		if errgo.Cause(err) == params.ErrNotFound {
-			// Make a prettier error message for the user.
-			return errgo.WithCausef(nil, params.ErrNotFound, "cannot retrieve %q: %s not found", curl, etype)
-		}
-		return errgo.NoteMask(err, fmt.Sprintf("cannot retrieve %s %q", etype, curl), errgo.Any)
+		return nil, nil, s.retrieveFailed(curl, err)
 	}
-	defer r.Close()
+	s.sendEvent(Event{
+		Kind: EventDownloading,
+		URL:  curl,
+		Id:   data.Id,
+	})
+	return &streamReader{
+		ReadCloser: data.VerifiedReader(),
+		store:      s,
+		url:        curl,
+		id:         data.Id,
+	}, data.Id, nil
+}
 
-	hash := sha512.New384()
-	size, err := io.Copy(io.MultiWriter(hash, w), r)
+// getStreamData returns the archive data for GetStream. If there is an
+// archive cache, the archive's id and hash are retrieved first, and the
+// archive is only transferred if it is not in the cache.
+func (s *CharmStore) getStreamData(curl *charm.URL) (*csclient.ArchiveData, error) {
+	if s.archives == nil {
+		data, err := s.client.GetArchiveData(curl)
+		return data, errgo.Mask(err, errgo.Any)
+	}
+	info, err := archiveInfo(s.client, curl)
 	if err != nil {
-		return errgo.Notef(err, "cannot read entity archive")
+		return nil, errgo.Mask(err, errgo.Any)
 	}
-	if size != expectSize {
-		return errgo.Newf("size mismatch; network corruption?")
+	if f := s.archives.open(info); f != nil {
+		data := *info
+		data.ReadCloser = f
+		return &data, nil
 	}
-	if fmt.Sprintf("%x", hash.Sum(nil)) != expectHash {
-		return errgo.Newf("hash mismatch; network corruption?")
+	data, err := s.client.GetArchiveData(info.Id)
+	return data, errgo.Mask(err, errgo.Any)
+}
+
+// streamReader is the reader returned by CharmStore.GetStream. It
+// sends an event when the archive has been verified or has failed.
+type streamReader struct {
+	io.ReadCloser
+	store *CharmStore
+	url   *charm.URL
+	id    *charm.URL
+	done  bool
+}
+
+// Read implements io.Reader.Read.
+func (r *streamReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	if err == nil || r.done {
+		return n, err
 	}
-	return nil
+	r.done = true
+	if err == io.EOF {
+		r.store.sendEvent(Event{
+			Kind: EventVerified,
+			URL:  r.url,
+			Id:   r.id,
+		})
+		return n, err
+	}
+	return n, r.store.retrieveFailed(r.url, err)
+}
+
+// retrieveFailed sends an event for the given error encountered when
+// retrieving the archive with the given URL, and returns the error
+// to report.
+func (s *CharmStore) retrieveFailed(curl *charm.URL, err error) error {
+	etype := "charm"
+	if curl.Series == "bundle" {
+		etype = "bundle"
+	}
+	s.sendEvent(Event{
+		Kind: EventFailed,
+		URL:  curl,
+		Err:  err,
+	})
+	if errgo.Cause(err) == params.ErrNotFound {
+		// Make a prettier error message for the user.
+		return errgo.WithCausef(nil, params.ErrNotFound, "cannot retrieve %q: %s not found", curl, etype)
+	}
+	if _, ok := errgo.Cause(err).(*csclient.HashMismatchError); ok {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.NoteMask(err, fmt.Sprintf("cannot retrieve %s %q", etype, curl), errgo.Any)
 }
 
 // Resolve implements Interface.Resolve.
@@ -159,29 +312,109 @@ func (s *CharmStore) ResolveWithChannel(ref *charm.URL) (*charm.URL, params.Chan
 // ResolveWithPreferredChannel does the same thing as ResolveWithChannel() but
 // allows callers to specify a preferred channel to use.
 func (s *CharmStore) ResolveWithPreferredChannel(ref *charm.URL, channel params.Channel) (*charm.URL, params.Channel, []string, error) {
-	var result struct {
-		Id              params.IdResponse
-		SupportedSeries params.SupportedSeriesResponse
-		Published       params.PublishedResponse
+	r, err := s.resolveWithEvents(ref, channel)
+	if err != nil {
+		return nil, params.NoChannel, nil, errgo.Mask(err, errgo.Any)
+	}
+	return r.URL, r.Channel, r.SupportedSeries, nil
+}
+
+// ResolveWithPublishedInfo does the same thing as
+// ResolveWithPreferredChannel() but, instead of choosing the best
+// channel to use, returns information on all the channels that the
+// entity is published in, so that callers can choose a channel
+// themselves.
+func (s *CharmStore) ResolveWithPublishedInfo(ref *charm.URL, channel params.Channel) (*charm.URL, []params.PublishedInfo, []string, error) {
+	r, err := s.resolveWithEvents(ref, channel)
+	if err != nil {
+		return nil, nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	return r.URL, r.Published, r.SupportedSeries, nil
+}
+
+// ResolveForBase does the same thing as ResolveWithPreferredChannel()
+// but only resolves to revisions that run on the given base. If the
+// base has no name, any base is accepted. Note that the charm store
+// does not record the architectures that charms run on, so the
+// architecture of the base is not used.
+//
+// If ref already specifies a series, it must be the series
+// of the base.
+func (s *CharmStore) ResolveForBase(ref *charm.URL, channel params.Channel, base Base) (*charm.URL, params.Channel, []string, error) {
+	if base.Name != "" && ref.Series != "bundle" {
+		series := baseSeries(base.Name, base.Channel)
+		if series == "" {
+			return nil, params.NoChannel, nil, errgo.Newf("unknown base %s/%s", base.Name, base.Channel)
+		}
+		if ref.Series != "" && ref.Series != series {
+			return nil, params.NoChannel, nil, resolveNotFoundError(ref)
+		}
+		ref = ref.WithSeries(series)
+	}
+	r, err := s.resolveWithEvents(ref, channel)
+	if err != nil {
+		return nil, params.NoChannel, nil, errgo.Mask(err, errgo.Any)
 	}
+	return r.URL, r.Channel, r.SupportedSeries, nil
+}
 
+// resolveWithEvents resolves ref in the given channel,
+// sending events to report progress.
+func (s *CharmStore) resolveWithEvents(ref *charm.URL, channel params.Channel) (ResolveResult, error) {
+	s.sendEvent(Event{
+		Kind: EventResolving,
+		URL:  ref,
+	})
+	r, err := s.resolve(ref, channel)
+	if err != nil {
+		s.sendEvent(Event{
+			Kind: EventFailed,
+			URL:  ref,
+			Err:  err,
+		})
+		return ResolveResult{}, errgo.Mask(err, errgo.Any)
+	}
+	s.sendEvent(Event{
+		Kind: EventResolved,
+		URL:  ref,
+		Id:   r.URL,
+	})
+	return r, nil
+}
+
+// resolve implements resolveWithEvents.
+func (s *CharmStore) resolve(ref *charm.URL, channel params.Channel) (ResolveResult, error) {
+	if r, ok := s.seriesCache.getResolved(s.cacheScope(), ref, channel); ok {
+		return r, nil
+	}
+	if !s.bypassNotFound && s.notFound.contains(ref, channel) {
+		return ResolveResult{}, resolveNotFoundError(ref)
+	}
+	var result resolveMetaResult
 	if _, err := s.client.MetaWithChannel(ref, &result, channel); err != nil {
 		if errgo.Cause(err) == params.ErrNotFound {
-			// Make a prettier error message for the user.
-			etype := "charm"
-			switch ref.Series {
-			case "bundle":
-				etype = "bundle"
-			case "":
-				etype = "charm or bundle"
-			}
-			return nil, params.NoChannel, nil, errgo.WithCausef(nil, params.ErrNotFound, "cannot resolve URL %q: %s not found", ref, etype)
+			s.notFound.add(ref, channel)
+			return ResolveResult{}, resolveNotFoundError(ref)
 		}
-		return nil, params.NoChannel, nil, errgo.NoteMask(err, fmt.Sprintf("cannot resolve charm URL %q", ref), errgo.Any)
+		return ResolveResult{}, errgo.NoteMask(err, fmt.Sprintf("cannot resolve charm URL %q", ref), errgo.Any)
 	}
+	return s.resolved(ref, channel, result), nil
+}
 
+// resolveMetaResult holds the metadata requested
+// when resolving a charm URL.
+type resolveMetaResult struct {
+	Id              params.IdResponse
+	SupportedSeries params.SupportedSeriesResponse
+	Published       params.PublishedResponse
+}
+
+// resolved records that ref was resolved in the given preferred channel
+// to the entity with the given metadata, and returns the result.
+func (s *CharmStore) resolved(ref *charm.URL, preferredChannel params.Channel, meta resolveMetaResult) ResolveResult {
 	// If no preferredChannel is specified then we should use the (optional)
 	// csclient channel value as our preferredChannel.
+	channel := preferredChannel
 	if channel == params.NoChannel {
 		channel = s.client.Channel()
 	}
@@ -190,8 +423,137 @@ func (s *CharmStore) ResolveWithPreferredChannel(ref *charm.URL, channel params.
 	// of getting stale. Perhaps add params.PublishedResponse.BestChannel
 	// or, less desireably, have params.PublishedResponse.Info be
 	// priority-ordered.
-	channel = bestChannel(s.client, result.Published.Info, channel)
-	return result.Id.Id, channel, result.SupportedSeries.SupportedSeries, nil
+	r := ResolveResult{
+		URL:             meta.Id.Id,
+		Channel:         bestChannel(s.client, meta.Published.Info, channel),
+		Published:       meta.Published.Info,
+		SupportedSeries: meta.SupportedSeries.SupportedSeries,
+	}
+	s.seriesCache.addResolved(s.cacheScope(), ref, preferredChannel, r)
+	s.notFound.remove(ref, preferredChannel)
+	return r
+}
+
+// ResolveResult holds the result of resolving
+// a single URL with ResolveMany.
+type ResolveResult struct {
+	// URL holds the fully qualified id that the URL resolved to.
+	URL *charm.URL
+
+	// Channel holds the best channel to use for the entity.
+	Channel params.Channel
+
+	// Published holds information on all the channels
+	// that the entity is published in.
+	Published []params.PublishedInfo
+
+	// SupportedSeries holds the series supported by the entity.
+	SupportedSeries []string
+
+	// Err holds any error encountered resolving the URL.
+	// When no matching entity was found, its cause is
+	// params.ErrNotFound.
+	Err error
+}
+
+// copy returns a copy of r that does not share its slices.
+func (r ResolveResult) copy() ResolveResult {
+	r.Published = append([]params.PublishedInfo(nil), r.Published...)
+	r.SupportedSeries = append([]string(nil), r.SupportedSeries...)
+	return r
+}
+
+// ResolveMany is like ResolveWithChannel except that it resolves
+// several URLs at once, using a single charm store request for all the
+// URLs that are not already cached. This is useful when processing a
+// bundle, which may refer to many charms. As that request ignores
+// authorization, URLs that it does not resolve, such as those of
+// private charms, are then resolved individually. It returns a result for each
+// of the given URLs, in the same order; the returned error is only
+// non-nil if the charm store request itself failed.
+func (s *CharmStore) ResolveMany(refs []*charm.URL) ([]ResolveResult, error) {
+	channel := s.client.Channel()
+	results := make([]ResolveResult, len(refs))
+	var ids []*charm.URL
+	var indexes []int
+	for i, ref := range refs {
+		s.sendEvent(Event{
+			Kind: EventResolving,
+			URL:  ref,
+		})
+		if r, ok := s.seriesCache.getResolved(s.cacheScope(), ref, channel); ok {
+			results[i] = r
+			continue
+		}
+		if !s.bypassNotFound && s.notFound.contains(ref, channel) {
+			results[i].Err = resolveNotFoundError(ref)
+			continue
+		}
+		ids = append(ids, ref)
+		indexes = append(indexes, i)
+	}
+	if len(ids) > 0 {
+		var metaResults []resolveMetaResult
+		resolved, err := s.client.BulkMeta(ids, &metaResults)
+		if err != nil {
+			err = errgo.NoteMask(err, "cannot resolve charm URLs", errgo.Any)
+			for _, ref := range refs {
+				s.sendEvent(Event{
+					Kind: EventFailed,
+					URL:  ref,
+					Err:  err,
+				})
+			}
+			return nil, err
+		}
+		for j, id := range resolved {
+			i, ref := indexes[j], ids[j]
+			if id == nil {
+				// The bulk request ignores authorization, so the
+				// entity may exist but not be visible to it. Resolve
+				// it with an authorized request, which records
+				// the entity as not found only if it really is.
+				r, err := s.resolve(ref, channel)
+				if err != nil {
+					results[i].Err = err
+					continue
+				}
+				results[i] = r
+				continue
+			}
+			results[i] = s.resolved(ref, channel, metaResults[j])
+		}
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			s.sendEvent(Event{
+				Kind: EventFailed,
+				URL:  refs[i],
+				Err:  r.Err,
+			})
+			continue
+		}
+		s.sendEvent(Event{
+			Kind: EventResolved,
+			URL:  refs[i],
+			Id:   r.URL,
+		})
+	}
+	return results, nil
+}
+
+// resolveNotFoundError returns the error returned
+// when no entity matching ref can be found.
+func resolveNotFoundError(ref *charm.URL) error {
+	// Make a prettier error message for the user.
+	etype := "charm"
+	switch ref.Series {
+	case "bundle":
+		etype = "bundle"
+	case "":
+		etype = "charm or bundle"
+	}
+	return errgo.WithCausef(nil, params.ErrNotFound, "cannot resolve URL %q: %s not found", ref, etype)
 }
 
 // GetFileFromArchive streams the contents of the requested filename from the
@@ -8,13 +8,18 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/juju/charm/v9"
 	jujutesting "github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
 	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient"
 	"github.com/juju/charmrepo/v7/csclient/params"
 	charmtesting "github.com/juju/charmrepo/v7/testing"
 )
@@ -117,3 +122,203 @@ func (s *charmStoreRepoSuite) TestGetFileFromArchive(c *gc.C) {
 		}
 	}
 }
+
+func (s *charmStoreRepoSuite) TestGetHashMismatch(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/meta/any") {
+			writeJSON(w, params.MetaAnyResponse{
+				Id: charm.MustParseURL("cs:~bob/xenial/wordpress-1"),
+				Meta: map[string]interface{}{
+					"hash":         params.HashResponse{Sum: "1234"},
+					"archive-size": params.ArchiveSizeResponse{Size: 5},
+				},
+			})
+			return
+		}
+		w.Header().Set(params.EntityIdHeader, "cs:~bob/xenial/wordpress-1")
+		w.Header().Set(params.ContentHashHeader, "1234")
+		w.Header().Set("Via", "1.1 squid")
+		w.Header().Set("Content-Length", "5")
+		fmt.Fprint(w, "hello")
+	}))
+	defer srv.Close()
+
+	st := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: srv.URL,
+	})
+	_, err := st.Get(charm.MustParseURL("cs:~bob/wordpress"), filepath.Join(c.MkDir(), "archive.charm"))
+	c.Assert(err, gc.ErrorMatches, `hash mismatch reading archive of "cs:~bob/xenial/wordpress-1" \(expected 5 bytes with hash 1234, got 5 bytes with hash [0-9a-f]+, response was proxied\); network corruption\?`)
+	mismatch, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(mismatch.Id.String(), gc.Equals, "cs:~bob/xenial/wordpress-1")
+	c.Assert(mismatch.ExpectedHash, gc.Equals, "1234")
+	c.Assert(mismatch.BytesRead, gc.Equals, int64(5))
+	c.Assert(mismatch.Proxied, jc.IsTrue)
+}
+
+func (s *charmStoreRepoSuite) TestResolveForBase(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+	store.addCharm("cs:~bob/mysql-6", "focal")
+
+	st := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	id, _, series, err := st.ResolveForBase(charm.MustParseURL("cs:~bob/mysql"), params.NoChannel, charmrepo.Base{
+		Name:         "ubuntu",
+		Channel:      "18.04",
+		Architecture: "amd64",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/mysql-5")
+	c.Assert(series, jc.DeepEquals, []string{"xenial", "bionic"})
+
+	id, _, _, err = st.ResolveForBase(charm.MustParseURL("cs:~bob/mysql"), params.NoChannel, charmrepo.Base{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/mysql-6")
+
+	_, _, _, err = st.ResolveForBase(charm.MustParseURL("cs:~bob/xenial/mysql"), params.NoChannel, charmrepo.Base{
+		Name:    "ubuntu",
+		Channel: "20.04",
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot resolve URL "cs:~bob/xenial/mysql": charm not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, _, _, err = st.ResolveForBase(charm.MustParseURL("cs:~bob/mysql"), params.NoChannel, charmrepo.Base{
+		Name:    "ubuntu",
+		Channel: "22.04",
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *charmStoreRepoSuite) TestGetStream(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/xenial/wordpress-1")
+
+	var events []string
+	st := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	}).WithEventHandler(func(e charmrepo.Event) {
+		events = append(events, e.String())
+	})
+	r, id, err := st.GetStream(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/xenial/wordpress-1")
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(r.Close(), gc.IsNil)
+	c.Assert(data, jc.DeepEquals, e.archive)
+	c.Assert(events, jc.DeepEquals, []string{
+		"downloading cs:~bob/xenial/wordpress-1",
+		"verified cs:~bob/xenial/wordpress-1",
+	})
+
+	_, _, err = st.GetStream(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.ErrorMatches, `cannot retrieve "cs:~bob/mysql": charm not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *charmStoreRepoSuite) TestGetStreamHashMismatch(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/meta/any") {
+			writeJSON(w, params.MetaAnyResponse{
+				Id: charm.MustParseURL("cs:~bob/xenial/wordpress-1"),
+				Meta: map[string]interface{}{
+					"hash":         params.HashResponse{Sum: "1234"},
+					"archive-size": params.ArchiveSizeResponse{Size: 5},
+				},
+			})
+			return
+		}
+		w.Header().Set(params.EntityIdHeader, "cs:~bob/xenial/wordpress-1")
+		w.Header().Set(params.ContentHashHeader, "1234")
+		w.Header().Set("Content-Length", "5")
+		fmt.Fprint(w, "hello")
+	}))
+	defer srv.Close()
+
+	st := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: srv.URL,
+	})
+	r, _, err := st.GetStream(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	mismatch, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, jc.IsTrue, gc.Commentf("error %v", err))
+	c.Assert(mismatch.ExpectedHash, gc.Equals, "1234")
+}
+
+func (s *charmStoreRepoSuite) TestResolveMany(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+	store.addCharm("cs:~bob/xenial/wordpress-2")
+	store.addCharm("cs:~bob/xenial/secret-1").private = true
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	}).WithSeriesCache(charmrepo.NewSeriesCache(time.Minute))
+
+	// Resolve one URL beforehand so that it is cached.
+	_, _, err := repo.Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.metaRequests, gc.Equals, 1)
+
+	results, err := repo.ResolveMany([]*charm.URL{
+		charm.MustParseURL("cs:~bob/mysql"),
+		charm.MustParseURL("cs:~bob/wordpress"),
+		charm.MustParseURL("cs:~bob/nothere"),
+		charm.MustParseURL("cs:~bob/secret"),
+	})
+	c.Assert(err, gc.IsNil)
+	// The URLs not found by the bulk request are
+	// resolved individually.
+	c.Assert(store.metaRequests, gc.Equals, 3)
+	c.Assert(results, gc.HasLen, 4)
+	c.Assert(results[0].Err, gc.IsNil)
+	c.Assert(results[0].URL.String(), gc.Equals, "cs:~bob/mysql-5")
+	c.Assert(results[0].Channel, gc.Equals, params.StableChannel)
+	c.Assert(results[0].SupportedSeries, jc.DeepEquals, []string{"xenial", "bionic"})
+	c.Assert(results[1].Err, gc.IsNil)
+	c.Assert(results[1].URL.String(), gc.Equals, "cs:~bob/xenial/wordpress-2")
+	c.Assert(results[1].SupportedSeries, jc.DeepEquals, []string{"xenial"})
+	c.Assert(results[2].URL, gc.IsNil)
+	c.Assert(results[2].Err, gc.ErrorMatches, `cannot resolve URL "cs:~bob/nothere": charm or bundle not found`)
+	c.Assert(errgo.Cause(results[2].Err), gc.Equals, params.ErrNotFound)
+	c.Assert(results[3].Err, gc.IsNil)
+	c.Assert(results[3].URL.String(), gc.Equals, "cs:~bob/xenial/secret-1")
+
+	// The resolved URLs are now cached.
+	for _, id := range []string{"cs:~bob/mysql", "cs:~bob/secret"} {
+		_, _, err = repo.Resolve(charm.MustParseURL(id))
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(store.metaRequests, gc.Equals, 3)
+}
+
+func (s *charmStoreRepoSuite) TestResolveWithPublishedInfo(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	}).WithSeriesCache(charmrepo.NewSeriesCache(time.Minute))
+	for i := 0; i < 2; i++ {
+		id, published, series, err := repo.ResolveWithPublishedInfo(charm.MustParseURL("cs:~bob/mysql"), params.NoChannel)
+		c.Assert(err, gc.IsNil)
+		c.Assert(id.String(), gc.Equals, "cs:~bob/mysql-5")
+		c.Assert(published, jc.DeepEquals, []params.PublishedInfo{{
+			Channel: params.StableChannel,
+			Current: true,
+		}})
+		c.Assert(series, jc.DeepEquals, []string{"xenial", "bionic"})
+	}
+	c.Assert(store.metaRequests, gc.Equals, 1)
+
+	_, _, _, err := repo.ResolveWithPublishedInfo(charm.MustParseURL("cs:~bob/nothere"), params.NoChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
@@ -6,6 +6,7 @@ package csclient // import "github.com/juju/charmrepo/v7/csclient"
 import (
 	"crypto/sha512"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -23,11 +24,15 @@ type ReadSeekCloser interface {
 // openArchive is used to turn the current charm or bundle implementations
 // into readers for their corresponding archive.
 // It returns the corresponding archive reader, its hex-encoded SHA384 hash
-// and size.
-func openArchive(entity interface{}) (r ReadSeekCloser, hash string, size int64, err error) {
+// and size. If stream is true, archives for directories are created
+// as they are read rather than being written to a temporary file.
+func openArchive(entity interface{}, stream bool) (r ReadSeekCloser, hash string, size int64, err error) {
 	var path string
 	switch entity := entity.(type) {
 	case archiverTo:
+		if stream {
+			return openArchiveStream(entity)
+		}
 		// For example: charm.CharmDir or charm.BundleDir.
 		file, err := newRemoveOnCloseTempFile("entity-archive")
 		if err != nil {
@@ -104,3 +109,102 @@ func (r *removeOnCloseFile) Close() error {
 	r.File.Close()
 	return os.Remove(r.File.Name())
 }
+
+// openArchiveStream returns a reader that reads an archive of the
+// given entity as it is created. The archive is created once up
+// front to find its hash and size, so the entity must produce
+// the same archive each time; this is true of charm.CharmDir and
+// charm.BundleDir as long as the directory is not changed.
+func openArchiveStream(entity archiverTo) (r ReadSeekCloser, hash string, size int64, err error) {
+	h := sha512.New384()
+	w := &countingWriter{w: h}
+	if err := entity.ArchiveTo(w); err != nil {
+		return nil, "", 0, errgo.Notef(err, "cannot create entity archive")
+	}
+	hash = fmt.Sprintf("%x", h.Sum(nil))
+	return &archiveStream{
+		entity: entity,
+		hash:   hash,
+	}, hash, w.n, nil
+}
+
+// archiveStream is a reader that creates an archive as it is read.
+// It can only seek back to the start of the archive, which is enough
+// for the request body to be resent after a macaroon discharge.
+type archiveStream struct {
+	entity archiverTo
+	hash   string
+
+	// r and h hold the reader for the archive currently
+	// being created and the hash of the data read so far,
+	// or nil if reading has not started. The done channel
+	// is closed when the archive has been created.
+	r    *io.PipeReader
+	h    hash.Hash
+	done chan struct{}
+	pos  int64
+}
+
+// Read implements io.Reader.Read. It returns an error rather
+// than io.EOF if the archive read does not have the expected
+// hash, so that a changed directory is not uploaded.
+func (s *archiveStream) Read(buf []byte) (int, error) {
+	if s.r == nil {
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pw.CloseWithError(s.entity.ArchiveTo(pw))
+		}()
+		s.r = pr
+		s.h = sha512.New384()
+		s.done = done
+	}
+	n, err := s.r.Read(buf)
+	s.h.Write(buf[:n])
+	s.pos += int64(n)
+	if err == io.EOF && fmt.Sprintf("%x", s.h.Sum(nil)) != s.hash {
+		return n, errgo.New("archive changed while being uploaded")
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.Seek. Only seeking to the start
+// of the archive or to the current position is supported.
+func (s *archiveStream) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case offset == 0 && whence == io.SeekCurrent:
+		return s.pos, nil
+	case offset == 0 && whence == io.SeekStart:
+		s.Close()
+		return 0, nil
+	}
+	return s.pos, errgo.Newf("cannot seek to offset %d (whence %d) in streamed archive", offset, whence)
+}
+
+// Close implements io.Closer.Close. It stops any archive
+// currently being created, and waits for it to stop so that
+// the entity is never used to create two archives at once.
+func (s *archiveStream) Close() error {
+	if s.r != nil {
+		s.r.Close()
+		<-s.done
+	}
+	s.r = nil
+	s.done = nil
+	s.h = nil
+	s.pos = 0
+	return nil
+}
+
+// countingWriter is an io.Writer that counts the bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	w.n += int64(n)
+	return n, err
+}
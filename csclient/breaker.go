@@ -0,0 +1,153 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StoreUnavailableError is the error cause returned when a request
+// is not made because a CircuitBreaker has found the charm store
+// to be unavailable.
+type StoreUnavailableError struct {
+	// Failures holds the number of consecutive
+	// failed requests that tripped the breaker.
+	Failures int
+
+	// LastError holds the error from the last failed request.
+	LastError string
+
+	// RetryAfter holds the time after which a request
+	// will be allowed through to probe the store.
+	RetryAfter time.Time
+}
+
+// Error implements error.Error.
+func (e *StoreUnavailableError) Error() string {
+	return fmt.Sprintf("charm store unavailable after %d consecutive failures (last error: %s); not retrying until %s", e.Failures, e.LastError, e.RetryAfter.Format(time.RFC3339))
+}
+
+// CircuitBreaker stops requests being made to a charm store that
+// appears to be down, so that callers fail fast rather than waiting
+// for each of their requests to fail.
+//
+// After Threshold consecutive requests have failed because of a network
+// error or a server status indicating an outage, the breaker trips and
+// further requests fail immediately with a *StoreUnavailableError
+// cause. Once ProbeInterval has passed, a single request is allowed
+// through to probe the store: if it succeeds, the breaker is reset;
+// otherwise it stays tripped for another interval.
+//
+// A CircuitBreaker may be shared between several clients
+// and is safe to use concurrently.
+type CircuitBreaker struct {
+	threshold     int
+	probeInterval time.Duration
+	now           func() time.Time
+
+	mu         sync.Mutex
+	failures   int
+	lastError  string
+	retryAfter time.Time
+	probing    bool
+}
+
+// NewCircuitBreaker returns a breaker that trips after the given
+// number of consecutive failures and probes the store at the
+// given interval while it is tripped.
+func NewCircuitBreaker(threshold int, probeInterval time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold:     threshold,
+		probeInterval: probeInterval,
+		now:           time.Now,
+	}
+}
+
+// allow returns an error if a request should not be made. It is OK
+// to call allow on a nil breaker. If allow returns nil, the
+// result of the request must be recorded by calling done.
+func (b *CircuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || b.now().Before(b.retryAfter) {
+		return &StoreUnavailableError{
+			Failures:   b.failures,
+			LastError:  b.lastError,
+			RetryAfter: b.retryAfter,
+		}
+	}
+	b.probing = true
+	return nil
+}
+
+// done records the result of a request allowed by allow.
+// It is OK to call done on a nil breaker.
+func (b *CircuitBreaker) done(resp *http.Response, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	switch {
+	case err != nil && isCallerStopped(err):
+		// The caller canceled the request or its deadline
+		// passed, which says nothing about the store.
+		return
+	case err != nil && !isAPIError(err):
+		b.lastError = err.Error()
+	case resp != nil && isOutageStatus(resp.StatusCode):
+		b.lastError = "unexpected response status from server: " + resp.Status
+	default:
+		b.failures = 0
+		b.lastError = ""
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.retryAfter = b.now().Add(b.probeInterval)
+	}
+}
+
+// isCallerStopped reports whether err was caused by the caller
+// canceling the request or by the request's deadline passing.
+func isCallerStopped(err error) bool {
+	return underlyingError(err, func(err error) bool {
+		return isCanceled(err) || errors.Is(err, context.DeadlineExceeded)
+	}) != nil
+}
+
+// Tripped reports whether the breaker is currently
+// stopping requests from being made.
+func (b *CircuitBreaker) Tripped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
+
+// isOutageStatus reports whether the given response status
+// indicates that the charm store is not available.
+func isOutageStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// ChangesParams holds the parameters for a Client.Changes request.
+type ChangesParams struct {
+	// Since restricts the results to entities published
+	// at or after the given time. A zero time is ignored.
+	Since time.Time
+
+	// Until restricts the results to entities published
+	// before the given time. A zero time is ignored.
+	Until time.Time
+
+	// Limit holds the maximum number of results returned
+	// by the charm store. If it is zero, there is no limit.
+	// Note that the limit is applied before results outside
+	// the requested times are discarded.
+	Limit int
+}
+
+// Changes returns the entities that have been published in the charm
+// store, most recently published first. Mirroring tools can use it to
+// discover new revisions by passing the publish time of the most recent
+// entity they have seen as p.Since.
+func (c *Client) Changes(p ChangesParams) ([]params.Published, error) {
+	if p.Limit < 0 {
+		return nil, errgo.Newf("negative limit")
+	}
+	// The charm store only accepts dates, so ask for whole days and
+	// discard the results that fall outside the requested times.
+	v := url.Values{}
+	if p.Limit > 0 {
+		v.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if !p.Since.IsZero() {
+		v.Set("start", p.Since.UTC().Format(apiDateFormat))
+	}
+	if !p.Until.IsZero() {
+		v.Set("stop", p.Until.UTC().Format(apiDateFormat))
+	}
+	path := "/changes/published"
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+	var published []params.Published
+	if err := c.Get(path, &published); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get published changes", isAPIError)
+	}
+	result := published[:0]
+	for _, pub := range published {
+		if !p.Since.IsZero() && pub.PublishTime.Before(p.Since) {
+			continue
+		}
+		if !p.Until.IsZero() && !pub.PublishTime.Before(p.Until) {
+			continue
+		}
+		result = append(result, pub)
+	}
+	return result, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ErrClosed is the error cause returned when a request
+// is made with a client that has been closed.
+var ErrClosed = errgo.New("client has been closed")
+
+// closer records whether a client has been closed. It is
+// shared between a client and the clients derived from it.
+type closer struct {
+	once sync.Once
+
+	// done is closed when the client is closed, so that
+	// background work started by the client can stop.
+	done chan struct{}
+
+	// mu guards logBuffers.
+	mu sync.Mutex
+
+	// logBuffers holds the open log buffers created with the
+	// client, which are closed before the client is closed.
+	logBuffers map[*LogBuffer]bool
+}
+
+func newCloser() *closer {
+	return &closer{
+		done:       make(chan struct{}),
+		logBuffers: make(map[*LogBuffer]bool),
+	}
+}
+
+// close closes any open log buffers, sending the messages buffered in
+// them, and then marks the client as closed. It returns the first
+// error encountered closing a log buffer.
+func (cl *closer) close() error {
+	var err error
+	cl.once.Do(func() {
+		cl.mu.Lock()
+		buffers := cl.logBuffers
+		cl.logBuffers = nil
+		cl.mu.Unlock()
+		for b := range buffers {
+			if berr := b.Close(); berr != nil && err == nil {
+				err = errgo.NoteMask(berr, "cannot close log buffer", errgo.Any)
+			}
+		}
+		close(cl.done)
+	})
+	return err
+}
+
+// addLogBuffer records that the given log buffer should be closed
+// when the client is closed. It reports whether the client
+// is still open.
+func (cl *closer) addLogBuffer(b *LogBuffer) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.logBuffers == nil {
+		return false
+	}
+	cl.logBuffers[b] = true
+	return true
+}
+
+// removeLogBuffer removes a log buffer added with addLogBuffer.
+func (cl *closer) removeLogBuffer(b *LogBuffer) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	delete(cl.logBuffers, b)
+}
+
+// closed reports whether the client has been closed.
+func (cl *closer) closed() bool {
+	select {
+	case <-cl.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the client and the clients derived from it (for example
+// with WithChannel), stopping any background work and closing idle
+// connections held by the HTTP client used to make requests. Requests
+// already in progress are not affected, but any later request fails
+// with an error with an ErrClosed cause.
+//
+// Any open log buffers created with the client are closed first, so
+// that the messages buffered in them are sent; the first error
+// encountered sending them is returned.
+//
+// Note that if Params.BakeryClient or Params.DischargeCache was
+// provided, the idle connections of its HTTP client are closed too,
+// which may affect other users of that client.
+func (c *Client) Close() error {
+	err := c.closer.close()
+	if bclient := c.bakeryClient(); bclient != nil && bclient.Client != nil {
+		bclient.Client.CloseIdleConnections()
+	}
+	return errgo.Mask(err, errgo.Any)
+}
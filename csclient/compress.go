@@ -0,0 +1,69 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// acceptEncoding holds the value of the Accept-Encoding
+// header sent with requests for compressible responses.
+const acceptEncoding = "gzip, deflate"
+
+// acceptsCompression reports whether a request to the given API path
+// should ask for a compressed response. Only metadata is requested in
+// compressed form: archives and resources are already compressed or
+// must be verified against their hash as sent.
+func acceptsCompression(req *http.Request, path string) bool {
+	return req.Method == "GET" &&
+		req.Header.Get("Accept-Encoding") == "" &&
+		strings.HasPrefix(endpointLabel(path), "meta")
+}
+
+// decompressResponse replaces the body of the given response with
+// its decompressed contents if the server compressed it.
+func decompressResponse(resp *http.Response) error {
+	var r io.ReadCloser
+	var err error
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		r, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		r, err = zlib.NewReader(resp.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		resp.Body.Close()
+		return errgo.Notef(err, "cannot decompress response")
+	}
+	resp.Body = &decompressedBody{
+		ReadCloser: r,
+		body:       resp.Body,
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// decompressedBody reads from a decompressor, closing
+// both it and the underlying response body when closed.
+type decompressedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+// Close implements io.Closer.Close.
+func (b *decompressedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
@@ -14,7 +14,9 @@ package csclient // import "github.com/juju/charmrepo/v7/csclient"
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha512"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -25,10 +27,12 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery"
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery/agent"
 	"github.com/juju/charm/v9"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
@@ -53,14 +57,40 @@ const defaultMinMultipartUploadSize = 5 * 1024 * 1024
 var ServerURL = "https://api.jujucharms.com/charmstore"
 
 // Client represents the client side of a charm store.
+//
+// A Client is safe for concurrent use by multiple goroutines. Clients
+// derived from it with WithChannel or WithRequestId start with a copy
+// of its settings; changing the settings of one client (for example
+// with SetHTTPHeader) does not affect the others.
 type Client struct {
-	params                 Params
-	bclient                httpClient
+	params         Params
+	bclient        httpClient
+	channel        params.Channel
+	userAgentValue string
+	requestId      string
+	notices        *noticeTracker
+	closer         *closer
+	whoami         *whoAmICache
+
+	// timeout, if non-nil, overrides the timeouts
+	// in params. See WithTimeout.
+	timeout *time.Duration
+
+	// mu guards settings. A settings value is never changed once
+	// it has been stored, so it may be used without holding mu.
+	mu       sync.Mutex
+	settings *clientSettings
+}
+
+// clientSettings holds the client settings that
+// may be changed after the client has been created.
+type clientSettings struct {
+	user                   string
+	password               string
+	bearerToken            string
 	header                 http.Header
 	statsDisabled          bool
-	channel                params.Channel
 	minMultipartUploadSize int64
-	userAgentValue         string
 }
 
 // Params holds parameters for creating a new charm store client.
@@ -79,13 +109,172 @@ type Params struct {
 	// client.
 	Password string
 
+	// BearerToken holds a token to send in an "Authorization: Bearer"
+	// header with each request, as an alternative to basic
+	// authentication and macaroons, for charm stores behind an
+	// authenticating proxy. It is ignored if User is set.
+	BearerToken string
+
+	// AuthHeaderFunc, if non-nil, is called before each attempt to
+	// send a request to the charm store, so that it can set
+	// authorization headers on the request, for example with
+	// short-lived credentials that are rotated while the client is in
+	// use. It is called after any headers implied by User or
+	// BearerToken have been set, so it may override them. If it returns
+	// an error, the request fails with that error. It may be called
+	// concurrently.
+	AuthHeaderFunc func(req *http.Request) error
+
 	// BakeryClient holds the bakery client to use when making
 	// requests to the store. This is used in preference to
 	// HTTPClient.
 	BakeryClient *httpbakery.Client
 
+	// DischargeCache, if non-nil, holds macaroons shared with
+	// other clients, and is used in preference to BakeryClient.
+	DischargeCache *DischargeCache
+
+	// AgentAuthInfo, if non-nil, holds agent credentials to use to
+	// log in without user interaction, for example from a continuous
+	// integration system. When it is set, the client that is created
+	// when BakeryClient is nil uses agent authentication instead
+	// of opening a web browser. It is ignored if BakeryClient is
+	// set; use agent.SetUpAuth to configure such a client instead.
+	//
+	// Credentials may be read from the file named by the
+	// BAKERY_AGENT_FILE environment variable with
+	// agent.AuthInfoFromEnvironment.
+	AgentAuthInfo *agent.AuthInfo
+
+	// TLSConfig, if non-nil, holds the TLS configuration used to
+	// connect to the charm store, for example to trust the internal
+	// certificate authority of a private charm store by setting
+	// RootCAs, or to authenticate with a client certificate. It is
+	// used by the client that is created when BakeryClient is nil
+	// and is ignored otherwise. Like Proxy, it is also used to connect
+	// to docker registries in that case. InsecureSkipVerify should
+	// only be set when testing.
+	TLSConfig *tls.Config
+
+	// Proxy, if non-nil, specifies the proxy to use for requests
+	// to the charm store in place of the proxy configured by the
+	// HTTP_PROXY and related environment variables. It has the same
+	// semantics as http.Transport.Proxy; use http.ProxyURL to always
+	// use the same proxy. HTTP, HTTPS and SOCKS5 proxies are
+	// supported. Like TLSConfig, it is ignored if BakeryClient is set.
+	Proxy func(req *http.Request) (*url.URL, error)
+
+	// InsecureRegistries holds the hosts, including any port, of
+	// docker registries that are accessed with plain HTTP rather
+	// than HTTPS when pushing and pulling docker resources, like the
+	// docker daemon's setting of the same name. It should only be
+	// used for registries on trusted networks and for testing.
+	InsecureRegistries []string
+
 	// UserAgentVersion allows the overriding of the user agent version.
 	UserAgentValue string
+
+	// VerifyArchives specifies that the readers returned by GetArchive
+	// and GetArchiveData should check that the archive data matches
+	// the hash and size reported by the charm store. When the data does
+	// not match, the reader returns an error with a *HashMismatchError
+	// cause instead of io.EOF.
+	VerifyArchives bool
+
+	// VerifyResources is like VerifyArchives, but applies to the
+	// readers returned by GetResource and GetResourceWithProgress.
+	// The error cause has its Resource field set.
+	VerifyResources bool
+
+	// HashAlgorithms holds the content hash algorithms accepted when
+	// retrieving archives and resources, most preferred first. If it
+	// is empty, only SHA384, as used by the charm store, is accepted.
+	// Including SHA256 allows the client to interoperate with stores
+	// and proxies that only expose SHA256 content hashes; the
+	// algorithm actually used is reported in ArchiveData and
+	// ResourceData. Uploads always use SHA384.
+	HashAlgorithms []HashAlgorithm
+
+	// ArchiveFileCache, if non-nil, is used to cache files
+	// retrieved with GetFileFromArchive.
+	ArchiveFileCache *ArchiveFileCache
+
+	// RetryPolicy holds the policy used to retry requests that fail
+	// because of a temporary problem. If it is nil, requests are not
+	// retried, except for the parts of multipart uploads, which are
+	// retried immediately up to ten times.
+	RetryPolicy *RetryPolicy
+
+	// CircuitBreaker, if non-nil, is used to stop requests being
+	// made while the charm store appears to be unavailable.
+	CircuitBreaker *CircuitBreaker
+
+	// RateLimiter, if non-nil, is used to limit the rate
+	// at which requests are made to the charm store.
+	RateLimiter *RateLimiter
+
+	// SkipDuplicateUploads specifies that UploadArchive (and so
+	// UploadCharm and UploadBundle) should not upload an archive
+	// when the latest uploaded revision of the entity already has
+	// the same hash; the id of that revision is returned instead.
+	// This applies only when no revision is specified and the
+	// entity is not being published.
+	SkipDuplicateUploads bool
+
+	// StreamArchives specifies that when a charm.CharmDir or
+	// charm.BundleDir is uploaded, its archive should be created
+	// as it is sent rather than being written to a temporary
+	// file first. The directory is read twice, once to calculate
+	// the archive hash and once to send it, and the upload fails
+	// if it changes in between.
+	StreamArchives bool
+
+	// CheckPublish specifies that Publish should check the
+	// resources to be published with CheckPublish first, failing
+	// with a *PublishCheckError cause if any problems are found.
+	CheckPublish bool
+
+	// MinMultipartUploadSize holds the minimum size of resource
+	// upload that is split into parts that are uploaded (and
+	// retried) separately. If it is zero, 5MiB is used.
+	MinMultipartUploadSize int64
+
+	// PreferredPartSize holds the size of each part of a multipart
+	// resource upload. Fewer, larger parts may perform better over
+	// high-latency links. The size is adjusted to the limits set by
+	// the charm store, and increased if necessary so that the upload
+	// does not need more parts than the charm store allows. If it is
+	// zero, the upload is divided into as many parts as the charm
+	// store allows, subject to its minimum part size.
+	PreferredPartSize int64
+
+	// Metrics, if non-nil, is informed about
+	// each request made to the charm store.
+	Metrics Metrics
+
+	// Logger, if non-nil, is informed about each attempt to send a
+	// request to the charm store and about each decision to retry,
+	// including retries of multipart upload parts. Use NewLoggoLogger
+	// to log them at debug level.
+	Logger Logger
+
+	// RequestTimeout, if non-zero, holds the time within which each
+	// request must complete, including any retries and reading the
+	// response body. It does not apply to requests that transfer
+	// archives or resources, which use TransferTimeout instead.
+	// Client.WithTimeout may be used to override it for some calls.
+	RequestTimeout time.Duration
+
+	// TransferTimeout, if non-zero, holds the time within which
+	// each request that downloads or uploads an archive or resource
+	// must complete. If it is zero, transfers are not limited.
+	TransferTimeout time.Duration
+
+	// Notice, if non-nil, is called the first time that each
+	// distinct deprecation notice is received from the charm
+	// store, so that it can be logged or shown to the user.
+	// It may be called concurrently.
+	Notice func(DeprecationNotice)
 }
 
 type httpClient interface {
@@ -97,27 +286,125 @@ func New(p Params) *Client {
 	if p.URL == "" {
 		p.URL = ServerURL
 	}
-	bclient := p.BakeryClient
-	if bclient == nil {
-		bclient = httpbakery.NewClient()
-		bclient.AddInteractor(httpbakery.WebBrowserInteractor{})
+	var bclient httpClient
+	switch {
+	case p.DischargeCache != nil:
+		bclient = p.DischargeCache
+	case p.BakeryClient != nil:
+		bclient = p.BakeryClient
+	default:
+		bclient = newBakeryClient(p)
 	}
 	uav := p.UserAgentValue
 	if uav == "" {
 		uav = userAgentValue
 	}
+	minMultipartUploadSize := p.MinMultipartUploadSize
+	if minMultipartUploadSize <= 0 {
+		minMultipartUploadSize = defaultMinMultipartUploadSize
+	}
+	return &Client{
+		bclient:        bclient,
+		params:         p,
+		userAgentValue: uav,
+		notices:        new(noticeTracker),
+		whoami:         new(whoAmICache),
+		closer:         newCloser(),
+		settings: &clientSettings{
+			user:                   p.User,
+			password:               p.Password,
+			bearerToken:            p.BearerToken,
+			minMultipartUploadSize: minMultipartUploadSize,
+		},
+	}
+}
+
+// newBakeryClient returns the client used when Params.BakeryClient is
+// nil. If the agent credentials cannot be used, the returned client
+// fails every request without it being sent, retried or counted by
+// the circuit breaker (see Client.sendWithRetry).
+func newBakeryClient(p Params) httpClient {
+	bclient := httpbakery.NewClient()
+	if transport := newTransport(p); transport != nil {
+		bclient.Client.Transport = transport
+	}
+	if p.AgentAuthInfo == nil {
+		bclient.AddInteractor(httpbakery.WebBrowserInteractor{})
+		return bclient
+	}
+	if err := agent.SetUpAuth(bclient, p.AgentAuthInfo); err != nil {
+		return errorClient{errgo.Notef(err, "cannot set up agent authentication")}
+	}
+	return bclient
+}
+
+// newTransport returns the transport that uses p.TLSConfig and
+// p.Proxy, or nil if neither is set and the default transport
+// should be used.
+func newTransport(p Params) http.RoundTripper {
+	if p.TLSConfig == nil && p.Proxy == nil {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if p.TLSConfig != nil {
+		transport.TLSClientConfig = p.TLSConfig.Clone()
+	}
+	if p.Proxy != nil {
+		transport.Proxy = p.Proxy
+	}
+	return transport
+}
+
+// errorClient implements httpClient by failing every request.
+type errorClient struct {
+	err error
+}
+
+// Do implements httpClient.Do.
+func (c errorClient) Do(*http.Request) (*http.Response, error) {
+	return nil, c.err
+}
+
+// getSettings returns the current settings of the client.
+func (c *Client) getSettings() *clientSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings
+}
+
+// updateSettings calls f to change a copy of the current
+// settings and then replaces the settings with the copy.
+func (c *Client) updateSettings(f func(s *clientSettings)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	settings := *c.settings
+	f(&settings)
+	c.settings = &settings
+}
+
+// clone returns a copy of the client.
+func (c *Client) clone() *Client {
 	return &Client{
-		bclient:                bclient,
-		params:                 p,
-		minMultipartUploadSize: defaultMinMultipartUploadSize,
-		userAgentValue:         uav,
+		params:         c.params,
+		bclient:        c.bclient,
+		channel:        c.channel,
+		userAgentValue: c.userAgentValue,
+		requestId:      c.requestId,
+		notices:        c.notices,
+		whoami:         c.whoami,
+		closer:         c.closer,
+		timeout:        c.timeout,
+		settings:       c.getSettings(),
 	}
 }
 
 // SetMinMultipartUploadSize sets the minimum size of resource upload
-// that will trigger a multipart upload. This is mainly useful for testing.
+// that will trigger a multipart upload, overriding
+// Params.MinMultipartUploadSize. This is mainly useful for testing.
 func (c *Client) SetMinMultipartUploadSize(n int64) {
-	c.minMultipartUploadSize = n
+	c.updateSettings(func(s *clientSettings) {
+		s.minMultipartUploadSize = n
+	})
 }
 
 // ServerURL returns the charm store URL used by the client.
@@ -125,18 +412,27 @@ func (c *Client) ServerURL() string {
 	return c.params.URL
 }
 
+// User returns the name of the user that the client authenticates as
+// with basic authentication, or the empty string if it does not use
+// basic authentication.
+func (c *Client) User() string {
+	return c.getSettings().user
+}
+
 // DisableStats disables incrementing download stats when retrieving archives
 // from the charm store.
 func (c *Client) DisableStats() {
-	c.statsDisabled = true
+	c.updateSettings(func(s *clientSettings) {
+		s.statsDisabled = true
+	})
 }
 
 // WithChannel returns a new client whose requests are done using the
 // given channel.
 func (c *Client) WithChannel(channel params.Channel) *Client {
-	client := *c
+	client := c.clone()
 	client.channel = channel
-	return &client
+	return client
 }
 
 // Channel returns the currently set channel.
@@ -147,15 +443,52 @@ func (c *Client) Channel() params.Channel {
 // SetHTTPHeader sets custom HTTP headers that will be sent to the charm store
 // on each request.
 func (c *Client) SetHTTPHeader(header http.Header) {
-	c.header = header
+	header = header.Clone()
+	c.updateSettings(func(s *clientSettings) {
+		s.header = header
+	})
 }
 
 // GetArchive retrieves the archive for the given charm or bundle, returning a
 // reader its data can be read from, the fully qualified id of the
 // corresponding entity, the hex-encoded SHA384 hash of the data and its size.
+// The size is -1 if it is not known, which happens when the response is
+// chunked, for example by a reverse proxy that strips Content-Length.
+// If Params.HashAlgorithms allows other algorithms, the hash may have been
+// produced by one of those instead; use GetArchiveData to find out which.
 func (c *Client) GetArchive(id *charm.URL) (r io.ReadCloser, eid *charm.URL, hash string, size int64, err error) {
-	fail := func(err error) (io.ReadCloser, *charm.URL, string, int64, error) {
-		return nil, nil, "", 0, err
+	data, err := c.GetArchiveData(id)
+	if err != nil {
+		return nil, nil, "", 0, errgo.Mask(err, errgo.Any)
+	}
+	return data.ReadCloser, data.Id, data.Hash, data.Size, nil
+}
+
+// GetArchiveData is like GetArchive except that it returns the
+// information about the archive as an ArchiveData value, which
+// includes information useful for diagnosing transfer problems.
+func (c *Client) GetArchiveData(id *charm.URL) (*ArchiveData, error) {
+	data, err := c.getArchiveData(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if c.params.VerifyArchives {
+		data.ReadCloser = newVerifyingReader(data.ReadCloser, HashMismatchError{
+			Id:            data.Id,
+			HashAlgorithm: data.HashAlgorithm,
+			ExpectedHash:  data.Hash,
+			ExpectedSize:  data.Size,
+			Proxied:       data.Proxied,
+		})
+	}
+	return data, nil
+}
+
+// getArchiveData is the internal version of GetArchiveData.
+// It never verifies the archive data.
+func (c *Client) getArchiveData(id *charm.URL) (*ArchiveData, error) {
+	fail := func(err error) (*ArchiveData, error) {
+		return nil, err
 	}
 	// Create the request.
 	req, err := http.NewRequest("GET", "", nil)
@@ -163,9 +496,11 @@ func (c *Client) GetArchive(id *charm.URL) (r io.ReadCloser, eid *charm.URL, has
 		return fail(errgo.Notef(err, "cannot make new request"))
 	}
 
+	c.setWantDigest(req)
+
 	// Send the request.
 	v := url.Values{}
-	if c.statsDisabled {
+	if c.getSettings().statsDisabled {
 		v.Set("stats", "0")
 	}
 	u := url.URL{
@@ -188,7 +523,7 @@ func (c *Client) GetArchive(id *charm.URL) (r io.ReadCloser, eid *charm.URL, has
 		resp.Body.Close()
 		return fail(errgo.Newf("no %s header found in response", params.EntityIdHeader))
 	}
-	eid, err = charm.ParseURL(entityId)
+	eid, err := charm.ParseURL(entityId)
 	if err != nil {
 		// The server did not return a valid id.
 		resp.Body.Close()
@@ -199,37 +534,105 @@ func (c *Client) GetArchive(id *charm.URL) (r io.ReadCloser, eid *charm.URL, has
 		resp.Body.Close()
 		return fail(errgo.Newf("archive get returned not fully qualified entity id %q", eid))
 	}
-	hash = resp.Header.Get(params.ContentHashHeader)
-	if hash == "" {
+	hash, hashAlgorithm, err := c.responseHash(resp.Header)
+	if err != nil {
 		resp.Body.Close()
-		return fail(errgo.Newf("no %s header found in response", params.ContentHashHeader))
+		return fail(errgo.Mask(err))
+	}
+
+	// The content length is unknown (-1) when the response is
+	// chunked, for example by a reverse proxy. In that case
+	// only the hash of the archive can be verified.
+	return &ArchiveData{
+		ReadCloser:    resp.Body,
+		Id:            eid,
+		Hash:          hash,
+		HashAlgorithm: hashAlgorithm,
+		Size:          resp.ContentLength,
+		Proxied:       isProxied(resp.Header),
+	}, nil
+}
+
+// WriteArchiveTo retrieves the archive for the given charm or bundle
+// and writes it to w, checking that the data matches the hash and size
+// reported by the charm store. It returns the fully qualified id of the
+// entity and the hex-encoded hash of the archive, as for GetArchive.
+//
+// If the data does not match, an error with a *HashMismatchError cause
+// is returned; note that the mismatched data will already have been
+// written to w.
+func (c *Client) WriteArchiveTo(id *charm.URL, w io.Writer) (eid *charm.URL, hash string, err error) {
+	data, err := c.getArchiveData(id)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Any)
 	}
+	defer data.Close()
+	if _, err := data.CopyVerified(w); err != nil {
+		if _, ok := err.(*HashMismatchError); ok {
+			return nil, "", errgo.Mask(err, errgo.Any)
+		}
+		return nil, "", errgo.Notef(err, "cannot read entity archive")
+	}
+	return data.Id, data.Hash, nil
+}
 
-	// Validate the response contents.
-	if resp.ContentLength < 0 {
-		// TODO frankban: handle the case the contents are chunked.
-		resp.Body.Close()
-		return fail(errgo.Newf("no content length found in response"))
+// GetArchiveWithProgress is like GetArchive except that the given progress
+// is notified as the archive data is read from the returned reader.
+// Progress.Start is called with an empty upload id before GetArchiveWithProgress
+// returns, and Progress.Transferred is called with the total number of
+// bytes read so far. The other Progress methods are not called.
+func (c *Client) GetArchiveWithProgress(id *charm.URL, progress Progress) (r io.ReadCloser, eid *charm.URL, hash string, size int64, err error) {
+	r, eid, hash, size, err = c.GetArchive(id)
+	if err != nil {
+		return nil, nil, "", 0, errgo.Mask(err, errgo.Any)
 	}
-	return resp.Body, eid, hash, resp.ContentLength, nil
+	return newDownloadProgressReader(r, progress), eid, hash, size, nil
 }
 
 // GetFileFromArchive streams the contents of the requested filename from the
 // given charm or bundle archive, returning a reader its data can be read from.
+//
+// If the client has an ArchiveFileCache, the id is first resolved and
+// the hash of the entity's archive retrieved with a metadata request,
+// and the contents of the file are served from the cache when the
+// hash is the same as when the file was last retrieved. Otherwise the
+// file is retrieved from the resolved entity, so that its contents
+// match the hash.
 func (c *Client) GetFileFromArchive(id *charm.URL, filename string) (io.ReadCloser, error) {
 	fail := func(err error) (io.ReadCloser, error) {
 		return nil, err
 	}
 
+	cache := c.params.ArchiveFileCache
+	var (
+		key  archiveFileKey
+		hash string
+	)
+	if cache != nil {
+		var result struct {
+			Hash params.HashResponse
+		}
+		eid, err := c.Meta(id, &result)
+		if err != nil {
+			return fail(errgo.NoteMask(err, "cannot get file from archive", isAPIError))
+		}
+		id, hash = eid, result.Hash.Sum
+		key = newArchiveFileKey(id, c.channel, filename)
+		if cached := cache.get(key); cached != nil && cached.validator == hash {
+			return ioutil.NopCloser(bytes.NewReader(cached.data)), nil
+		}
+	}
+
 	// Create the request.
 	req, err := http.NewRequest("GET", "", nil)
 	if err != nil {
 		return fail(errgo.Notef(err, "cannot make new request"))
 	}
+	c.setWantDigest(req)
 
 	// Send the request.
 	v := url.Values{}
-	if c.statsDisabled {
+	if c.getSettings().statsDisabled {
 		v.Set("stats", "0")
 	}
 	u := url.URL{
@@ -245,8 +648,127 @@ func (c *Client) GetFileFromArchive(id *charm.URL, filename string) (io.ReadClos
 		}
 		return fail(errgo.NoteMask(err, "cannot get file from archive", isAPIError))
 	}
+	if cache == nil || hash == "" || resp.ContentLength < 0 || resp.ContentLength > maxCachedFileSize {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fail(errgo.Notef(err, "cannot read file from archive"))
+	}
+	cache.add(&archiveFileEntry{
+		key:       key,
+		validator: hash,
+		data:      data,
+	})
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
 
-	return resp.Body, nil
+// Manifest returns information on all the files contained in the archive
+// of the given charm or bundle, without downloading the archive itself.
+func (c *Client) Manifest(id *charm.URL) ([]params.ManifestFile, error) {
+	var result []params.ManifestFile
+	if err := c.Get("/"+id.Path()+"/meta/manifest", &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get archive manifest", isAPIError)
+	}
+	return result, nil
+}
+
+// Related returns the charms related to the given charm: for each
+// interface provided by the charm, the charms that require it, and
+// for each interface required by the charm, the charms that provide
+// it. Metadata on the related charms may be requested by passing
+// include names (for example "charm-metadata").
+func (c *Client) Related(id *charm.URL, includes ...string) (*params.RelatedResponse, error) {
+	path := "/" + id.Path() + "/meta/charm-related"
+	if len(includes) > 0 {
+		path += "?" + url.Values{"include": includes}.Encode()
+	}
+	var result params.RelatedResponse
+	if err := c.Get(path, &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get related charms", isAPIError)
+	}
+	return &result, nil
+}
+
+// maxConcurrentFileRequests holds the maximum number of
+// concurrent requests made by GetFiles.
+const maxConcurrentFileRequests = 8
+
+// GetFiles is like GetFileFromArchive except that it retrieves several
+// files from the archive at once, making the requests concurrently. It
+// returns a map from each path to a reader for its contents; all the
+// readers must be closed after use. Paths that do not exist in the
+// archive are omitted from the result.
+//
+// If the id is not fully specified, it is resolved once before any
+// file is retrieved, so that all the files come from the same
+// revision of the entity.
+func (c *Client) GetFiles(id *charm.URL, paths []string) (map[string]io.ReadCloser, error) {
+	if id.Revision == -1 || id.Series == "" {
+		var result struct{}
+		eid, err := c.Meta(id, &result)
+		if err != nil {
+			return nil, errgo.NoteMask(err, "cannot resolve id", isAPIError)
+		}
+		id = eid
+	}
+	seen := make(map[string]bool)
+	var uniquePaths []string
+	for _, path := range paths {
+		if !seen[path] {
+			seen[path] = true
+			uniquePaths = append(uniquePaths, path)
+		}
+	}
+	paths = uniquePaths
+
+	type fileResult struct {
+		path string
+		r    io.ReadCloser
+		err  error
+	}
+	sem := make(chan struct{}, maxConcurrentFileRequests)
+	results := make(chan fileResult, len(paths))
+	for _, path := range paths {
+		path := path
+		go func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r, err := c.GetFileFromArchive(id, path)
+			results <- fileResult{path, r, err}
+		}()
+	}
+	files := make(map[string]io.ReadCloser)
+	var firstErr error
+	for range paths {
+		result := <-results
+		switch {
+		case result.err == nil:
+			files[result.path] = result.r
+		case isFileNotFoundError(result.err):
+		case firstErr == nil:
+			firstErr = errgo.NoteMask(result.err, fmt.Sprintf("cannot get %q", result.path), errgo.Any)
+		}
+	}
+	if firstErr != nil {
+		for _, r := range files {
+			r.Close()
+		}
+		return nil, firstErr
+	}
+	return files, nil
+}
+
+// isFileNotFoundError reports whether the given error was returned
+// from GetFileFromArchive because the archive does not contain the
+// requested file (as opposed to the entity itself not being found).
+func isFileNotFoundError(err error) bool {
+	if errgo.Cause(err) != params.ErrNotFound {
+		return false
+	}
+	perr, ok := underlyingError(err, isParamsError).(*params.Error)
+	return ok && strings.HasSuffix(perr.Message, "not found in the archive")
 }
 
 // ListResources retrieves the metadata about resources for the given charms.
@@ -255,6 +777,9 @@ func (c *Client) GetFileFromArchive(id *charm.URL, filename string) (io.ReadClos
 func (c *Client) ListResources(id *charm.URL) ([]params.Resource, error) {
 	var result []params.Resource
 	if err := c.Get("/"+id.Path()+"/meta/resources", &result); err != nil {
+		if isNotSupportedError(err) {
+			return nil, resourcesNotSupported(err)
+		}
 		return nil, errgo.NoteMask(err, "cannot get resource metadata from the charm store", isAPIError)
 	}
 	return result, nil
@@ -324,6 +849,9 @@ func (c *Client) AddDockerResource(id *charm.URL, resourceName string, imageName
 		Digest:    digest,
 		ImageName: imageName,
 	}, &result); err != nil {
+		if isNotSupportedError(err) {
+			return 0, resourcesNotSupported(err)
+		}
 		return 0, errgo.Mask(err)
 	}
 	return result.Revision, nil
@@ -341,6 +869,9 @@ func (c *Client) DockerResourceDownloadInfo(id *charm.URL, resourceName string,
 	}
 	var result params.DockerInfoResponse
 	if err := c.Get(path, &result); err != nil {
+		if isNotSupportedError(err) {
+			return nil, resourcesNotSupported(err)
+		}
 		return nil, errgo.Mask(err)
 	}
 	return &result, nil
@@ -354,6 +885,9 @@ func (c *Client) DockerResourceUploadInfo(id *charm.URL, resourceName string) (*
 	path := fmt.Sprintf("/%s/docker-resource-upload-info?resource-name=%s", id.Path(), url.QueryEscape(resourceName))
 	var result params.DockerInfoResponse
 	if err := c.Get(path, &result); err != nil {
+		if isNotSupportedError(err) {
+			return nil, resourcesNotSupported(err)
+		}
 		return nil, errgo.Mask(err)
 	}
 	return &result, nil
@@ -361,6 +895,72 @@ func (c *Client) DockerResourceUploadInfo(id *charm.URL, resourceName string) (*
 
 var ErrUploadNotFound = errgo.Newf("upload not found")
 
+// ErrNotSupported is the error cause returned when the charm store
+// does not implement the endpoint needed for an operation, for example
+// when an old charm store without resource support is asked for
+// resource information.
+var ErrNotSupported = errgo.Newf("operation not supported by the charm store")
+
+// resourcesNotSupported returns an error with an ErrNotSupported
+// cause noting that the store does not support resources.
+func resourcesNotSupported(err error) error {
+	return errgo.WithCausef(err, ErrNotSupported, "charm store does not support resources")
+}
+
+// isNotSupportedError reports whether the given error, returned
+// from a request to the charm store, indicates that the store
+// does not implement the requested endpoint at all, as opposed
+// to an endpoint that exists reporting that an entity or
+// resource was not found.
+func isNotSupportedError(err error) bool {
+	if serr, ok := underlyingError(err, isUnexpectedStatusError).(*unexpectedStatusError); ok {
+		switch serr.StatusCode {
+		case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			return true
+		}
+		return false
+	}
+	switch errgo.Cause(err) {
+	case params.ErrMethodNotAllowed:
+		return true
+	case params.ErrNotFound:
+		// The charm store reports unknown metadata and unknown
+		// endpoints as not found errors with a specific message.
+		if perr, ok := underlyingError(err, isParamsError).(*params.Error); ok {
+			return strings.HasPrefix(perr.Message, "unknown metadata") ||
+				perr.Message == "not found"
+		}
+	}
+	return false
+}
+
+// underlyingError returns the first error in the chain of
+// errors wrapped to make err for which match returns true,
+// or nil if there is none.
+func underlyingError(err error, match func(error) bool) error {
+	for err != nil {
+		if match(err) {
+			return err
+		}
+		w, ok := err.(errgo.Wrapper)
+		if !ok {
+			return nil
+		}
+		err = w.Underlying()
+	}
+	return nil
+}
+
+func isUnexpectedStatusError(err error) bool {
+	_, ok := err.(*unexpectedStatusError)
+	return ok
+}
+
+func isParamsError(err error) bool {
+	_, ok := err.(*params.Error)
+	return ok
+}
+
 // ResumeUploadResource is like UploadResource except that if uploadId is non-empty,
 // it specifies the id of an existing upload to resume; if an upload with this ID is not
 // found, an error with an ErrUploadNotFound cause is returned.
@@ -384,6 +984,7 @@ func (c *Client) ResumeUploadResourceWithRevision(
 	if progress == nil {
 		progress = noProgress{}
 	}
+	c = c.withOperationId()
 	info := &uploadInfo{
 		id:           id,
 		resourceName: resourceName,
@@ -393,12 +994,44 @@ func (c *Client) ResumeUploadResourceWithRevision(
 		progress:     progress,
 		content:      content,
 	}
-	if size >= c.minMultipartUploadSize {
+	if size >= c.getSettings().minMultipartUploadSize {
 		return c.uploadMultipartResource(uploadId, info)
 	}
 	return c.uploadSinglePartResource(info)
 }
 
+// ListUploads returns information on all the multipart uploads that have
+// been started but not yet completed, for example because a call to
+// ResumeUploadResource was interrupted. Any of the returned uploads may
+// be continued with ResumeUploadResource or discarded with AbortUpload.
+func (c *Client) ListUploads() ([]params.UploadInfoResponse, error) {
+	var result params.ListUploadsResponse
+	if err := c.Get("/upload", &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot list uploads", isAPIError)
+	}
+	return result.Uploads, nil
+}
+
+// AbortUpload cancels the multipart upload with the given id, so that
+// the storage used by any parts already uploaded can be reclaimed
+// before the upload expires. If the upload is not found, an error with
+// an ErrUploadNotFound cause is returned.
+func (c *Client) AbortUpload(uploadId string) error {
+	req, err := http.NewRequest("DELETE", "", nil)
+	if err != nil {
+		return errgo.Notef(err, "cannot make new request")
+	}
+	resp, err := c.Do(req, "/upload/"+url.PathEscape(uploadId))
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return errgo.WithCausef(nil, ErrUploadNotFound, "")
+		}
+		return errgo.NoteMask(err, "cannot abort upload", isAPIError)
+	}
+	resp.Body.Close()
+	return nil
+}
+
 func (c *Client) uploadSinglePartResource(info *uploadInfo) (revision int, err error) {
 	info.progress.Start("", time.Time{})
 	hash, size1, err := readerHashAndSize(io.NewSectionReader(info.content, 0, info.size))
@@ -430,6 +1063,9 @@ func (c *Client) uploadSinglePartResource(info *uploadInfo) (revision int, err e
 	url := fmt.Sprintf("%s?hash=%s&filename=%s", path, url.QueryEscape(hash), url.QueryEscape(info.path))
 	resp, err := c.Do(req, url)
 	if err != nil {
+		if isNotSupportedError(err) {
+			return 0, resourcesNotSupported(err)
+		}
 		return 0, errgo.NoteMask(err, "cannot post resource", isAPIError)
 	}
 	defer resp.Body.Close()
@@ -480,10 +1116,17 @@ func (c *Client) uploadMultipartResource(uploadId string, info *uploadInfo) (int
 	info.progress.Start(info.UploadId, info.Expires)
 	// Calculate the part size, but round up so that we have
 	// enough parts to cover the remainder at the end.
-	info.preferredPartSize = (info.size + int64(info.MaxParts) - 1) / int64(info.MaxParts)
-	if info.preferredPartSize > info.MaxPartSize {
+	minPartSize := (info.size + int64(info.MaxParts) - 1) / int64(info.MaxParts)
+	if minPartSize > info.MaxPartSize {
 		return 0, errgo.Newf("resource too big (allowed %.3fGB)", float64(info.MaxPartSize)*float64(info.MaxParts)/1e9)
 	}
+	info.preferredPartSize = c.params.PreferredPartSize
+	if info.preferredPartSize > info.MaxPartSize {
+		info.preferredPartSize = info.MaxPartSize
+	}
+	if info.preferredPartSize < minPartSize {
+		info.preferredPartSize = minPartSize
+	}
 	if info.preferredPartSize < info.MinPartSize {
 		info.preferredPartSize = info.MinPartSize
 	}
@@ -653,6 +1296,38 @@ func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
 	return pos, err
 }
 
+// downloadProgressReader implements an io.ReadCloser that informs
+// a Progress implementation of the number of bytes read so far.
+type downloadProgressReader struct {
+	io.ReadCloser
+	p   Progress
+	pos int64
+}
+
+// newDownloadProgressReader returns a reader that reads from r and calls
+// p.Transferred with the number of bytes that have been read.
+// If p is nil, r is returned unchanged.
+func newDownloadProgressReader(r io.ReadCloser, p Progress) io.ReadCloser {
+	if p == nil {
+		return r
+	}
+	p.Start("", time.Time{})
+	return &downloadProgressReader{
+		ReadCloser: r,
+		p:          p,
+	}
+}
+
+// Read implements io.Reader.Read.
+func (p *downloadProgressReader) Read(pb []byte) (int, error) {
+	n, err := p.ReadCloser.Read(pb)
+	if n > 0 {
+		p.pos += int64(n)
+		p.p.Transferred(p.pos)
+	}
+	return n, err
+}
+
 // uploadPart uploads a single part of a multipart upload
 // and returns the hash of the part.
 func (c *Client) uploadPart(uploadId string, part int, r io.ReaderAt, p0, p1 int64, progress Progress) (string, error) {
@@ -661,40 +1336,65 @@ func (c *Client) uploadPart(uploadId string, part int, r io.ReaderAt, p0, p1 int
 		return "", errgo.Notef(err, "cannot read resource")
 	}
 	hash := fmt.Sprintf("%x", h.Sum(nil))
+	policy := c.params.RetryPolicy
+	if policy == nil {
+		policy = defaultUploadRetryPolicy
+	}
 	var lastError error
 	section := newProgressReader(io.NewSectionReader(r, p0, p1-p0), progress, p0)
-	for i := 0; i < 10; i++ {
+	for i := 1; i <= policy.attempts(); i++ {
 		req, err := http.NewRequest("PUT", "", section)
 		if err != nil {
 			return "", errgo.Mask(err)
 		}
 		req.Header.Set("Content-Type", "application/octet-stream")
 		req.ContentLength = p1 - p0
-		resp, err := c.Do(req, fmt.Sprintf("/upload/%s/%d?hash=%s&offset=%d", uploadId, part, hash, p0))
+		resp, err := c.do(req, fmt.Sprintf("/upload/%s/%d?hash=%s&offset=%d", uploadId, part, hash, p0), nil)
 		if err == nil {
 			// Success
 			resp.Body.Close()
 			return hash, nil
 		}
-		if isAPIError(err) {
-			// It's a genuine error from the charm store, so
-			// stop trying.
+		if !IsRetryable(err) {
+			// It's a genuine error from the charm store or
+			// the upload was canceled, so stop trying.
 			return "", errgo.Mask(err, isAPIError)
 		}
 		progress.Error(err)
 		lastError = err
 		section.Seek(0, 0)
-		// Try again.
+		if i < policy.attempts() {
+			// Try again.
+			d, werr := policy.wait(req.Context(), i)
+			c.logRetry(req, i+1, d, err)
+			if werr != nil {
+				return "", errgo.Mask(werr)
+			}
+		}
 	}
 	return "", errgo.Notef(lastError, "too many attempts; last error")
 }
 
 // Publish tells the charmstore to mark the given charm as published with the
 // given resource revisions to the given channels.
+//
+// If Params.CheckPublish was set, the resources are checked with
+// CheckPublish before anything is published.
 func (c *Client) Publish(id *charm.URL, channels []params.Channel, resources map[string]int) error {
 	if len(channels) == 0 {
 		return nil
 	}
+	if c.params.CheckPublish {
+		report, err := c.CheckPublish(id, resources)
+		if err != nil {
+			return errgo.NoteMask(err, "cannot check resources", isAPIError)
+		}
+		if !report.OK() {
+			return &PublishCheckError{
+				Report: report,
+			}
+		}
+	}
 	val := &params.PublishRequest{
 		Resources: resources,
 		Channels:  channels,
@@ -705,12 +1405,54 @@ func (c *Client) Publish(id *charm.URL, channels []params.Channel, resources map
 	return nil
 }
 
+// Unpublish withdraws the entity with the given id, which should
+// include a revision, from the given channels, so that it is no longer
+// the current entity in those channels. This can be used to pull a bad
+// release. If the entity is not found, an error with a
+// params.ErrNotFound cause is returned; if the user may not publish
+// it, the cause is params.ErrUnauthorized or params.ErrForbidden. If
+// the charm store does not support unpublishing, an error with an
+// ErrNotSupported cause is returned.
+func (c *Client) Unpublish(id *charm.URL, channels []params.Channel) error {
+	if len(channels) == 0 {
+		return nil
+	}
+	for _, ch := range channels {
+		if ch == params.UnpublishedChannel {
+			return errgo.Newf("cannot unpublish from the %q channel", ch)
+		}
+	}
+	val := &params.UnpublishRequest{
+		Channels: channels,
+	}
+	if err := c.Put("/"+id.Path()+"/unpublish", val); err != nil {
+		if isNotSupportedError(err) {
+			return errgo.WithCausef(err, ErrNotSupported, "charm store does not support unpublishing")
+		}
+		return errgo.NoteMask(err, fmt.Sprintf("cannot unpublish %s", id), isAPIError)
+	}
+	return nil
+}
+
 // ResourceData holds information about a resource.
 // It must be closed after use.
 type ResourceData struct {
 	io.ReadCloser
 	Size int64
 	Hash string
+
+	// HashAlgorithm holds the algorithm used to produce Hash.
+	// The zero value means SHA384.
+	HashAlgorithm HashAlgorithm
+
+	// Id and Name hold the charm id and the
+	// name of the resource that was requested.
+	Id   *charm.URL
+	Name string
+
+	// Proxied holds whether the resource is being
+	// retrieved through an HTTP proxy.
+	Proxied bool
 }
 
 // GetResource retrieves byes of the resource with the given name and revision
@@ -728,12 +1470,17 @@ func (c *Client) GetResource(id *charm.URL, name string, revision int) (result R
 		return result, errgo.Notef(err, "cannot make new request")
 	}
 
+	c.setWantDigest(req)
+
 	url := "/" + id.Path() + "/resource/" + name
 	if revision >= 0 {
 		url += "/" + strconv.Itoa(revision)
 	}
 	resp, err := c.Do(req, url)
 	if err != nil {
+		if isNotSupportedError(err) {
+			return result, resourcesNotSupported(err)
+		}
 		return result, errgo.NoteMask(err, "cannot get resource", isAPIError)
 	}
 	defer func() {
@@ -743,16 +1490,43 @@ func (c *Client) GetResource(id *charm.URL, name string, revision int) (result R
 	}()
 
 	// Validate the response headers.
-	hash := resp.Header.Get(params.ContentHashHeader)
-	if hash == "" {
-		return result, errgo.Newf("no %s header found in response", params.ContentHashHeader)
+	hash, hashAlgorithm, err := c.responseHash(resp.Header)
+	if err != nil {
+		return result, errgo.Mask(err)
+	}
+
+	result = ResourceData{
+		ReadCloser:    resp.Body,
+		Size:          resp.ContentLength,
+		Hash:          hash,
+		HashAlgorithm: hashAlgorithm,
+		Id:            id,
+		Name:          name,
+		Proxied:       isProxied(resp.Header),
+	}
+	if c.params.VerifyResources {
+		result.ReadCloser = newVerifyingReader(result.ReadCloser, HashMismatchError{
+			Id:            id,
+			Resource:      name,
+			HashAlgorithm: hashAlgorithm,
+			ExpectedHash:  hash,
+			ExpectedSize:  result.Size,
+			Proxied:       result.Proxied,
+		})
 	}
+	return result, nil
+}
 
-	return ResourceData{
-		ReadCloser: resp.Body,
-		Size:       resp.ContentLength,
-		Hash:       hash,
-	}, nil
+// GetResourceWithProgress is like GetResource except that the given
+// progress is notified as the resource data is read from the result,
+// in the same way as for GetArchiveWithProgress.
+func (c *Client) GetResourceWithProgress(id *charm.URL, name string, revision int, progress Progress) (ResourceData, error) {
+	result, err := c.GetResource(id, name, revision)
+	if err != nil {
+		return result, errgo.Mask(err, errgo.Any)
+	}
+	result.ReadCloser = newDownloadProgressReader(result.ReadCloser, progress)
+	return result, nil
 }
 
 // ResourceMeta returns the metadata for the resource on charm id with the
@@ -765,11 +1539,43 @@ func (c *Client) ResourceMeta(id *charm.URL, name string, revision int) (params.
 	}
 	var result params.Resource
 	if err := c.Get(path, &result); err != nil {
+		if isNotSupportedError(err) {
+			return result, resourcesNotSupported(err)
+		}
 		return result, errgo.NoteMask(err, fmt.Sprintf("cannot get %q", path), isAPIError)
 	}
 	return result, nil
 }
 
+// ResourceRevisions returns the metadata for every revision of the
+// resource with the given name on charm id that exists in the charm
+// store, ordered by revision, including revisions that have never been
+// published. The charm store does not report when each revision was
+// uploaded, so the results do not include upload times.
+//
+// The charm store has no endpoint that lists resource revisions, so
+// this makes a request for each possible revision up to the most
+// recently uploaded one.
+func (c *Client) ResourceRevisions(id *charm.URL, name string) ([]params.Resource, error) {
+	client := c.WithChannel(params.UnpublishedChannel)
+	latest, err := client.ResourceMeta(id, name, -1)
+	if err != nil {
+		return nil, errgo.Mask(err, isAPIError)
+	}
+	resources := make([]params.Resource, 0, latest.Revision+1)
+	for rev := 0; rev < latest.Revision; rev++ {
+		r, err := client.ResourceMeta(id, name, rev)
+		if errgo.Cause(err) == params.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err, isAPIError)
+		}
+		resources = append(resources, r)
+	}
+	return append(resources, latest), nil
+}
+
 // StatsUpdate updates the download stats for the given id and specific time.
 func (c *Client) StatsUpdate(req params.StatsUpdateRequest) error {
 	return c.Put("/stats/update", req)
@@ -786,7 +1592,7 @@ func (c *Client) UploadCharm(id *charm.URL, ch charm.Charm) (*charm.URL, error)
 	if id.Revision != -1 {
 		return nil, errgo.Newf("revision specified in %q, but should not be specified", id)
 	}
-	r, hash, size, err := openArchive(ch)
+	r, hash, size, err := openArchive(ch, c.params.StreamArchives)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot open charm archive")
 	}
@@ -805,7 +1611,7 @@ func (c *Client) UploadCharmWithRevision(id *charm.URL, ch charm.Charm, promulga
 	if id.Revision == -1 {
 		return errgo.Newf("revision not specified in %q", id)
 	}
-	r, hash, size, err := openArchive(ch)
+	r, hash, size, err := openArchive(ch, c.params.StreamArchives)
 	if err != nil {
 		return errgo.Notef(err, "cannot open charm archive")
 	}
@@ -825,7 +1631,7 @@ func (c *Client) UploadBundle(id *charm.URL, b charm.Bundle) (*charm.URL, error)
 	if id.Revision != -1 {
 		return nil, errgo.Newf("revision specified in %q, but should not be specified", id)
 	}
-	r, hash, size, err := openArchive(b)
+	r, hash, size, err := openArchive(b, c.params.StreamArchives)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot open bundle archive")
 	}
@@ -844,7 +1650,7 @@ func (c *Client) UploadBundleWithRevision(id *charm.URL, b charm.Bundle, promulg
 	if id.Revision == -1 {
 		return errgo.Newf("revision not specified in %q", id)
 	}
-	r, hash, size, err := openArchive(b)
+	r, hash, size, err := openArchive(b, c.params.StreamArchives)
 	if err != nil {
 		return errgo.Notef(err, "cannot open charm archive")
 	}
@@ -860,23 +1666,23 @@ func (c *Client) UploadBundleWithRevision(id *charm.URL, b charm.Bundle, promulg
 // (for example when synchronizing between charmstores). If a revision
 // is specified, then PUT will be used instead of POST.
 //
+// The request is sent with an "Expect: 100-continue" header, so that
+// authorization failures are reported before the archive is sent. This
+// relies on the HTTP transport having a non-zero ExpectContinueTimeout,
+// as http.DefaultTransport does; otherwise the archive is sent straight
+// away.
+//
 // This is the method used internally by UploadBundle, UploadCharm and UploadCharmWithRevision;
 // one of those methods should usually be used in preference.
 func (c *Client) UploadArchive(id *charm.URL, body io.ReadSeeker, hash string, size int64, promulgatedRevision int, chans []params.Channel) (*charm.URL, error) {
-	// When uploading archives, it can be a problem that the
-	// an error response is returned while we are still writing
-	// the body data.
-	// To avoid this, we log in first so that we don't need to
-	// do the macaroon exchange after POST.
-	// Unfortunately this won't help matters if the user is logged in but
-	// doesn't have privileges to write to the stated charm.
-	// A better solution would be to fix https://github.com/golang/go/issues/3665
-	// and use the 100-Continue client functionality.
-	//
-	// We only need to do this when basic auth credentials are not provided.
-	if c.params.User == "" {
-		if err := c.Login(); err != nil {
-			return nil, errgo.NoteMask(err, "cannot log in", isAPIError)
+	c = c.withOperationId()
+	if c.params.SkipDuplicateUploads && id.Revision == -1 && len(chans) == 0 {
+		existingId, err := c.uploadedWithHash(id, hash)
+		if err != nil {
+			return nil, errgo.Mask(err, isAPIError)
+		}
+		if existingId != nil {
+			return existingId, nil
 		}
 	}
 	method := "POST"
@@ -899,6 +1705,13 @@ func (c *Client) UploadArchive(id *charm.URL, body io.ReadSeeker, hash string, s
 		return nil, errgo.Notef(err, "cannot make new request")
 	}
 	req.Header.Set("Content-Type", "application/zip")
+	// When uploading archives, it can be a problem that an error
+	// response (for example a macaroon discharge-required error, or
+	// a refusal because the user cannot write to the charm) is
+	// returned while we are still writing the body data. Asking the
+	// server to confirm that it will accept the body means that such
+	// errors are reported before any of the archive is sent.
+	req.Header.Set("Expect", "100-continue")
 	req.ContentLength = size
 	for _, c := range chans {
 		urlParams["channel"] = append(urlParams["channel"], string(c))
@@ -922,6 +1735,25 @@ func (c *Client) UploadArchive(id *charm.URL, body io.ReadSeeker, hash string, s
 	return result.Id, nil
 }
 
+// uploadedWithHash returns the id of the latest uploaded revision of
+// the given entity if it has the given hash, or nil otherwise.
+func (c *Client) uploadedWithHash(id *charm.URL, hash string) (*charm.URL, error) {
+	var result struct {
+		Hash params.HashResponse
+	}
+	existingId, err := c.MetaWithChannel(id, &result, params.UnpublishedChannel)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot check for existing archive", isAPIError)
+	}
+	if result.Hash.Sum != hash {
+		return nil, nil
+	}
+	return existingId, nil
+}
+
 // PutExtraInfo puts extra-info data for the given id.
 // Each entry in the info map causes a value in extra-info with
 // that key to be set to the associated value.
@@ -953,6 +1785,13 @@ func (c *Client) PutCommonInfo(id *charm.URL, info map[string]interface{}) error
 // becomes "bundle-machine-count", but may also
 // be specified in the field's tag
 //
+// The fields of embedded structs are treated as if they were fields
+// of the outer struct, so common sets of includes can be shared
+// between result types. As with encoding/json, a field in the outer
+// struct hides any field with the same name in an embedded struct,
+// and fields with the same name at the same depth are ignored unless
+// exactly one of them has its name specified in a tag.
+//
 // This example will fill in the result structure with information
 // about the given id, including information on its archive
 // size (include archive-size), upload time (include archive-upload-time)
@@ -989,35 +1828,18 @@ func (c *Client) MetaWithChannel(id *charm.URL, result interface{}, channel para
 	// At this point, resultv refers to the struct value pointed
 	// to by result, and resultt is its type.
 
-	numField := resultt.NumField()
-	includes := make([]string, 0, numField)
+	fields, err := metaFields(resultt)
+	if err != nil {
+		return nil, err
+	}
+	includes := make([]string, 0, len(fields)+1)
 
 	// If a channel override is specified add it to the query parameters.
 	if channel != params.NoChannel {
 		includes = append(includes, "channel="+string(channel))
 	}
-
-	// results holds an entry for each field in the result value,
-	// pointing to the value for that field.
-	results := make(map[string]reflect.Value)
-	for i := 0; i < numField; i++ {
-		field := resultt.Field(i)
-		if field.PkgPath != "" {
-			// Field is private; ignore it.
-			continue
-		}
-		if field.Anonymous {
-			// At some point in the future, it might be nice to
-			// support anonymous fields, but for now the
-			// additional complexity doesn't seem worth it.
-			return nil, fmt.Errorf("anonymous fields not supported")
-		}
-		apiName := field.Tag.Get("csclient")
-		if apiName == "" {
-			apiName = hyphenate(field.Name)
-		}
-		includes = append(includes, "include="+apiName)
-		results[apiName] = resultv.FieldByName(field.Name).Addr()
+	for _, f := range fields {
+		includes = append(includes, "include="+f.name)
 	}
 	// We unmarshal into rawResult, then unmarshal each field
 	// separately into its place in the final result value.
@@ -1025,10 +1847,7 @@ func (c *Client) MetaWithChannel(id *charm.URL, result interface{}, channel para
 	// that will unpack all the values inside the Meta field,
 	// but we want to keep them raw so that we can unmarshal
 	// them ourselves.
-	var rawResult struct {
-		Id   *charm.URL
-		Meta map[string]json.RawMessage
-	}
+	var rawResult rawMetaResponse
 	path := "/" + id.Path() + "/meta/any"
 	if len(includes) > 0 {
 		path += "?" + strings.Join(includes, "&")
@@ -1036,24 +1855,283 @@ func (c *Client) MetaWithChannel(id *charm.URL, result interface{}, channel para
 	if err := c.Get(path, &rawResult); err != nil {
 		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get %q", path), isAPIError)
 	}
+	if err := unmarshalMeta(resultv, fields, rawResult.Meta); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return rawResult.Id, nil
+}
+
+// MetaAny is like Meta except that the metadata to fetch is given by
+// include name (for example "archive-size" or "extra-info/digest")
+// rather than by the fields of a struct, which is useful when the
+// includes are only known at run time. It returns the raw metadata
+// keyed by include name, and the fully qualified id of the entity.
+// As with Meta, includes without a value are omitted from the result.
+func (c *Client) MetaAny(id *charm.URL, includes ...string) (map[string]json.RawMessage, *charm.URL, error) {
+	values := make(url.Values)
+	for _, include := range includes {
+		values.Add("include", include)
+	}
+	u := url.URL{
+		Path:     "/" + id.Path() + "/meta/any",
+		RawQuery: values.Encode(),
+	}
+	var rawResult rawMetaResponse
+	if err := c.Get(u.String(), &rawResult); err != nil {
+		return nil, nil, errgo.NoteMask(err, fmt.Sprintf("cannot get %q", u.String()), isAPIError)
+	}
+	if rawResult.Meta == nil {
+		rawResult.Meta = make(map[string]json.RawMessage)
+	}
+	return rawResult.Meta, rawResult.Id, nil
+}
+
+// BulkMeta is like Meta except that it fetches metadata on several
+// charms or bundles in a single request. The result value must be a
+// pointer to a slice of structs of the kind passed to Meta; the slice
+// is set to hold an element for each of the given ids, in the same
+// order.
+//
+// BulkMeta returns the fully qualified id of each entity. If an entity
+// does not exist or the client is not authorized to read it, its id
+// is nil and the corresponding result element is left zero.
+//
+// This example fetches the latest revision of each of the given charms.
+//
+//	var results []struct {
+//		IdRevision params.IdRevisionResponse
+//	}
+//	ids, err := client.BulkMeta(ids, &results)
+func (c *Client) BulkMeta(ids []*charm.URL, result interface{}) ([]*charm.URL, error) {
+	if result == nil {
+		return nil, fmt.Errorf("expected valid result pointer, not nil")
+	}
+	resultv := reflect.ValueOf(result)
+	resultt := resultv.Type()
+	if resultt.Kind() != reflect.Ptr || resultt.Elem().Kind() != reflect.Slice || resultt.Elem().Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected pointer to slice of struct, not %T", result)
+	}
+	slicet := resultt.Elem()
+	fields, err := metaFields(slicet.Elem())
+	if err != nil {
+		return nil, err
+	}
+	slicev := reflect.MakeSlice(slicet, len(ids), len(ids))
+	resultv.Elem().Set(slicev)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// Include the ignore-auth flag so that non-public results do not generate
+	// an error for the whole request.
+	values := url.Values{}
+	values.Set("ignore-auth", "1")
+	for _, f := range fields {
+		values.Add("include", f.name)
+	}
+	for _, id := range ids {
+		values.Add("id", id.String())
+	}
+	u := url.URL{
+		Path:     "/meta/any",
+		RawQuery: values.Encode(),
+	}
+	var rawResults map[string]rawMetaResponse
+	if err := c.Get(u.String(), &rawResults); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get metadata from the charm store", isAPIError)
+	}
+	resolved := make([]*charm.URL, len(ids))
+	for i, id := range ids {
+		rawResult, ok := rawResults[id.String()]
+		if !ok {
+			continue
+		}
+		if err := unmarshalMeta(slicev.Index(i), fields, rawResult.Meta); err != nil {
+			return nil, errgo.Notef(err, "bad metadata for %q", id)
+		}
+		resolved[i] = rawResult.Id
+	}
+	return resolved, nil
+}
+
+// rawMetaResponse holds a meta/any response
+// with the metadata values left unparsed.
+type rawMetaResponse struct {
+	Id   *charm.URL
+	Meta map[string]json.RawMessage
+}
+
+// metaField holds a field of a struct used to
+// hold the result of a metadata request.
+type metaField struct {
+	// name holds the name of the metadata include.
+	name string
+
+	// index holds the index sequence of the field in the
+	// struct, as used by reflect.Value.FieldByIndex.
+	index []int
+}
+
+// metaFields returns the metadata fields of the given
+// struct type, as documented in Client.Meta.
+//
+// Fields of anonymous struct fields are promoted following the same
+// rules as encoding/json. The fields of the outer struct are found
+// first, then those of the structs it embeds, and so on, one depth at
+// a time. Of the fields with a given name, those at the shallowest
+// depth hide the others; if there is more than one at that depth, the
+// one with a csclient tag is used if it is the only one, and otherwise
+// the name is ambiguous and none of them is used.
+func metaFields(t reflect.Type) ([]metaField, error) {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var candidates []metaCandidate
+	visited := make(map[reflect.Type]bool)
+	next := []embedded{{t: t}}
+	for len(next) > 0 {
+		current := next
+		next = nil
+		for _, e := range current {
+			if visited[e.t] {
+				// The struct's fields are hidden by the
+				// same fields at a shallower depth.
+				continue
+			}
+			for i := 0; i < e.t.NumField(); i++ {
+				field := e.t.Field(i)
+				index := append(append([]int(nil), e.index...), i)
+				apiName := field.Tag.Get("csclient")
+				if field.Anonymous && apiName == "" {
+					ft := field.Type
+					isPtr := ft.Kind() == reflect.Ptr
+					if isPtr {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						if isPtr && field.PkgPath != "" {
+							// An unexported pointer field cannot
+							// be allocated; ignore it.
+							continue
+						}
+						next = append(next, embedded{ft, index})
+						continue
+					}
+				}
+				if field.PkgPath != "" {
+					// Field is private; ignore it.
+					continue
+				}
+				isTagged := apiName != ""
+				if !isTagged {
+					apiName = hyphenate(field.Name)
+				}
+				candidates = append(candidates, metaCandidate{
+					metaField: metaField{
+						name:  apiName,
+						index: index,
+					},
+					tagged: isTagged,
+				})
+			}
+		}
+		// Mark the structs only after the whole depth has been
+		// visited, so that a struct embedded more than once at the
+		// same depth makes its fields ambiguous.
+		for _, e := range current {
+			visited[e.t] = true
+		}
+	}
+	byName := make(map[string][]metaCandidate)
+	var names []string
+	for _, f := range candidates {
+		if _, ok := byName[f.name]; !ok {
+			names = append(names, f.name)
+		}
+		byName[f.name] = append(byName[f.name], f)
+	}
+	fields := make([]metaField, 0, len(names))
+	for _, name := range names {
+		if f, ok := dominantMetaField(byName[name]); ok {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// metaCandidate holds a field that may be used
+// for a metadata include.
+type metaCandidate struct {
+	metaField
+
+	// tagged holds whether the include name
+	// was specified in the field's tag.
+	tagged bool
+}
+
+// dominantMetaField returns the field to use out of the given
+// fields with the same name, in order of depth, and reports whether
+// there is one.
+func dominantMetaField(fields []metaCandidate) (metaField, bool) {
+	depth := len(fields[0].index)
+	n := 1
+	for n < len(fields) && len(fields[n].index) == depth {
+		n++
+	}
+	fields = fields[:n]
+	if len(fields) == 1 {
+		return fields[0].metaField, true
+	}
+	var dominant *metaCandidate
+	for i := range fields {
+		if !fields[i].tagged {
+			continue
+		}
+		if dominant != nil {
+			return metaField{}, false
+		}
+		dominant = &fields[i]
+	}
+	if dominant == nil {
+		return metaField{}, false
+	}
+	return dominant.metaField, true
+}
+
+// unmarshalMeta unmarshals the given raw metadata into the
+// fields of the struct value v.
+func unmarshalMeta(v reflect.Value, fields []metaField, meta map[string]json.RawMessage) error {
 	// Note that the server is not required to send back values
 	// for all fields. "If there is no metadata for the given meta path, the
 	// element will be omitted"
 	// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetaany
-	for name, r := range rawResult.Meta {
-		v, ok := results[name]
+	for _, f := range fields {
+		r, ok := meta[f.name]
 		if !ok {
-			// The server has produced a result that we
-			// don't know about. Ignore it.
 			continue
 		}
 		// Unmarshal the raw JSON into the final struct field.
-		err := json.Unmarshal(r, v.Interface())
-		if err != nil {
-			return nil, errgo.Notef(err, "cannot unmarshal %s", name)
+		if err := json.Unmarshal(r, fieldByIndex(v, f.index).Addr().Interface()); err != nil {
+			return errgo.Notef(err, "cannot unmarshal %s", f.name)
 		}
 	}
-	return rawResult.Id, nil
+	return nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex except that it
+// allocates any nil embedded struct pointers on the way to the field.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
 }
 
 // hyphenate returns the hyphenated version of the given
@@ -1083,11 +2161,17 @@ func hyphenate(s string) string {
 // be a pointer to the expected data, but may be nil if no result is
 // desired.
 func (c *Client) Get(path string, result interface{}) error {
-	req, err := http.NewRequest("GET", "", nil)
+	return c.GetWithContext(context.Background(), path, result)
+}
+
+// GetWithContext is like Get except that the request is made with the
+// given context, so that it can be canceled or given a deadline.
+func (c *Client) GetWithContext(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "", nil)
 	if err != nil {
 		return errgo.Notef(err, "cannot make new request")
 	}
-	resp, err := c.Do(req, path)
+	resp, err := c.DoWithContext(ctx, req, path)
 	if err != nil {
 		return errgo.Mask(err, isAPIError)
 	}
@@ -1120,13 +2204,20 @@ func (c *Client) PutWithResponse(path string, val, result interface{}) error {
 // the given HTTP method on the given charm store path, sending
 // val as the JSON request body and unmarshaling the JSON response into result.
 func (c *Client) DoWithResponse(method string, path string, val, result interface{}) error {
+	return c.DoWithResponseContext(context.Background(), method, path, val, result)
+}
+
+// DoWithResponseContext is like DoWithResponse except that the request
+// is made with the given context, so that it can be canceled or given
+// a deadline.
+func (c *Client) DoWithResponseContext(ctx context.Context, method string, path string, val, result interface{}) error {
 	data, err := json.Marshal(val)
 	if err != nil {
 		return errgo.Notef(err, "cannot marshal PUT body")
 	}
-	req, _ := http.NewRequest(method, "", bytes.NewReader(data))
+	req, _ := newBytesRequest(method, data)
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.Do(req, path)
+	resp, err := c.DoWithContext(ctx, req, path)
 	if err != nil {
 		return errgo.Mask(err, isAPIError)
 	}
@@ -1138,6 +2229,33 @@ func (c *Client) DoWithResponse(method string, path string, val, result interfac
 	return nil
 }
 
+// newBytesRequest returns a new request with the given
+// method and data as its body.
+func newBytesRequest(method string, data []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, "", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	// The bakery client needs to seek the body to resend the request
+	// after discharging macaroons, but http.NewRequest hides the Seek
+	// method of a *bytes.Reader, so replace the body.
+	req.Body = bytesBody{bytes.NewReader(data)}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return bytesBody{bytes.NewReader(data)}, nil
+	}
+	return req, nil
+}
+
+// bytesBody is a request body that implements io.Seeker.
+type bytesBody struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer.Close.
+func (bytesBody) Close() error {
+	return nil
+}
+
 // Do makes an arbitrary request to the charm store.
 // It adds appropriate headers to the given HTTP request,
 // sends it to the charm store, and returns the resulting
@@ -1154,18 +2272,68 @@ func (c *Client) DoWithResponse(method string, path string, val, result interfac
 //
 // Any error returned from the underlying httpbakery.Do
 // request will have an unchanged error cause.
+//
+// Each request is sent with a RequestIdHeader header holding
+// the client's request id (see WithRequestId), or a new id if the
+// client has none and the request does not already specify one.
+// The id can be retrieved from any returned error with ErrorRequestId.
+// An error response from the charm store is returned as a
+// *params.Error, with its RequestId and StatusCode fields set.
+//
+// If the client has a retry policy, requests that fail with a
+// temporary error are retried, as long as the request body (if any)
+// can be obtained again with req.GetBody.
+//
+// The request is made with the request's context; see DoWithContext.
 func (c *Client) Do(req *http.Request, path string) (*http.Response, error) {
-	if c.params.User != "" {
-		userPass := c.params.User + ":" + c.params.Password
+	return c.do(req, path, c.params.RetryPolicy)
+}
+
+// DoWithContext is like Do except that the request is made with the
+// given context. Canceling the context, or reaching its deadline,
+// stops the request, including any waits between retries and for the
+// client's rate limiter, and makes reading the response body fail.
+func (c *Client) DoWithContext(ctx context.Context, req *http.Request, path string) (*http.Response, error) {
+	return c.do(req.WithContext(ctx), path, c.params.RetryPolicy)
+}
+
+// do is the internal version of Do. It retries the
+// request according to the given policy, which may be nil.
+func (c *Client) do(req *http.Request, path string, policy *RetryPolicy) (*http.Response, error) {
+	requestId := req.Header.Get(RequestIdHeader)
+	if requestId == "" {
+		requestId = c.requestId
+		if requestId == "" {
+			requestId = newRequestId()
+		}
+		req.Header.Set(RequestIdHeader, requestId)
+	}
+	resp, err := c.do1(req, path, policy)
+	if err != nil {
+		return nil, withRequestId(err, requestId)
+	}
+	return resp, nil
+}
+
+func (c *Client) do1(req *http.Request, path string, policy *RetryPolicy) (*http.Response, error) {
+	if c.closer.closed() {
+		return nil, errgo.WithCausef(nil, ErrClosed, "")
+	}
+	settings := c.getSettings()
+	switch {
+	case settings.user != "":
+		userPass := settings.user + ":" + settings.password
 		authBasic := base64.StdEncoding.EncodeToString([]byte(userPass))
 		req.Header.Set("Authorization", "Basic "+authBasic)
+	case settings.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+settings.bearerToken)
 	}
 
 	// Prepare the request.
 	if !strings.HasPrefix(path, "/") {
 		return nil, errgo.Newf("path %q is not absolute", path)
 	}
-	for k, vv := range c.header {
+	for k, vv := range settings.header {
 		req.Header[k] = append(req.Header[k], vv...)
 	}
 
@@ -1184,12 +2352,35 @@ func (c *Client) Do(req *http.Request, path string) (*http.Response, error) {
 		u.RawQuery = values.Encode()
 	}
 	req.URL = u
+	compressed := acceptsCompression(req, path)
+	if compressed {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	var cancel context.CancelFunc
+	if timeout := c.requestTimeout(path); timeout > 0 {
+		req, cancel = withTimeout(req, timeout)
+	}
 
 	// Send the request.
-	resp, err := c.bclient.Do(req)
+	start := time.Now()
+	resp, retries, err := c.sendWithRetry(req, policy)
+	if cancel != nil {
+		if err != nil {
+			cancel()
+		} else {
+			resp.Body = &cancelBody{resp.Body, cancel}
+		}
+	}
+	c.recordMetrics(req, path, start, retries, resp, err)
 	if err != nil {
 		return nil, errgo.Mask(err, isAPIError)
 	}
+	if compressed {
+		if err := decompressResponse(resp); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	c.handleNotice(resp)
 
 	if resp.StatusCode == http.StatusOK {
 		return resp, nil
@@ -1203,7 +2394,10 @@ func (c *Client) Do(req *http.Request, path string) (*http.Response, error) {
 	}
 
 	if resp.Header.Get("Content-Type") != "application/json" {
-		return nil, errgo.Newf("unexpected response status from server: %v", resp.Status)
+		return nil, &unexpectedStatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
 	}
 	var perr params.Error
 	if err := json.Unmarshal(data, &perr); err != nil {
@@ -1212,9 +2406,79 @@ func (c *Client) Do(req *http.Request, path string) (*http.Response, error) {
 	if perr.Message == "" {
 		return nil, errgo.Newf("error response with empty message %s", sizeLimit(data))
 	}
+	perr.StatusCode = resp.StatusCode
 	return nil, &perr
 }
 
+// sendWithRetry sends the given request, retrying it
+// as allowed by the given policy, which may be nil.
+// It also returns the number of times the request was retried.
+func (c *Client) sendWithRetry(req *http.Request, policy *RetryPolicy) (*http.Response, int, error) {
+	attempts := policy.attempts()
+	if req.Body != nil && req.GetBody == nil {
+		// The body cannot be replayed, so we can't retry.
+		attempts = 1
+	}
+	if ec, ok := c.bclient.(errorClient); ok {
+		// The client could not be set up, so no request can
+		// succeed. This is not a failure of the charm store, so
+		// it is neither retried nor counted by the breaker.
+		return nil, 0, ec.err
+	}
+	breaker := c.params.CircuitBreaker
+	for i := 1; ; i++ {
+		if err := c.params.RateLimiter.wait(req.Context()); err != nil {
+			return nil, i - 1, err
+		}
+		// The authorization header is set before asking the breaker,
+		// so that a failure to set it cannot leave a probe
+		// request outstanding.
+		if c.params.AuthHeaderFunc != nil {
+			if err := c.params.AuthHeaderFunc(req); err != nil {
+				return nil, i - 1, errgo.Notef(err, "cannot set authorization header")
+			}
+		}
+		if err := breaker.allow(); err != nil {
+			return nil, i - 1, err
+		}
+		start := time.Now()
+		resp, err := c.bclient.Do(req)
+		breaker.done(resp, err)
+		c.logRequest(req, i, start, resp, err)
+		if i >= attempts || !policy.retryable(resp, err) {
+			return resp, i - 1, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		d, werr := policy.wait(req.Context(), i)
+		c.logRetry(req, i+1, d, err)
+		if werr != nil {
+			return nil, i, werr
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, i, errgo.Notef(err, "cannot rewind request body")
+			}
+			req.Body = body
+		}
+	}
+}
+
+// unexpectedStatusError is returned from Do when the server
+// responds with an error status but without a JSON error body.
+type unexpectedStatusError struct {
+	StatusCode int
+	Status     string
+	RequestId  string
+}
+
+// Error implements error.Error.
+func (e *unexpectedStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status from server: %v", e.Status)
+}
+
 func sizeLimit(data []byte) []byte {
 	const max = 1024
 	if len(data) < max {
@@ -1224,34 +2488,48 @@ func sizeLimit(data []byte) []byte {
 }
 
 // Log sends a log message to the charmstore's log database.
+// To reduce the number of requests made by callers that log
+// frequently, use a LogBuffer instead (see NewLogBuffer).
 func (cs *Client) Log(typ params.LogType, level params.LogLevel, message string, urls ...*charm.URL) error {
-	b, err := json.Marshal(message)
+	log, err := newLog(typ, level, message, urls)
 	if err != nil {
-		return errgo.Notef(err, "cannot marshal log message")
+		return errgo.Mask(err)
 	}
+	if err := cs.sendLogs([]params.Log{log}); err != nil {
+		return errgo.NoteMask(err, "cannot send log message", isAPIError)
+	}
+	return nil
+}
 
-	// Prepare and send the log.
-	// TODO (frankban): we might want to buffer logs in order to reduce
-	// requests.
-	logs := []params.Log{{
+// newLog returns the log entry for the given message.
+func newLog(typ params.LogType, level params.LogLevel, message string, urls []*charm.URL) (params.Log, error) {
+	b, err := json.Marshal(message)
+	if err != nil {
+		return params.Log{}, errgo.Notef(err, "cannot marshal log message")
+	}
+	return params.Log{
 		Data:  (*json.RawMessage)(&b),
 		Level: level,
 		Type:  typ,
 		URLs:  urls,
-	}}
-	b, err = json.Marshal(logs)
+	}, nil
+}
+
+// sendLogs sends the given log entries to the charm store in a
+// single request.
+func (cs *Client) sendLogs(logs []params.Log) error {
+	b, err := json.Marshal(logs)
 	if err != nil {
 		return errgo.Notef(err, "cannot marshal log message")
 	}
-
-	req, err := http.NewRequest("POST", "", bytes.NewReader(b))
+	req, err := newBytesRequest("POST", b)
 	if err != nil {
 		return errgo.Notef(err, "cannot create log request")
 	}
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := cs.Do(req, "/log")
 	if err != nil {
-		return errgo.NoteMask(err, "cannot send log message", isAPIError)
+		return errgo.Mask(err, isAPIError)
 	}
 	resp.Body.Close()
 	return nil
@@ -1262,19 +2540,87 @@ func (cs *Client) Log(typ params.LogType, level params.LogLevel, message string,
 // perfoming a login interaction then the error will have a cause of type
 // *httpbakery.InteractionError.
 func (cs *Client) Login() error {
+	cs.whoami.invalidate()
 	if err := cs.Get("/delegatable-macaroon", &struct{}{}); err != nil {
 		return errgo.NoteMask(err, "cannot retrieve the authentication macaroon", isAPIError)
 	}
 	return nil
 }
 
+// Logout discards the credentials used by the client: the basic
+// authentication credentials and bearer token from Params, and any
+// cookies (such as macaroons obtained by Login) that the bakery client
+// holds for the charm store. Later requests are made anonymously until
+// the client authenticates again, possibly as a different user.
+//
+// Clients derived from the client keep their credentials, although
+// they share the bakery client's cookies with it.
+func (cs *Client) Logout() error {
+	cs.updateSettings(func(s *clientSettings) {
+		s.user = ""
+		s.password = ""
+		s.bearerToken = ""
+	})
+	cs.whoami.invalidate()
+	bclient := cs.bakeryClient()
+	if bclient == nil || bclient.Client == nil || bclient.Client.Jar == nil {
+		return nil
+	}
+	u, err := url.Parse(cs.params.URL)
+	if err != nil {
+		return errgo.Notef(err, "cannot parse charm store URL")
+	}
+	clearCookies(bclient.Client.Jar, u)
+	return nil
+}
+
+// clearCookies removes the cookies held in jar for the given URL.
+// As the jar does not report the paths of the cookies, each cookie is
+// removed from every path that could apply to the URL.
+func clearCookies(jar http.CookieJar, u *url.URL) {
+	cookies := jar.Cookies(u)
+	if len(cookies) == 0 {
+		return
+	}
+	paths := []string{"/"}
+	p := strings.TrimSuffix(u.Path, "/")
+	for i := 1; i < len(p); i++ {
+		if p[i] == '/' {
+			paths = append(paths, p[:i])
+		}
+	}
+	if len(p) > 1 {
+		paths = append(paths, p)
+	}
+	var expired []*http.Cookie
+	for _, cookie := range cookies {
+		for _, path := range paths {
+			expired = append(expired, &http.Cookie{
+				Name:   cookie.Name,
+				Path:   path,
+				MaxAge: -1,
+			})
+		}
+	}
+	jar.SetCookies(u, expired)
+}
+
 // WhoAmI returns the user and list of groups associated with the macaroon
 // used to authenticate.
+//
+// A successful response is cached, and returned by later calls made by
+// the client and the clients derived from it, until Login, Logout,
+// SetHTTPHeader or InvalidateWhoAmI is called.
 func (cs *Client) WhoAmI() (*params.WhoAmIResponse, error) {
+	settings := cs.getSettings()
+	if resp := cs.whoami.get(settings); resp != nil {
+		return resp, nil
+	}
 	var response params.WhoAmIResponse
 	if err := cs.Get("/whoami", &response); err != nil {
 		return nil, errgo.Mask(err, isAPIError)
 	}
+	cs.whoami.set(settings, &response)
 	return &response, nil
 }
 
@@ -1291,46 +2637,29 @@ func (cs *Client) Latest(curls []*charm.URL) ([]CharmRevision, error) {
 	if len(curls) == 0 {
 		return nil, nil
 	}
-
-	// Prepare the request to the charm store.
-	urls := make([]string, len(curls))
-	values := url.Values{}
-	// Include the ignore-auth flag so that non-public results do not generate
-	// an error for the whole request.
-	values.Add("ignore-auth", "1")
-	values.Add("include", "id-revision")
+	ids := make([]*charm.URL, len(curls))
 	for i, curl := range curls {
-		url := curl.WithRevision(-1).String()
-		urls[i] = url
-		values.Add("id", url)
+		ids[i] = curl.WithRevision(-1)
 	}
-	u := url.URL{
-		Path:     "/meta/any",
-		RawQuery: values.Encode(),
-	}
-
-	// Execute the request and retrieve results.
-	var results map[string]struct {
-		Meta struct {
-			IdRevision params.IdRevisionResponse `json:"id-revision"`
-		}
+	var results []struct {
+		IdRevision params.IdRevisionResponse
 	}
-	if err := cs.Get(u.String(), &results); err != nil {
-		return nil, errgo.NoteMask(err, "cannot get metadata from the charm store", isAPIError)
+	resolved, err := cs.BulkMeta(ids, &results)
+	if err != nil {
+		return nil, errgo.Mask(err, isAPIError)
 	}
 
 	// Build the response.
 	responses := make([]CharmRevision, len(curls))
-	for i, url := range urls {
-		result, found := results[url]
-		if !found {
+	for i, id := range resolved {
+		if id == nil {
 			responses[i] = CharmRevision{
 				Err: params.ErrNotFound,
 			}
 			continue
 		}
 		responses[i] = CharmRevision{
-			Revision: result.Meta.IdRevision.Revision,
+			Revision: results[i].IdRevision.Revision,
 		}
 	}
 	return responses, nil
@@ -1364,6 +2693,12 @@ func isAPIError(err error) bool {
 	if _, ok := err.(params.ErrorCode); ok {
 		return true
 	}
+	if _, ok := err.(*StoreUnavailableError); ok {
+		return true
+	}
+	if err == ErrClosed {
+		return true
+	}
 	return IsAuthorizationError(err)
 }
 
@@ -4,10 +4,47 @@
 package csclient_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/bakery"
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/bakery/checkers"
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/bakerytest"
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery"
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery/agent"
+	"github.com/juju/charm/v9"
 	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
 	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
 )
 
 type suite struct {
@@ -50,3 +87,3498 @@ func (s *suite) TestHyphenate(c *gc.C) {
 		c.Assert(csclient.Hyphenate(test.val), gc.Equals, test.expect)
 	}
 }
+
+func (s *suite) TestListUploads(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, gc.Equals, "GET")
+		c.Check(req.URL.Path, gc.Equals, "/v5/upload")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Uploads":[{"UploadId":"u1","MaxParts":10},{"UploadId":"u2"}]}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	uploads, err := client.ListUploads()
+	c.Assert(err, gc.IsNil)
+	c.Assert(uploads, gc.HasLen, 2)
+	c.Assert(uploads[0].UploadId, gc.Equals, "u1")
+	c.Assert(uploads[0].MaxParts, gc.Equals, 10)
+	c.Assert(uploads[1].UploadId, gc.Equals, "u2")
+}
+
+func (s *suite) TestAbortUpload(c *gc.C) {
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, gc.Equals, "DELETE")
+		if req.URL.Path != "/v5/upload/u1" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Message":"upload not found","Code":"not found"}`)
+			return
+		}
+		deleted = append(deleted, req.URL.Path)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	err := client.AbortUpload("u1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(deleted, jc.DeepEquals, []string{"/v5/upload/u1"})
+
+	err = client.AbortUpload("u2")
+	c.Assert(errgo.Cause(err), gc.Equals, csclient.ErrUploadNotFound)
+}
+
+func (s *suite) TestRetryPolicy(c *gc.C) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.Header().Set("Content-Type", "application/json")
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"Message":"try later","Code":"service unavailable"}`)
+			return
+		}
+		fmt.Fprint(w, `{"User":"bob"}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+		RetryPolicy: &csclient.RetryPolicy{
+			MaxAttempts: 3,
+			Delay:       time.Millisecond,
+			Jitter:      0.5,
+		},
+	})
+	resp, err := client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.User, gc.Equals, "bob")
+	c.Assert(attempts, gc.Equals, 3)
+
+	// Without a policy, the first error is returned.
+	attempts = 0
+	client = csclient.New(csclient.Params{URL: srv.URL})
+	_, err = client.WhoAmI()
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrServiceUnavailable)
+	c.Assert(attempts, gc.Equals, 1)
+}
+
+func (s *suite) TestWhoAmICache(c *gc.C) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/v5/delegatable-macaroon" {
+			fmt.Fprint(w, "{}")
+			return
+		}
+		requests++
+		fmt.Fprintf(w, `{"User":%q,"Groups":["g1"]}`, req.Header.Get("X-User"))
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	client.SetHTTPHeader(http.Header{"X-User": {"bob"}})
+	resp, err := client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp, jc.DeepEquals, &params.WhoAmIResponse{User: "bob", Groups: []string{"g1"}})
+	resp.Groups[0] = "changed"
+
+	// The response is cached, and shared with derived clients.
+	resp, err = client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp, jc.DeepEquals, &params.WhoAmIResponse{User: "bob", Groups: []string{"g1"}})
+	edge := client.WithChannel(params.EdgeChannel)
+	_, err = edge.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(requests, gc.Equals, 1)
+
+	// Changing the headers of a client invalidates its cached response.
+	edge.SetHTTPHeader(http.Header{"X-User": {"alice"}})
+	resp, err = edge.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.User, gc.Equals, "alice")
+	c.Assert(requests, gc.Equals, 2)
+	resp, err = client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.User, gc.Equals, "bob")
+	c.Assert(requests, gc.Equals, 3)
+
+	// Logging in invalidates the cached response.
+	err = client.Login()
+	c.Assert(err, gc.IsNil)
+	_, err = client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(requests, gc.Equals, 4)
+
+	client.InvalidateWhoAmI()
+	_, err = client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(requests, gc.Equals, 5)
+}
+
+func (s *suite) TestDoWithContext(c *gc.C) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+		RetryPolicy: &csclient.RetryPolicy{
+			MaxAttempts: 5,
+			Delay:       time.Hour,
+		},
+	})
+
+	// Canceling the context stops the wait between retries.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, gc.IsNil)
+	_, err = client.DoWithContext(ctx, req, "/test")
+	c.Assert(err, gc.ErrorMatches, `cannot wait to retry request: context deadline exceeded`)
+	c.Assert(attempts, gc.Equals, 1)
+
+	// A canceled context stops the request being made.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = client.GetWithContext(ctx, "/test", nil)
+	c.Assert(err, gc.ErrorMatches, `.*context canceled`)
+	c.Assert(csclient.IsRetryable(err), jc.IsFalse)
+	err = client.DoWithResponseContext(ctx, "PUT", "/test", "value", nil)
+	c.Assert(err, gc.ErrorMatches, `.*context canceled`)
+	c.Assert(attempts, gc.Equals, 1)
+}
+
+func (s *suite) TestRetryPolicyNotRetryable(c *gc.C) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"Message":"not here","Code":"not found"}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+		RetryPolicy: &csclient.RetryPolicy{
+			MaxAttempts: 5,
+		},
+	})
+	_, err := client.WhoAmI()
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(attempts, gc.Equals, 1)
+}
+
+func (s *suite) TestRetryPolicyDelay(c *gc.C) {
+	p := &csclient.RetryPolicy{
+		Delay:    time.Second,
+		MaxDelay: time.Minute,
+	}
+	c.Assert(csclient.RetryPolicyDelay(p, 1), gc.Equals, time.Second)
+	c.Assert(csclient.RetryPolicyDelay(p, 3), gc.Equals, 4*time.Second)
+	c.Assert(csclient.RetryPolicyDelay(p, 100), gc.Equals, time.Minute)
+
+	// Without a maximum delay, the delay stops
+	// doubling well before it overflows.
+	p = &csclient.RetryPolicy{
+		Delay: time.Second,
+	}
+	jittered := &csclient.RetryPolicy{
+		Delay:  time.Second,
+		Jitter: 1,
+	}
+	prev := time.Duration(0)
+	for attempt := 1; attempt <= 200; attempt++ {
+		d := csclient.RetryPolicyDelay(p, attempt)
+		c.Assert(d >= prev, jc.IsTrue, gc.Commentf("attempt %d: delay %v after %v", attempt, d, prev))
+		prev = d
+		d = csclient.RetryPolicyDelay(jittered, attempt)
+		c.Assert(d >= 0, jc.IsTrue, gc.Commentf("attempt %d: jittered delay %v", attempt, d))
+	}
+	c.Assert(prev > 50*365*24*time.Hour, jc.IsTrue)
+}
+
+func (s *suite) TestGetFileFromArchiveCache(c *gc.C) {
+	hash := "hash1"
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v5/~bob/wordpress/meta/any":
+			c.Check(req.URL.Query()["include"], jc.DeepEquals, []string{"hash"})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(params.MetaAnyResponse{
+				Id: charm.MustParseURL("cs:~bob/xenial/wordpress-1"),
+				Meta: map[string]interface{}{
+					"hash": params.HashResponse{Sum: hash},
+				},
+			})
+		case "/v5/~bob/xenial/wordpress-1/archive/config.yaml":
+			c.Check(req.Header.Get("If-None-Match"), gc.Equals, "")
+			downloads++
+			fmt.Fprint(w, "contents of "+hash)
+		default:
+			c.Errorf("unexpected request path %q", req.URL.Path)
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:              srv.URL,
+		ArchiveFileCache: csclient.NewArchiveFileCache(10),
+	})
+	id := charm.MustParseURL("cs:~bob/wordpress")
+	readFile := func() string {
+		r, err := client.GetFileFromArchive(id, "config.yaml")
+		c.Assert(err, gc.IsNil)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		c.Assert(err, gc.IsNil)
+		return string(data)
+	}
+	c.Assert(readFile(), gc.Equals, "contents of hash1")
+	c.Assert(readFile(), gc.Equals, "contents of hash1")
+	c.Assert(downloads, gc.Equals, 1)
+
+	// When the entity changes, the new contents are retrieved.
+	hash = "hash2"
+	c.Assert(readFile(), gc.Equals, "contents of hash2")
+	c.Assert(readFile(), gc.Equals, "contents of hash2")
+	c.Assert(downloads, gc.Equals, 2)
+}
+
+func (s *suite) TestGetFileFromArchiveNotModified(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	r, err := client.GetFileFromArchive(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), "config.yaml")
+	c.Assert(err, gc.ErrorMatches, `cannot get file from archive: unexpected response status from server: 304 Not Modified`)
+	c.Assert(r, gc.IsNil)
+}
+
+func (s *suite) TestDoConditionalRequestNotModified(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Header.Get("If-None-Match"), gc.Equals, `"etag"`)
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("If-None-Match", `"etag"`)
+	resp, err := client.Do(req, "/~bob/xenial/wordpress-1/archive/config.yaml")
+	c.Assert(err, gc.ErrorMatches, `unexpected response status from server: 304 Not Modified`)
+	c.Assert(resp, gc.IsNil)
+}
+
+func (s *suite) TestGetArchiveWithProgress(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(params.EntityIdHeader, "cs:~bob/xenial/wordpress-1")
+		w.Header().Set(params.ContentHashHeader, "somehash")
+		w.Header().Set("Content-Length", "11")
+		fmt.Fprint(w, "hello world")
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	var progress recordingProgress
+	r, eid, hash, size, err := client.GetArchiveWithProgress(charm.MustParseURL("cs:~bob/wordpress"), &progress)
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+	c.Assert(eid.String(), gc.Equals, "cs:~bob/xenial/wordpress-1")
+	c.Assert(hash, gc.Equals, "somehash")
+	c.Assert(size, gc.Equals, int64(11))
+	c.Assert(progress.started, gc.Equals, true)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "hello world")
+	c.Assert(progress.transferred, gc.Equals, int64(11))
+}
+
+type recordingProgress struct {
+	started     bool
+	transferred int64
+	errors      []error
+}
+
+func (p *recordingProgress) Start(uploadId string, expires time.Time) {
+	p.started = true
+}
+
+func (p *recordingProgress) Transferred(total int64) {
+	p.transferred = total
+}
+
+func (p *recordingProgress) Error(err error) {
+	p.errors = append(p.errors, err)
+}
+
+func (p *recordingProgress) Finalizing() {}
+
+var resourcesNotSupportedTests = []struct {
+	about       string
+	status      int
+	contentType string
+	body        string
+	expectCause error
+}{{
+	about:       "endpoint missing",
+	status:      http.StatusNotFound,
+	contentType: "text/plain",
+	body:        "404 page not found",
+	expectCause: csclient.ErrNotSupported,
+}, {
+	about:       "unknown metadata",
+	status:      http.StatusNotFound,
+	contentType: "application/json",
+	body:        `{"Message":"unknown metadata \"resources\"","Code":"not found"}`,
+	expectCause: csclient.ErrNotSupported,
+}, {
+	about:       "method not allowed",
+	status:      http.StatusMethodNotAllowed,
+	contentType: "application/json",
+	body:        `{"Message":"GET not allowed","Code":"method not allowed"}`,
+	expectCause: csclient.ErrNotSupported,
+}, {
+	about:       "entity not found",
+	status:      http.StatusNotFound,
+	contentType: "application/json",
+	body:        `{"Message":"no matching charm or bundle for cs:wordpress","Code":"not found"}`,
+	expectCause: params.ErrNotFound,
+}}
+
+func (s *suite) TestResourcesNotSupported(c *gc.C) {
+	for i, test := range resourcesNotSupportedTests {
+		c.Logf("test %d: %s", i, test.about)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", test.contentType)
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+		client := csclient.New(csclient.Params{URL: srv.URL})
+		_, err := client.ListResources(charm.MustParseURL("cs:wordpress"))
+		c.Check(errgo.Cause(err), gc.Equals, test.expectCause)
+		_, err = client.GetResource(charm.MustParseURL("cs:wordpress"), "data", 1)
+		c.Check(errgo.Cause(err), gc.Equals, test.expectCause)
+		srv.Close()
+	}
+}
+
+func (s *suite) TestWriteArchiveTo(c *gc.C) {
+	content := "archive content"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(params.EntityIdHeader, "cs:~bob/xenial/wordpress-1")
+		w.Header().Set(params.ContentHashHeader, hashOf("archive content"))
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	var buf bytes.Buffer
+	eid, hash, err := client.WriteArchiveTo(charm.MustParseURL("cs:~bob/wordpress"), &buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(eid.String(), gc.Equals, "cs:~bob/xenial/wordpress-1")
+	c.Assert(hash, gc.Equals, hashOf(content))
+	c.Assert(buf.String(), gc.Equals, content)
+
+	// Corrupt the content.
+	content = "archive c0ntent"
+	buf.Reset()
+	_, _, err = client.WriteArchiveTo(charm.MustParseURL("cs:~bob/wordpress"), &buf)
+	mismatch, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(mismatch.ActualHash, gc.Equals, hashOf(content))
+	c.Assert(mismatch.Proxied, gc.Equals, false)
+}
+
+func hashOf(s string) string {
+	return fmt.Sprintf("%x", sha512.Sum384([]byte(s)))
+}
+
+func (s *suite) TestGetArchiveVerify(c *gc.C) {
+	content := "archive content"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(params.EntityIdHeader, "cs:~bob/xenial/wordpress-1")
+		w.Header().Set(params.ContentHashHeader, hashOf("archive content"))
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:            srv.URL,
+		VerifyArchives: true,
+	})
+	r, _, _, _, err := client.GetArchive(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, content)
+
+	content = "archive c0ntent"
+	r, _, _, _, err = client.GetArchive(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.FitsTypeOf, (*csclient.HashMismatchError)(nil))
+}
+
+func (s *suite) TestGetArchiveChunked(c *gc.C) {
+	content := "archive content"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(params.EntityIdHeader, "cs:~bob/xenial/wordpress-1")
+		w.Header().Set(params.ContentHashHeader, hashOf("archive content"))
+		// Flushing part of the body forces a chunked response.
+		fmt.Fprint(w, content[:5])
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, content[5:])
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:            srv.URL,
+		VerifyArchives: true,
+	})
+	r, eid, hash, size, err := client.GetArchive(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(eid.String(), gc.Equals, "cs:~bob/xenial/wordpress-1")
+	c.Assert(hash, gc.Equals, hashOf(content))
+	c.Assert(size, gc.Equals, int64(-1))
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, content)
+
+	// The hash is still verified.
+	content = "archive c0ntent"
+	var buf bytes.Buffer
+	_, _, err = client.WriteArchiveTo(charm.MustParseURL("cs:~bob/wordpress"), &buf)
+	c.Assert(err, gc.ErrorMatches, `hash mismatch reading archive of "cs:~bob/xenial/wordpress-1" \(expected hash [0-9a-f]+, got 15 bytes with hash [0-9a-f]+\); network corruption\?`)
+}
+
+func (s *suite) TestGetResourceVerify(c *gc.C) {
+	content := "resource content"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/~bob/kubernetes/mysql-1/resource/data/2")
+		w.Header().Set(params.ContentHashHeader, hashOf("resource content"))
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:             srv.URL,
+		VerifyResources: true,
+	})
+	id := charm.MustParseURL("cs:~bob/kubernetes/mysql-1")
+	r, err := client.GetResource(id, "data", 2)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, content)
+
+	content = "resource c0ntent"
+	r, err = client.GetResource(id, "data", 2)
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.FitsTypeOf, (*csclient.HashMismatchError)(nil))
+	c.Assert(err, gc.ErrorMatches, `hash mismatch reading resource "data" of "cs:~bob/kubernetes/mysql-1" .*`)
+	mismatch := err.(*csclient.HashMismatchError)
+	c.Assert(mismatch.ActualHash, gc.Equals, hashOf(content))
+}
+
+func (s *suite) TestHashAlgorithms(c *gc.C) {
+	content := "archive content"
+	sha256Hash := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	var wantDigest string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		wantDigest = req.Header.Get("Want-Digest")
+		w.Header().Set(params.EntityIdHeader, "cs:~bob/xenial/wordpress-1")
+		w.Header().Set(params.ContentSha256Header, sha256Hash)
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+
+	// By default, only SHA384 hashes are accepted.
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	_, err := client.GetArchiveData(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.ErrorMatches, "no Content-Sha384 header found in response")
+	c.Assert(wantDigest, gc.Equals, "")
+
+	client = csclient.New(csclient.Params{
+		URL:            srv.URL,
+		VerifyArchives: true,
+		HashAlgorithms: []csclient.HashAlgorithm{csclient.SHA384, csclient.SHA256},
+	})
+	data, err := client.GetArchiveData(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(wantDigest, gc.Equals, "sha-384, sha-256")
+	c.Assert(data.Hash, gc.Equals, sha256Hash)
+	c.Assert(data.HashAlgorithm, gc.Equals, csclient.SHA256)
+	b, err := ioutil.ReadAll(data)
+	data.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(b), gc.Equals, content)
+
+	// The SHA256 hash is verified.
+	content = "archive c0ntent"
+	var buf bytes.Buffer
+	_, _, err = client.WriteArchiveTo(charm.MustParseURL("cs:~bob/wordpress"), &buf)
+	mismatch, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(mismatch.HashAlgorithm, gc.Equals, csclient.SHA256)
+	c.Assert(mismatch.ActualHash, gc.Equals, fmt.Sprintf("%x", sha256.Sum256([]byte(content))))
+
+	client = csclient.New(csclient.Params{
+		URL:            srv.URL,
+		HashAlgorithms: []csclient.HashAlgorithm{"md5"},
+	})
+	_, err = client.GetResource(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), "data", 1)
+	c.Assert(err, gc.ErrorMatches, `unsupported hash algorithm "md5"`)
+}
+
+func (s *suite) TestResourceRevisions(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Query().Get("channel"), gc.Equals, "unpublished")
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/v5/~bob/kubernetes/mysql-1/meta/resources/data":
+			fmt.Fprint(w, `{"Name":"data","Revision":3,"Size":30}`)
+		case "/v5/~bob/kubernetes/mysql-1/meta/resources/data/0":
+			fmt.Fprint(w, `{"Name":"data","Revision":0,"Size":0}`)
+		case "/v5/~bob/kubernetes/mysql-1/meta/resources/data/2":
+			fmt.Fprint(w, `{"Name":"data","Revision":2,"Size":20}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"not found","Message":"resource not found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	resources, err := client.ResourceRevisions(charm.MustParseURL("cs:~bob/kubernetes/mysql-1"), "data")
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, jc.DeepEquals, []params.Resource{{
+		Name:     "data",
+		Revision: 0,
+	}, {
+		Name:     "data",
+		Revision: 2,
+		Size:     20,
+	}, {
+		Name:     "data",
+		Revision: 3,
+		Size:     30,
+	}})
+
+	_, err = client.ResourceRevisions(charm.MustParseURL("cs:~bob/kubernetes/mysql-1"), "missing")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *suite) TestManifest(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/~bob/xenial/wordpress-1/meta/manifest")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"Name":"metadata.yaml","Size":42},{"Name":"hooks/install","Size":10,"Hash":"abc"}]`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	files, err := client.Manifest(charm.MustParseURL("cs:~bob/xenial/wordpress-1"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, jc.DeepEquals, []params.ManifestFile{{
+		Name: "metadata.yaml",
+		Size: 42,
+	}, {
+		Name: "hooks/install",
+		Size: 10,
+		Hash: "abc",
+	}})
+}
+
+func (s *suite) TestCounter(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/stats/counter/archive-download:xenial:wordpress:bob:*")
+		c.Check(req.URL.Query(), jc.DeepEquals, url.Values{
+			"list":  {"1"},
+			"by":    {"week"},
+			"start": {"2022-01-03"},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"Key":"archive-download:xenial:wordpress:bob:1","Date":"2022-01-09","Count":5}]`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	stats, err := client.Counter(csclient.CounterParams{
+		Key:    csclient.DownloadStatsKey(charm.MustParseURL("cs:~bob/xenial/wordpress")),
+		Prefix: true,
+		List:   true,
+		By:     csclient.StatsByWeek,
+		Start:  time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats, jc.DeepEquals, []params.Statistic{{
+		Key:   "archive-download:xenial:wordpress:bob:1",
+		Date:  "2022-01-09",
+		Count: 5,
+	}})
+
+	_, err = client.Counter(csclient.CounterParams{
+		Key:  csclient.DownloadStatsKey(charm.MustParseURL("cs:~bob/xenial/wordpress-1")),
+		List: true,
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot list stats without a key prefix`)
+}
+
+func (s *suite) TestStats(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/wordpress/meta/stats")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ArchiveDownloadCount":10,"ArchiveDownload":{"Total":10,"Day":1},"ArchiveDownloadAllRevisions":{"Total":20}}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	stats, err := client.Stats(charm.MustParseURL("cs:wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats, jc.DeepEquals, &params.StatsResponse{
+		ArchiveDownloadCount: 10,
+		ArchiveDownload: params.StatsCount{
+			Total: 10,
+			Day:   1,
+		},
+		ArchiveDownloadAllRevisions: params.StatsCount{
+			Total: 20,
+		},
+	})
+}
+
+func (s *suite) TestChanges(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/changes/published")
+		c.Check(req.URL.Query(), jc.DeepEquals, url.Values{
+			"limit": {"3"},
+			"start": {"2022-01-03"},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[
+			{"Id":"cs:~bob/xenial/wordpress-2","PublishTime":"2022-01-04T10:00:00Z"},
+			{"Id":"cs:~bob/xenial/mysql-1","PublishTime":"2022-01-03T12:00:00Z"},
+			{"Id":"cs:~bob/xenial/wordpress-1","PublishTime":"2022-01-03T09:00:00Z"}
+		]`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	published, err := client.Changes(csclient.ChangesParams{
+		Since: time.Date(2022, 1, 3, 12, 0, 0, 0, time.UTC),
+		Limit: 3,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(published, jc.DeepEquals, []params.Published{{
+		Id:          charm.MustParseURL("cs:~bob/xenial/wordpress-2"),
+		PublishTime: time.Date(2022, 1, 4, 10, 0, 0, 0, time.UTC),
+	}, {
+		Id:          charm.MustParseURL("cs:~bob/xenial/mysql-1"),
+		PublishTime: time.Date(2022, 1, 3, 12, 0, 0, 0, time.UTC),
+	}})
+}
+
+func (s *suite) TestNewWithOptions(c *gc.C) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		c.Check(req.URL.Query().Get("channel"), gc.Equals, "edge")
+		c.Check(req.Header.Get("X-Test"), gc.Equals, "value")
+		c.Check(req.Header.Get("User-Agent"), gc.Equals, "test-agent")
+		c.Check(req.Header.Get("Authorization"), gc.Equals, "Bearer secret")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `"ok"`)
+	}))
+	defer srv.Close()
+
+	var logger recordingLogger
+	client := csclient.NewWithOptions(srv.URL,
+		csclient.WithChannel(params.EdgeChannel),
+		csclient.WithHTTPHeader(http.Header{"X-Test": {"value"}}),
+		csclient.WithUserAgent("test-agent"),
+		csclient.WithBearerToken("secret"),
+		csclient.WithRetryPolicy(&csclient.RetryPolicy{MaxAttempts: 2}),
+		csclient.WithLogger(&logger),
+		csclient.WithParams(func(p *csclient.Params) {
+			p.SkipDuplicateUploads = true
+		}),
+	)
+	c.Assert(client.ServerURL(), gc.Equals, srv.URL)
+	c.Assert(client.Channel(), gc.Equals, params.EdgeChannel)
+	var got string
+	err := client.Get("/test", &got)
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.Equals, "ok")
+	c.Assert(attempts, gc.Equals, 2)
+	c.Assert(logger.records, gc.HasLen, 3)
+
+	// With no URL, the default charm store is used.
+	client = csclient.NewWithOptions("")
+	c.Assert(client.ServerURL(), gc.Equals, csclient.ServerURL)
+}
+
+func (s *suite) TestDerivedClientSettings(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%q", req.Header.Get("X-Test"))
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	header := http.Header{"X-Test": {"before"}}
+	client.SetHTTPHeader(header)
+	derived := client.WithChannel(params.EdgeChannel)
+
+	// Changing the header after the fact does not affect the client.
+	header.Set("X-Test", "changed")
+	// Changing the settings of the original client does
+	// not affect the derived one.
+	client.SetHTTPHeader(http.Header{"X-Test": {"after"}})
+
+	var got string
+	err := client.Get("/test", &got)
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.Equals, "after")
+	err = derived.Get("/test", &got)
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.Equals, "before")
+}
+
+func (s *suite) TestConcurrentUse(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			client.SetHTTPHeader(http.Header{"X-Test": {fmt.Sprint(i)}})
+			client.DisableStats()
+			client.SetMinMultipartUploadSize(int64(i))
+		}()
+		go func() {
+			defer wg.Done()
+			err := client.WithChannel(params.EdgeChannel).Get("/test", nil)
+			c.Check(err, gc.IsNil)
+		}()
+		go func() {
+			defer wg.Done()
+			err := client.Get("/test", nil)
+			c.Check(err, gc.IsNil)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *suite) TestBulkMeta(c *gc.C) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/meta/any")
+		queries = append(queries, req.URL.Query())
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"cs:wordpress": {"Id": "cs:xenial/wordpress-3", "Meta": {"id-revision": {"Revision": 3}, "extra-info/digest": "abc"}},
+			"cs:~bob/mysql": {"Id": "cs:~bob/bionic/mysql-7", "Meta": {"id-revision": {"Revision": 7}}}
+		}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	var results []struct {
+		IdRevision params.IdRevisionResponse
+		Digest     string `csclient:"extra-info/digest"`
+	}
+	ids, err := client.BulkMeta([]*charm.URL{
+		charm.MustParseURL("cs:wordpress"),
+		charm.MustParseURL("cs:~bob/mysql"),
+		charm.MustParseURL("cs:missing"),
+	}, &results)
+	c.Assert(err, gc.IsNil)
+	c.Assert(queries, jc.DeepEquals, []url.Values{{
+		"id":          {"cs:wordpress", "cs:~bob/mysql", "cs:missing"},
+		"include":     {"id-revision", "extra-info/digest"},
+		"ignore-auth": {"1"},
+	}})
+	c.Assert(ids, jc.DeepEquals, []*charm.URL{
+		charm.MustParseURL("cs:xenial/wordpress-3"),
+		charm.MustParseURL("cs:~bob/bionic/mysql-7"),
+		nil,
+	})
+	c.Assert(results, gc.HasLen, 3)
+	c.Assert(results[0].IdRevision.Revision, gc.Equals, 3)
+	c.Assert(results[0].Digest, gc.Equals, "abc")
+	c.Assert(results[1].IdRevision.Revision, gc.Equals, 7)
+	c.Assert(results[1].Digest, gc.Equals, "")
+	c.Assert(results[2].IdRevision.Revision, gc.Equals, 0)
+
+	revs, err := client.Latest([]*charm.URL{
+		charm.MustParseURL("cs:wordpress-1"),
+		charm.MustParseURL("cs:~bob/mysql"),
+		charm.MustParseURL("cs:missing"),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(queries[1]["include"], jc.DeepEquals, []string{"id-revision"})
+	c.Assert(revs, jc.DeepEquals, []csclient.CharmRevision{
+		{Revision: 3},
+		{Revision: 7},
+		{Err: params.ErrNotFound},
+	})
+}
+
+func (s *suite) TestBulkMetaBadResult(c *gc.C) {
+	client := csclient.New(csclient.Params{URL: "http://0.1.2.3"})
+	var result struct{}
+	_, err := client.BulkMeta(nil, &result)
+	c.Assert(err, gc.ErrorMatches, `expected pointer to slice of struct, not \*struct {}`)
+}
+
+// CommonMeta, OwnerMeta, CommonOwnerMeta and RevisionMeta
+// are embedded in result structs in TestMetaEmbeddedFields.
+type CommonMeta struct {
+	IdRevision params.IdRevisionResponse
+	Digest     string `csclient:"extra-info/digest"`
+}
+
+type OwnerMeta struct {
+	IdUser params.IdUserResponse
+	Digest string `csclient:"extra-info/digest"`
+}
+
+type CommonOwnerMeta struct {
+	CommonMeta
+	OwnerMeta
+}
+
+type RevisionMeta struct {
+	Revision params.IdRevisionResponse `csclient:"id-revision"`
+}
+
+func (s *suite) TestMetaEmbeddedFields(c *gc.C) {
+	var includes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		includes = req.URL.Query()["include"]
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Id":"cs:~bob/xenial/wordpress-3","Meta":{
+			"id-revision": {"Revision": 3},
+			"id-user": {"User": "bob"},
+			"extra-info/digest": "abc",
+			"archive-size": {"Size": 99}
+		}}`)
+	}))
+	defer srv.Close()
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	id := charm.MustParseURL("cs:~bob/wordpress")
+
+	var result1 struct {
+		CommonMeta
+		ArchiveSize params.ArchiveSizeResponse
+	}
+	_, err := client.Meta(id, &result1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(includes, jc.DeepEquals, []string{"archive-size", "id-revision", "extra-info/digest"})
+	c.Assert(result1.IdRevision.Revision, gc.Equals, 3)
+	c.Assert(result1.Digest, gc.Equals, "abc")
+	c.Assert(result1.ArchiveSize.Size, gc.Equals, int64(99))
+
+	// Embedded struct pointers are allocated when needed.
+	var result2 struct {
+		*OwnerMeta
+	}
+	_, err = client.Meta(id, &result2)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result2.OwnerMeta, gc.NotNil)
+	c.Assert(result2.IdUser.User, gc.Equals, "bob")
+
+	// Fields in the outer struct hide embedded fields.
+	var result3 struct {
+		CommonMeta
+		Digest json.RawMessage `csclient:"extra-info/digest"`
+	}
+	_, err = client.Meta(id, &result3)
+	c.Assert(err, gc.IsNil)
+	c.Assert(includes, jc.DeepEquals, []string{"extra-info/digest", "id-revision"})
+	c.Assert(string(result3.Digest), gc.Equals, `"abc"`)
+	c.Assert(result3.CommonMeta.Digest, gc.Equals, "")
+
+	// Fields with the same name at the same depth are
+	// ambiguous, and are ignored.
+	var result4 struct {
+		CommonMeta
+		OwnerMeta
+	}
+	_, err = client.Meta(id, &result4)
+	c.Assert(err, gc.IsNil)
+	c.Assert(includes, jc.DeepEquals, []string{"id-revision", "id-user"})
+	c.Assert(result4.IdRevision.Revision, gc.Equals, 3)
+	c.Assert(result4.IdUser.User, gc.Equals, "bob")
+	c.Assert(result4.CommonMeta.Digest, gc.Equals, "")
+	c.Assert(result4.OwnerMeta.Digest, gc.Equals, "")
+
+	// Ambiguous fields in embedded structs are hidden
+	// by fields in the outer struct.
+	var result5 struct {
+		Digest string `csclient:"extra-info/digest"`
+		CommonOwnerMeta
+	}
+	_, err = client.Meta(id, &result5)
+	c.Assert(err, gc.IsNil)
+	c.Assert(includes, jc.DeepEquals, []string{"extra-info/digest", "id-revision", "id-user"})
+	c.Assert(result5.Digest, gc.Equals, "abc")
+	c.Assert(result5.IdRevision.Revision, gc.Equals, 3)
+
+	// Of fields with the same name at the same depth,
+	// the only one with a tag is used.
+	var result6 struct {
+		CommonMeta
+		RevisionMeta
+	}
+	_, err = client.Meta(id, &result6)
+	c.Assert(err, gc.IsNil)
+	c.Assert(includes, jc.DeepEquals, []string{"id-revision", "extra-info/digest"})
+	c.Assert(result6.Revision.Revision, gc.Equals, 3)
+	c.Assert(result6.IdRevision.Revision, gc.Equals, 0)
+}
+
+func (s *suite) TestMetaAny(c *gc.C) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/~bob/wordpress/meta/any")
+		query = req.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Id":"cs:~bob/xenial/wordpress-3","Meta":{"archive-size":{"Size":99},"extra-info/a b":"c"}}`)
+	}))
+	defer srv.Close()
+	client := csclient.New(csclient.Params{URL: srv.URL})
+
+	meta, id, err := client.WithChannel(params.EdgeChannel).MetaAny(charm.MustParseURL("cs:~bob/wordpress"), "archive-size", "extra-info/a b", "missing")
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/xenial/wordpress-3")
+	c.Assert(query, jc.DeepEquals, url.Values{
+		"include": {"archive-size", "extra-info/a b", "missing"},
+		"channel": {"edge"},
+	})
+	c.Assert(meta, gc.HasLen, 2)
+	c.Assert(string(meta["archive-size"]), gc.Equals, `{"Size":99}`)
+	c.Assert(string(meta["extra-info/a b"]), gc.Equals, `"c"`)
+}
+
+func (s *suite) TestUnpublish(c *gc.C) {
+	var requests []params.UnpublishRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, gc.Equals, "PUT")
+		switch req.URL.Path {
+		case "/v5/~bob/xenial/wordpress-3/unpublish":
+			var r params.UnpublishRequest
+			err := json.NewDecoder(req.Body).Decode(&r)
+			c.Check(err, gc.IsNil)
+			requests = append(requests, r)
+		case "/v5/~bob/xenial/missing-1/unpublish":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"not found","Message":"no matching charm or bundle for cs:~bob/xenial/missing-1"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client := csclient.New(csclient.Params{URL: srv.URL})
+
+	err := client.Unpublish(charm.MustParseURL("cs:~bob/xenial/wordpress-3"), []params.Channel{params.StableChannel, params.CandidateChannel})
+	c.Assert(err, gc.IsNil)
+	c.Assert(requests, jc.DeepEquals, []params.UnpublishRequest{{
+		Channels: []params.Channel{params.StableChannel, params.CandidateChannel},
+	}})
+
+	// Nothing is sent when there are no channels.
+	err = client.Unpublish(charm.MustParseURL("cs:~bob/xenial/wordpress-3"), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(requests, gc.HasLen, 1)
+
+	err = client.Unpublish(charm.MustParseURL("cs:~bob/xenial/wordpress-3"), []params.Channel{params.UnpublishedChannel})
+	c.Assert(err, gc.ErrorMatches, `cannot unpublish from the "unpublished" channel`)
+
+	err = client.Unpublish(charm.MustParseURL("cs:~bob/xenial/missing-1"), []params.Channel{params.StableChannel})
+	c.Assert(err, gc.ErrorMatches, `cannot unpublish cs:~bob/xenial/missing-1: no matching charm or bundle for cs:~bob/xenial/missing-1`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = client.Unpublish(charm.MustParseURL("cs:~bob/xenial/other-1"), []params.Channel{params.StableChannel})
+	c.Assert(err, gc.ErrorMatches, `charm store does not support unpublishing: unexpected response status from server: 404 Not Found`)
+	c.Assert(errgo.Cause(err), gc.Equals, csclient.ErrNotSupported)
+}
+
+func (s *suite) TestPerms(c *gc.C) {
+	perms := map[string]params.PermResponse{
+		"edge": {
+			Read:  []string{"bob"},
+			Write: []string{"bob"},
+		},
+		"stable": {
+			Read:  []string{"everyone"},
+			Write: []string{"bob"},
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		channel := req.URL.Query().Get("channel")
+		if channel == "" {
+			channel = "stable"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.URL.Path == "/v5/~bob/wordpress/allperms":
+			json.NewEncoder(w).Encode(params.AllPermsResponse{
+				Perms: map[params.Channel]params.PermResponse{
+					params.EdgeChannel:   perms["edge"],
+					params.StableChannel: perms["stable"],
+				},
+			})
+		case req.URL.Path == "/v5/~bob/wordpress/meta/perm" && req.Method == "GET":
+			json.NewEncoder(w).Encode(perms[channel])
+		case req.URL.Path == "/v5/~bob/wordpress/meta/perm" && req.Method == "PUT":
+			var p params.PermRequest
+			err := json.NewDecoder(req.Body).Decode(&p)
+			c.Check(err, gc.IsNil)
+			perms[channel] = params.PermResponse(p)
+		case req.URL.Path == "/v5/~bob/wordpress/meta/perm/read" && req.Method == "GET":
+			json.NewEncoder(w).Encode(perms[channel].Read)
+		case req.URL.Path == "/v5/~bob/wordpress/meta/perm/write" && req.Method == "GET":
+			json.NewEncoder(w).Encode(perms[channel].Write)
+		case req.URL.Path == "/v5/~bob/wordpress/meta/perm/write" && req.Method == "PUT":
+			p := perms[channel]
+			err := json.NewDecoder(req.Body).Decode(&p.Write)
+			c.Check(err, gc.IsNil)
+			perms[channel] = p
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"not found","Message":"not found"}`)
+		}
+	}))
+	defer srv.Close()
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	id := charm.MustParseURL("cs:~bob/wordpress")
+
+	p, err := client.Perms(id, params.EdgeChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p, jc.DeepEquals, perms["edge"])
+	p, err = client.Perms(id, params.NoChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p, jc.DeepEquals, perms["stable"])
+
+	all, err := client.AllPerms(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(all, gc.HasLen, 2)
+	c.Assert(all[params.StableChannel], jc.DeepEquals, perms["stable"])
+
+	err = client.SetPerms(id, params.EdgeChannel, params.PermRequest{
+		Read:  []string{"bob", "alice"},
+		Write: []string{"bob"},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(perms["edge"].Read, jc.DeepEquals, []string{"bob", "alice"})
+
+	err = client.Grant(id, params.EdgeChannel, csclient.WritePermission, "alice", "bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(perms["edge"].Write, jc.DeepEquals, []string{"bob", "alice"})
+	err = client.Revoke(id, params.EdgeChannel, csclient.WritePermission, "bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(perms["edge"].Write, jc.DeepEquals, []string{"alice"})
+	c.Assert(perms["edge"].Read, jc.DeepEquals, []string{"bob", "alice"})
+
+	err = client.Grant(id, params.EdgeChannel, "admin", "alice")
+	c.Assert(err, gc.ErrorMatches, `unknown permission "admin"`)
+
+	_, err = client.Perms(charm.MustParseURL("cs:~bob/missing"), params.NoChannel)
+	c.Assert(err, gc.ErrorMatches, `cannot get permissions for cs:~bob/missing: not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *suite) TestExtraInfo(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/v5/~bob/wordpress/meta/extra-info":
+			fmt.Fprint(w, `{"digest":"abc","build":{"number":42}}`)
+		case "/v5/~bob/wordpress/meta/any":
+			c.Check(req.URL.Query()["include"], jc.DeepEquals, []string{"extra-info/digest", "extra-info/missing"})
+			fmt.Fprint(w, `{"Id":"cs:~bob/xenial/wordpress-1","Meta":{"extra-info/digest":"abc"}}`)
+		case "/v5/~bob/wordpress/meta/extra-info/build":
+			fmt.Fprint(w, `{"number":42}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"metadata not found","Message":"metadata not found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	id := charm.MustParseURL("cs:~bob/wordpress")
+
+	info, err := client.ExtraInfo(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, gc.HasLen, 2)
+	var decoded struct {
+		Digest string `json:"digest"`
+		Build  struct {
+			Number int `json:"number"`
+		} `json:"build"`
+	}
+	err = csclient.DecodeInfo(info, &decoded)
+	c.Assert(err, gc.IsNil)
+	c.Assert(decoded.Digest, gc.Equals, "abc")
+	c.Assert(decoded.Build.Number, gc.Equals, 42)
+
+	info, err = client.ExtraInfo(id, "digest", "missing")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, jc.DeepEquals, map[string]json.RawMessage{
+		"digest": json.RawMessage(`"abc"`),
+	})
+
+	var build struct {
+		Number int `json:"number"`
+	}
+	err = client.ExtraInfoValue(id, "build", &build)
+	c.Assert(err, gc.IsNil)
+	c.Assert(build.Number, gc.Equals, 42)
+
+	var digest string
+	err = client.ExtraInfoValue(id, "other", &digest)
+	c.Assert(err, gc.ErrorMatches, `cannot get extra-info "other": metadata not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrMetadataNotFound)
+}
+
+func (s *suite) TestCommonInfo(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/v5/~bob/wordpress/meta/common-info":
+			fmt.Fprint(w, `{"homepage":"https://example.com","bugs-url":"https://example.com/bugs"}`)
+		case "/v5/~bob/wordpress/meta/any":
+			c.Check(req.URL.Query()["include"], jc.DeepEquals, []string{"common-info/homepage"})
+			fmt.Fprint(w, `{"Id":"cs:~bob/xenial/wordpress-1","Meta":{"common-info/homepage":"https://example.com"}}`)
+		case "/v5/~bob/wordpress/meta/common-info/bugs-url":
+			fmt.Fprint(w, `"https://example.com/bugs"`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"metadata not found","Message":"metadata not found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	id := charm.MustParseURL("cs:~bob/wordpress")
+
+	info, err := client.CommonInfo(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, jc.DeepEquals, map[string]json.RawMessage{
+		"homepage": json.RawMessage(`"https://example.com"`),
+		"bugs-url": json.RawMessage(`"https://example.com/bugs"`),
+	})
+
+	info, err = client.CommonInfo(id, "homepage")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, jc.DeepEquals, map[string]json.RawMessage{
+		"homepage": json.RawMessage(`"https://example.com"`),
+	})
+
+	var bugsURL string
+	err = client.CommonInfoValue(id, "bugs-url", &bugsURL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bugsURL, gc.Equals, "https://example.com/bugs")
+
+	err = client.CommonInfoValue(id, "other", &bugsURL)
+	c.Assert(err, gc.ErrorMatches, `cannot get common-info "other": metadata not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrMetadataNotFound)
+}
+
+func (s *suite) TestRateLimiterReserve(c *gc.C) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := csclient.NewRateLimiter(10, 2)
+	csclient.SetRateLimiterNow(limiter, func() time.Time {
+		return now
+	})
+	// A burst is allowed straight away.
+	c.Assert(csclient.RateLimiterReserve(limiter), gc.Equals, time.Duration(0))
+	c.Assert(csclient.RateLimiterReserve(limiter), gc.Equals, time.Duration(0))
+	// Further requests are spaced out.
+	c.Assert(csclient.RateLimiterReserve(limiter), gc.Equals, 100*time.Millisecond)
+	c.Assert(csclient.RateLimiterReserve(limiter), gc.Equals, 200*time.Millisecond)
+
+	// Tokens accumulate over time up to the burst size.
+	now = now.Add(time.Minute)
+	c.Assert(csclient.RateLimiterReserve(limiter), gc.Equals, time.Duration(0))
+	c.Assert(csclient.RateLimiterReserve(limiter), gc.Equals, time.Duration(0))
+	c.Assert(csclient.RateLimiterReserve(limiter), gc.Equals, 100*time.Millisecond)
+}
+
+func (s *suite) TestRateLimiter(c *gc.C) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:         srv.URL,
+		RateLimiter: csclient.NewRateLimiter(100, 1),
+	})
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		err := client.Get("/test", nil)
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(time.Since(start) >= 30*time.Millisecond, jc.IsTrue)
+	c.Assert(requests, gc.Equals, 4)
+
+	// Waiting stops when the request is canceled.
+	client = csclient.New(csclient.Params{
+		URL:         srv.URL,
+		RateLimiter: csclient.NewRateLimiter(0.001, 1),
+	})
+	err := client.Get("/test", nil)
+	c.Assert(err, gc.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "", nil)
+	c.Assert(err, gc.IsNil)
+	_, err = client.Do(req, "/test")
+	c.Assert(err, gc.ErrorMatches, `cannot wait for rate limiter: context deadline exceeded`)
+	c.Assert(requests, gc.Equals, 5)
+}
+
+func (s *suite) TestCircuitBreaker(c *gc.C) {
+	var mu sync.Mutex
+	requests := 0
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if status != http.StatusOK {
+			http.Error(w, "down", status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := csclient.NewCircuitBreaker(2, time.Minute)
+	csclient.SetCircuitBreakerNow(breaker, func() time.Time {
+		return now
+	})
+	client := csclient.New(csclient.Params{
+		URL:            srv.URL,
+		CircuitBreaker: breaker,
+	})
+
+	// Requests fail normally until the threshold is reached.
+	for i := 0; i < 2; i++ {
+		err := client.Get("/test", nil)
+		c.Assert(err, gc.ErrorMatches, `unexpected response status from server: 503 Service Unavailable`)
+	}
+	c.Assert(breaker.Tripped(), jc.IsTrue)
+
+	// Further requests fail fast without contacting the store.
+	err := client.Get("/test", nil)
+	c.Assert(err, gc.ErrorMatches, `charm store unavailable after 2 consecutive failures \(last error: unexpected response status from server: 503 Service Unavailable\); not retrying until 2022-01-01T00:01:00Z`)
+	_, ok := errgo.Cause(err).(*csclient.StoreUnavailableError)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(requests, gc.Equals, 2)
+
+	// The breaker is shared by derived clients.
+	err = client.WithChannel(params.EdgeChannel).Get("/test", nil)
+	_, ok = errgo.Cause(err).(*csclient.StoreUnavailableError)
+	c.Assert(ok, jc.IsTrue)
+
+	// After the interval, a failing probe keeps the breaker tripped.
+	now = now.Add(time.Minute)
+	err = client.Get("/test", nil)
+	c.Assert(err, gc.ErrorMatches, `unexpected response status from server: 503 Service Unavailable`)
+	c.Assert(requests, gc.Equals, 3)
+	err = client.Get("/test", nil)
+	_, ok = errgo.Cause(err).(*csclient.StoreUnavailableError)
+	c.Assert(ok, jc.IsTrue)
+
+	// A successful probe resets the breaker.
+	now = now.Add(time.Minute)
+	status = http.StatusOK
+	err = client.Get("/test", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(breaker.Tripped(), jc.IsFalse)
+	err = client.Get("/test", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(requests, gc.Equals, 5)
+}
+
+func (s *suite) TestCircuitBreakerIgnoresCallerCancellation(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+
+	breaker := csclient.NewCircuitBreaker(1, time.Minute)
+	client := csclient.New(csclient.Params{
+		URL:            srv.URL,
+		CircuitBreaker: breaker,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := client.GetWithContext(ctx, "/test", nil)
+	c.Assert(err, gc.NotNil)
+	c.Assert(breaker.Tripped(), jc.IsFalse)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = client.GetWithContext(ctx, "/test", nil)
+	c.Assert(err, gc.NotNil)
+	c.Assert(breaker.Tripped(), jc.IsFalse)
+}
+
+func (s *suite) TestCircuitBreakerAuthHeaderFuncFailsDuringProbe(c *gc.C) {
+	var mu sync.Mutex
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status != http.StatusOK {
+			http.Error(w, "down", status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := csclient.NewCircuitBreaker(1, time.Minute)
+	csclient.SetCircuitBreakerNow(breaker, func() time.Time {
+		return now
+	})
+	var authErr error
+	client := csclient.New(csclient.Params{
+		URL:            srv.URL,
+		CircuitBreaker: breaker,
+		AuthHeaderFunc: func(req *http.Request) error {
+			return authErr
+		},
+	})
+	err := client.Get("/test", nil)
+	c.Assert(err, gc.ErrorMatches, `unexpected response status from server: 503 Service Unavailable`)
+	c.Assert(breaker.Tripped(), jc.IsTrue)
+
+	// A failure to set the authorization header when the
+	// probe is due does not stop later probes.
+	now = now.Add(time.Minute)
+	authErr = errgo.New("no credentials")
+	err = client.Get("/test", nil)
+	c.Assert(err, gc.ErrorMatches, `cannot set authorization header: no credentials`)
+
+	authErr = nil
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	err = client.Get("/test", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(breaker.Tripped(), jc.IsFalse)
+}
+
+func (s *suite) TestRelated(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/xenial/wordpress-1/meta/charm-related")
+		c.Check(req.URL.Query(), jc.DeepEquals, url.Values{
+			"include": {"id-name"},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"Requires": {"http": [{"Id": "cs:xenial/haproxy-3", "Meta": {"id-name": {"Name": "haproxy"}}}]},
+			"Provides": {"mysql": [{"Id": "cs:xenial/mysql-5", "Meta": {"id-name": {"Name": "mysql"}}}]}
+		}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	related, err := client.Related(charm.MustParseURL("cs:xenial/wordpress-1"), "id-name")
+	c.Assert(err, gc.IsNil)
+	c.Assert(related, jc.DeepEquals, &params.RelatedResponse{
+		Requires: map[string][]params.EntityResult{
+			"http": {{
+				Id:   charm.MustParseURL("cs:xenial/haproxy-3"),
+				Meta: map[string]interface{}{"id-name": map[string]interface{}{"Name": "haproxy"}},
+			}},
+		},
+		Provides: map[string][]params.EntityResult{
+			"mysql": {{
+				Id:   charm.MustParseURL("cs:xenial/mysql-5"),
+				Meta: map[string]interface{}{"id-name": map[string]interface{}{"Name": "mysql"}},
+			}},
+		},
+	})
+}
+
+func (s *suite) TestServerStatus(c *gc.C) {
+	mongoPassed := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/v5/debug/status":
+			fmt.Fprintf(w, `{
+				"mongo_connected": {"Name": "MongoDB is connected", "Value": "Connected", "Passed": %v},
+				"server_started": {"Name": "Server started", "Value": "2022-01-01 00:00:00", "Passed": true}
+			}`, mongoPassed)
+		case "/v5/debug/info":
+			fmt.Fprint(w, `{"GitCommit": "abcdef", "Version": "5.7.0"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	status, err := client.ServerStatus()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status, jc.DeepEquals, map[string]params.DebugStatus{
+		"mongo_connected": {
+			Name:   "MongoDB is connected",
+			Value:  "Connected",
+			Passed: true,
+		},
+		"server_started": {
+			Name:   "Server started",
+			Value:  "2022-01-01 00:00:00",
+			Passed: true,
+		},
+	})
+	info, err := client.ServerInfo()
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, jc.DeepEquals, &params.DebugInfo{
+		GitCommit: "abcdef",
+		Version:   "5.7.0",
+	})
+	err = client.CheckServer()
+	c.Assert(err, gc.IsNil)
+
+	mongoPassed = false
+	err = client.CheckServer()
+	c.Assert(err, gc.ErrorMatches, `charm store status checks failed: MongoDB is connected: Connected`)
+}
+
+func (s *suite) TestCheckServerWrongAPIVersion(c *gc.C) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	err := client.CheckServer()
+	c.Assert(err, gc.ErrorMatches, `charm store at ".*" does not support API version v5: cannot get server status: unexpected response status from server: 404 Not Found`)
+}
+
+func (s *suite) TestDeprecationNotice(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v5/deprecated" {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Sunset", "Fri, 30 Sep 2022 00:00:00 GMT")
+			w.Header().Set("Warning", `299 charmstore "the charm store is being replaced by \"charmhub\""`)
+			w.Header().Set("Link", `<https://example.com/other>; rel="alternate", <https://example.com/migrate>; rel="deprecation"`)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	var notices []csclient.DeprecationNotice
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+		Notice: func(n csclient.DeprecationNotice) {
+			notices = append(notices, n)
+		},
+	})
+	err := client.Get("/other", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(notices, gc.HasLen, 0)
+	c.Assert(client.Notices(), gc.HasLen, 0)
+
+	expect := []csclient.DeprecationNotice{{
+		Message: `the charm store is being replaced by "charmhub"`,
+		Sunset:  time.Date(2022, 9, 30, 0, 0, 0, 0, time.UTC),
+		Link:    "https://example.com/migrate",
+	}}
+	for i := 0; i < 2; i++ {
+		err = client.Get("/deprecated", nil)
+		c.Assert(err, gc.IsNil)
+	}
+	err = client.WithChannel(params.EdgeChannel).Get("/deprecated", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(notices, jc.DeepEquals, expect)
+	c.Assert(client.Notices(), jc.DeepEquals, expect)
+}
+
+func (s *suite) TestSkipDuplicateUploads(c *gc.C) {
+	archive := []byte("archive data")
+	hash := fmt.Sprintf("%x", sha512.Sum384(archive))
+	existingHash := ""
+	posts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/v5/~bob/xenial/wordpress/meta/any":
+			c.Check(req.URL.Query()["channel"], jc.DeepEquals, []string{"unpublished"})
+			c.Check(req.URL.Query()["include"], jc.DeepEquals, []string{"hash"})
+			if existingHash == "" {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"Code":"not found","Message":"no matching charm or bundle"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"Id":"cs:~bob/xenial/wordpress-3","Meta":{"hash":{"Sum":%q}}}`, existingHash)
+		case req.Method == "POST" && req.URL.Path == "/v5/~bob/xenial/wordpress/archive":
+			posts++
+			fmt.Fprint(w, `{"Id":"cs:~bob/xenial/wordpress-4"}`)
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:                  srv.URL,
+		User:                 "bob",
+		Password:             "secret",
+		SkipDuplicateUploads: true,
+	})
+	path := filepath.Join(c.MkDir(), "archive.charm")
+	err := ioutil.WriteFile(path, archive, 0644)
+	c.Assert(err, gc.IsNil)
+	upload := func() *charm.URL {
+		f, err := os.Open(path)
+		c.Assert(err, gc.IsNil)
+		defer f.Close()
+		id, err := client.UploadArchive(charm.MustParseURL("cs:~bob/xenial/wordpress"), f, hash, int64(len(archive)), -1, nil)
+		c.Assert(err, gc.IsNil)
+		return id
+	}
+
+	// The entity does not exist yet.
+	c.Assert(upload().String(), gc.Equals, "cs:~bob/xenial/wordpress-4")
+	c.Assert(posts, gc.Equals, 1)
+
+	// The latest revision has a different hash.
+	existingHash = "other"
+	c.Assert(upload().String(), gc.Equals, "cs:~bob/xenial/wordpress-4")
+	c.Assert(posts, gc.Equals, 2)
+
+	// The latest revision is identical.
+	existingHash = hash
+	c.Assert(upload().String(), gc.Equals, "cs:~bob/xenial/wordpress-3")
+	c.Assert(posts, gc.Equals, 2)
+}
+
+const streamedCharmManifest = `
+charms:
+- name: wordpress
+  series: [xenial]
+`
+
+func (s *suite) TestUploadArchiveExpectContinue(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Header.Get("Expect"), gc.Equals, "100-continue")
+		// Reject the upload without reading the body.
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"Code":"forbidden","Message":"access denied"}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:      srv.URL,
+		User:     "bob",
+		Password: "secret",
+	})
+	body := &readCounter{
+		ReadSeeker: strings.NewReader(strings.Repeat("x", 1024*1024)),
+	}
+	_, err := client.UploadArchive(charm.MustParseURL("cs:~bob/xenial/wordpress"), body, "hash", 1024*1024, -1, nil)
+	c.Assert(err, gc.ErrorMatches, `cannot post archive: access denied`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	c.Assert(body.n, gc.Equals, int64(0))
+}
+
+// readCounter counts the bytes read from a ReadSeeker.
+type readCounter struct {
+	io.ReadSeeker
+	n int64
+}
+
+func (r *readCounter) Read(buf []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(buf)
+	r.n += int64(n)
+	return n, err
+}
+
+func (s *suite) TestUploadCharmStreamed(c *gc.C) {
+	repo, err := charmtesting.GenerateRepo(c.MkDir(), strings.NewReader(streamedCharmManifest), "xenial")
+	c.Assert(err, gc.IsNil)
+	dir := repo.CharmDir("wordpress")
+
+	var uploaded []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, gc.Equals, "POST")
+		c.Check(req.URL.Path, gc.Equals, "/v5/~bob/xenial/wordpress/archive")
+		data, err := ioutil.ReadAll(req.Body)
+		c.Check(err, gc.IsNil)
+		c.Check(int64(len(data)), gc.Equals, req.ContentLength)
+		c.Check(req.URL.Query().Get("hash"), gc.Equals, fmt.Sprintf("%x", sha512.Sum384(data)))
+		uploaded = data
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Id":"cs:~bob/xenial/wordpress-0"}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:            srv.URL,
+		User:           "bob",
+		Password:       "secret",
+		StreamArchives: true,
+	})
+	id, err := client.UploadCharm(charm.MustParseURL("cs:~bob/xenial/wordpress"), dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/xenial/wordpress-0")
+	_, err = zip.NewReader(bytes.NewReader(uploaded), int64(len(uploaded)))
+	c.Assert(err, gc.IsNil)
+
+	// The stream can be read again from the start.
+	r, hash, size, err := csclient.OpenArchive(dir, true)
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len(uploaded)))
+	c.Assert(hash, gc.Equals, fmt.Sprintf("%x", sha512.Sum384(uploaded)))
+	for i := 0; i < 2; i++ {
+		_, err = r.Seek(0, io.SeekStart)
+		c.Assert(err, gc.IsNil)
+		data, err := ioutil.ReadAll(r)
+		c.Assert(err, gc.IsNil)
+		c.Assert(data, jc.DeepEquals, uploaded)
+	}
+	_, err = r.Seek(10, io.SeekStart)
+	c.Assert(err, gc.ErrorMatches, `cannot seek to offset 10 \(whence 0\) in streamed archive`)
+
+	// Reading fails if the directory changes.
+	err = ioutil.WriteFile(filepath.Join(dir.Path, "README.md"), []byte("changed"), 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = r.Seek(0, io.SeekStart)
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.ErrorMatches, "archive changed while being uploaded")
+}
+
+func (s *suite) TestArchiveStreamSeekDuringRead(c *gc.C) {
+	archiver := &chunkArchiver{
+		data: []byte(strings.Repeat("archive data ", 1000)),
+	}
+	r, _, _, err := csclient.OpenArchive(archiver, true)
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+	// Seeking part way through the archive stops it being
+	// created before it is created again from the start.
+	for i := 0; i < 5; i++ {
+		_, err = io.ReadFull(r, make([]byte, 10))
+		c.Assert(err, gc.IsNil)
+		_, err = r.Seek(0, io.SeekStart)
+		c.Assert(err, gc.IsNil)
+	}
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, archiver.data)
+	c.Assert(archiver.calls, gc.Equals, 7)
+}
+
+// chunkArchiver writes its data in small chunks, recording
+// how many times it has been called without any locking, so
+// that the race detector finds any archives created at once.
+type chunkArchiver struct {
+	data  []byte
+	calls int
+}
+
+func (a *chunkArchiver) ArchiveTo(w io.Writer) error {
+	defer func() {
+		a.calls++
+	}()
+	for data := a.data; len(data) > 0; {
+		n := 10
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (s *suite) TestPushDockerResource(c *gc.C) {
+	// Make an OCI image archive.
+	blobs := make(map[string][]byte)
+	addBlob := func(data []byte) string {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		blobs[digest] = data
+		return digest
+	}
+	config := []byte(`{"architecture":"amd64"}`)
+	layer := []byte("layer data")
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q,"size":%d},"layers":[{"digest":%q,"size":%d}]}`, addBlob(config), len(config), addBlob(layer), len(layer)))
+	manifestDigest := addBlob(manifest)
+	index := fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d}]}`, manifestDigest, len(manifest))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	addFile := func(name string, data []byte) {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		})
+		c.Assert(err, gc.IsNil)
+		_, err = tw.Write(data)
+		c.Assert(err, gc.IsNil)
+	}
+	addFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	addFile("index.json", []byte(index))
+	for digest, data := range blobs {
+		addFile("blobs/sha256/"+strings.TrimPrefix(digest, "sha256:"), data)
+	}
+	c.Assert(tw.Close(), gc.IsNil)
+	imagePath := filepath.Join(c.MkDir(), "image.tar")
+	err := ioutil.WriteFile(imagePath, buf.Bytes(), 0644)
+	c.Assert(err, gc.IsNil)
+
+	// The registry already has the image config.
+	result := pushDockerResource(c, imagePath, map[string][]byte{
+		addBlob(config): config,
+	})
+	c.Assert(result.digest, gc.Equals, manifestDigest)
+	c.Assert(result.pushed, jc.DeepEquals, map[string][]byte{
+		addBlob(config): config,
+		addBlob(layer):  layer,
+	})
+	c.Assert(string(result.manifest), gc.Equals, string(manifest))
+}
+
+func (s *suite) TestPushDockerResourceDockerArchive(c *gc.C) {
+	config, layers, archive := dockerSaveArchive(c)
+	imagePath := filepath.Join(c.MkDir(), "image.tar")
+	err := ioutil.WriteFile(imagePath, archive, 0644)
+	c.Assert(err, gc.IsNil)
+	result := pushDockerResource(c, imagePath, nil)
+	checkConvertedImage(c, result, config, layers)
+}
+
+func (s *suite) TestPushDockerResourceFromDaemon(c *gc.C) {
+	config, layers, archive := dockerSaveArchive(c)
+	socket := filepath.Join(c.MkDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	c.Assert(err, gc.IsNil)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, gc.Equals, "GET")
+		c.Check(req.URL.Path, gc.Equals, "/images/get")
+		if name := req.URL.Query().Get("names"); name != "example.com/wordpress:v1" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"message":"No such image: %s"}`, name)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Write(archive)
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+	s.PatchEnvironment("DOCKER_HOST", "unix://"+socket)
+
+	result := pushDockerResource(c, "docker-daemon:example.com/wordpress:v1", nil)
+	checkConvertedImage(c, result, config, layers)
+
+	client := csclient.New(csclient.Params{
+		URL: "http://0.1.2.3",
+	})
+	_, err = client.PushDockerResource(charm.MustParseURL("cs:~bob/kubernetes/wordpress-1"), "image", "docker-daemon:example.com/other")
+	c.Assert(err, gc.ErrorMatches, `cannot open image: cannot get "example.com/other" from docker daemon: No such image: example.com/other`)
+}
+
+// dockerSaveArchive returns an image archive in the format written by
+// "docker save", with the image config and layers that it holds.
+func dockerSaveArchive(c *gc.C) (config []byte, layers [][]byte, archive []byte) {
+	config = []byte(`{"architecture":"amd64","rootfs":{"type":"layers"}}`)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, err := zw.Write([]byte("second layer"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(zw.Close(), gc.IsNil)
+	layers = [][]byte{[]byte("first layer"), gzipped.Bytes()}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	addFile := func(name string, data []byte) {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		})
+		c.Assert(err, gc.IsNil)
+		_, err = tw.Write(data)
+		c.Assert(err, gc.IsNil)
+	}
+	addFile("manifest.json", []byte(`[{"Config":"abc.json","RepoTags":["example.com/wordpress:v1"],"Layers":["1/layer.tar","2/layer.tar"]}]`))
+	addFile("abc.json", config)
+	addFile("1/layer.tar", layers[0])
+	addFile("2/layer.tar", layers[1])
+	c.Assert(tw.Close(), gc.IsNil)
+	return config, layers, buf.Bytes()
+}
+
+// checkConvertedImage checks that the result of pushing a docker
+// archive holding the given config and layers is an OCI image
+// holding them.
+func checkConvertedImage(c *gc.C, result dockerPushResult, config []byte, layers [][]byte) {
+	digest := func(data []byte) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	}
+	c.Assert(result.digest, gc.Equals, digest(result.manifest))
+	c.Assert(result.pushed, jc.DeepEquals, map[string][]byte{
+		digest(config):    config,
+		digest(layers[0]): layers[0],
+		digest(layers[1]): layers[1],
+	})
+	var manifest map[string]interface{}
+	err := json.Unmarshal(result.manifest, &manifest)
+	c.Assert(err, gc.IsNil)
+	descriptor := func(mediaType string, data []byte) map[string]interface{} {
+		return map[string]interface{}{
+			"mediaType": mediaType,
+			"digest":    digest(data),
+			"size":      float64(len(data)),
+		}
+	}
+	c.Assert(manifest, jc.DeepEquals, map[string]interface{}{
+		"schemaVersion": float64(2),
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor("application/vnd.oci.image.config.v1+json", config),
+		"layers": []interface{}{
+			descriptor("application/vnd.oci.image.layer.v1.tar", layers[0]),
+			descriptor("application/vnd.oci.image.layer.v1.tar+gzip", layers[1]),
+		},
+	})
+}
+
+// dockerPushResult holds the result of pushDockerResource.
+type dockerPushResult struct {
+	// digest holds the digest of the image added
+	// to the resource.
+	digest string
+
+	// pushed holds the blobs held by the registry,
+	// keyed by digest.
+	pushed map[string][]byte
+
+	// manifest holds the manifest pushed.
+	manifest []byte
+}
+
+// pushDockerResource pushes the given image as revision 3 of the
+// image resource of cs:~bob/kubernetes/wordpress-1, using a fake
+// registry that starts off holding the given blobs.
+func pushDockerResource(c *gc.C, image string, pushed map[string][]byte) dockerPushResult {
+	result := dockerPushResult{
+		pushed: make(map[string][]byte),
+	}
+	for digest, data := range pushed {
+		result.pushed[digest] = data
+	}
+	var registry *httptest.Server
+	registry = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			user, password, _ := req.BasicAuth()
+			c.Check(user, gc.Equals, "docker-user")
+			c.Check(password, gc.Equals, "docker-password")
+			c.Check(req.URL.Query().Get("scope"), gc.Equals, "repository:bob/wordpress/image:pull,push")
+			fmt.Fprint(w, `{"token":"secret-token"}`)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:bob/wordpress/image:pull,push"`, registry.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		const prefix = "/v2/bob/wordpress/image/"
+		switch {
+		case req.Method == "HEAD" && strings.HasPrefix(req.URL.Path, prefix+"blobs/"):
+			if _, ok := result.pushed[strings.TrimPrefix(req.URL.Path, prefix+"blobs/")]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case req.Method == "POST" && req.URL.Path == prefix+"blobs/uploads/":
+			w.Header().Set("Location", "/upload/1?state=x")
+			w.WriteHeader(http.StatusAccepted)
+		case req.Method == "PUT" && req.URL.Path == "/upload/1":
+			c.Check(req.URL.Query().Get("state"), gc.Equals, "x")
+			data, err := ioutil.ReadAll(req.Body)
+			c.Check(err, gc.IsNil)
+			result.pushed[req.URL.Query().Get("digest")] = data
+			w.WriteHeader(http.StatusCreated)
+		case req.Method == "PUT" && req.URL.Path == prefix+"manifests/v1":
+			c.Check(req.Header.Get("Content-Type"), gc.Equals, "application/vnd.oci.image.manifest.v1+json")
+			data, err := ioutil.ReadAll(req.Body)
+			c.Check(err, gc.IsNil)
+			result.manifest = data
+			w.WriteHeader(http.StatusCreated)
+		default:
+			c.Errorf("unexpected registry request %s %s", req.Method, req.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer registry.Close()
+	registryHost := strings.TrimPrefix(registry.URL, "https://")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/v5/~bob/kubernetes/wordpress-1/docker-resource-upload-info":
+			c.Check(req.URL.Query().Get("resource-name"), gc.Equals, "image")
+			json.NewEncoder(w).Encode(params.DockerInfoResponse{
+				ImageName: registryHost + "/bob/wordpress/image:v1",
+				Username:  "docker-user",
+				Password:  "docker-password",
+			})
+		case req.Method == "POST" && req.URL.Path == "/v5/~bob/kubernetes/wordpress-1/resource/image":
+			var body params.DockerResourceUploadRequest
+			err := json.NewDecoder(req.Body).Decode(&body)
+			c.Check(err, gc.IsNil)
+			result.digest = body.Digest
+			fmt.Fprint(w, `{"Revision":3}`)
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	bclient := httpbakery.NewClient()
+	bclient.Client.Transport = registry.Client().Transport
+	client := csclient.New(csclient.Params{
+		URL:          srv.URL,
+		User:         "bob",
+		Password:     "secret",
+		BakeryClient: bclient,
+	})
+	rev, err := client.PushDockerResource(charm.MustParseURL("cs:~bob/kubernetes/wordpress-1"), "image", image)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 3)
+	return result
+}
+
+func (s *suite) TestPullDockerResource(c *gc.C) {
+	s.testPullDockerResource(c, false)
+}
+
+func (s *suite) TestPullDockerResourceInsecureRegistry(c *gc.C) {
+	s.testPullDockerResource(c, true)
+}
+
+// testPullDockerResource tests pulling a docker resource from a
+// registry that is reached with plain HTTP if insecure is true,
+// and with the TLS configuration in the client parameters
+// otherwise.
+func (s *suite) testPullDockerResource(c *gc.C, insecure bool) {
+	blobs := make(map[string][]byte)
+	addBlob := func(data []byte) string {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		blobs[digest] = data
+		return digest
+	}
+	config := []byte(`{"architecture":"amd64"}`)
+	layer := []byte("layer data")
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":%q,"size":%d},"layers":[{"digest":%q,"size":%d}]}`, addBlob(config), len(config), addBlob(layer), len(layer)))
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+
+	newServer := httptest.NewTLSServer
+	if insecure {
+		newServer = httptest.NewServer
+	}
+	registry := newServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, password, _ := req.BasicAuth(); user != "docker-user" || password != "docker-password" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		const prefix = "/v2/bob/wordpress/image/"
+		switch {
+		case req.URL.Path == prefix+"manifests/"+manifestDigest:
+			c.Check(req.Header.Get("Accept"), jc.Contains, "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write(manifest)
+		case strings.HasPrefix(req.URL.Path, prefix+"blobs/"):
+			data, ok := blobs[strings.TrimPrefix(req.URL.Path, prefix+"blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		default:
+			c.Errorf("unexpected registry request %s %s", req.Method, req.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer registry.Close()
+	registryHost := strings.TrimPrefix(strings.TrimPrefix(registry.URL, "https://"), "http://")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/~bob/kubernetes/wordpress-1/resource/image/2")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(params.DockerInfoResponse{
+			ImageName: registryHost + "/bob/wordpress/image@" + manifestDigest,
+			Username:  "docker-user",
+			Password:  "docker-password",
+		})
+	}))
+	defer srv.Close()
+
+	p := csclient.Params{
+		URL: srv.URL,
+	}
+	if insecure {
+		p.InsecureRegistries = []string{registryHost}
+	} else {
+		p.TLSConfig = registry.Client().Transport.(*http.Transport).TLSClientConfig
+	}
+	client := csclient.New(p)
+	id := charm.MustParseURL("cs:~bob/kubernetes/wordpress-1")
+
+	dir := filepath.Join(c.MkDir(), "image")
+	digest, err := client.PullDockerResource(id, "image", 2, dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(digest, gc.Equals, manifestDigest)
+	for d, data := range blobs {
+		got, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(d, "sha256:")))
+		c.Assert(err, gc.IsNil)
+		c.Assert(got, jc.DeepEquals, data)
+	}
+	index, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(index), jc.JSONEquals, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    manifestDigest,
+			"size":      len(manifest),
+		}},
+	})
+
+	var buf bytes.Buffer
+	digest, err = client.PullDockerResourceArchive(id, "image", 2, &buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(digest, gc.Equals, manifestDigest)
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, gc.IsNil)
+		names = append(names, hdr.Name)
+	}
+	c.Assert(names, jc.SameContents, []string{
+		"blobs/sha256/" + strings.TrimPrefix(addBlob(config), "sha256:"),
+		"blobs/sha256/" + strings.TrimPrefix(addBlob(layer), "sha256:"),
+		"blobs/sha256/" + strings.TrimPrefix(manifestDigest, "sha256:"),
+		"index.json",
+		"oci-layout",
+	})
+
+	// A blob that does not match its digest is rejected.
+	blobs[addBlob(layer)] = []byte("layer dat!")
+	_, err = client.PullDockerResource(id, "image", 2, c.MkDir())
+	c.Assert(err, gc.ErrorMatches, `cannot pull image ".*": blob sha256:[0-9a-f]+ does not match its digest \(got sha256:[0-9a-f]+\)`)
+}
+
+type recordingMetrics struct {
+	mu      sync.Mutex
+	metrics []csclient.RequestMetrics
+}
+
+func (r *recordingMetrics) RequestDone(m csclient.RequestMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m.Latency = 0
+	r.metrics = append(r.metrics, m)
+}
+
+func (s *suite) TestMetrics(c *gc.C) {
+	logRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/v5/~bob/xenial/wordpress-1/meta/any":
+			fmt.Fprint(w, `{"Id":"cs:~bob/xenial/wordpress-1"}`)
+		case "/v5/~bob/xenial/wordpress-1/archive":
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set(params.EntityIdHeader, "cs:~bob/xenial/wordpress-1")
+			w.Header().Set(params.ContentHashHeader, fmt.Sprintf("%x", sha512.Sum384([]byte("archive"))))
+			fmt.Fprint(w, "archive")
+		case "/v5/~bob/xenial/missing/meta/any":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"not found","Message":"not found"}`)
+		case "/v5/log":
+			logRequests++
+			if logRequests == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	var metrics recordingMetrics
+	client := csclient.New(csclient.Params{
+		URL:     srv.URL,
+		Metrics: &metrics,
+		RetryPolicy: &csclient.RetryPolicy{
+			MaxAttempts: 2,
+		},
+	})
+	var meta struct{}
+	_, err := client.Meta(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), &meta)
+	c.Assert(err, gc.IsNil)
+	r, _, _, _, err := client.GetArchive(charm.MustParseURL("cs:~bob/xenial/wordpress-1"))
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	r.Close()
+	_, err = client.Meta(charm.MustParseURL("cs:~bob/xenial/missing"), &meta)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = client.Log(params.IngestionType, params.InfoLevel, "hello")
+	c.Assert(err, gc.IsNil)
+
+	closedSrv := httptest.NewServer(http.NotFoundHandler())
+	closedSrv.Close()
+	badClient := csclient.New(csclient.Params{
+		URL:     closedSrv.URL,
+		Metrics: &metrics,
+	})
+	_, err = badClient.Meta(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), &meta)
+	c.Assert(err, gc.NotNil)
+
+	c.Assert(metrics.metrics, gc.HasLen, 5)
+	c.Assert(metrics.metrics[4].Err, gc.NotNil)
+	metrics.metrics[4].Err = nil
+	c.Assert(metrics.metrics, jc.DeepEquals, []csclient.RequestMetrics{{
+		Method:        "GET",
+		Endpoint:      "meta/any",
+		StatusCode:    http.StatusOK,
+		BytesReceived: int64(len(`{"Id":"cs:~bob/xenial/wordpress-1"}`)),
+	}, {
+		Method:        "GET",
+		Endpoint:      "archive",
+		StatusCode:    http.StatusOK,
+		BytesReceived: int64(len("archive")),
+	}, {
+		Method:        "GET",
+		Endpoint:      "meta/any",
+		StatusCode:    http.StatusNotFound,
+		BytesReceived: int64(len(`{"Code":"not found","Message":"not found"}`)),
+	}, {
+		Method:     "POST",
+		Endpoint:   "log",
+		StatusCode: http.StatusOK,
+		BytesSent:  metrics.metrics[3].BytesSent,
+		Retries:    1,
+	}, {
+		Method:   "GET",
+		Endpoint: "meta/any",
+	}})
+	c.Assert(metrics.metrics[3].BytesSent > 0, jc.IsTrue)
+}
+
+var endpointLabelTests = []struct {
+	path   string
+	expect string
+}{
+	{"/~bob/xenial/wordpress-1/meta/any?include=id", "meta/any"},
+	{"/wordpress/meta/charm-metadata", "meta/charm-metadata"},
+	{"/meta/any?id=wordpress", "meta/any"},
+	{"/~bob/xenial/wordpress/archive?hash=x", "archive"},
+	{"/~bob/xenial/wordpress/archive/metadata.yaml", "archive"},
+	{"/~bob/kubernetes/mysql-1/resource/data/3", "resource"},
+	{"/upload/abc/1?hash=x", "upload"},
+	{"/whoami", "whoami"},
+	{"/debug/status", "debug"},
+	{"/something/else", "other"},
+}
+
+func (s *suite) TestEndpointLabel(c *gc.C) {
+	for i, test := range endpointLabelTests {
+		c.Logf("test %d: %s", i, test.path)
+		c.Assert(csclient.EndpointLabel(test.path), gc.Equals, test.expect)
+	}
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []csclient.LogRecord
+}
+
+func (l *recordingLogger) Log(r csclient.LogRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r.Event == csclient.LogRequest {
+		r.Duration = 0
+	}
+	l.records = append(l.records, r)
+}
+
+func (s *suite) TestLogger(c *gc.C) {
+	logRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		logRequests++
+		if logRequests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	var logger recordingLogger
+	client := csclient.New(csclient.Params{
+		URL:    srv.URL,
+		Logger: &logger,
+		RetryPolicy: &csclient.RetryPolicy{
+			MaxAttempts: 2,
+			Delay:       time.Millisecond,
+		},
+	}).WithRequestId("req-1")
+	err := client.Log(params.IngestionType, params.InfoLevel, "hello")
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(logger.records, jc.DeepEquals, []csclient.LogRecord{{
+		Event:      csclient.LogRequest,
+		Method:     "POST",
+		URL:        srv.URL + "/v5/log",
+		RequestId:  "req-1",
+		Attempt:    1,
+		StatusCode: http.StatusServiceUnavailable,
+	}, {
+		Event:     csclient.LogRetry,
+		Method:    "POST",
+		URL:       srv.URL + "/v5/log",
+		RequestId: "req-1",
+		Attempt:   2,
+		Duration:  time.Millisecond,
+	}, {
+		Event:      csclient.LogRequest,
+		Method:     "POST",
+		URL:        srv.URL + "/v5/log",
+		RequestId:  "req-1",
+		Attempt:    2,
+		StatusCode: http.StatusOK,
+	}})
+	c.Assert(logger.records[0].String(), gc.Equals, "POST "+srv.URL+"/v5/log [req-1]: 503 Service Unavailable in 0s (attempt 1)")
+	c.Assert(logger.records[1].String(), gc.Equals, "retrying POST "+srv.URL+"/v5/log [req-1] (attempt 2 after 1ms)")
+}
+
+func (s *suite) TestLogBuffer(c *gc.C) {
+	var mu sync.Mutex
+	var batches [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/log")
+		var logs []params.Log
+		err := json.NewDecoder(req.Body).Decode(&logs)
+		c.Check(err, gc.IsNil)
+		var batch []string
+		for _, log := range logs {
+			var msg string
+			err := json.Unmarshal(*log.Data, &msg)
+			c.Check(err, gc.IsNil)
+			batch = append(batch, msg)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, batch)
+	}))
+	defer srv.Close()
+	getBatches := func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), batches...)
+	}
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	buf := client.NewLogBuffer(csclient.LogBufferParams{
+		FlushInterval: time.Hour,
+		BatchSize:     3,
+	})
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		err := buf.Log(params.IngestionType, params.InfoLevel, msg)
+		c.Assert(err, gc.IsNil)
+	}
+	// Reaching the batch size sends the buffered entries.
+	c.Assert(getBatches(), jc.DeepEquals, [][]string{{"a", "b", "c"}})
+
+	err := buf.Flush()
+	c.Assert(err, gc.IsNil)
+	c.Assert(getBatches(), jc.DeepEquals, [][]string{{"a", "b", "c"}, {"d"}})
+
+	// Flushing an empty buffer does nothing.
+	err = buf.Flush()
+	c.Assert(err, gc.IsNil)
+	c.Assert(getBatches(), gc.HasLen, 2)
+
+	err = buf.Log(params.IngestionType, params.InfoLevel, "e")
+	c.Assert(err, gc.IsNil)
+	err = buf.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(getBatches(), jc.DeepEquals, [][]string{{"a", "b", "c"}, {"d"}, {"e"}})
+
+	err = buf.Log(params.IngestionType, params.InfoLevel, "f")
+	c.Assert(err, gc.ErrorMatches, "log buffer is closed")
+
+	// Entries are sent in the background after the flush interval.
+	buf = client.NewLogBuffer(csclient.LogBufferParams{
+		FlushInterval: time.Millisecond,
+	})
+	defer buf.Close()
+	err = buf.Log(params.IngestionType, params.InfoLevel, "g")
+	c.Assert(err, gc.IsNil)
+	for deadline := time.Now().Add(5 * time.Second); len(getBatches()) < 4 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(getBatches(), jc.DeepEquals, [][]string{{"a", "b", "c"}, {"d"}, {"e"}, {"g"}})
+}
+
+func (s *suite) TestLogBufferBackgroundError(c *gc.C) {
+	requests := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"Message":"no logging for you","Code":"forbidden"}`))
+		requests <- struct{}{}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	buf := client.NewLogBuffer(csclient.LogBufferParams{
+		FlushInterval: time.Millisecond,
+	})
+	err := buf.Log(params.IngestionType, params.InfoLevel, "hello")
+	c.Assert(err, gc.IsNil)
+	<-requests
+
+	// The error from the background send is returned once.
+	flushErr := buf.Flush()
+	for deadline := time.Now().Add(5 * time.Second); flushErr == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		flushErr = buf.Flush()
+	}
+	c.Assert(flushErr, gc.ErrorMatches, "cannot send log messages: no logging for you")
+	c.Assert(errgo.Cause(flushErr), gc.Equals, params.ErrForbidden)
+	err = buf.Close()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *suite) TestLogBufferSendsAfterBackgroundError(c *gc.C) {
+	var mu sync.Mutex
+	var messages []string
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"Message":"no logging for you","Code":"forbidden"}`))
+			return
+		}
+		var logs []params.Log
+		err := json.NewDecoder(req.Body).Decode(&logs)
+		c.Check(err, gc.IsNil)
+		for _, log := range logs {
+			var msg string
+			err := json.Unmarshal(*log.Data, &msg)
+			c.Check(err, gc.IsNil)
+			messages = append(messages, msg)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	buf := client.NewLogBuffer(csclient.LogBufferParams{
+		FlushInterval: time.Hour,
+	})
+	err := buf.Log(params.IngestionType, params.InfoLevel, "a")
+	c.Assert(err, gc.IsNil)
+
+	// The buffered messages are sent even though an earlier
+	// background send failed, and that failure is reported.
+	csclient.SetLogBufferError(buf, errgo.New("background failure"))
+	err = buf.Flush()
+	c.Assert(err, gc.ErrorMatches, "background failure")
+	mu.Lock()
+	c.Assert(messages, jc.DeepEquals, []string{"a"})
+	mu.Unlock()
+
+	// When sending fails too, both errors are reported.
+	err = buf.Log(params.IngestionType, params.InfoLevel, "b")
+	c.Assert(err, gc.IsNil)
+	csclient.SetLogBufferError(buf, errgo.New("background failure"))
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	err = buf.Close()
+	c.Assert(err, gc.ErrorMatches, `cannot send log messages: no logging for you \(earlier error: background failure\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+}
+
+func (s *suite) TestLogBufferClosedWithClient(c *gc.C) {
+	var mu sync.Mutex
+	var messages []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var logs []params.Log
+		err := json.NewDecoder(req.Body).Decode(&logs)
+		c.Check(err, gc.IsNil)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, log := range logs {
+			var msg string
+			err := json.Unmarshal(*log.Data, &msg)
+			c.Check(err, gc.IsNil)
+			messages = append(messages, msg)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	buf := client.NewLogBuffer(csclient.LogBufferParams{
+		FlushInterval: time.Hour,
+	})
+	err := buf.Log(params.IngestionType, params.InfoLevel, "hello")
+	c.Assert(err, gc.IsNil)
+
+	// Closing the client sends the buffered messages
+	// rather than waiting for the flush interval.
+	err = client.Close()
+	c.Assert(err, gc.IsNil)
+	mu.Lock()
+	c.Assert(messages, jc.DeepEquals, []string{"hello"})
+	mu.Unlock()
+	err = buf.Log(params.IngestionType, params.InfoLevel, "goodbye")
+	c.Assert(err, gc.ErrorMatches, "log buffer is closed")
+	err = buf.Close()
+	c.Assert(err, gc.IsNil)
+
+	// A log buffer created with a closed client is closed.
+	buf = client.NewLogBuffer(csclient.LogBufferParams{})
+	err = buf.Log(params.IngestionType, params.InfoLevel, "goodbye")
+	c.Assert(err, gc.ErrorMatches, "log buffer is closed")
+}
+
+func (s *suite) TestGetLogs(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, gc.Equals, "GET")
+		c.Check(req.URL.Path, gc.Equals, "/v5/log")
+		c.Check(req.URL.Query(), jc.DeepEquals, url.Values{
+			"type":  {"ingestion"},
+			"level": {"error"},
+			"id":    {"cs:~bob/xenial/wordpress-1"},
+			"limit": {"2"},
+			"skip":  {"4"},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{
+			"Data": "boom",
+			"Level": "error",
+			"Type": "ingestion",
+			"URLs": ["cs:~bob/xenial/wordpress-1"],
+			"Time": "2022-01-04T10:00:00Z"
+		}]`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	logs, err := client.GetLogs(csclient.LogFilter{
+		Type:   params.IngestionType,
+		Level:  params.ErrorLevel,
+		URLs:   []*charm.URL{charm.MustParseURL("cs:~bob/xenial/wordpress-1")},
+		Limit:  2,
+		Offset: 4,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(logs, jc.DeepEquals, []params.LogResponse{{
+		Data:  json.RawMessage(`"boom"`),
+		Level: params.ErrorLevel,
+		Type:  params.IngestionType,
+		URLs:  []*charm.URL{charm.MustParseURL("cs:~bob/xenial/wordpress-1")},
+		Time:  time.Date(2022, 1, 4, 10, 0, 0, 0, time.UTC),
+	}})
+
+	_, err = client.GetLogs(csclient.LogFilter{Offset: -1})
+	c.Assert(err, gc.ErrorMatches, "negative offset")
+}
+
+func (s *suite) TestLoggerUploadPartRetry(c *gc.C) {
+	partRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/v5/upload":
+			fmt.Fprint(w, `{"UploadId":"u1","MaxParts":1,"MinPartSize":1,"MaxPartSize":100}`)
+		case req.Method == "PUT" && req.URL.Path == "/v5/upload/u1/0":
+			partRequests++
+			if partRequests == 1 {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		case req.Method == "PUT" && req.URL.Path == "/v5/upload/u1":
+			fmt.Fprint(w, `{}`)
+		case req.Method == "POST" && req.URL.Path == "/v5/~bob/kubernetes/mysql-1/resource/data":
+			fmt.Fprint(w, `{"Revision":3}`)
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	var logger recordingLogger
+	client := csclient.New(csclient.Params{
+		URL:    srv.URL,
+		Logger: &logger,
+		RetryPolicy: &csclient.RetryPolicy{
+			MaxAttempts: 2,
+		},
+	})
+	client.SetMinMultipartUploadSize(1)
+	content := "resource data"
+	rev, err := client.UploadResource(charm.MustParseURL("cs:~bob/kubernetes/mysql-1"), "data", "data.txt", strings.NewReader(content), int64(len(content)), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 3)
+
+	var retries []csclient.LogRecord
+	for _, r := range logger.records {
+		if r.Event == csclient.LogRetry {
+			retries = append(retries, r)
+		}
+	}
+	c.Assert(retries, gc.HasLen, 1)
+	c.Assert(retries[0].Method, gc.Equals, "PUT")
+	c.Assert(retries[0].URL, gc.Matches, srv.URL+`/v5/upload/u1/0\?hash=.*`)
+	c.Assert(retries[0].Attempt, gc.Equals, 2)
+	c.Assert(retries[0].Err, gc.ErrorMatches, `unexpected response status from server: 502 Bad Gateway`)
+	c.Assert(logger.records, gc.HasLen, 6)
+}
+
+func (s *suite) TestMultipartParams(c *gc.C) {
+	var partSizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/v5/upload":
+			partSizes = nil
+			fmt.Fprint(w, `{"UploadId":"u1","MaxParts":10,"MinPartSize":1,"MaxPartSize":30}`)
+		case req.Method == "PUT" && strings.HasPrefix(req.URL.Path, "/v5/upload/u1/"):
+			data, err := ioutil.ReadAll(req.Body)
+			c.Check(err, gc.IsNil)
+			partSizes = append(partSizes, len(data))
+		case req.Method == "PUT" && req.URL.Path == "/v5/upload/u1":
+			fmt.Fprint(w, `{}`)
+		case req.Method == "POST" && req.URL.Path == "/v5/~bob/kubernetes/mysql-1/resource/data":
+			fmt.Fprint(w, `{"Revision":3}`)
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	content := strings.Repeat("x", 40)
+	tests := []struct {
+		about             string
+		preferredPartSize int64
+		expectPartSizes   []int
+	}{{
+		about:           "default part size",
+		expectPartSizes: []int{4, 4, 4, 4, 4, 4, 4, 4, 4, 4},
+	}, {
+		about:             "preferred part size",
+		preferredPartSize: 15,
+		expectPartSizes:   []int{15, 15, 10},
+	}, {
+		about:             "preferred part size too small for max parts",
+		preferredPartSize: 2,
+		expectPartSizes:   []int{4, 4, 4, 4, 4, 4, 4, 4, 4, 4},
+	}, {
+		about:             "preferred part size larger than max part size",
+		preferredPartSize: 100,
+		expectPartSizes:   []int{30, 10},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		client := csclient.New(csclient.Params{
+			URL:                    srv.URL,
+			MinMultipartUploadSize: 10,
+			PreferredPartSize:      test.preferredPartSize,
+		})
+		rev, err := client.UploadResource(charm.MustParseURL("cs:~bob/kubernetes/mysql-1"), "data", "data.txt", strings.NewReader(content), int64(len(content)), nil)
+		c.Assert(err, gc.IsNil)
+		c.Assert(rev, gc.Equals, 3)
+		c.Assert(partSizes, jc.DeepEquals, test.expectPartSizes)
+	}
+}
+
+func (s *suite) TestCompressedResponses(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body string
+		status := http.StatusOK
+		switch req.URL.Path {
+		case "/v5/meta/any":
+			body = `{"cs:wordpress":{"Id":"cs:xenial/wordpress-1"}}`
+		case "/v5/wordpress/meta/any":
+			body = `{"Id":"cs:xenial/wordpress-1"}`
+		case "/v5/missing/meta/any":
+			status = http.StatusNotFound
+			body = `{"Code":"not found","Message":"no matching charm"}`
+		case "/v5/wordpress/archive":
+			c.Check(req.Header.Get("Accept-Encoding"), gc.Not(gc.Equals), "gzip, deflate")
+			w.Header().Set(params.EntityIdHeader, "cs:xenial/wordpress-1")
+			w.Header().Set(params.ContentHashHeader, fmt.Sprintf("%x", sha512.Sum384([]byte("archive"))))
+			fmt.Fprint(w, "archive")
+			return
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+			return
+		}
+		c.Check(req.Header.Get("Accept-Encoding"), gc.Equals, "gzip, deflate")
+		w.Header().Set("Content-Type", "application/json")
+		var cw io.WriteCloser
+		if req.URL.Path == "/v5/meta/any" {
+			w.Header().Set("Content-Encoding", "deflate")
+			cw = zlib.NewWriter(w)
+		} else {
+			w.Header().Set("Content-Encoding", "gzip")
+			cw = gzip.NewWriter(w)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(cw, body)
+		cw.Close()
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	var bulk map[string]params.IdResponse
+	err := client.Get("/meta/any?id=wordpress", &bulk)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bulk["cs:wordpress"].Id, jc.DeepEquals, charm.MustParseURL("cs:xenial/wordpress-1"))
+
+	var meta params.IdResponse
+	err = client.Get("/wordpress/meta/any", &meta)
+	c.Assert(err, gc.IsNil)
+	c.Assert(meta.Id, jc.DeepEquals, charm.MustParseURL("cs:xenial/wordpress-1"))
+
+	err = client.Get("/missing/meta/any", &meta)
+	c.Assert(err, gc.ErrorMatches, "no matching charm")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	r, _, _, _, err := client.GetArchive(charm.MustParseURL("wordpress"))
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "archive")
+}
+
+func (s *suite) TestTimeouts(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		switch req.URL.Path {
+		case "/v5/wordpress/meta/any":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"Id":"cs:xenial/wordpress-1"}`)
+		case "/v5/wordpress/archive":
+			w.Header().Set(params.EntityIdHeader, "cs:xenial/wordpress-1")
+			w.Header().Set(params.ContentHashHeader, fmt.Sprintf("%x", sha512.Sum384([]byte("archive"))))
+			fmt.Fprint(w, "archive")
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:            srv.URL,
+		RequestTimeout: 50 * time.Millisecond,
+	})
+	var meta params.IdResponse
+	err := client.Get("/wordpress/meta/any", &meta)
+	c.Assert(err, gc.ErrorMatches, `Get .*: context deadline exceeded`)
+
+	// Transfers are not limited by RequestTimeout.
+	r, _, _, _, err := client.GetArchive(charm.MustParseURL("wordpress"))
+	c.Assert(err, gc.IsNil)
+	r.Close()
+
+	// WithTimeout overrides the timeouts in Params.
+	err = client.WithTimeout(0).Get("/wordpress/meta/any", &meta)
+	c.Assert(err, gc.IsNil)
+	c.Assert(meta.Id, jc.DeepEquals, charm.MustParseURL("cs:xenial/wordpress-1"))
+	_, _, _, _, err = client.WithTimeout(50 * time.Millisecond).GetArchive(charm.MustParseURL("wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot get archive: Get .*: context deadline exceeded`)
+
+	client = csclient.New(csclient.Params{
+		URL:             srv.URL,
+		TransferTimeout: 50 * time.Millisecond,
+	})
+	_, _, _, _, err = client.GetArchive(charm.MustParseURL("wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot get archive: Get .*: context deadline exceeded`)
+}
+
+func (s *suite) TestIsRetryable(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v5/missing/meta/any":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"not found","Message":"no matching charm or bundle"}`)
+		case "/v5/unavailable/meta/any":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"Code":"service unavailable","Message":"try again later"}`)
+		case "/v5/broken/meta/any":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"Message":"database failure"}`)
+		case "/v5/bad/meta/any":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/v5/limited/meta/any":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/v5/unimplemented/meta/any":
+			w.WriteHeader(http.StatusNotImplemented)
+		case "/v5/gateway/meta/any":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	tests := []struct {
+		id         string
+		statusCode int
+		retryable  bool
+	}{
+		{"missing", http.StatusNotFound, false},
+		{"unavailable", http.StatusServiceUnavailable, true},
+		{"broken", http.StatusInternalServerError, false},
+		{"bad", http.StatusBadRequest, false},
+		{"limited", http.StatusTooManyRequests, true},
+		{"unimplemented", http.StatusNotImplemented, false},
+		{"gateway", http.StatusBadGateway, true},
+	}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.id)
+		var meta struct{}
+		_, err := client.Meta(charm.MustParseURL(test.id), &meta)
+		c.Assert(err, gc.NotNil)
+		c.Assert(csclient.ErrorStatusCode(err), gc.Equals, test.statusCode)
+		c.Assert(csclient.IsRetryable(err), gc.Equals, test.retryable)
+	}
+
+	closedSrv := httptest.NewServer(http.NotFoundHandler())
+	closedSrv.Close()
+	var meta struct{}
+	_, err := csclient.New(csclient.Params{URL: closedSrv.URL}).Meta(charm.MustParseURL("wordpress"), &meta)
+	c.Assert(err, gc.NotNil)
+	c.Assert(csclient.ErrorStatusCode(err), gc.Equals, 0)
+	c.Assert(csclient.IsRetryable(err), jc.IsTrue)
+
+	err = errgo.Mask(&url.Error{Op: "Get", URL: srv.URL, Err: context.Canceled})
+	c.Assert(csclient.IsRetryable(err), jc.IsFalse)
+	c.Assert(csclient.IsRetryable(nil), jc.IsFalse)
+}
+
+func (s *suite) TestSearch(c *gc.C) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v5/search")
+		req.ParseForm()
+		queries = append(queries, req.Form)
+		skip, _ := strconv.Atoi(req.Form.Get("skip"))
+		limit, _ := strconv.Atoi(req.Form.Get("limit"))
+		resp := params.SearchResponse{
+			Total: 5,
+		}
+		for i := skip; i < skip+limit && i < 5; i++ {
+			resp.Results = append(resp.Results, params.EntityResult{
+				Id: charm.MustParseURL(fmt.Sprintf("cs:xenial/wordpress-%d", i)),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	iter := client.Search(csclient.SearchParams{
+		Text: "wordpress",
+		Filters: map[string][]string{
+			"series": {"xenial"},
+		},
+		Include:  []string{"charm-metadata"},
+		PageSize: 2,
+	})
+	c.Assert(iter.Total(), gc.Equals, -1)
+	var ids []string
+	for iter.Next() {
+		ids = append(ids, iter.Entity().Id.String())
+	}
+	c.Assert(iter.Err(), gc.IsNil)
+	c.Assert(iter.Total(), gc.Equals, 5)
+	c.Assert(ids, jc.DeepEquals, []string{
+		"cs:xenial/wordpress-0",
+		"cs:xenial/wordpress-1",
+		"cs:xenial/wordpress-2",
+		"cs:xenial/wordpress-3",
+		"cs:xenial/wordpress-4",
+	})
+	c.Assert(queries, gc.HasLen, 3)
+	for i, q := range queries {
+		c.Assert(q, jc.DeepEquals, url.Values{
+			"text":    {"wordpress"},
+			"series":  {"xenial"},
+			"include": {"charm-metadata"},
+			"skip":    {strconv.Itoa(i * 2)},
+			"limit":   {"2"},
+		})
+	}
+	c.Assert(iter.Next(), jc.IsFalse)
+	c.Assert(queries, gc.HasLen, 3)
+}
+
+func (s *suite) TestSearchError(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"Code":"bad request","Message":"invalid parameter: sort"}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	iter := client.Search(csclient.SearchParams{
+		Sort: "bad",
+	})
+	c.Assert(iter.Next(), jc.IsFalse)
+	c.Assert(iter.Err(), gc.ErrorMatches, `cannot search: invalid parameter: sort`)
+	c.Assert(errgo.Cause(iter.Err()), gc.Equals, params.ErrBadRequest)
+
+	iter = client.Search(csclient.SearchParams{
+		PageSize: -1,
+	})
+	c.Assert(iter.Next(), jc.IsFalse)
+	c.Assert(iter.Err(), gc.ErrorMatches, `negative page size`)
+}
+
+func (s *suite) TestBearerToken(c *gc.C) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth = append(auth, req.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:         srv.URL,
+		BearerToken: "secret-token",
+	})
+	err := client.Get("/whoami", nil)
+	c.Assert(err, gc.IsNil)
+
+	// Basic authentication takes precedence.
+	client = csclient.New(csclient.Params{
+		URL:         srv.URL,
+		User:        "bob",
+		Password:    "pass",
+		BearerToken: "secret-token",
+	})
+	err = client.Get("/whoami", nil)
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(auth, jc.DeepEquals, []string{
+		"Bearer secret-token",
+		"Basic Ym9iOnBhc3M=",
+	})
+}
+
+func (s *suite) TestAuthHeaderFunc(c *gc.C) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth = append(auth, req.Header.Get("Authorization"))
+		if len(auth) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+
+	token := 0
+	client := csclient.New(csclient.Params{
+		URL:         srv.URL,
+		BearerToken: "static-token",
+		AuthHeaderFunc: func(req *http.Request) error {
+			token++
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer token-%d", token))
+			return nil
+		},
+		RetryPolicy: &csclient.RetryPolicy{
+			MaxAttempts: 2,
+		},
+	})
+	err := client.Get("/whoami", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(auth, jc.DeepEquals, []string{
+		"Bearer token-1",
+		"Bearer token-2",
+	})
+
+	client = csclient.New(csclient.Params{
+		URL: srv.URL,
+		AuthHeaderFunc: func(req *http.Request) error {
+			return errgo.New("vault sealed")
+		},
+	})
+	err = client.Get("/whoami", nil)
+	c.Assert(err, gc.ErrorMatches, `cannot set authorization header: vault sealed`)
+	c.Assert(auth, gc.HasLen, 2)
+}
+
+func (s *suite) TestLogout(c *gc.C) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var cookies []string
+		for _, cookie := range req.Cookies() {
+			cookies = append(cookies, cookie.Name)
+		}
+		auth = append(auth, req.Header.Get("Authorization")+";"+strings.Join(cookies, ","))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"User":"bob"}`)
+	}))
+	defer srv.Close()
+
+	bclient := httpbakery.NewClient()
+	u, err := url.Parse(srv.URL + "/charmstore")
+	c.Assert(err, gc.IsNil)
+	bclient.Client.Jar.SetCookies(u, []*http.Cookie{{
+		Name:  "macaroon-1",
+		Value: "x",
+		Path:  "/",
+	}, {
+		Name:  "macaroon-2",
+		Value: "y",
+		Path:  "/charmstore",
+	}})
+	client := csclient.New(csclient.Params{
+		URL:          srv.URL + "/charmstore",
+		User:         "bob",
+		Password:     "pass",
+		BakeryClient: bclient,
+	})
+	_, err = client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+
+	err = client.Logout()
+	c.Assert(err, gc.IsNil)
+	c.Assert(bclient.Client.Jar.Cookies(u), gc.HasLen, 0)
+	// The cached identity is forgotten too.
+	_, err = client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(auth, jc.DeepEquals, []string{
+		"Basic Ym9iOnBhc3M=;macaroon-2,macaroon-1",
+		";",
+	})
+}
+
+func (s *suite) TestDischargeCache(c *gc.C) {
+	var discharges int32
+	discharger := bakerytest.NewDischarger(nil)
+	defer discharger.Close()
+	discharger.CheckerP = httpbakery.ThirdPartyCaveatCheckerPFunc(func(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams) ([]checkers.Caveat, error) {
+		atomic.AddInt32(&discharges, 1)
+		// Give the other requests time to need a discharge too.
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil
+	})
+
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	b := bakery.New(bakery.BakeryParams{
+		Key:     key,
+		Locator: discharger,
+	})
+	op := bakery.Op{Entity: "store", Action: "read"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		_, err := b.Checker.Auth(httpbakery.RequestMacaroons(req)...).Allow(ctx, op)
+		if err != nil {
+			m, err := b.Oven.NewMacaroon(ctx, httpbakery.RequestVersion(req), []checkers.Caveat{{
+				Location:  discharger.Location(),
+				Condition: "is-ok",
+			}}, op)
+			c.Check(err, gc.IsNil)
+			httpbakery.WriteError(ctx, w, httpbakery.NewDischargeRequiredError(httpbakery.DischargeRequiredErrorParams{
+				Macaroon: m,
+				Request:  req,
+			}))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	// Separately created clients that share a cache, and are used
+	// concurrently, discharge only once.
+	cache := csclient.NewDischargeCache(httpbakery.NewClient())
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		client := csclient.New(csclient.Params{
+			URL:            srv.URL,
+			DischargeCache: cache,
+		})
+		c.Assert(csclient.BakeryClient(client), gc.Equals, cache.BakeryClient())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.Get("/test", nil)
+			c.Check(err, gc.IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(atomic.LoadInt32(&discharges), gc.Equals, int32(1))
+}
+
+func (s *suite) TestAgentAuthInfo(c *gc.C) {
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	client := csclient.New(csclient.Params{
+		AgentAuthInfo: &agent.AuthInfo{
+			Key: key,
+			Agents: []agent.Agent{{
+				URL:      "https://candid.example.com",
+				Username: "ci-bot@candid",
+			}},
+		},
+	})
+	bclient := csclient.BakeryClient(client)
+	c.Assert(bclient, gc.NotNil)
+	c.Assert(bclient.Key, gc.Equals, key)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Errorf("unexpected request %s %s", req.Method, req.URL)
+	}))
+	defer srv.Close()
+	// The failure to set up authentication is not retried,
+	// and does not count as a failure of the charm store.
+	retries := 0
+	breaker := csclient.NewCircuitBreaker(1, time.Hour)
+	client = csclient.New(csclient.Params{
+		URL:           srv.URL,
+		AgentAuthInfo: &agent.AuthInfo{},
+		RetryPolicy: &csclient.RetryPolicy{
+			MaxAttempts: 3,
+			Retryable: func(*http.Response, error) bool {
+				retries++
+				return true
+			},
+		},
+		CircuitBreaker: breaker,
+	})
+	err = client.Get("/whoami", nil)
+	c.Assert(err, gc.ErrorMatches, `cannot set up agent authentication: no key in auth info`)
+	c.Assert(retries, gc.Equals, 0)
+	c.Assert(breaker.Tripped(), jc.IsFalse)
+}
+
+func (s *suite) TestTLSConfig(c *gc.C) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"User":"bob"}`)
+	}))
+	defer srv.Close()
+
+	// The server certificate is not trusted by default.
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	_, err := client.WhoAmI()
+	c.Assert(err, gc.ErrorMatches, `.*certificate.*`)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	client = csclient.New(csclient.Params{
+		URL: srv.URL,
+		TLSConfig: &tls.Config{
+			RootCAs: pool,
+		},
+	})
+	resp, err := client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.User, gc.Equals, "bob")
+}
+
+func (s *suite) TestProxy(c *gc.C) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"User":"bob"}`)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	c.Assert(err, gc.IsNil)
+
+	client := csclient.New(csclient.Params{
+		URL:   "http://charmstore.example.com",
+		Proxy: http.ProxyURL(proxyURL),
+	})
+	resp, err := client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.User, gc.Equals, "bob")
+	c.Assert(proxied, jc.DeepEquals, []string{"http://charmstore.example.com/v5/whoami"})
+}
+
+func (s *suite) TestClose(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Id":"cs:xenial/wordpress-1"}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	edgeClient := client.WithChannel(params.EdgeChannel)
+	var meta params.IdResponse
+	err := client.Get("/wordpress/meta/any", &meta)
+	c.Assert(err, gc.IsNil)
+
+	err = client.Close()
+	c.Assert(err, gc.IsNil)
+	_, err = client.Meta(charm.MustParseURL("wordpress"), &meta)
+	c.Assert(err, gc.ErrorMatches, `cannot get "/wordpress/meta/any.*": client has been closed`)
+	c.Assert(errgo.Cause(err), gc.Equals, csclient.ErrClosed)
+	err = edgeClient.Get("/wordpress/meta/any", &meta)
+	c.Assert(errgo.Cause(err), gc.Equals, csclient.ErrClosed)
+
+	// Closing again is OK.
+	err = client.Close()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *suite) TestExists(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/v5/meta/any":
+			c.Check(req.URL.Query().Get("ignore-auth"), gc.Equals, "1")
+			if req.URL.Query().Get("id") == "cs:~bob/public" {
+				fmt.Fprint(w, `{"cs:~bob/public":{"Id":"cs:~bob/xenial/public-1"}}`)
+				return
+			}
+			fmt.Fprint(w, `{}`)
+		case "/v5/~bob/private/meta/any":
+			w.Header().Set("WWW-Authenticate", "Macaroon")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"Code":"macaroon discharge required","Message":"authentication required"}`)
+		case "/v5/~bob/forbidden/meta/any":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"Code":"forbidden","Message":"access denied"}`)
+		case "/v5/~bob/missing/meta/any":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"not found","Message":"no matching charm or bundle"}`)
+		case "/v5/~bob/broken/meta/any":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"Message":"database failure"}`)
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL: srv.URL,
+	})
+	tests := []struct {
+		id          string
+		expectExist bool
+		expectVis   csclient.Visibility
+	}{{
+		id:          "cs:~bob/public",
+		expectExist: true,
+		expectVis:   csclient.VisibilityReadable,
+	}, {
+		id:          "cs:~bob/private",
+		expectExist: true,
+		expectVis:   csclient.VisibilityUnauthorized,
+	}, {
+		id:          "cs:~bob/forbidden",
+		expectExist: true,
+		expectVis:   csclient.VisibilityUnauthorized,
+	}, {
+		id:        "cs:~bob/missing",
+		expectVis: csclient.VisibilityNotFound,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.id)
+		exists, vis, err := client.Exists(charm.MustParseURL(test.id))
+		c.Assert(err, gc.IsNil)
+		c.Assert(exists, gc.Equals, test.expectExist)
+		c.Assert(vis, gc.Equals, test.expectVis)
+	}
+	_, _, err := client.Exists(charm.MustParseURL("cs:~bob/broken"))
+	c.Assert(err, gc.ErrorMatches, `cannot determine whether entity exists: database failure`)
+}
+
+func (s *suite) TestCheckPublish(c *gc.C) {
+	puts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/v5/~bob/xenial/wordpress-1/meta/resources":
+			c.Check(req.URL.Query().Get("channel"), gc.Equals, "unpublished")
+			fmt.Fprint(w, `[{"Name":"data","Revision":-1},{"Name":"image","Revision":-1},{"Name":"extra","Revision":-1}]`)
+		case req.Method == "GET" && req.URL.Path == "/v5/~bob/xenial/wordpress-1/meta/resources/data/2":
+			fmt.Fprint(w, `{"Name":"data","Revision":2}`)
+		case req.Method == "GET" && req.URL.Path == "/v5/~bob/xenial/wordpress-1/meta/resources/image/5":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"not found","Message":"resource not found"}`)
+		case req.Method == "PUT" && req.URL.Path == "/v5/~bob/xenial/wordpress-1/publish":
+			puts++
+		default:
+			c.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{
+		URL:          srv.URL,
+		User:         "bob",
+		Password:     "secret",
+		CheckPublish: true,
+	})
+	id := charm.MustParseURL("cs:~bob/xenial/wordpress-1")
+	resources := map[string]int{
+		"data":  2,
+		"image": 5,
+		"other": 1,
+	}
+	report, err := client.CheckPublish(id, resources)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.OK(), gc.Equals, false)
+	c.Assert(report.Problems, jc.DeepEquals, []csclient.ResourceProblem{{
+		Name:     "extra",
+		Revision: -1,
+		Kind:     csclient.ResourceNotSpecified,
+	}, {
+		Name:     "image",
+		Revision: 5,
+		Kind:     csclient.ResourceRevisionNotFound,
+	}, {
+		Name:     "other",
+		Revision: 1,
+		Kind:     csclient.ResourceNotDeclared,
+	}})
+
+	err = client.Publish(id, []params.Channel{params.StableChannel}, resources)
+	c.Assert(err, gc.ErrorMatches, `cannot publish cs:~bob/xenial/wordpress-1: invalid resources \(extra: revision not specified; image/5: revision not found; other/1: not declared by charm\)`)
+	checkErr, ok := errgo.Cause(err).(*csclient.PublishCheckError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(checkErr.Report.Problems, gc.HasLen, 3)
+	c.Assert(puts, gc.Equals, 0)
+
+	report, err = client.CheckPublish(charm.MustParseURL("cs:~bob/bundle/wordpress-simple-1"), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.OK(), gc.Equals, true)
+}
+
+func (s *suite) TestGetFiles(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v5/~bob/xenial/wordpress-1/archive/metadata.yaml":
+			fmt.Fprint(w, "name: wordpress")
+		case "/v5/~bob/xenial/wordpress-1/archive/config.yaml":
+			fmt.Fprint(w, "options: {}")
+		case "/v5/~bob/xenial/wordpress-1/archive/lxd-profile.yaml":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Message":"file \"lxd-profile.yaml\" not found in the archive","Code":"not found"}`)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Message":"no matching charm or bundle","Code":"not found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	files, err := client.GetFiles(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), []string{
+		"metadata.yaml",
+		"config.yaml",
+		"lxd-profile.yaml",
+	})
+	c.Assert(err, gc.IsNil)
+	contents := make(map[string]string)
+	for path, r := range files {
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		c.Assert(err, gc.IsNil)
+		contents[path] = string(data)
+	}
+	c.Assert(contents, jc.DeepEquals, map[string]string{
+		"metadata.yaml": "name: wordpress",
+		"config.yaml":   "options: {}",
+	})
+
+	_, err = client.GetFiles(charm.MustParseURL("cs:~bob/xenial/other-1"), []string{"metadata.yaml"})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *suite) TestGetFilesResolvesIdOnce(c *gc.C) {
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, req.URL.Path)
+		mu.Unlock()
+		switch req.URL.Path {
+		case "/v5/~bob/wordpress/meta/any":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"Id":"cs:~bob/xenial/wordpress-1"}`)
+		case "/v5/~bob/xenial/wordpress-1/archive/metadata.yaml":
+			fmt.Fprint(w, "name: wordpress")
+		case "/v5/~bob/xenial/wordpress-1/archive/config.yaml":
+			fmt.Fprint(w, "options: {}")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Message":"no matching charm or bundle","Code":"not found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	files, err := client.GetFiles(charm.MustParseURL("cs:~bob/wordpress"), []string{
+		"metadata.yaml",
+		"config.yaml",
+		"metadata.yaml",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 2)
+	for _, r := range files {
+		r.Close()
+	}
+	sort.Strings(requests)
+	c.Assert(requests, jc.DeepEquals, []string{
+		"/v5/~bob/wordpress/meta/any",
+		"/v5/~bob/xenial/wordpress-1/archive/config.yaml",
+		"/v5/~bob/xenial/wordpress-1/archive/metadata.yaml",
+	})
+}
+
+func (s *suite) TestRequestId(c *gc.C) {
+	var requestIds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestIds = append(requestIds, req.Header.Get(csclient.RequestIdHeader))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"Message":"not found","Code":"not found"}`)
+	}))
+	defer srv.Close()
+
+	client := csclient.New(csclient.Params{URL: srv.URL})
+	_, err := client.WhoAmI()
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(err, gc.ErrorMatches, "not found")
+	c.Assert(requestIds, gc.HasLen, 1)
+	c.Assert(requestIds[0], gc.Not(gc.Equals), "")
+	c.Assert(csclient.ErrorRequestId(err), gc.Equals, requestIds[0])
+
+	// Each operation has its own id by default.
+	_, err = client.WhoAmI()
+	c.Assert(csclient.ErrorRequestId(err), gc.Equals, requestIds[1])
+	c.Assert(requestIds[1], gc.Not(gc.Equals), requestIds[0])
+
+	// All requests made with WithRequestId share the same id.
+	opClient := client.WithRequestId("op-1")
+	_, err = opClient.WhoAmI()
+	c.Assert(csclient.ErrorRequestId(err), gc.Equals, "op-1")
+	_, err = opClient.ListResources(charm.MustParseURL("cs:wordpress"))
+	c.Assert(csclient.ErrorRequestId(err), gc.Equals, "op-1")
+	c.Assert(requestIds[2:], jc.DeepEquals, []string{"op-1", "op-1"})
+
+	// Error responses are returned from Do as *params.Error
+	// values, recording the request id and status code.
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, gc.IsNil)
+	_, err = opClient.Do(req, "/wordpress/meta/any")
+	perr, ok := err.(*params.Error)
+	c.Assert(ok, jc.IsTrue, gc.Commentf("error %#v", err))
+	c.Assert(perr.Code, gc.Equals, params.ErrNotFound)
+	c.Assert(perr.RequestId, gc.Equals, "op-1")
+	c.Assert(perr.StatusCode, gc.Equals, http.StatusNotFound)
+	c.Assert(csclient.ErrorStatusCode(err), gc.Equals, http.StatusNotFound)
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclientest // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// GetArchive implements csclient.Interface.GetArchive.
+func (c *Client) GetArchive(id *charm.URL) (r io.ReadCloser, eid *charm.URL, hash string, size int64, err error) {
+	if err := c.call("GetArchive", id); err != nil {
+		return nil, nil, "", 0, err
+	}
+	data, err := c.archiveData(id)
+	if err != nil {
+		return nil, nil, "", 0, errgo.Mask(err, errgo.Any)
+	}
+	return data.ReadCloser, data.Id, data.Hash, data.Size, nil
+}
+
+// GetArchiveData implements csclient.Interface.GetArchiveData.
+func (c *Client) GetArchiveData(id *charm.URL) (*csclient.ArchiveData, error) {
+	if err := c.call("GetArchiveData", id); err != nil {
+		return nil, err
+	}
+	return c.archiveData(id)
+}
+
+// GetArchiveWithProgress implements csclient.Interface.GetArchiveWithProgress.
+func (c *Client) GetArchiveWithProgress(id *charm.URL, progress csclient.Progress) (r io.ReadCloser, eid *charm.URL, hash string, size int64, err error) {
+	if err := c.call("GetArchiveWithProgress", id, progress); err != nil {
+		return nil, nil, "", 0, err
+	}
+	data, err := c.archiveData(id)
+	if err != nil {
+		return nil, nil, "", 0, errgo.Mask(err, errgo.Any)
+	}
+	r = data.ReadCloser
+	if progress != nil {
+		progress.Start("", time.Time{})
+		r = &progressReader{
+			ReadCloser: r,
+			progress:   progress,
+		}
+	}
+	return r, data.Id, data.Hash, data.Size, nil
+}
+
+// WriteArchiveTo implements csclient.Interface.WriteArchiveTo.
+func (c *Client) WriteArchiveTo(id *charm.URL, w io.Writer) (eid *charm.URL, hash string, err error) {
+	if err := c.call("WriteArchiveTo", id, w); err != nil {
+		return nil, "", err
+	}
+	data, err := c.archiveData(id)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Any)
+	}
+	defer data.Close()
+	if _, err := io.Copy(w, data); err != nil {
+		return nil, "", errgo.Notef(err, "cannot write entity archive")
+	}
+	return data.Id, data.Hash, nil
+}
+
+// GetFileFromArchive implements csclient.Interface.GetFileFromArchive.
+func (c *Client) GetFileFromArchive(id *charm.URL, filename string) (io.ReadCloser, error) {
+	if err := c.call("GetFileFromArchive", id, filename); err != nil {
+		return nil, err
+	}
+	return c.fileFromArchive(id, filename)
+}
+
+// GetFiles implements csclient.Interface.GetFiles.
+func (c *Client) GetFiles(id *charm.URL, paths []string) (map[string]io.ReadCloser, error) {
+	if err := c.call("GetFiles", id, paths); err != nil {
+		return nil, err
+	}
+	files := make(map[string]io.ReadCloser)
+	for _, path := range paths {
+		r, err := c.fileFromArchive(id, path)
+		if err == nil {
+			files[path] = r
+			continue
+		}
+		if errgo.Cause(err) == params.ErrNotFound && c.exists(id) {
+			continue
+		}
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return files, nil
+}
+
+// Manifest implements csclient.Interface.Manifest.
+func (c *Client) Manifest(id *charm.URL) ([]params.ManifestFile, error) {
+	if err := c.call("Manifest", id); err != nil {
+		return nil, err
+	}
+	zr, err := c.zipReader(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var files []params.ManifestFile
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		files = append(files, params.ManifestFile{
+			Name: f.Name,
+			Size: int64(f.UncompressedSize64),
+		})
+	}
+	return files, nil
+}
+
+// archiveData returns the archive for the entity with the given id.
+func (c *Client) archiveData(id *charm.URL) (*csclient.ArchiveData, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return &csclient.ArchiveData{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(e.archive)),
+		Id:         e.id,
+		Hash:       e.hash,
+		Size:       int64(len(e.archive)),
+	}, nil
+}
+
+// exists reports whether the entity with the given id exists.
+func (c *Client) exists(id *charm.URL) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.resolve(id, c.channel())
+	return err == nil
+}
+
+// zipReader returns a reader for the archive of
+// the entity with the given id.
+func (c *Client) zipReader(id *charm.URL) (*zip.Reader, error) {
+	c.mu.Lock()
+	e, err := c.resolve(id, c.channel())
+	c.mu.Unlock()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(e.archive), int64(len(e.archive)))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive")
+	}
+	return zr, nil
+}
+
+// fileFromArchive returns the contents of the given file in the
+// archive of the entity with the given id.
+func (c *Client) fileFromArchive(id *charm.URL, filename string) (io.ReadCloser, error) {
+	zr, err := c.zipReader(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	for _, f := range zr.File {
+		if f.Name != filename || f.FileInfo().IsDir() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot open %q", filename)
+		}
+		return r, nil
+	}
+	return nil, errgo.WithCausef(nil, params.ErrNotFound, "file %q not found in the archive", filename)
+}
+
+// progressReader notifies a Progress of the
+// number of bytes read from a ReadCloser.
+type progressReader struct {
+	io.ReadCloser
+	progress csclient.Progress
+	total    int64
+}
+
+// Read implements io.Reader.Read.
+func (r *progressReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	if n > 0 {
+		r.total += int64(n)
+		r.progress.Transferred(r.total)
+	}
+	return n, err
+}
@@ -0,0 +1,371 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package csclientest provides an in-memory implementation of
+// csclient.Interface for testing code that uses the charm store.
+package csclientest // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// ErrNotImplemented is the error cause returned by the methods
+// that the fake client does not implement, such as those that
+// deal with docker resources or statistics.
+var ErrNotImplemented = errgo.New("not implemented by fake client")
+
+// Call records a call to a method of a Client.
+type Call struct {
+	// Method holds the name of the method.
+	Method string
+
+	// Args holds the arguments passed to the method.
+	Args []interface{}
+}
+
+// Client is an in-memory implementation of csclient.Interface. It
+// holds charms, bundles and resources that can be added directly
+// with AddCharm, AddBundle and AddResource or uploaded through the
+// interface methods, records every call made through the interface
+// and can be made to fail any method with SetError.
+//
+// Charm URLs are resolved much as the charm store does: a URL with a
+// revision refers to that revision regardless of channel, and
+// otherwise the entity most recently published to the client's
+// channel is used. Promulgation and permissions are not modelled.
+//
+// A Client is safe for concurrent use.
+type Client struct {
+	// Channel holds the channel used to resolve charm URLs. If it
+	// is empty, the stable channel is used, as by the charm store.
+	// It should not be changed while the client is in use.
+	Channel params.Channel
+
+	// User holds the user name returned by WhoAmI. If it is
+	// empty, WhoAmI fails as if the user were not logged in.
+	User string
+
+	mu         sync.Mutex
+	calls      []Call
+	errors     map[string]error
+	entities   []*entity
+	resources  map[resourceKey]map[int]*resource
+	commonInfo map[string]map[string]json.RawMessage
+	perms      map[permKey]params.PermResponse
+	publishSeq int
+}
+
+var _ csclient.Interface = (*Client)(nil)
+
+// entity holds a charm or bundle.
+type entity struct {
+	id      *charm.URL
+	archive []byte
+	hash    string
+
+	// Exactly one of charm and bundle is non-nil.
+	charm  charm.Charm
+	bundle charm.Bundle
+
+	// published holds the sequence number of the most recent
+	// publication of the entity to each channel.
+	published map[params.Channel]int
+
+	// resources holds the resource revisions published
+	// with the entity.
+	resources map[string]int
+
+	meta      map[string]interface{}
+	extraInfo map[string]json.RawMessage
+}
+
+// resourceKey identifies a resource. Resources are shared between
+// all the revisions of a charm.
+type resourceKey struct {
+	base string
+	name string
+}
+
+type resource struct {
+	meta params.Resource
+	data []byte
+}
+
+// NewClient returns a new client holding no entities.
+func NewClient() *Client {
+	return &Client{
+		errors:     make(map[string]error),
+		resources:  make(map[resourceKey]map[int]*resource),
+		commonInfo: make(map[string]map[string]json.RawMessage),
+		perms:      make(map[permKey]params.PermResponse),
+	}
+}
+
+// AddCharm adds the given charm with the given id, which is given the
+// next available revision if it does not specify one, and publishes
+// it to the given channels. It returns the id of the added charm. The
+// call is not recorded.
+func (c *Client) AddCharm(id *charm.URL, ch charm.Charm, channels ...params.Channel) (*charm.URL, error) {
+	data, err := archiveData(ch)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open charm archive")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.addEntity(id, data, channels)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return e.id, nil
+}
+
+// AddBundle is like AddCharm except that it adds a bundle.
+func (c *Client) AddBundle(id *charm.URL, b charm.Bundle, channels ...params.Channel) (*charm.URL, error) {
+	data, err := archiveData(b)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open bundle archive")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.addEntity(id, data, channels)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return e.id, nil
+}
+
+// AddResource adds a new revision of the named resource, which must
+// be declared by the charm with the given id, holding the given data.
+// It returns the revision of the resource. The call is not recorded.
+func (c *Client) AddResource(id *charm.URL, name string, data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rev, err := c.addResource(id, name, -1, data)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	return rev, nil
+}
+
+// SetMeta sets the metadata with the given include name (for example
+// "charm-metrics" or "extra-info/digest") for the entity with the given
+// id, overriding any value derived from the entity. The value is
+// marshaled as JSON when it is returned by Meta or BulkMeta.
+func (c *Client) SetMeta(id *charm.URL, name string, value interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, params.UnpublishedChannel)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	e.meta[name] = value
+	return nil
+}
+
+// SetError causes subsequent calls to the method with the given name
+// (for example "GetArchive") to fail with the given error. The calls
+// are still recorded. If err is nil, the method behaves normally again.
+func (c *Client) SetError(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.errors, method)
+		return
+	}
+	c.errors[method] = err
+}
+
+// Calls returns the calls made to the client, in order.
+func (c *Client) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// ResetCalls forgets the calls made to the client so far.
+func (c *Client) ResetCalls() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = nil
+}
+
+// call records a call to the given method, returning
+// the error set for the method, if any.
+func (c *Client) call(method string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, Call{
+		Method: method,
+		Args:   args,
+	})
+	return c.errors[method]
+}
+
+// channel returns the channel used to resolve URLs.
+func (c *Client) channel() params.Channel {
+	if c.Channel == params.NoChannel {
+		return params.StableChannel
+	}
+	return c.Channel
+}
+
+// archiveData returns the archive data for the given charm or bundle.
+func archiveData(e interface{}) ([]byte, error) {
+	switch e := e.(type) {
+	case interface {
+		ArchiveTo(io.Writer) error
+	}:
+		var buf bytes.Buffer
+		if err := e.ArchiveTo(&buf); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return buf.Bytes(), nil
+	case *charm.CharmArchive:
+		return ioutil.ReadFile(e.Path)
+	case *charm.BundleArchive:
+		return ioutil.ReadFile(e.Path)
+	}
+	return nil, errgo.Newf("cannot get the archive for entity type %T", e)
+}
+
+// hashOf returns the hex-encoded SHA384 hash of the given data.
+func hashOf(data []byte) string {
+	return fmt.Sprintf("%x", sha512.Sum384(data))
+}
+
+// baseKey returns the key identifying all
+// the revisions of the entity with the given id.
+func baseKey(id *charm.URL) string {
+	return id.WithRevision(-1).WithSeries("").String()
+}
+
+// notFoundError returns an error with a params.ErrNotFound
+// cause reporting that id cannot be resolved.
+func notFoundError(id *charm.URL) error {
+	return errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", id)
+}
+
+// addEntity adds an entity with the given id and archive data.
+// It must be called with c.mu held.
+func (c *Client) addEntity(id *charm.URL, data []byte, channels []params.Channel) (*entity, error) {
+	e := &entity{
+		archive:   data,
+		hash:      hashOf(data),
+		published: make(map[params.Channel]int),
+		meta:      make(map[string]interface{}),
+		extraInfo: make(map[string]json.RawMessage),
+	}
+	if id.Series == "bundle" {
+		b, err := charm.ReadBundleArchiveBytes(data)
+		if err != nil {
+			return nil, errgo.WithCausef(err, params.ErrInvalidEntity, "cannot read bundle archive")
+		}
+		e.bundle = b
+	} else {
+		ch, err := charm.ReadCharmArchiveBytes(data)
+		if err != nil {
+			return nil, errgo.WithCausef(err, params.ErrInvalidEntity, "cannot read charm archive")
+		}
+		e.charm = ch
+	}
+	if id.Revision == -1 {
+		rev := 0
+		for _, other := range c.entities {
+			if baseKey(other.id) == baseKey(id) && other.id.Revision >= rev {
+				rev = other.id.Revision + 1
+			}
+		}
+		id = id.WithRevision(rev)
+	}
+	for _, other := range c.entities {
+		if *other.id == *id {
+			return nil, errgo.WithCausef(nil, params.ErrDuplicateUpload, "%s already exists", id)
+		}
+	}
+	e.id = id
+	c.entities = append(c.entities, e)
+	c.publish(e, channels, nil)
+	return e, nil
+}
+
+// publish publishes e to the given channels with the given
+// resources. It must be called with c.mu held.
+func (c *Client) publish(e *entity, channels []params.Channel, resources map[string]int) {
+	for _, ch := range channels {
+		c.publishSeq++
+		e.published[ch] = c.publishSeq
+	}
+	if len(channels) > 0 && resources != nil {
+		e.resources = resources
+	}
+}
+
+// matches reports whether e is referred to by the given id,
+// ignoring channels.
+func (e *entity) matches(id *charm.URL) bool {
+	if e.id.Schema != id.Schema || e.id.User != id.User || e.id.Name != id.Name {
+		return false
+	}
+	if id.Revision != -1 && id.Revision != e.id.Revision {
+		return false
+	}
+	if id.Series == "" || id.Series == e.id.Series {
+		return true
+	}
+	return e.id.Series == "" && e.charm != nil && containsString(e.charm.Meta().Series, id.Series)
+}
+
+// resolve returns the entity referred to by the given id in the
+// given channel. It must be called with c.mu held.
+func (c *Client) resolve(id *charm.URL, channel params.Channel) (*entity, error) {
+	var best *entity
+	bestKey := 0
+	for _, e := range c.entities {
+		if !e.matches(id) {
+			continue
+		}
+		key := e.id.Revision + 1
+		if id.Revision == -1 && channel != params.UnpublishedChannel {
+			key = e.published[channel]
+		}
+		if key > 0 && key > bestKey {
+			best, bestKey = e, key
+		}
+	}
+	if best == nil {
+		return nil, notFoundError(id)
+	}
+	return best, nil
+}
+
+// isCurrent reports whether e is the entity most recently
+// published to the given channel. It must be called with c.mu held.
+func (c *Client) isCurrent(e *entity, channel params.Channel) bool {
+	for _, other := range c.entities {
+		if baseKey(other.id) == baseKey(e.id) && other.id.Series == e.id.Series && other.published[channel] > e.published[channel] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclientest_test // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/csclientest"
+	"github.com/juju/charmrepo/v7/csclient/params"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
+)
+
+type clientSuite struct {
+	repo *charmtesting.Repo
+}
+
+var _ = gc.Suite(&clientSuite{})
+
+const repoManifest = `
+charms:
+- name: wordpress
+  series: [xenial]
+  resources:
+    data:
+      type: file
+      filename: data.zip
+bundles:
+- name: wordpress-simple
+  applications:
+    wordpress:
+      charm: wordpress
+      num_units: 1
+`
+
+func (s *clientSuite) SetUpTest(c *gc.C) {
+	repo, err := charmtesting.GenerateRepo(c.MkDir(), strings.NewReader(repoManifest), "xenial")
+	c.Assert(err, gc.IsNil)
+	s.repo = repo
+}
+
+func (s *clientSuite) TestArchiveAndMeta(c *gc.C) {
+	client := csclientest.NewClient()
+	id, err := client.AddCharm(charm.MustParseURL("cs:~bob/xenial/wordpress"), s.repo.CharmDir("wordpress"), params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/xenial/wordpress-0")
+
+	var client1 csclient.Interface = client
+	r, eid, hash, size, err := client1.GetArchive(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(eid, gc.DeepEquals, id)
+	c.Assert(int64(len(data)), gc.Equals, size)
+	c.Assert(hash, gc.Not(gc.Equals), "")
+
+	var meta struct {
+		CharmMetadata *charm.Meta
+		IdRevision    params.IdRevisionResponse
+		Published     params.PublishedResponse
+	}
+	eid, err = client.Meta(charm.MustParseURL("cs:~bob/wordpress"), &meta)
+	c.Assert(err, gc.IsNil)
+	c.Assert(eid, gc.DeepEquals, id)
+	c.Assert(meta.CharmMetadata.Name, gc.Equals, "wordpress")
+	c.Assert(meta.IdRevision.Revision, gc.Equals, 0)
+	c.Assert(meta.Published.Info, gc.DeepEquals, []params.PublishedInfo{{
+		Channel: params.StableChannel,
+		Current: true,
+	}})
+
+	f, err := client.GetFileFromArchive(id, "metadata.yaml")
+	c.Assert(err, gc.IsNil)
+	f.Close()
+	_, err = client.GetFileFromArchive(id, "nothing")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	c.Assert(client.Calls(), gc.HasLen, 4)
+	c.Assert(client.Calls()[0], gc.DeepEquals, csclientest.Call{
+		Method: "GetArchive",
+		Args:   []interface{}{charm.MustParseURL("cs:~bob/wordpress")},
+	})
+}
+
+func (s *clientSuite) TestChannels(c *gc.C) {
+	client := csclientest.NewClient()
+	id := charm.MustParseURL("cs:~bob/xenial/wordpress")
+	id0, err := client.UploadCharm(id, s.repo.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	id1, err := client.UploadCharm(id, s.repo.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id1.Revision, gc.Equals, 1)
+
+	// Nothing has been published to the stable channel.
+	_, _, _, _, err = client.GetArchive(id)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	ok, vis, err := client.Exists(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(vis, gc.Equals, csclient.VisibilityNotFound)
+
+	// A specific revision is found whatever the channel.
+	_, eid, _, _, err := client.GetArchive(id0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(eid, gc.DeepEquals, id0)
+
+	err = client.Publish(id0, []params.Channel{params.StableChannel}, nil)
+	c.Assert(err, gc.IsNil)
+	revs, err := client.Latest([]*charm.URL{id, charm.MustParseURL("cs:~bob/xenial/other")})
+	c.Assert(err, gc.IsNil)
+	c.Assert(revs, gc.DeepEquals, []csclient.CharmRevision{{
+		Revision: 0,
+	}, {
+		Err: params.ErrNotFound,
+	}})
+
+	client.Channel = params.UnpublishedChannel
+	revs, err = client.Latest([]*charm.URL{id})
+	c.Assert(err, gc.IsNil)
+	c.Assert(revs[0].Revision, gc.Equals, 1)
+
+	client.Channel = ""
+	err = client.Unpublish(id0, []params.Channel{params.StableChannel})
+	c.Assert(err, gc.IsNil)
+	ok, _, err = client.Exists(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *clientSuite) TestResources(c *gc.C) {
+	client := csclientest.NewClient()
+	id, err := client.AddCharm(charm.MustParseURL("cs:~bob/xenial/wordpress"), s.repo.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	rev, err := client.AddResource(id, "data", []byte("first"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 0)
+	content := []byte("second")
+	rev, err = client.UploadResource(id, "data", "data.zip", bytes.NewReader(content), int64(len(content)), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 1)
+	_, err = client.AddResource(id, "other", []byte("x"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	report, err := client.CheckPublish(id, map[string]int{"data": 2})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "cs:~bob/xenial/wordpress-0: invalid resources (data/2: revision not found)")
+
+	err = client.Publish(id, []params.Channel{params.StableChannel}, map[string]int{"data": 0})
+	c.Assert(err, gc.IsNil)
+	resources, err := client.ListResources(id.WithRevision(-1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 1)
+	c.Assert(resources[0].Revision, gc.Equals, 0)
+
+	r, err := client.GetResource(id, "data", -1)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "first")
+	c.Assert(r.Size, gc.Equals, int64(5))
+
+	revisions, err := client.ResourceRevisions(id, "data")
+	c.Assert(err, gc.IsNil)
+	c.Assert(revisions, gc.HasLen, 2)
+	c.Assert(revisions[1].Size, gc.Equals, int64(len(content)))
+}
+
+func (s *clientSuite) TestBundle(c *gc.C) {
+	client := csclientest.NewClient()
+	id, err := client.AddBundle(charm.MustParseURL("cs:~bob/bundle/wordpress-simple"), s.repo.BundleDir("wordpress-simple"), params.EdgeChannel)
+	c.Assert(err, gc.IsNil)
+	client.Channel = params.EdgeChannel
+	var meta struct {
+		BundleMetadata *charm.BundleData
+	}
+	_, err = client.Meta(id.WithRevision(-1), &meta)
+	c.Assert(err, gc.IsNil)
+	c.Assert(meta.BundleMetadata.Applications, gc.HasLen, 1)
+}
+
+func (s *clientSuite) TestInfo(c *gc.C) {
+	client := csclientest.NewClient()
+	id, err := client.AddCharm(charm.MustParseURL("cs:~bob/xenial/wordpress"), s.repo.CharmDir("wordpress"), params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	err = client.PutExtraInfo(id, map[string]interface{}{"a": 1})
+	c.Assert(err, gc.IsNil)
+	var a int
+	err = client.ExtraInfoValue(id, "a", &a)
+	c.Assert(err, gc.IsNil)
+	c.Assert(a, gc.Equals, 1)
+	err = client.CommonInfoValue(id, "a", &a)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrMetadataNotFound)
+
+	err = client.SetMeta(id, "charm-metrics", map[string]string{"x": "y"})
+	c.Assert(err, gc.IsNil)
+	var meta struct {
+		ExtraInfo    map[string]int
+		CharmMetrics map[string]string
+	}
+	_, err = client.Meta(id, &meta)
+	c.Assert(err, gc.IsNil)
+	c.Assert(meta.ExtraInfo, gc.DeepEquals, map[string]int{"a": 1})
+	c.Assert(meta.CharmMetrics, gc.DeepEquals, map[string]string{"x": "y"})
+
+	raw, eid, err := client.MetaAny(id, "extra-info/a", "missing")
+	c.Assert(err, gc.IsNil)
+	c.Assert(eid, gc.DeepEquals, id)
+	c.Assert(raw, gc.HasLen, 1)
+	c.Assert(string(raw["extra-info/a"]), gc.Equals, "1")
+}
+
+func (s *clientSuite) TestPerms(c *gc.C) {
+	client := csclientest.NewClient()
+	id, err := client.AddCharm(charm.MustParseURL("cs:~bob/xenial/wordpress"), s.repo.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	perms, err := client.Perms(id, params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(perms, gc.DeepEquals, params.PermResponse{
+		Read:  []string{"bob"},
+		Write: []string{"bob"},
+	})
+	err = client.Grant(id.WithRevision(-1), params.StableChannel, csclient.ReadPermission, "everyone")
+	c.Assert(err, gc.IsNil)
+	all, err := client.AllPerms(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(all[params.StableChannel].Read, gc.DeepEquals, []string{"bob", "everyone"})
+	c.Assert(all[params.EdgeChannel].Read, gc.DeepEquals, []string{"bob"})
+}
+
+func (s *clientSuite) TestSetError(c *gc.C) {
+	client := csclientest.NewClient()
+	testErr := errgo.New("test error")
+	client.SetError("WhoAmI", testErr)
+	_, err := client.WhoAmI()
+	c.Assert(err, gc.Equals, testErr)
+
+	client.SetError("WhoAmI", nil)
+	client.User = "bob"
+	resp, err := client.WhoAmI()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.User, gc.Equals, "bob")
+	c.Assert(client.Calls(), gc.HasLen, 2)
+
+	client.ResetCalls()
+	_, err = client.Stats(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, csclientest.ErrNotImplemented)
+	c.Assert(client.Calls(), gc.HasLen, 1)
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclientest // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"io"
+
+	"github.com/juju/charm/v9"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// The fake client does not support docker resources: the methods
+// below record the call and return an error with an ErrNotImplemented
+// cause, or the error set with SetError.
+
+// AddDockerResource implements csclient.Interface.AddDockerResource.
+func (c *Client) AddDockerResource(id *charm.URL, resourceName string, imageName, digest string) (revision int, err error) {
+	if err := c.call("AddDockerResource", id, resourceName, imageName, digest); err != nil {
+		return 0, err
+	}
+	return 0, notImplemented("AddDockerResource")
+}
+
+// DockerResourceDownloadInfo implements csclient.Interface.DockerResourceDownloadInfo.
+func (c *Client) DockerResourceDownloadInfo(id *charm.URL, resourceName string, revision int) (*params.DockerInfoResponse, error) {
+	if err := c.call("DockerResourceDownloadInfo", id, resourceName, revision); err != nil {
+		return nil, err
+	}
+	return nil, notImplemented("DockerResourceDownloadInfo")
+}
+
+// DockerResourceUploadInfo implements csclient.Interface.DockerResourceUploadInfo.
+func (c *Client) DockerResourceUploadInfo(id *charm.URL, resourceName string) (*params.DockerInfoResponse, error) {
+	if err := c.call("DockerResourceUploadInfo", id, resourceName); err != nil {
+		return nil, err
+	}
+	return nil, notImplemented("DockerResourceUploadInfo")
+}
+
+// PushDockerResource implements csclient.Interface.PushDockerResource.
+func (c *Client) PushDockerResource(id *charm.URL, resourceName, path string) (revision int, err error) {
+	if err := c.call("PushDockerResource", id, resourceName, path); err != nil {
+		return 0, err
+	}
+	return 0, notImplemented("PushDockerResource")
+}
+
+// PullDockerResource implements csclient.Interface.PullDockerResource.
+func (c *Client) PullDockerResource(id *charm.URL, resourceName string, revision int, dir string) (digest string, err error) {
+	if err := c.call("PullDockerResource", id, resourceName, revision, dir); err != nil {
+		return "", err
+	}
+	return "", notImplemented("PullDockerResource")
+}
+
+// PullDockerResourceArchive implements csclient.Interface.PullDockerResourceArchive.
+func (c *Client) PullDockerResourceArchive(id *charm.URL, resourceName string, revision int, w io.Writer) (digest string, err error) {
+	if err := c.call("PullDockerResourceArchive", id, resourceName, revision, w); err != nil {
+		return "", err
+	}
+	return "", notImplemented("PullDockerResourceArchive")
+}
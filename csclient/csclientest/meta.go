@@ -0,0 +1,352 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclientest // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// Meta implements csclient.Interface.Meta.
+func (c *Client) Meta(id *charm.URL, result interface{}) (*charm.URL, error) {
+	if err := c.call("Meta", id, result); err != nil {
+		return nil, err
+	}
+	return c.meta(id, result, c.channel())
+}
+
+// MetaWithChannel implements csclient.Interface.MetaWithChannel.
+func (c *Client) MetaWithChannel(id *charm.URL, result interface{}, channel params.Channel) (*charm.URL, error) {
+	if err := c.call("MetaWithChannel", id, result, channel); err != nil {
+		return nil, err
+	}
+	if channel == params.NoChannel {
+		channel = c.channel()
+	}
+	return c.meta(id, result, channel)
+}
+
+// MetaAny implements csclient.Interface.MetaAny.
+func (c *Client) MetaAny(id *charm.URL, includes ...string) (map[string]json.RawMessage, *charm.URL, error) {
+	if err := c.call("MetaAny", id, includes); err != nil {
+		return nil, nil, err
+	}
+	eid, meta, err := c.metaValues(id, c.channel())
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	result := make(map[string]json.RawMessage)
+	for _, include := range includes {
+		if value, ok := meta[include]; ok {
+			result[include] = value
+		}
+	}
+	return result, eid, nil
+}
+
+// BulkMeta implements csclient.Interface.BulkMeta.
+func (c *Client) BulkMeta(ids []*charm.URL, result interface{}) ([]*charm.URL, error) {
+	if err := c.call("BulkMeta", ids, result); err != nil {
+		return nil, err
+	}
+	resultv := reflect.ValueOf(result)
+	resultt := resultv.Type()
+	if resultt.Kind() != reflect.Ptr || resultt.Elem().Kind() != reflect.Slice || resultt.Elem().Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected pointer to slice of struct, not %T", result)
+	}
+	slicev := reflect.MakeSlice(resultt.Elem(), len(ids), len(ids))
+	resultv.Elem().Set(slicev)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	resolved := make([]*charm.URL, len(ids))
+	for i, id := range ids {
+		eid, meta, err := c.metaValues(id, c.channel())
+		if errgo.Cause(err) == params.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if err := csclient.UnmarshalMeta(meta, slicev.Index(i).Addr().Interface()); err != nil {
+			return nil, errgo.Notef(err, "bad metadata for %q", id)
+		}
+		resolved[i] = eid
+	}
+	return resolved, nil
+}
+
+// Latest implements csclient.Interface.Latest.
+func (c *Client) Latest(curls []*charm.URL) ([]csclient.CharmRevision, error) {
+	if err := c.call("Latest", curls); err != nil {
+		return nil, err
+	}
+	if len(curls) == 0 {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	responses := make([]csclient.CharmRevision, len(curls))
+	for i, curl := range curls {
+		e, err := c.resolve(curl.WithRevision(-1), c.channel())
+		if err != nil {
+			responses[i] = csclient.CharmRevision{
+				Err: params.ErrNotFound,
+			}
+			continue
+		}
+		responses[i] = csclient.CharmRevision{
+			Revision: e.id.Revision,
+		}
+	}
+	return responses, nil
+}
+
+// Exists implements csclient.Interface.Exists. As the fake
+// client does not model permissions, an entity that exists
+// is always readable.
+func (c *Client) Exists(id *charm.URL) (bool, csclient.Visibility, error) {
+	if err := c.call("Exists", id); err != nil {
+		return false, "", err
+	}
+	if !c.exists(id) {
+		return false, csclient.VisibilityNotFound, nil
+	}
+	return true, csclient.VisibilityReadable, nil
+}
+
+// Related implements csclient.Interface.Related.
+// It always returns an error with an ErrNotImplemented cause.
+func (c *Client) Related(id *charm.URL, includes ...string) (*params.RelatedResponse, error) {
+	if err := c.call("Related", id, includes); err != nil {
+		return nil, err
+	}
+	return nil, notImplemented("Related")
+}
+
+// ExtraInfo implements csclient.Interface.ExtraInfo.
+func (c *Client) ExtraInfo(id *charm.URL, keys ...string) (map[string]json.RawMessage, error) {
+	if err := c.call("ExtraInfo", id, keys); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return selectInfo(e.extraInfo, keys), nil
+}
+
+// ExtraInfoValue implements csclient.Interface.ExtraInfoValue.
+func (c *Client) ExtraInfoValue(id *charm.URL, key string, v interface{}) error {
+	if err := c.call("ExtraInfoValue", id, key, v); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return infoValue(e.extraInfo, "extra-info", key, v)
+}
+
+// PutExtraInfo implements csclient.Interface.PutExtraInfo.
+func (c *Client) PutExtraInfo(id *charm.URL, info map[string]interface{}) error {
+	if err := c.call("PutExtraInfo", id, info); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return putInfo(e.extraInfo, info)
+}
+
+// CommonInfo implements csclient.Interface.CommonInfo.
+func (c *Client) CommonInfo(id *charm.URL, keys ...string) (map[string]json.RawMessage, error) {
+	if err := c.call("CommonInfo", id, keys); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return selectInfo(c.commonInfo[baseKey(e.id)], keys), nil
+}
+
+// CommonInfoValue implements csclient.Interface.CommonInfoValue.
+func (c *Client) CommonInfoValue(id *charm.URL, key string, v interface{}) error {
+	if err := c.call("CommonInfoValue", id, key, v); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return infoValue(c.commonInfo[baseKey(e.id)], "common-info", key, v)
+}
+
+// PutCommonInfo implements csclient.Interface.PutCommonInfo.
+func (c *Client) PutCommonInfo(id *charm.URL, info map[string]interface{}) error {
+	if err := c.call("PutCommonInfo", id, info); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	key := baseKey(e.id)
+	if c.commonInfo[key] == nil {
+		c.commonInfo[key] = make(map[string]json.RawMessage)
+	}
+	return putInfo(c.commonInfo[key], info)
+}
+
+// meta fills out result with the metadata for the entity
+// with the given id in the given channel.
+func (c *Client) meta(id *charm.URL, result interface{}, channel params.Channel) (*charm.URL, error) {
+	if result == nil {
+		return nil, fmt.Errorf("expected valid result pointer, not nil")
+	}
+	eid, meta, err := c.metaValues(id, channel)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if err := csclient.UnmarshalMeta(meta, result); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return eid, nil
+}
+
+// metaValues returns the id of the entity with the given id in the
+// given channel and all its metadata, keyed by include name.
+func (c *Client) metaValues(id *charm.URL, channel params.Channel) (*charm.URL, map[string]json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, channel)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	values := map[string]interface{}{
+		"id": params.IdResponse{
+			Id:       e.id,
+			User:     e.id.User,
+			Series:   e.id.Series,
+			Name:     e.id.Name,
+			Revision: e.id.Revision,
+		},
+		"id-revision":  params.IdRevisionResponse{Revision: e.id.Revision},
+		"id-name":      params.IdNameResponse{Name: e.id.Name},
+		"id-user":      params.IdUserResponse{User: e.id.User},
+		"id-series":    params.IdSeriesResponse{Series: e.id.Series},
+		"archive-size": params.ArchiveSizeResponse{Size: int64(len(e.archive))},
+		"hash":         params.HashResponse{Sum: e.hash},
+		"published":    c.publishedInfo(e),
+		"extra-info":   e.extraInfo,
+	}
+	for key, value := range e.extraInfo {
+		values["extra-info/"+key] = value
+	}
+	if info := c.commonInfo[baseKey(e.id)]; info != nil {
+		values["common-info"] = info
+		for key, value := range info {
+			values["common-info/"+key] = value
+		}
+	}
+	if e.charm != nil {
+		values["charm-metadata"] = e.charm.Meta()
+		values["charm-config"] = e.charm.Config()
+		values["charm-actions"] = e.charm.Actions()
+		values["resources"] = c.entityResources(e)
+		series := e.charm.Meta().Series
+		if e.id.Series != "" {
+			series = []string{e.id.Series}
+		}
+		values["supported-series"] = params.SupportedSeriesResponse{SupportedSeries: series}
+	} else {
+		values["bundle-metadata"] = e.bundle.Data()
+	}
+	for name, value := range e.meta {
+		values[name] = value
+	}
+	meta := make(map[string]json.RawMessage)
+	for name, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, nil, errgo.Notef(err, "cannot marshal %s", name)
+		}
+		meta[name] = data
+	}
+	return e.id, meta, nil
+}
+
+// publishedInfo returns the channels that e has been published
+// to. It must be called with c.mu held.
+func (c *Client) publishedInfo(e *entity) params.PublishedResponse {
+	var resp params.PublishedResponse
+	for ch := range e.published {
+		resp.Info = append(resp.Info, params.PublishedInfo{
+			Channel: ch,
+			Current: c.isCurrent(e, ch),
+		})
+	}
+	sort.Slice(resp.Info, func(i, j int) bool {
+		return resp.Info[i].Channel < resp.Info[j].Channel
+	})
+	return resp
+}
+
+// selectInfo returns the values in info with the given
+// keys, or all of info if no keys are given.
+func selectInfo(info map[string]json.RawMessage, keys []string) map[string]json.RawMessage {
+	result := make(map[string]json.RawMessage)
+	for key, value := range info {
+		if len(keys) == 0 || containsString(keys, key) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// infoValue unmarshals the value in info with the given key into v.
+func infoValue(info map[string]json.RawMessage, kind, key string, v interface{}) error {
+	data, ok := info[key]
+	if !ok {
+		return errgo.WithCausef(nil, params.ErrMetadataNotFound, "cannot get %s %q", kind, key)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errgo.Notef(err, "cannot get %s %q", kind, key)
+	}
+	return nil
+}
+
+// putInfo stores the given values in info.
+func putInfo(info map[string]json.RawMessage, values map[string]interface{}) error {
+	for key, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return errgo.Notef(err, "cannot marshal %q", key)
+		}
+		info[key] = data
+	}
+	return nil
+}
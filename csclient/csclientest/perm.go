@@ -0,0 +1,166 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclientest // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// permKey identifies the permissions of an entity in a channel.
+// As in the charm store, permissions are shared between all the
+// revisions of an entity.
+type permKey struct {
+	base    string
+	channel params.Channel
+}
+
+// Perms implements csclient.Interface.Perms. Until they are changed,
+// only the owner of an entity may read or write it.
+func (c *Client) Perms(id *charm.URL, channel params.Channel) (params.PermResponse, error) {
+	if err := c.call("Perms", id, channel); err != nil {
+		return params.PermResponse{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, err := c.permKey(id, channel)
+	if err != nil {
+		return params.PermResponse{}, errgo.Mask(err, errgo.Any)
+	}
+	return c.getPerms(key, id), nil
+}
+
+// AllPerms implements csclient.Interface.AllPerms.
+func (c *Client) AllPerms(id *charm.URL) (map[params.Channel]params.PermResponse, error) {
+	if err := c.call("AllPerms", id); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[params.Channel]params.PermResponse)
+	for _, ch := range []params.Channel{
+		params.UnpublishedChannel,
+		params.EdgeChannel,
+		params.BetaChannel,
+		params.CandidateChannel,
+		params.StableChannel,
+	} {
+		key, err := c.permKey(id, ch)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		result[ch] = c.getPerms(key, id)
+	}
+	return result, nil
+}
+
+// SetPerms implements csclient.Interface.SetPerms.
+func (c *Client) SetPerms(id *charm.URL, channel params.Channel, perms params.PermRequest) error {
+	if err := c.call("SetPerms", id, channel, perms); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, err := c.permKey(id, channel)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	c.perms[key] = params.PermResponse{
+		Read:  append([]string(nil), perms.Read...),
+		Write: append([]string(nil), perms.Write...),
+	}
+	return nil
+}
+
+// Grant implements csclient.Interface.Grant.
+func (c *Client) Grant(id *charm.URL, channel params.Channel, perm csclient.Permission, users ...string) error {
+	if err := c.call("Grant", id, channel, perm, users); err != nil {
+		return err
+	}
+	return c.changePerm(id, channel, perm, func(current []string) []string {
+		for _, u := range users {
+			if !containsString(current, u) {
+				current = append(current, u)
+			}
+		}
+		return current
+	})
+}
+
+// Revoke implements csclient.Interface.Revoke.
+func (c *Client) Revoke(id *charm.URL, channel params.Channel, perm csclient.Permission, users ...string) error {
+	if err := c.call("Revoke", id, channel, perm, users); err != nil {
+		return err
+	}
+	return c.changePerm(id, channel, perm, func(current []string) []string {
+		var result []string
+		for _, u := range current {
+			if !containsString(users, u) {
+				result = append(result, u)
+			}
+		}
+		return result
+	})
+}
+
+// changePerm sets the given permission on the entity with the given
+// id to the result of calling change with its current value.
+func (c *Client) changePerm(id *charm.URL, channel params.Channel, perm csclient.Permission, change func([]string) []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, err := c.permKey(id, channel)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	perms := c.getPerms(key, id)
+	switch perm {
+	case csclient.ReadPermission:
+		perms.Read = change(perms.Read)
+	case csclient.WritePermission:
+		perms.Write = change(perms.Write)
+	default:
+		return errgo.Newf("unknown permission %q", perm)
+	}
+	c.perms[key] = perms
+	return nil
+}
+
+// permKey returns the key for the permissions of the entity with the
+// given id in the given channel. It must be called with c.mu held.
+func (c *Client) permKey(id *charm.URL, channel params.Channel) (permKey, error) {
+	if channel == params.NoChannel {
+		channel = c.channel()
+	}
+	e, err := c.resolve(id, params.UnpublishedChannel)
+	if err != nil {
+		return permKey{}, errgo.Mask(err, errgo.Any)
+	}
+	return permKey{
+		base:    baseKey(e.id),
+		channel: channel,
+	}, nil
+}
+
+// getPerms returns a copy of the permissions with the given key,
+// defaulting to access by the owner of id only. It must be called
+// with c.mu held.
+func (c *Client) getPerms(key permKey, id *charm.URL) params.PermResponse {
+	perms, ok := c.perms[key]
+	if !ok {
+		if id.User == "" {
+			return params.PermResponse{}
+		}
+		return params.PermResponse{
+			Read:  []string{id.User},
+			Write: []string{id.User},
+		}
+	}
+	return params.PermResponse{
+		Read:  append([]string(nil), perms.Read...),
+		Write: append([]string(nil), perms.Write...),
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclientest // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// ListResources implements csclient.Interface.ListResources.
+func (c *Client) ListResources(id *charm.URL) ([]params.Resource, error) {
+	if err := c.call("ListResources", id); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return c.entityResources(e), nil
+}
+
+// ResourceMeta implements csclient.Interface.ResourceMeta.
+func (c *Client) ResourceMeta(id *charm.URL, name string, revision int) (params.Resource, error) {
+	if err := c.call("ResourceMeta", id, name, revision); err != nil {
+		return params.Resource{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, err := c.resource(id, name, revision)
+	if err != nil {
+		return params.Resource{}, errgo.Mask(err, errgo.Any)
+	}
+	return r.meta, nil
+}
+
+// ResourceRevisions implements csclient.Interface.ResourceRevisions.
+func (c *Client) ResourceRevisions(id *charm.URL, name string) ([]params.Resource, error) {
+	if err := c.call("ResourceRevisions", id, name); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, params.UnpublishedChannel)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	revs := c.resources[resourceKey{baseKey(e.id), name}]
+	if len(revs) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "resource %q not found", name)
+	}
+	resources := make([]params.Resource, 0, len(revs))
+	for _, r := range revs {
+		resources = append(resources, r.meta)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Revision < resources[j].Revision
+	})
+	return resources, nil
+}
+
+// GetResource implements csclient.Interface.GetResource.
+func (c *Client) GetResource(id *charm.URL, name string, revision int) (csclient.ResourceData, error) {
+	if err := c.call("GetResource", id, name, revision); err != nil {
+		return csclient.ResourceData{}, err
+	}
+	return c.resourceData(id, name, revision)
+}
+
+// GetResourceWithProgress implements csclient.Interface.GetResourceWithProgress.
+func (c *Client) GetResourceWithProgress(id *charm.URL, name string, revision int, progress csclient.Progress) (csclient.ResourceData, error) {
+	if err := c.call("GetResourceWithProgress", id, name, revision, progress); err != nil {
+		return csclient.ResourceData{}, err
+	}
+	data, err := c.resourceData(id, name, revision)
+	if err != nil {
+		return data, errgo.Mask(err, errgo.Any)
+	}
+	if progress != nil {
+		progress.Start("", time.Time{})
+		data.ReadCloser = &progressReader{
+			ReadCloser: data.ReadCloser,
+			progress:   progress,
+		}
+	}
+	return data, nil
+}
+
+// UploadResource implements csclient.Interface.UploadResource.
+func (c *Client) UploadResource(id *charm.URL, name, path string, file io.ReaderAt, size int64, progress csclient.Progress) (revision int, err error) {
+	if err := c.call("UploadResource", id, name, path, file, size, progress); err != nil {
+		return 0, err
+	}
+	return c.uploadResource(id, name, -1, file, size, progress)
+}
+
+// UploadResourceWithRevision implements csclient.Interface.UploadResourceWithRevision.
+func (c *Client) UploadResourceWithRevision(id *charm.URL, name string, rev int, path string, file io.ReaderAt, size int64, progress csclient.Progress) (revision int, err error) {
+	if err := c.call("UploadResourceWithRevision", id, name, rev, path, file, size, progress); err != nil {
+		return 0, err
+	}
+	return c.uploadResource(id, name, rev, file, size, progress)
+}
+
+// ResumeUploadResource implements csclient.Interface.ResumeUploadResource.
+// As the fake client does not hold multipart uploads, an error with a
+// csclient.ErrUploadNotFound cause is returned if uploadId is not empty.
+func (c *Client) ResumeUploadResource(uploadId string, id *charm.URL, resourceName, path string, content io.ReaderAt, size int64, progress csclient.Progress) (revision int, err error) {
+	if err := c.call("ResumeUploadResource", uploadId, id, resourceName, path, content, size, progress); err != nil {
+		return 0, err
+	}
+	if uploadId != "" {
+		return 0, errgo.WithCausef(nil, csclient.ErrUploadNotFound, "")
+	}
+	return c.uploadResource(id, resourceName, -1, content, size, progress)
+}
+
+// ResumeUploadResourceWithRevision implements
+// csclient.Interface.ResumeUploadResourceWithRevision. See
+// ResumeUploadResource for its treatment of uploadId.
+func (c *Client) ResumeUploadResourceWithRevision(uploadId string, id *charm.URL, resourceName string, rev int, path string, content io.ReaderAt, size int64, progress csclient.Progress) (revision int, err error) {
+	if err := c.call("ResumeUploadResourceWithRevision", uploadId, id, resourceName, rev, path, content, size, progress); err != nil {
+		return 0, err
+	}
+	if uploadId != "" {
+		return 0, errgo.WithCausef(nil, csclient.ErrUploadNotFound, "")
+	}
+	return c.uploadResource(id, resourceName, rev, content, size, progress)
+}
+
+// ListUploads implements csclient.Interface.ListUploads.
+// There are never any uploads in progress.
+func (c *Client) ListUploads() ([]params.UploadInfoResponse, error) {
+	if err := c.call("ListUploads"); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// AbortUpload implements csclient.Interface.AbortUpload. As there
+// are never any uploads in progress, it always returns an error with
+// a csclient.ErrUploadNotFound cause.
+func (c *Client) AbortUpload(uploadId string) error {
+	if err := c.call("AbortUpload", uploadId); err != nil {
+		return err
+	}
+	return errgo.WithCausef(nil, csclient.ErrUploadNotFound, "")
+}
+
+// uploadResource reads the resource content and adds it as the given
+// revision of the named resource, or the next revision if rev is -1.
+func (c *Client) uploadResource(id *charm.URL, name string, rev int, content io.ReaderAt, size int64, progress csclient.Progress) (int, error) {
+	if progress != nil {
+		progress.Start("", time.Time{})
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(content, 0, size))
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot read resource")
+	}
+	if progress != nil {
+		progress.Transferred(size)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rev, err = c.addResource(id, name, rev, data)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	return rev, nil
+}
+
+// addResource adds the given revision of the named resource, or the
+// next revision if rev is -1. It must be called with c.mu held.
+func (c *Client) addResource(id *charm.URL, name string, rev int, data []byte) (int, error) {
+	e, err := c.resolve(id, params.UnpublishedChannel)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	if e.charm == nil {
+		return 0, errgo.Newf("%s is not a charm", e.id)
+	}
+	meta, ok := e.charm.Meta().Resources[name]
+	if !ok {
+		return 0, errgo.WithCausef(nil, params.ErrNotFound, "resource %q not found in charm metadata", name)
+	}
+	key := resourceKey{baseKey(e.id), name}
+	revs := c.resources[key]
+	if revs == nil {
+		revs = make(map[int]*resource)
+		c.resources[key] = revs
+	}
+	if rev == -1 {
+		rev = 0
+		for r := range revs {
+			if r >= rev {
+				rev = r + 1
+			}
+		}
+	}
+	if _, ok := revs[rev]; ok {
+		return 0, errgo.WithCausef(nil, params.ErrDuplicateUpload, "resource %s/%d already exists", name, rev)
+	}
+	fingerprint := sha512.Sum384(data)
+	revs[rev] = &resource{
+		meta: params.Resource{
+			Name:        name,
+			Type:        meta.Type.String(),
+			Path:        meta.Path,
+			Description: meta.Description,
+			Revision:    rev,
+			Fingerprint: fingerprint[:],
+			Size:        int64(len(data)),
+		},
+		data: data,
+	}
+	return rev, nil
+}
+
+// resourceData returns the content of the given revision
+// of the named resource.
+func (c *Client) resourceData(id *charm.URL, name string, revision int) (csclient.ResourceData, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, err := c.resource(id, name, revision)
+	if err != nil {
+		return csclient.ResourceData{}, errgo.Mask(err, errgo.Any)
+	}
+	return csclient.ResourceData{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(r.data)),
+		Size:       r.meta.Size,
+		Hash:       fmt.Sprintf("%x", r.meta.Fingerprint),
+		Id:         id,
+		Name:       name,
+	}, nil
+}
+
+// resource returns the given revision of the named resource. If
+// revision is negative, the revision published with the charm is
+// returned, or the latest revision if none was published. It must be
+// called with c.mu held.
+func (c *Client) resource(id *charm.URL, name string, revision int) (*resource, error) {
+	e, err := c.resolve(id, c.channel())
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	revs := c.resources[resourceKey{baseKey(e.id), name}]
+	if revision < 0 {
+		if rev, ok := e.resources[name]; ok {
+			revision = rev
+		} else {
+			for rev := range revs {
+				if rev > revision {
+					revision = rev
+				}
+			}
+		}
+	}
+	r, ok := revs[revision]
+	if !ok {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "resource %q not found", name)
+	}
+	return r, nil
+}
+
+// entityResources returns the resources declared by the charm e, each
+// with the revision that would be returned by resource, or revision -1
+// if none has been uploaded. It must be called with c.mu held.
+func (c *Client) entityResources(e *entity) []params.Resource {
+	if e.charm == nil {
+		return nil
+	}
+	var resources []params.Resource
+	for name, meta := range e.charm.Meta().Resources {
+		r, err := c.resource(e.id, name, -1)
+		if err == nil {
+			resources = append(resources, r.meta)
+			continue
+		}
+		resources = append(resources, params.Resource{
+			Name:        name,
+			Type:        meta.Type.String(),
+			Path:        meta.Path,
+			Description: meta.Description,
+			Revision:    -1,
+		})
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Name < resources[j].Name
+	})
+	return resources
+}
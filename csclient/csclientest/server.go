@@ -0,0 +1,136 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclientest // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// Stats implements csclient.Interface.Stats.
+// It always returns an error with an ErrNotImplemented cause.
+func (c *Client) Stats(id *charm.URL) (*params.StatsResponse, error) {
+	if err := c.call("Stats", id); err != nil {
+		return nil, err
+	}
+	return nil, notImplemented("Stats")
+}
+
+// StatsUpdate implements csclient.Interface.StatsUpdate.
+// The update is recorded but has no other effect.
+func (c *Client) StatsUpdate(req params.StatsUpdateRequest) error {
+	return c.call("StatsUpdate", req)
+}
+
+// Counter implements csclient.Interface.Counter.
+// It always returns an error with an ErrNotImplemented cause.
+func (c *Client) Counter(p csclient.CounterParams) ([]params.Statistic, error) {
+	if err := c.call("Counter", p); err != nil {
+		return nil, err
+	}
+	return nil, notImplemented("Counter")
+}
+
+// Changes implements csclient.Interface.Changes.
+// It always returns an error with an ErrNotImplemented cause.
+func (c *Client) Changes(p csclient.ChangesParams) ([]params.Published, error) {
+	if err := c.call("Changes", p); err != nil {
+		return nil, err
+	}
+	return nil, notImplemented("Changes")
+}
+
+// Login implements csclient.Interface.Login.
+func (c *Client) Login() error {
+	return c.call("Login")
+}
+
+// Logout implements csclient.Interface.Logout.
+// It clears c.User.
+func (c *Client) Logout() error {
+	if err := c.call("Logout"); err != nil {
+		return err
+	}
+	c.User = ""
+	return nil
+}
+
+// WhoAmI implements csclient.Interface.WhoAmI. It returns c.User, or
+// an error with a params.ErrUnauthorized cause if that is empty.
+func (c *Client) WhoAmI() (*params.WhoAmIResponse, error) {
+	if err := c.call("WhoAmI"); err != nil {
+		return nil, err
+	}
+	if c.User == "" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "not logged in")
+	}
+	return &params.WhoAmIResponse{
+		User: c.User,
+	}, nil
+}
+
+// Log implements csclient.Interface.Log.
+// The message is recorded but has no other effect.
+func (c *Client) Log(typ params.LogType, level params.LogLevel, message string, urls ...*charm.URL) error {
+	return c.call("Log", typ, level, message, urls)
+}
+
+// GetLogs implements csclient.Interface.GetLogs.
+// It always returns an error with an ErrNotImplemented cause.
+func (c *Client) GetLogs(filter csclient.LogFilter) ([]params.LogResponse, error) {
+	if err := c.call("GetLogs", filter); err != nil {
+		return nil, err
+	}
+	return nil, notImplemented("GetLogs")
+}
+
+// ServerURL implements csclient.Interface.ServerURL.
+// It returns csclient.ServerURL.
+func (c *Client) ServerURL() string {
+	c.call("ServerURL")
+	return csclient.ServerURL
+}
+
+// ServerStatus implements csclient.Interface.ServerStatus.
+// The fake server has no status checks.
+func (c *Client) ServerStatus() (map[string]params.DebugStatus, error) {
+	if err := c.call("ServerStatus"); err != nil {
+		return nil, err
+	}
+	return map[string]params.DebugStatus{}, nil
+}
+
+// ServerInfo implements csclient.Interface.ServerInfo.
+func (c *Client) ServerInfo() (*params.DebugInfo, error) {
+	if err := c.call("ServerInfo"); err != nil {
+		return nil, err
+	}
+	return &params.DebugInfo{}, nil
+}
+
+// CheckServer implements csclient.Interface.CheckServer.
+func (c *Client) CheckServer() error {
+	return c.call("CheckServer")
+}
+
+// Notices implements csclient.Interface.Notices.
+// The fake server never sends deprecation notices.
+func (c *Client) Notices() []csclient.DeprecationNotice {
+	c.call("Notices")
+	return nil
+}
+
+// Close implements csclient.Interface.Close.
+func (c *Client) Close() error {
+	return c.call("Close")
+}
+
+// notImplemented returns an error with an ErrNotImplemented
+// cause reporting that the given method is not implemented.
+func notImplemented(method string) error {
+	return errgo.WithCausef(nil, ErrNotImplemented, "%s", method)
+}
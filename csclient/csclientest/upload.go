@@ -0,0 +1,209 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclientest // import "github.com/juju/charmrepo/v7/csclient/csclientest"
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// UploadCharm implements csclient.Interface.UploadCharm.
+func (c *Client) UploadCharm(id *charm.URL, ch charm.Charm) (*charm.URL, error) {
+	if err := c.call("UploadCharm", id, ch); err != nil {
+		return nil, err
+	}
+	if id.Revision != -1 {
+		return nil, errgo.Newf("revision specified in %q, but should not be specified", id)
+	}
+	return c.upload(id, ch, "cannot open charm archive")
+}
+
+// UploadCharmWithRevision implements csclient.Interface.UploadCharmWithRevision.
+// The promulgated revision is ignored.
+func (c *Client) UploadCharmWithRevision(id *charm.URL, ch charm.Charm, promulgatedRevision int) error {
+	if err := c.call("UploadCharmWithRevision", id, ch, promulgatedRevision); err != nil {
+		return err
+	}
+	if id.Revision == -1 {
+		return errgo.Newf("revision not specified in %q", id)
+	}
+	_, err := c.upload(id, ch, "cannot open charm archive")
+	return errgo.Mask(err, errgo.Any)
+}
+
+// UploadBundle implements csclient.Interface.UploadBundle.
+func (c *Client) UploadBundle(id *charm.URL, b charm.Bundle) (*charm.URL, error) {
+	if err := c.call("UploadBundle", id, b); err != nil {
+		return nil, err
+	}
+	if id.Revision != -1 {
+		return nil, errgo.Newf("revision specified in %q, but should not be specified", id)
+	}
+	return c.upload(id, b, "cannot open bundle archive")
+}
+
+// UploadBundleWithRevision implements csclient.Interface.UploadBundleWithRevision.
+// The promulgated revision is ignored.
+func (c *Client) UploadBundleWithRevision(id *charm.URL, b charm.Bundle, promulgatedRevision int) error {
+	if err := c.call("UploadBundleWithRevision", id, b, promulgatedRevision); err != nil {
+		return err
+	}
+	if id.Revision == -1 {
+		return errgo.Newf("revision not specified in %q", id)
+	}
+	_, err := c.upload(id, b, "cannot open bundle archive")
+	return errgo.Mask(err, errgo.Any)
+}
+
+// UploadArchive implements csclient.Interface.UploadArchive.
+// The promulgated revision is ignored.
+func (c *Client) UploadArchive(id *charm.URL, body io.ReadSeeker, hash string, size int64, promulgatedRevision int, chans []params.Channel) (*charm.URL, error) {
+	if err := c.call("UploadArchive", id, body, hash, size, promulgatedRevision, chans); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, size+1))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive")
+	}
+	if int64(len(data)) != size || hashOf(data) != hash {
+		return nil, errgo.WithCausef(nil, params.ErrInvalidEntity, "archive does not match the given hash and size")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.addEntity(id, data, chans)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return e.id, nil
+}
+
+// Publish implements csclient.Interface.Publish.
+func (c *Client) Publish(id *charm.URL, channels []params.Channel, resources map[string]int) error {
+	if err := c.call("Publish", id, channels, resources); err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, params.UnpublishedChannel)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for name, rev := range resources {
+		if _, ok := c.resources[resourceKey{baseKey(e.id), name}][rev]; !ok {
+			return errgo.WithCausef(nil, params.ErrNotFound, "resource %s/%d not found", name, rev)
+		}
+	}
+	published := make(map[string]int)
+	for name, rev := range resources {
+		published[name] = rev
+	}
+	c.publish(e, channels, published)
+	return nil
+}
+
+// Unpublish implements csclient.Interface.Unpublish.
+func (c *Client) Unpublish(id *charm.URL, channels []params.Channel) error {
+	if err := c.call("Unpublish", id, channels); err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	for _, ch := range channels {
+		if ch == params.UnpublishedChannel {
+			return errgo.Newf("cannot unpublish from the %q channel", ch)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.resolve(id, params.UnpublishedChannel)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for _, ch := range channels {
+		delete(e.published, ch)
+	}
+	return nil
+}
+
+// CheckPublish implements csclient.Interface.CheckPublish.
+func (c *Client) CheckPublish(id *charm.URL, resources map[string]int) (*csclient.PublishReport, error) {
+	if err := c.call("CheckPublish", id, resources); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := &csclient.PublishReport{
+		Id: id,
+	}
+	declared := make(map[string]bool)
+	if id.Series != "bundle" {
+		e, err := c.resolve(id, params.UnpublishedChannel)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		for name := range e.charm.Meta().Resources {
+			declared[name] = true
+			if _, ok := resources[name]; !ok {
+				report.Problems = append(report.Problems, csclient.ResourceProblem{
+					Name:     name,
+					Revision: -1,
+					Kind:     csclient.ResourceNotSpecified,
+				})
+			}
+		}
+		id = e.id
+	}
+	for name, rev := range resources {
+		switch {
+		case !declared[name]:
+			report.Problems = append(report.Problems, csclient.ResourceProblem{
+				Name:     name,
+				Revision: rev,
+				Kind:     csclient.ResourceNotDeclared,
+			})
+		case rev < 0:
+			report.Problems = append(report.Problems, csclient.ResourceProblem{
+				Name:     name,
+				Revision: -1,
+				Kind:     csclient.ResourceNotSpecified,
+			})
+		case c.resources[resourceKey{baseKey(id), name}][rev] == nil:
+			report.Problems = append(report.Problems, csclient.ResourceProblem{
+				Name:     name,
+				Revision: rev,
+				Kind:     csclient.ResourceRevisionNotFound,
+			})
+		}
+	}
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Name < report.Problems[j].Name
+	})
+	return report, nil
+}
+
+// upload adds the given charm or bundle with the given id.
+func (c *Client) upload(id *charm.URL, e interface{}, errMsg string) (*charm.URL, error) {
+	data, err := archiveData(e)
+	if err != nil {
+		return nil, errgo.Notef(err, "%s", errMsg)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	added, err := c.addEntity(id, data, nil)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return added.id, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// HashAlgorithm names an algorithm used to hash archive and resource
+// content.
+type HashAlgorithm string
+
+const (
+	// SHA384 is the algorithm used by the charm store. It is
+	// reported in the Content-Sha384 response header.
+	SHA384 HashAlgorithm = "sha384"
+
+	// SHA256 is an alternative algorithm exposed by some stores and
+	// proxies. It is reported in the Content-Sha256 response header.
+	SHA256 HashAlgorithm = "sha256"
+)
+
+// defaultHashAlgorithms holds the hash algorithms accepted when
+// Params.HashAlgorithms is empty.
+var defaultHashAlgorithms = []HashAlgorithm{SHA384}
+
+// header returns the response header holding the
+// hex-encoded hash for the algorithm.
+func (a HashAlgorithm) header() string {
+	switch a {
+	case SHA384, "":
+		return params.ContentHashHeader
+	case SHA256:
+		return params.ContentSha256Header
+	}
+	return ""
+}
+
+// digestName returns the name of the algorithm
+// as used in the Want-Digest request header.
+func (a HashAlgorithm) digestName() string {
+	switch a {
+	case SHA384, "":
+		return "sha-384"
+	case SHA256:
+		return "sha-256"
+	}
+	return ""
+}
+
+// newHash returns a new hash.Hash for the algorithm.
+// The zero algorithm is treated as SHA384.
+func (a HashAlgorithm) newHash() hash.Hash {
+	if a == SHA256 {
+		return sha256.New()
+	}
+	return sha512.New384()
+}
+
+// hashAlgorithms returns the hash algorithms accepted
+// by the client, most preferred first.
+func (c *Client) hashAlgorithms() []HashAlgorithm {
+	if len(c.params.HashAlgorithms) == 0 {
+		return defaultHashAlgorithms
+	}
+	return c.params.HashAlgorithms
+}
+
+// setWantDigest sets the Want-Digest header on req to advertise the
+// content hashes accepted by the client, when any alternatives to the
+// charm store's SHA384 hash are accepted.
+func (c *Client) setWantDigest(req *http.Request) {
+	algs := c.hashAlgorithms()
+	if len(algs) == 1 && algs[0] == SHA384 {
+		return
+	}
+	names := make([]string, 0, len(algs))
+	for _, alg := range algs {
+		if name := alg.digestName(); name != "" {
+			names = append(names, name)
+		}
+	}
+	req.Header.Set("Want-Digest", strings.Join(names, ", "))
+}
+
+// responseHash returns the hex-encoded content hash found in the
+// given response headers, and the algorithm used to produce it. The
+// header for the most preferred accepted algorithm is used.
+func (c *Client) responseHash(h http.Header) (string, HashAlgorithm, error) {
+	algs := c.hashAlgorithms()
+	headers := make([]string, len(algs))
+	for i, alg := range algs {
+		headers[i] = alg.header()
+		if headers[i] == "" {
+			return "", "", errgo.Newf("unsupported hash algorithm %q", alg)
+		}
+		if hash := h.Get(headers[i]); hash != "" {
+			return hash, alg, nil
+		}
+	}
+	return "", "", errgo.Newf("no %s header found in response", strings.Join(headers, " or "))
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery"
+	"gopkg.in/errgo.v1"
+)
+
+// maxSharedDischarges holds the maximum number of times a request
+// is retried after a discharge made through a DischargeCache.
+const maxSharedDischarges = 5
+
+// DischargeCache holds the macaroons obtained when authenticating to
+// the charm store so that they can be shared by several clients, for
+// example by workers performing bulk operations concurrently. When a
+// request needs a macaroon to be discharged, only one discharge is
+// made at a time; requests that needed a discharge while another was
+// in progress are retried with its result instead of each performing
+// their own third-party discharge.
+//
+// Clients derived from a client with WithChannel or WithRequestId
+// always share its macaroons; a DischargeCache is needed only to
+// share them between clients created separately. It is safe to
+// use concurrently.
+type DischargeCache struct {
+	bclient *httpbakery.Client
+
+	// mu is held while discharging. It guards generation, which
+	// is incremented whenever a discharge succeeds.
+	mu         sync.Mutex
+	generation uint64
+}
+
+// NewDischargeCache returns a cache that uses the given bakery client,
+// and its cookie jar, to discharge and hold macaroons. If bclient is
+// nil, a client that opens a web browser to interact with the user
+// is used.
+func NewDischargeCache(bclient *httpbakery.Client) *DischargeCache {
+	if bclient == nil {
+		bclient = httpbakery.NewClient()
+		bclient.AddInteractor(httpbakery.WebBrowserInteractor{})
+	}
+	return &DischargeCache{
+		bclient: bclient,
+	}
+}
+
+// BakeryClient returns the bakery client used by the cache.
+func (c *DischargeCache) BakeryClient() *httpbakery.Client {
+	return c.bclient
+}
+
+// Do implements httpClient.Do by sending the request with the cached
+// macaroons, discharging a new macaroon if required.
+func (c *DischargeCache) Do(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		generation := c.currentGeneration()
+		resp, err := c.bclient.DoWithCustomError(req, getDischargeError)
+		derr, ok := errgo.Cause(err).(*dischargeRequiredError)
+		if !ok {
+			return resp, err
+		}
+		if i >= maxSharedDischarges {
+			return nil, errgo.Notef(derr.err, "too many (%d) discharge requests", i)
+		}
+		if err := c.discharge(req, derr.err, generation); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if err := rewindBody(req); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+}
+
+// currentGeneration returns the number of discharges made so far.
+func (c *DischargeCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// discharge resolves the given discharge-required error, which was
+// returned when the request was made after the given number of
+// discharges. If another discharge has succeeded since then, the
+// request is retried without discharging again.
+func (c *DischargeCache) discharge(req *http.Request, err error, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return nil
+	}
+	if err := c.bclient.HandleError(req.Context(), req.URL, err); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	c.generation++
+	return nil
+}
+
+// dischargeRequiredError wraps a discharge-required error so that
+// the bakery client returns it rather than discharging the macaroon.
+type dischargeRequiredError struct {
+	err error
+}
+
+// Error implements error.Error.
+func (e *dischargeRequiredError) Error() string {
+	return e.err.Error()
+}
+
+// getDischargeError is used as the custom error function for the
+// bakery client. It is like httpbakery.DefaultGetError except that
+// discharge-required errors are wrapped in a *dischargeRequiredError.
+func getDischargeError(resp *http.Response) error {
+	err := httpbakery.DefaultGetError(resp)
+	if berr, ok := errgo.Cause(err).(*httpbakery.Error); ok && berr.Code == httpbakery.ErrDischargeRequired {
+		return &dischargeRequiredError{err}
+	}
+	return err
+}
+
+// rewindBody prepares the body of req to be sent again.
+func rewindBody(req *http.Request) error {
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+		return nil
+	case req.GetBody != nil:
+		body, err := req.GetBody()
+		if err != nil {
+			return errgo.Notef(err, "cannot rewind request body")
+		}
+		req.Body = body
+		return nil
+	}
+	if seeker, ok := req.Body.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return errgo.Notef(err, "cannot rewind request body")
+		}
+		return nil
+	}
+	return errgo.New("cannot rewind request body")
+}
+
+// bakeryClient returns the bakery client used by c,
+// or nil if it does not use one.
+func (c *Client) bakeryClient() *httpbakery.Client {
+	switch bclient := c.bclient.(type) {
+	case *httpbakery.Client:
+		return bclient
+	case *DischargeCache:
+		return bclient.bclient
+	}
+	return nil
+}
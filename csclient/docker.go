@@ -0,0 +1,538 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// PushDockerResource pushes the given image to the charm store's
+// associated docker registry and then adds it as a new revision of the
+// given resource of the charm with the given id, returning the new
+// revision.
+//
+// The path may name an OCI image layout directory or a tar archive of
+// one, such as that written by "skopeo copy" with an oci-archive
+// destination, or an archive written by "docker save" (or a directory
+// holding its contents), which is converted to an OCI image. A path
+// of the form "docker-daemon:IMAGE" names an image in the local docker
+// daemon, which is read as if by "docker save"; the daemon is found
+// using the DOCKER_HOST environment variable, or at its usual unix
+// socket if that is not set. TLS connections to the daemon are not
+// supported.
+//
+// The image must be a single image, which may be a multi-platform
+// image index.
+func (c *Client) PushDockerResource(id *charm.URL, resourceName, path string) (revision int, err error) {
+	dir, cleanup, err := openImageLayout(path)
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot open image")
+	}
+	defer cleanup()
+	image, err := readImageIndex(dir)
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot read image")
+	}
+	info, err := c.DockerResourceUploadInfo(id, resourceName)
+	if err != nil {
+		return 0, errgo.Mask(err, isAPIError)
+	}
+	reg, tag, err := c.newRegistryClient(info.ImageName, info.Username, info.Password)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	if err := reg.pushManifest(dir, image, tag); err != nil {
+		return 0, errgo.Notef(err, "cannot push image to %q", info.ImageName)
+	}
+	revision, err = c.AddDockerResource(id, resourceName, "", image.Digest)
+	if err != nil {
+		return 0, errgo.Mask(err, isAPIError)
+	}
+	return revision, nil
+}
+
+// ociDescriptor holds a reference to a blob in an OCI image layout.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ociManifest holds the parts of an OCI image manifest or image
+// index that are needed to push it. Docker's equivalent formats
+// use the same fields.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    *ociDescriptor  `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// digestPattern matches a digest that can be used to name a blob.
+var digestPattern = regexp.MustCompile(`^([a-z0-9]+):([a-f0-9]+)$`)
+
+// dockerDaemonPrefix marks an image path that names
+// an image in the local docker daemon.
+const dockerDaemonPrefix = "docker-daemon:"
+
+// openImageLayout returns the OCI image layout directory for the given
+// image path, as accepted by PushDockerResource, extracting the image
+// to a temporary directory if the path names a tar archive or an image
+// in the docker daemon, and converting it if it was written by "docker
+// save". The returned cleanup function must be called when the
+// directory is no longer needed.
+func openImageLayout(path string) (dir string, cleanup func(), err error) {
+	dir, cleanup, err = readImageLayout(path)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		return dir, cleanup, nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		// Leave readImageIndex to report the missing index.
+		return dir, cleanup, nil
+	}
+	// Convert the image into a new directory rather
+	// than adding to one that we did not create.
+	ociDir, ociCleanup, err := tempImageDir()
+	if err != nil {
+		cleanup()
+		return "", nil, errgo.Mask(err)
+	}
+	err = convertDockerArchive(dir, ociDir)
+	cleanup()
+	if err != nil {
+		ociCleanup()
+		return "", nil, errgo.Notef(err, "cannot convert docker archive")
+	}
+	return ociDir, ociCleanup, nil
+}
+
+// readImageLayout returns a directory holding the contents of the
+// image at the given path, which may be in OCI image layout or "docker
+// save" format.
+func readImageLayout(path string) (dir string, cleanup func(), err error) {
+	if ref := strings.TrimPrefix(path, dockerDaemonPrefix); ref != path {
+		dir, cleanup, err := tempImageDir()
+		if err != nil {
+			return "", nil, errgo.Mask(err)
+		}
+		if err := saveDaemonImage(ref, dir); err != nil {
+			cleanup()
+			return "", nil, errgo.Notef(err, "cannot get %q from docker daemon", ref)
+		}
+		return dir, cleanup, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	if info.IsDir() {
+		return path, func() {}, nil
+	}
+	dir, cleanup, err = tempImageDir()
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	if err := extractTar(path, dir); err != nil {
+		cleanup()
+		return "", nil, errgo.Mask(err)
+	}
+	return dir, cleanup, nil
+}
+
+// tempImageDir creates a temporary directory to hold an image,
+// and returns it with a function that removes it.
+func tempImageDir() (dir string, cleanup func(), err error) {
+	dir, err = ioutil.TempDir("", "charmrepo-image")
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// extractTar extracts the regular files in the
+// tar archive at the given path into dir.
+func extractTar(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	return errgo.Mask(extractTarReader(f, dir))
+}
+
+// extractTarReader extracts the regular files in the
+// tar archive read from r into dir.
+func extractTarReader(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot read image archive")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		dst, err := archiveFilePath(dir, hdr.Name)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := writeFile(dst, tr); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+}
+
+// archiveFilePath returns the path within dir of the file with the
+// given slash-separated name from an image archive, making sure that
+// the name does not refer to a file outside dir.
+func archiveFilePath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errgo.Newf("invalid file name %q in image archive", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// writeFile writes the contents of r to a new file at the given path.
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(f.Close())
+}
+
+// readImageIndex returns the descriptor of the single
+// image held in the OCI image layout in dir.
+func readImageIndex(dir string) (ociDescriptor, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return ociDescriptor{}, errgo.Notef(err, "not an OCI image layout")
+	}
+	var index ociManifest
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ociDescriptor{}, errgo.Notef(err, "cannot unmarshal image index")
+	}
+	if len(index.Manifests) != 1 {
+		return ociDescriptor{}, errgo.Newf("image layout holds %d images, not one", len(index.Manifests))
+	}
+	return index.Manifests[0], nil
+}
+
+// blobPath returns the path of the blob with the
+// given digest in the OCI image layout in dir.
+func blobPath(dir, digest string) (string, error) {
+	m := digestPattern.FindStringSubmatch(digest)
+	if m == nil {
+		return "", errgo.Newf("invalid digest %q", digest)
+	}
+	return filepath.Join(dir, "blobs", m[1], m[2]), nil
+}
+
+// registryClient pushes images to a single repository in a docker
+// registry, authenticating with a username and password as described
+// by https://docs.docker.com/registry/spec/auth/token/.
+type registryClient struct {
+	client   *http.Client
+	url      *url.URL
+	repo     string
+	username string
+	password string
+
+	// auth holds the Authorization header to send,
+	// or the empty string before the registry has
+	// asked for authorization.
+	auth string
+}
+
+// newRegistryClient returns a client for the repository of the given
+// docker image name, and the reference (a tag or digest) that it names
+// within the repository.
+func (c *Client) newRegistryClient(imageName, username, password string) (*registryClient, string, error) {
+	i := strings.Index(imageName, "/")
+	if i == -1 {
+		return nil, "", errgo.Newf("image name %q does not include a registry host", imageName)
+	}
+	host, repo := imageName[:i], imageName[i+1:]
+	ref := "latest"
+	if j := strings.Index(repo, "@"); j != -1 {
+		repo, ref = repo[:j], repo[j+1:]
+	} else if j := strings.LastIndex(repo, ":"); j > strings.LastIndex(repo, "/") {
+		repo, ref = repo[:j], repo[j+1:]
+	}
+	scheme := "https"
+	for _, h := range c.params.InsecureRegistries {
+		if h == host {
+			scheme = "http"
+			break
+		}
+	}
+	return &registryClient{
+		client:   c.plainHTTPClient(),
+		url:      &url.URL{Scheme: scheme, Host: host},
+		repo:     repo,
+		username: username,
+		password: password,
+	}, ref, nil
+}
+
+// pushManifest pushes the manifest or image index with the given
+// descriptor, and all the blobs and manifests it refers to, from the
+// OCI image layout in dir, naming it in the registry with the given
+// reference.
+func (r *registryClient) pushManifest(dir string, d ociDescriptor, ref string) error {
+	path, err := blobPath(dir, d.Digest)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errgo.Notef(err, "cannot read manifest")
+	}
+	if strings.HasPrefix(d.Digest, "sha256:") && d.Digest != fmt.Sprintf("sha256:%x", sha256.Sum256(data)) {
+		return errgo.Newf("manifest %s does not match its digest", d.Digest)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return errgo.Notef(err, "cannot unmarshal manifest %s", d.Digest)
+	}
+	for _, child := range m.Manifests {
+		if err := r.pushManifest(dir, child, child.Digest); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if m.Config != nil {
+		if err := r.pushBlob(dir, *m.Config); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	for _, layer := range m.Layers {
+		if err := r.pushBlob(dir, layer); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	mediaType := d.MediaType
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	resp, err := r.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", r.endpoint("manifests/"+ref), bytes.NewReader(data))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return registryError(resp, "cannot put manifest %s", d.Digest)
+	}
+	return nil
+}
+
+// pushBlob pushes the blob with the given descriptor from the OCI image
+// layout in dir, unless the registry already holds it.
+func (r *registryClient) pushBlob(dir string, d ociDescriptor) error {
+	path, err := blobPath(dir, d.Digest)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp, err := r.do(func() (*http.Request, error) {
+		return http.NewRequest("HEAD", r.endpoint("blobs/"+d.Digest), nil)
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+	default:
+		return registryError(resp, "cannot check blob %s", d.Digest)
+	}
+
+	resp, err = r.do(func() (*http.Request, error) {
+		return http.NewRequest("POST", r.endpoint("blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return registryError(resp, "cannot start upload of blob %s", d.Digest)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return errgo.Notef(err, "cannot start upload of blob %s", d.Digest)
+	}
+	query := location.Query()
+	query.Set("digest", d.Digest)
+	location.RawQuery = query.Encode()
+
+	resp, err = r.do(func() (*http.Request, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot open blob")
+		}
+		req, err := http.NewRequest("PUT", location.String(), f)
+		if err != nil {
+			f.Close()
+			return nil, errgo.Mask(err)
+		}
+		req.ContentLength = d.Size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return registryError(resp, "cannot upload blob %s", d.Digest)
+	}
+	return nil
+}
+
+// endpoint returns the URL of the given
+// path within the client's repository.
+func (r *registryClient) endpoint(path string) string {
+	u := *r.url
+	u.Path = "/v2/" + r.repo + "/" + path
+	return u.String()
+}
+
+// do sends the request returned by newReq. If the registry responds
+// that authorization is required, the client obtains it and sends a
+// new request returned by newReq.
+func (r *registryClient) do(newReq func() (*http.Request, error)) (*http.Response, error) {
+	for i := 0; ; i++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if r.auth != "" {
+			req.Header.Set("Authorization", r.auth)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized || i > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := r.authorize(challenge); err != nil {
+			return nil, errgo.Notef(err, "cannot authorize with registry")
+		}
+	}
+}
+
+// challengeParamPattern matches a parameter in a
+// WWW-Authenticate challenge.
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authorize sets the client's authorization
+// to satisfy the given challenge.
+func (r *registryClient) authorize(challenge string) error {
+	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(r.username+":"+r.password))
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	switch scheme {
+	case "basic":
+		r.auth = basicAuth
+		return nil
+	case "bearer":
+	default:
+		return errgo.Newf("unsupported authorization challenge %q", challenge)
+	}
+	params := make(map[string]string)
+	for _, m := range challengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return errgo.Newf("invalid realm in authorization challenge %q", challenge)
+	}
+	query := realm.Query()
+	for _, p := range []string{"service", "scope"} {
+		if params[p] != "" {
+			query.Set(p, params[p])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Authorization", basicAuth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return registryError(resp, "cannot get token")
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return errgo.Notef(err, "cannot unmarshal token")
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errgo.New("no token in response")
+	}
+	r.auth = "Bearer " + token.Token
+	return nil
+}
+
+// registryError returns an error describing the
+// given unexpected response from a registry.
+func registryError(resp *http.Response, f string, a ...interface{}) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := fmt.Sprintf(f, a...)
+	if len(data) == 0 {
+		return errgo.Newf("%s: unexpected status %q", msg, resp.Status)
+	}
+	return errgo.Newf("%s: unexpected status %q: %s", msg, resp.Status, sizeLimit(data))
+}
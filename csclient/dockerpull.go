@@ -0,0 +1,250 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// manifestMediaTypes holds the media types of the
+// manifests and image indexes that can be pulled.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// PullDockerResource pulls the image for the given revision of the
+// given resource of the charm with the given id from its docker
+// registry, writing it as an OCI image layout in dir, which is created
+// if it does not exist. If revision is negative, the currently
+// published resource for the client's channel is pulled.
+//
+// The digest of every blob and manifest pulled is verified. The digest
+// of the image manifest (or image index) is returned.
+func (c *Client) PullDockerResource(id *charm.URL, resourceName string, revision int, dir string) (digest string, err error) {
+	info, err := c.DockerResourceDownloadInfo(id, resourceName, revision)
+	if err != nil {
+		return "", errgo.Mask(err, isAPIError)
+	}
+	reg, ref, err := c.newRegistryClient(info.ImageName, info.Username, info.Password)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errgo.Mask(err)
+	}
+	image, err := reg.pullManifest(dir, ref)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot pull image %q", info.ImageName)
+	}
+	if err := writeImageIndex(dir, image); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return image.Digest, nil
+}
+
+// PullDockerResourceArchive is like PullDockerResource except that
+// it writes the image layout to w as a tar archive.
+func (c *Client) PullDockerResourceArchive(id *charm.URL, resourceName string, revision int, w io.Writer) (digest string, err error) {
+	dir, err := ioutil.TempDir("", "charmrepo-image")
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	defer os.RemoveAll(dir)
+	digest, err = c.PullDockerResource(id, resourceName, revision, dir)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	if err := writeTar(w, dir); err != nil {
+		return "", errgo.Notef(err, "cannot write image archive")
+	}
+	return digest, nil
+}
+
+// pullManifest pulls the manifest or image index with the given
+// reference, and all the blobs and manifests it refers to, into the
+// OCI image layout in dir. It returns the descriptor of the manifest.
+func (r *registryClient) pullManifest(dir, ref string) (ociDescriptor, error) {
+	resp, err := r.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", r.endpoint("manifests/"+ref), nil)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ociDescriptor{}, registryError(resp, "cannot get manifest %s", ref)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ociDescriptor{}, errgo.Notef(err, "cannot read manifest %s", ref)
+	}
+	d := ociDescriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Size:      int64(len(data)),
+	}
+	if digestPattern.MatchString(ref) && ref != d.Digest {
+		return ociDescriptor{}, errgo.Newf("manifest %s does not match its digest", ref)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ociDescriptor{}, errgo.Notef(err, "cannot unmarshal manifest %s", ref)
+	}
+	if m.MediaType != "" {
+		d.MediaType = m.MediaType
+	}
+	for _, child := range m.Manifests {
+		if _, err := r.pullManifest(dir, child.Digest); err != nil {
+			return ociDescriptor{}, errgo.Mask(err)
+		}
+	}
+	if m.Config != nil {
+		if err := r.pullBlob(dir, *m.Config); err != nil {
+			return ociDescriptor{}, errgo.Mask(err)
+		}
+	}
+	for _, layer := range m.Layers {
+		if err := r.pullBlob(dir, layer); err != nil {
+			return ociDescriptor{}, errgo.Mask(err)
+		}
+	}
+	path, err := blobPath(dir, d.Digest)
+	if err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	return d, nil
+}
+
+// pullBlob pulls the blob with the given descriptor into the OCI image
+// layout in dir, verifying its digest and size.
+func (r *registryClient) pullBlob(dir string, d ociDescriptor) error {
+	if !strings.HasPrefix(d.Digest, "sha256:") {
+		return errgo.Newf("cannot verify blob with digest %q", d.Digest)
+	}
+	path, err := blobPath(dir, d.Digest)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		// Blobs are shared between the manifests of an image index.
+		return nil
+	}
+	resp, err := r.do(func() (*http.Request, error) {
+		return http.NewRequest("GET", r.endpoint("blobs/"+d.Digest), nil)
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return registryError(resp, "cannot get blob %s", d.Digest)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errgo.Mask(err)
+	}
+	h := sha256.New()
+	tmpPath := path + ".part"
+	if err := writeFile(tmpPath, io.TeeReader(resp.Body, h)); err != nil {
+		os.Remove(tmpPath)
+		return errgo.Notef(err, "cannot download blob %s", d.Digest)
+	}
+	if err := checkBlob(tmpPath, d, h); err != nil {
+		os.Remove(tmpPath)
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(tmpPath, path))
+}
+
+// checkBlob checks that the blob downloaded to the given path, whose
+// contents have been written to h, matches the given descriptor.
+func checkBlob(path string, d ociDescriptor, h hash.Hash) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if d.Size > 0 && info.Size() != d.Size {
+		return errgo.Newf("blob %s has size %d, not %d", d.Digest, info.Size(), d.Size)
+	}
+	if digest := fmt.Sprintf("sha256:%x", h.Sum(nil)); digest != d.Digest {
+		return errgo.Newf("blob %s does not match its digest (got %s)", d.Digest, digest)
+	}
+	return nil
+}
+
+// writeImageIndex writes the index.json and oci-layout files
+// for an OCI image layout holding the given image to dir.
+func writeImageIndex(dir string, image ociDescriptor) error {
+	index, err := json.Marshal(struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		Manifests     []ociDescriptor `json:"manifests"`
+	}{2, []ociDescriptor{image}})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644); err != nil {
+		return errgo.Mask(err)
+	}
+	layout := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	return errgo.Mask(ioutil.WriteFile(filepath.Join(dir, "oci-layout"), layout, 0644))
+}
+
+// writeTar writes the regular files in dir to w as a tar archive.
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     filepath.ToSlash(name),
+			Mode:     0644,
+			Size:     info.Size(),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return errgo.Mask(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return errgo.Mask(err)
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(tw.Close())
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Media types used in the OCI images converted from docker archives.
+const (
+	ociManifestMediaType  = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType    = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType     = "application/vnd.oci.image.layer.v1.tar"
+	ociGzipLayerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// defaultDockerHost holds the address of the docker
+// daemon used when DOCKER_HOST is not set.
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// dockerArchiveImage holds an entry in the manifest.json
+// file of an archive written by "docker save".
+type dockerArchiveImage struct {
+	Config string
+	Layers []string
+}
+
+// convertDockerArchive converts the image held in the contents of a
+// "docker save" archive in src to an OCI image layout in dst. The
+// configuration and layers are used as they are, so the image ID and
+// layer digests are unchanged.
+func convertDockerArchive(src, dst string) error {
+	data, err := ioutil.ReadFile(filepath.Join(src, "manifest.json"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var images []dockerArchiveImage
+	if err := json.Unmarshal(data, &images); err != nil {
+		return errgo.Notef(err, "cannot unmarshal manifest.json")
+	}
+	if len(images) != 1 {
+		return errgo.Newf("archive holds %d images, not one", len(images))
+	}
+	image := images[0]
+	config, err := addArchiveBlob(src, image.Config, dst)
+	if err != nil {
+		return errgo.Notef(err, "cannot add image config")
+	}
+	config.MediaType = ociConfigMediaType
+	manifest := struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Config        ociDescriptor   `json:"config"`
+		Layers        []ociDescriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        config,
+		Layers:        make([]ociDescriptor, 0, len(image.Layers)),
+	}
+	for _, name := range image.Layers {
+		layer, err := addArchiveBlob(src, name, dst)
+		if err != nil {
+			return errgo.Notef(err, "cannot add image layer")
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	d, err := addBlob(dst, bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	d.MediaType = ociManifestMediaType
+	return errgo.Mask(writeImageIndex(dst, d))
+}
+
+// addArchiveBlob adds the file with the given name in the contents of
+// a "docker save" archive in src as a blob in the OCI image layout in
+// dst, and returns its descriptor. The media type is that of a layer.
+func addArchiveBlob(src, name, dst string) (ociDescriptor, error) {
+	path, err := archiveFilePath(src, name)
+	if err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	defer f.Close()
+	return addBlob(dst, bufio.NewReader(f))
+}
+
+// addBlob adds the data read from r as a blob in the OCI image layout
+// in dir, and returns its descriptor. The media type is that of a
+// layer, compressed or not according to the data.
+func addBlob(dir string, r *bufio.Reader) (ociDescriptor, error) {
+	mediaType := ociLayerMediaType
+	if magic, _ := r.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		mediaType = ociGzipLayerMediaType
+	}
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(blobDir, ".tmp")
+	if err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	if err := f.Close(); err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	digest := fmt.Sprintf("sha256:%x", h.Sum(nil))
+	path, err := blobPath(dir, digest)
+	if err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return ociDescriptor{}, errgo.Mask(err)
+	}
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      size,
+	}, nil
+}
+
+// saveDaemonImage writes the contents of the archive of the image with
+// the given reference in the local docker daemon, as written by "docker
+// save", to dir.
+func saveDaemonImage(ref, dir string) error {
+	client, baseURL, err := dockerDaemonClient()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp, err := client.Get(baseURL + "/images/get?names=" + url.QueryEscape(ref))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Message string `json:"message"`
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err := json.Unmarshal(data, &body); err == nil && body.Message != "" {
+			return errgo.New(body.Message)
+		}
+		return errgo.Newf("unexpected status %q", resp.Status)
+	}
+	return errgo.Mask(extractTarReader(resp.Body, dir))
+}
+
+// dockerDaemonClient returns an HTTP client for the docker daemon
+// named by the DOCKER_HOST environment variable, and the base URL of
+// its API.
+func dockerDaemonClient() (*http.Client, string, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "invalid docker host %q", host)
+	}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		return &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		}, "http://docker", nil
+	case "tcp":
+		return &http.Client{}, "http://" + u.Host, nil
+	}
+	return nil, "", errgo.Newf("unsupported docker host %q", host)
+}
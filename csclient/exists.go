@@ -0,0 +1,83 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"net/http"
+
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery"
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// Visibility describes whether a charm or bundle
+// can be read by a client.
+type Visibility string
+
+const (
+	// VisibilityNotFound is used when the entity does not exist.
+	VisibilityNotFound Visibility = "not found"
+
+	// VisibilityUnauthorized is used when the entity exists
+	// but the client is not authorized to read it.
+	VisibilityUnauthorized Visibility = "unauthorized"
+
+	// VisibilityReadable is used when the entity
+	// exists and the client can read it.
+	VisibilityReadable Visibility = "readable"
+)
+
+// Exists reports whether the charm or bundle with the given id exists
+// in the client's channel, and whether the client is authorized to
+// read it. An error is returned only if this cannot be determined.
+//
+// Exists never asks for authorization: the client's existing
+// credentials are used, but no macaroons are discharged, so a
+// private entity that would be readable after logging in is
+// reported as VisibilityUnauthorized.
+func (c *Client) Exists(id *charm.URL) (bool, Visibility, error) {
+	// Entities that cannot be read are omitted from
+	// an ignore-auth request, so first look for the
+	// entity in the same way as BulkMeta.
+	var result []struct{}
+	ids, err := c.BulkMeta([]*charm.URL{id}, &result)
+	if err != nil {
+		return false, "", errgo.Mask(err, isAPIError)
+	}
+	if ids[0] != nil {
+		return true, VisibilityReadable, nil
+	}
+	// The entity either does not exist or cannot be read; an
+	// unauthorized request tells which without discharging.
+	client := c.clone()
+	client.bclient = c.plainHTTPClient()
+	var meta params.MetaAnyResponse
+	err = client.Get("/"+id.Path()+"/meta/any", &meta)
+	switch cause := errgo.Cause(err); {
+	case err == nil:
+		return true, VisibilityReadable, nil
+	case cause == params.ErrNotFound:
+		return false, VisibilityNotFound, nil
+	case cause == params.ErrUnauthorized,
+		cause == params.ErrForbidden,
+		cause == params.ErrorCode(httpbakery.ErrDischargeRequired):
+		return true, VisibilityUnauthorized, nil
+	}
+	return false, "", errgo.NoteMask(err, "cannot determine whether entity exists", isAPIError)
+}
+
+// plainHTTPClient returns an HTTP client that sends requests with
+// the same cookies and transport as the client but does not discharge
+// macaroons. If the client has no bakery client, the returned client
+// uses the TLS configuration and proxy in the client's parameters.
+func (c *Client) plainHTTPClient() *http.Client {
+	if bclient := c.bakeryClient(); bclient != nil && bclient.Client != nil {
+		return bclient.Client
+	}
+	return &http.Client{
+		Transport: newTransport(c.params),
+	}
+}
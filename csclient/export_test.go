@@ -3,6 +3,44 @@
 
 package csclient
 
+import (
+	"time"
+
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery"
+)
+
 var (
-	Hyphenate = hyphenate
+	Hyphenate     = hyphenate
+	OpenArchive   = openArchive
+	EndpointLabel = endpointLabel
 )
+
+func SetCircuitBreakerNow(b *CircuitBreaker, now func() time.Time) {
+	b.now = now
+}
+
+func SetRateLimiterNow(l *RateLimiter, now func() time.Time) {
+	l.now = now
+}
+
+func RateLimiterReserve(l *RateLimiter) time.Duration {
+	return l.reserve()
+}
+
+// BakeryClient returns the bakery client used by c,
+// or nil if it does not use one.
+func BakeryClient(c *Client) *httpbakery.Client {
+	return c.bakeryClient()
+}
+
+func RetryPolicyDelay(p *RetryPolicy, attempt int) time.Duration {
+	return p.delay(attempt)
+}
+
+// SetLogBufferError sets the error recorded from sending
+// the messages in b in the background.
+func SetLogBufferError(b *LogBuffer, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
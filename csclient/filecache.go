@@ -0,0 +1,108 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/juju/charm/v9"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// maxCachedFileSize holds the size of the largest archive
+// file that will be kept in an ArchiveFileCache.
+const maxCachedFileSize = 1024 * 1024
+
+// ArchiveFileCache holds the contents of files retrieved with
+// Client.GetFileFromArchive, so that repeated requests for the same
+// file in an unchanged entity do not download the file again.
+//
+// Each entry is stored with the hash of the archive of the entity it
+// was read from. Before a file is read, the hash of the entity's
+// archive is retrieved with a metadata request, and the cached
+// contents are used when the hash has not changed.
+//
+// An ArchiveFileCache may be shared between several clients
+// and is safe to use concurrently.
+type ArchiveFileCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[archiveFileKey]*list.Element
+	lru     *list.List
+}
+
+// NewArchiveFileCache returns a new cache that holds at most
+// maxEntries files, discarding the least recently used
+// entries when it is full.
+func NewArchiveFileCache(maxEntries int) *ArchiveFileCache {
+	return &ArchiveFileCache{
+		maxEntries: maxEntries,
+		entries:    make(map[archiveFileKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+type archiveFileKey struct {
+	id       string
+	channel  params.Channel
+	filename string
+}
+
+type archiveFileEntry struct {
+	key       archiveFileKey
+	validator string
+	data      []byte
+}
+
+func newArchiveFileKey(id *charm.URL, channel params.Channel, filename string) archiveFileKey {
+	return archiveFileKey{
+		id:       id.String(),
+		channel:  channel,
+		filename: filename,
+	}
+}
+
+// get returns the cache entry with the given key, or nil if there is
+// none. It is OK to call get on a nil cache.
+func (c *ArchiveFileCache) get(key archiveFileKey) *archiveFileEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*archiveFileEntry)
+}
+
+// add adds the given entry to the cache, replacing any
+// existing entry with the same key.
+func (c *ArchiveFileCache) add(entry *archiveFileEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*archiveFileEntry).key)
+	}
+}
+
+// Len returns the number of files held in the cache.
+func (c *ArchiveFileCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
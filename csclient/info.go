@@ -0,0 +1,100 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// ExtraInfo returns the extra-info data for the given id. If any keys
+// are given, only the values with those keys are returned; keys without
+// a value are omitted from the result.
+//
+// The values can be decoded with DecodeInfo or json.Unmarshal.
+func (c *Client) ExtraInfo(id *charm.URL, keys ...string) (map[string]json.RawMessage, error) {
+	return c.getInfo(id, "extra-info", keys)
+}
+
+// ExtraInfoValue unmarshals the extra-info value with the given key for
+// the given id into the value pointed to by v. If there is no such
+// value, an error with a params.ErrMetadataNotFound cause is returned.
+func (c *Client) ExtraInfoValue(id *charm.URL, key string, v interface{}) error {
+	return c.getInfoValue(id, "extra-info", key, v)
+}
+
+// CommonInfo returns the common-info data for the given id, which is
+// shared between all revisions of the entity. If any keys are given,
+// only the values with those keys are returned; keys without a value
+// are omitted from the result.
+func (c *Client) CommonInfo(id *charm.URL, keys ...string) (map[string]json.RawMessage, error) {
+	return c.getInfo(id, "common-info", keys)
+}
+
+// CommonInfoValue unmarshals the common-info value with the given key
+// for the given id into the value pointed to by v. If there is no such
+// value, an error with a params.ErrMetadataNotFound cause is returned.
+func (c *Client) CommonInfoValue(id *charm.URL, key string, v interface{}) error {
+	return c.getInfoValue(id, "common-info", key, v)
+}
+
+// DecodeInfo decodes info, as returned by ExtraInfo or CommonInfo,
+// into the value pointed to by v, which is usually a pointer to a
+// struct with a field for each key of interest. The fields are
+// matched to the keys as by json.Unmarshal.
+func DecodeInfo(info map[string]json.RawMessage, v interface{}) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errgo.Notef(err, "cannot decode info")
+	}
+	return nil
+}
+
+// getInfo returns the values held in the given kind of info
+// (for example "extra-info") for the given id. If keys is not
+// empty, only those keys are returned.
+func (c *Client) getInfo(id *charm.URL, kind string, keys []string) (map[string]json.RawMessage, error) {
+	if len(keys) == 0 {
+		var result map[string]json.RawMessage
+		if err := c.Get("/"+id.Path()+"/meta/"+kind, &result); err != nil {
+			return nil, errgo.NoteMask(err, "cannot get "+kind, isAPIError)
+		}
+		if result == nil {
+			result = make(map[string]json.RawMessage)
+		}
+		return result, nil
+	}
+	values := url.Values{}
+	for _, key := range keys {
+		values.Add("include", kind+"/"+key)
+	}
+	var rawResult rawMetaResponse
+	if err := c.Get("/"+id.Path()+"/meta/any?"+values.Encode(), &rawResult); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get "+kind, isAPIError)
+	}
+	result := make(map[string]json.RawMessage)
+	for name, value := range rawResult.Meta {
+		if key := strings.TrimPrefix(name, kind+"/"); key != name {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+// getInfoValue unmarshals the value with the given key
+// in the given kind of info for id into v.
+func (c *Client) getInfoValue(id *charm.URL, kind, key string, v interface{}) error {
+	if err := c.Get("/"+id.Path()+"/meta/"+kind+"/"+key, v); err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot get %s %q", kind, key), isAPIError)
+	}
+	return nil
+}
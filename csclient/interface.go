@@ -0,0 +1,124 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// Interface holds the charm store operations provided by Client, so
+// that code using a client can be tested with a fake implementation
+// such as the one in the csclientest package.
+//
+// It does not include the methods that derive new clients or change
+// their settings (for example WithChannel and SetHTTPHeader), the
+// methods that make raw API requests (for example Get and Do), or
+// Search, as their results are tied to the concrete client.
+type Interface interface {
+	// Archives.
+	GetArchive(id *charm.URL) (r io.ReadCloser, eid *charm.URL, hash string, size int64, err error)
+	GetArchiveData(id *charm.URL) (*ArchiveData, error)
+	GetArchiveWithProgress(id *charm.URL, progress Progress) (r io.ReadCloser, eid *charm.URL, hash string, size int64, err error)
+	WriteArchiveTo(id *charm.URL, w io.Writer) (eid *charm.URL, hash string, err error)
+	GetFileFromArchive(id *charm.URL, filename string) (io.ReadCloser, error)
+	GetFiles(id *charm.URL, paths []string) (map[string]io.ReadCloser, error)
+	Manifest(id *charm.URL) ([]params.ManifestFile, error)
+
+	// Metadata.
+	Meta(id *charm.URL, result interface{}) (*charm.URL, error)
+	MetaWithChannel(id *charm.URL, result interface{}, channel params.Channel) (*charm.URL, error)
+	MetaAny(id *charm.URL, includes ...string) (map[string]json.RawMessage, *charm.URL, error)
+	BulkMeta(ids []*charm.URL, result interface{}) ([]*charm.URL, error)
+	Latest(curls []*charm.URL) ([]CharmRevision, error)
+	Exists(id *charm.URL) (bool, Visibility, error)
+	Related(id *charm.URL, includes ...string) (*params.RelatedResponse, error)
+	ExtraInfo(id *charm.URL, keys ...string) (map[string]json.RawMessage, error)
+	ExtraInfoValue(id *charm.URL, key string, v interface{}) error
+	PutExtraInfo(id *charm.URL, info map[string]interface{}) error
+	CommonInfo(id *charm.URL, keys ...string) (map[string]json.RawMessage, error)
+	CommonInfoValue(id *charm.URL, key string, v interface{}) error
+	PutCommonInfo(id *charm.URL, info map[string]interface{}) error
+
+	// Uploading and publishing.
+	UploadCharm(id *charm.URL, ch charm.Charm) (*charm.URL, error)
+	UploadCharmWithRevision(id *charm.URL, ch charm.Charm, promulgatedRevision int) error
+	UploadBundle(id *charm.URL, b charm.Bundle) (*charm.URL, error)
+	UploadBundleWithRevision(id *charm.URL, b charm.Bundle, promulgatedRevision int) error
+	UploadArchive(id *charm.URL, body io.ReadSeeker, hash string, size int64, promulgatedRevision int, chans []params.Channel) (*charm.URL, error)
+	Publish(id *charm.URL, channels []params.Channel, resources map[string]int) error
+	Unpublish(id *charm.URL, channels []params.Channel) error
+	CheckPublish(id *charm.URL, resources map[string]int) (*PublishReport, error)
+
+	// Permissions.
+	Perms(id *charm.URL, channel params.Channel) (params.PermResponse, error)
+	AllPerms(id *charm.URL) (map[params.Channel]params.PermResponse, error)
+	SetPerms(id *charm.URL, channel params.Channel, perms params.PermRequest) error
+	Grant(id *charm.URL, channel params.Channel, perm Permission, users ...string) error
+	Revoke(id *charm.URL, channel params.Channel, perm Permission, users ...string) error
+
+	// Resources.
+	ListResources(id *charm.URL) ([]params.Resource, error)
+	ResourceMeta(id *charm.URL, name string, revision int) (params.Resource, error)
+	ResourceRevisions(id *charm.URL, name string) ([]params.Resource, error)
+	GetResource(id *charm.URL, name string, revision int) (ResourceData, error)
+	GetResourceWithProgress(id *charm.URL, name string, revision int, progress Progress) (ResourceData, error)
+	UploadResource(id *charm.URL, name, path string, file io.ReaderAt, size int64, progress Progress) (revision int, err error)
+	UploadResourceWithRevision(id *charm.URL, name string, rev int, path string, file io.ReaderAt, size int64, progress Progress) (revision int, err error)
+	ResumeUploadResource(uploadId string, id *charm.URL, resourceName, path string, content io.ReaderAt, size int64, progress Progress) (revision int, err error)
+	ResumeUploadResourceWithRevision(uploadId string, id *charm.URL, resourceName string, rev int, path string, content io.ReaderAt, size int64, progress Progress) (revision int, err error)
+	ListUploads() ([]params.UploadInfoResponse, error)
+	AbortUpload(uploadId string) error
+
+	// Docker resources.
+	AddDockerResource(id *charm.URL, resourceName string, imageName, digest string) (revision int, err error)
+	DockerResourceDownloadInfo(id *charm.URL, resourceName string, revision int) (*params.DockerInfoResponse, error)
+	DockerResourceUploadInfo(id *charm.URL, resourceName string) (*params.DockerInfoResponse, error)
+	PushDockerResource(id *charm.URL, resourceName, path string) (revision int, err error)
+	PullDockerResource(id *charm.URL, resourceName string, revision int, dir string) (digest string, err error)
+	PullDockerResourceArchive(id *charm.URL, resourceName string, revision int, w io.Writer) (digest string, err error)
+
+	// Statistics and changes.
+	Stats(id *charm.URL) (*params.StatsResponse, error)
+	StatsUpdate(req params.StatsUpdateRequest) error
+	Counter(p CounterParams) ([]params.Statistic, error)
+	Changes(p ChangesParams) ([]params.Published, error)
+
+	// Users and the server.
+	Login() error
+	Logout() error
+	WhoAmI() (*params.WhoAmIResponse, error)
+	Log(typ params.LogType, level params.LogLevel, message string, urls ...*charm.URL) error
+	GetLogs(filter LogFilter) ([]params.LogResponse, error)
+	ServerURL() string
+	ServerStatus() (map[string]params.DebugStatus, error)
+	ServerInfo() (*params.DebugInfo, error)
+	CheckServer() error
+	Notices() []DeprecationNotice
+	Close() error
+}
+
+var _ Interface = (*Client)(nil)
+
+// UnmarshalMeta fills out the given result, which must be a pointer to
+// a struct as accepted by Client.Meta, from the given metadata keyed
+// by include name, as returned from the charm store in response to a
+// meta/any request. It is useful for implementations of Interface.
+func UnmarshalMeta(meta map[string]json.RawMessage, result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Struct {
+		return errgo.Newf("expected pointer to struct, not %T", result)
+	}
+	fields, err := metaFields(resultv.Type().Elem())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return unmarshalMeta(resultv.Elem(), fields, meta)
+}
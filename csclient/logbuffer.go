@@ -0,0 +1,185 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+const (
+	defaultLogFlushInterval = 10 * time.Second
+	defaultLogBatchSize     = 100
+)
+
+// LogBufferParams holds parameters for a LogBuffer.
+type LogBufferParams struct {
+	// FlushInterval holds the longest time that a log entry is
+	// buffered before it is sent. If it is zero, 10 seconds is used.
+	FlushInterval time.Duration
+
+	// BatchSize holds the number of buffered entries that causes
+	// them to be sent straight away. If it is zero, 100 is used.
+	BatchSize int
+}
+
+// LogBuffer coalesces log messages and sends them to the charm
+// store's log database in batches, reducing the number of requests
+// made by callers that log frequently. Buffered messages are sent
+// when the flush interval has elapsed since the first of them was
+// logged, when the batch size is reached, and when Flush or Close is
+// called.
+//
+// Errors sending messages in the background are returned from the
+// next call to Log, Flush or Close. A LogBuffer is closed when the
+// client that created it is closed. A LogBuffer is safe for concurrent
+// use.
+type LogBuffer struct {
+	client *Client
+	params LogBufferParams
+
+	// sendMu is held while sending logs, so that
+	// batches are sent in order.
+	sendMu sync.Mutex
+
+	// mu guards the fields below.
+	mu     sync.Mutex
+	logs   []params.Log
+	timer  *time.Timer
+	err    error
+	closed bool
+}
+
+// NewLogBuffer returns a LogBuffer that sends log messages
+// with the client. It should be closed after use.
+func (c *Client) NewLogBuffer(p LogBufferParams) *LogBuffer {
+	if p.FlushInterval <= 0 {
+		p.FlushInterval = defaultLogFlushInterval
+	}
+	if p.BatchSize <= 0 {
+		p.BatchSize = defaultLogBatchSize
+	}
+	b := &LogBuffer{
+		client: c,
+		params: p,
+	}
+	b.closed = !c.closer.addLogBuffer(b)
+	return b
+}
+
+// Log adds a log message to the buffer. It is like Client.Log except
+// that the message is usually sent later. If the batch size has been
+// reached, the buffered messages are sent before Log returns.
+func (b *LogBuffer) Log(typ params.LogType, level params.LogLevel, message string, urls ...*charm.URL) error {
+	log, err := newLog(typ, level, message, urls)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errgo.Newf("log buffer is closed")
+	}
+	if err := b.takeError(); err != nil {
+		b.mu.Unlock()
+		return errgo.Mask(err, errgo.Any)
+	}
+	b.logs = append(b.logs, log)
+	full := len(b.logs) >= b.params.BatchSize
+	if !full && b.timer == nil {
+		b.timer = time.AfterFunc(b.params.FlushInterval, b.flushInBackground)
+	}
+	b.mu.Unlock()
+	if full {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush sends any buffered log messages. It returns any error
+// encountered sending them or sending messages in the background
+// since the last call to Log, Flush or Close. The buffered messages
+// are sent even when an earlier send failed.
+func (b *LogBuffer) Flush() error {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	b.mu.Lock()
+	logs := b.take()
+	prevErr := b.takeError()
+	b.mu.Unlock()
+	err := b.send(logs)
+	switch {
+	case err != nil && prevErr != nil:
+		return errgo.WithCausef(nil, errgo.Cause(err), "%v (earlier error: %v)", err, prevErr)
+	case err != nil:
+		return errgo.Mask(err, errgo.Any)
+	case prevErr != nil:
+		return errgo.Mask(prevErr, errgo.Any)
+	}
+	return nil
+}
+
+// Close flushes the buffer and stops any background sending.
+// Subsequent calls to Log will fail.
+func (b *LogBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.client.closer.removeLogBuffer(b)
+	return b.Flush()
+}
+
+// flushInBackground is called when the flush interval has
+// elapsed. Any error is saved to be returned later.
+func (b *LogBuffer) flushInBackground() {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	b.mu.Lock()
+	logs := b.take()
+	b.mu.Unlock()
+	if err := b.send(logs); err != nil {
+		b.mu.Lock()
+		if b.err == nil {
+			b.err = err
+		}
+		b.mu.Unlock()
+	}
+}
+
+// take removes and returns the buffered logs.
+// It must be called with b.mu held.
+func (b *LogBuffer) take() []params.Log {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	logs := b.logs
+	b.logs = nil
+	return logs
+}
+
+// takeError clears and returns any error saved from sending logs in
+// the background. It must be called with b.mu held.
+func (b *LogBuffer) takeError() error {
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// send sends the given logs, if any.
+// It must be called with b.sendMu held.
+func (b *LogBuffer) send(logs []params.Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	if err := b.client.sendLogs(logs); err != nil {
+		return errgo.NoteMask(err, "cannot send log messages", isAPIError)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// Logger is implemented by values that log the requests made by a
+// Client. See Params.Logger.
+type Logger interface {
+	// Log is called with each record. It may be called concurrently.
+	Log(r LogRecord)
+}
+
+// LogEvent identifies the kind of a LogRecord.
+type LogEvent string
+
+const (
+	// LogRequest is logged when an attempt to send
+	// a request has completed, successfully or not.
+	LogRequest LogEvent = "request"
+
+	// LogRetry is logged when a request is
+	// about to be retried after a failed attempt.
+	LogRetry LogEvent = "retry"
+)
+
+// LogRecord holds information about a request made by a client.
+type LogRecord struct {
+	// Event holds the kind of record.
+	Event LogEvent
+
+	// Method and URL hold the method and URL of the request.
+	Method string
+	URL    string
+
+	// RequestId holds the request id sent with the request.
+	RequestId string
+
+	// Attempt holds the attempt number, counting from 1. For a
+	// LogRetry record, it holds the number of the next attempt.
+	Attempt int
+
+	// StatusCode holds the status code of the response to
+	// a LogRequest record, or zero if there was no response.
+	StatusCode int
+
+	// Duration holds the time taken by a LogRequest attempt
+	// or, for a LogRetry record, the delay before retrying.
+	Duration time.Duration
+
+	// Err holds the error from a LogRequest attempt that received
+	// no response or, for a LogRetry record, the error that caused
+	// the retry, if any.
+	Err error
+}
+
+// String returns a single line description of the record.
+func (r LogRecord) String() string {
+	req := fmt.Sprintf("%s %s [%s]", r.Method, r.URL, r.RequestId)
+	switch {
+	case r.Event == LogRetry && r.Err != nil:
+		return fmt.Sprintf("retrying %s (attempt %d after %v): %v", req, r.Attempt, r.Duration, r.Err)
+	case r.Event == LogRetry:
+		return fmt.Sprintf("retrying %s (attempt %d after %v)", req, r.Attempt, r.Duration)
+	case r.Err != nil:
+		return fmt.Sprintf("%s failed after %v (attempt %d): %v", req, r.Duration, r.Attempt, r.Err)
+	}
+	return fmt.Sprintf("%s: %d %s in %v (attempt %d)", req, r.StatusCode, http.StatusText(r.StatusCode), r.Duration, r.Attempt)
+}
+
+// NewLoggoLogger returns a Logger that
+// logs records to the given logger at debug level.
+func NewLoggoLogger(logger loggo.Logger) Logger {
+	return loggoLogger{logger}
+}
+
+type loggoLogger struct {
+	logger loggo.Logger
+}
+
+// Log implements Logger.Log.
+func (l loggoLogger) Log(r LogRecord) {
+	l.logger.Debugf("%s", r)
+}
+
+// log sends the given record to the client's logger, if any.
+func (c *Client) log(r LogRecord) {
+	if c.params.Logger != nil {
+		c.params.Logger.Log(r)
+	}
+}
+
+// logRequest logs the given attempt to send the request.
+func (c *Client) logRequest(req *http.Request, attempt int, start time.Time, resp *http.Response, err error) {
+	if c.params.Logger == nil {
+		return
+	}
+	r := LogRecord{
+		Event:     LogRequest,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		RequestId: req.Header.Get(RequestIdHeader),
+		Attempt:   attempt,
+		Duration:  time.Since(start),
+		Err:       err,
+	}
+	if resp != nil {
+		r.StatusCode = resp.StatusCode
+	}
+	c.log(r)
+}
+
+// logRetry logs that the given request is being retried
+// after the given delay because of the given error.
+func (c *Client) logRetry(req *http.Request, attempt int, delay time.Duration, err error) {
+	c.log(LogRecord{
+		Event:     LogRetry,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		RequestId: req.Header.Get(RequestIdHeader),
+		Attempt:   attempt,
+		Duration:  delay,
+		Err:       err,
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// LogFilter holds the parameters for a Client.GetLogs request.
+// Zero-valued fields are ignored.
+type LogFilter struct {
+	// Type restricts the results to logs of the given type.
+	Type params.LogType
+
+	// Level restricts the results to logs of the given level.
+	Level params.LogLevel
+
+	// URLs restricts the results to logs associated
+	// with any of the given entities.
+	URLs []*charm.URL
+
+	// Limit holds the maximum number of logs returned. If it is
+	// zero, the charm store's default limit is used.
+	Limit int
+
+	// Offset holds the number of logs to skip, which
+	// can be used with Limit to page through the results.
+	Offset int
+}
+
+// GetLogs returns the log messages held in the charm store's log
+// database that match the given filter, most recent first. Usually
+// only charm store administrators are allowed to retrieve logs.
+func (c *Client) GetLogs(filter LogFilter) ([]params.LogResponse, error) {
+	if filter.Limit < 0 {
+		return nil, errgo.Newf("negative limit")
+	}
+	if filter.Offset < 0 {
+		return nil, errgo.Newf("negative offset")
+	}
+	v := url.Values{}
+	if filter.Type != "" {
+		v.Set("type", string(filter.Type))
+	}
+	if filter.Level != "" {
+		v.Set("level", string(filter.Level))
+	}
+	for _, id := range filter.URLs {
+		v.Add("id", id.String())
+	}
+	if filter.Limit > 0 {
+		v.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	if filter.Offset > 0 {
+		v.Set("skip", strconv.Itoa(filter.Offset))
+	}
+	path := "/log"
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+	var logs []params.LogResponse
+	if err := c.Get(path, &logs); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get logs", isAPIError)
+	}
+	return logs, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics is implemented by values that record metrics about the
+// requests made by a Client. See Params.Metrics.
+type Metrics interface {
+	// RequestDone is called once for each request sent to the charm
+	// store, when the response body has been closed or when the
+	// request has failed without a response. It may be called
+	// concurrently.
+	RequestDone(m RequestMetrics)
+}
+
+// RequestMetrics holds metrics about a single request.
+type RequestMetrics struct {
+	// Method holds the HTTP method of the request.
+	Method string
+
+	// Endpoint holds a label for the API endpoint requested that does
+	// not depend on the entity involved, such as "archive",
+	// "meta/any" or "upload". It is "other" for unrecognised paths.
+	Endpoint string
+
+	// StatusCode holds the status code of the response,
+	// or zero if no response was received.
+	StatusCode int
+
+	// Latency holds the time taken to receive the response
+	// headers, including any retries.
+	Latency time.Duration
+
+	// BytesSent holds the size of the request body.
+	BytesSent int64
+
+	// BytesReceived holds the number of bytes
+	// of the response body that were read.
+	BytesReceived int64
+
+	// Retries holds the number of times the request was retried.
+	Retries int
+
+	// Err holds the error if no response was received.
+	Err error
+}
+
+// globalEndpoints holds the API endpoints that
+// do not refer to a particular entity.
+var globalEndpoints = map[string]bool{
+	"changes":              true,
+	"debug":                true,
+	"delegatable-macaroon": true,
+	"list":                 true,
+	"log":                  true,
+	"logout":               true,
+	"macaroon":             true,
+	"meta":                 true,
+	"search":               true,
+	"set-auth-cookie":      true,
+	"stats":                true,
+	"upload":               true,
+	"whoami":               true,
+}
+
+// entityEndpoints holds the API endpoints
+// that follow an entity id.
+var entityEndpoints = map[string]bool{
+	"archive":                     true,
+	"diagram.svg":                 true,
+	"docker-resource-upload-info": true,
+	"expand-id":                   true,
+	"icon.svg":                    true,
+	"meta":                        true,
+	"promulgate":                  true,
+	"publish":                     true,
+	"readme":                      true,
+	"resource":                    true,
+}
+
+// endpointLabel returns the value for RequestMetrics.Endpoint
+// for a request to the given charm store API path.
+func endpointLabel(path string) string {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	elems := strings.Split(strings.Trim(path, "/"), "/")
+	if globalEndpoints[elems[0]] {
+		return metaLabel(elems)
+	}
+	for i, elem := range elems {
+		if entityEndpoints[elem] {
+			return metaLabel(elems[i:])
+		}
+	}
+	return "other"
+}
+
+// metaLabel returns the label for the given path elements,
+// starting with the endpoint, including the kind of metadata
+// for meta endpoints.
+func metaLabel(elems []string) string {
+	if elems[0] == "meta" && len(elems) > 1 {
+		return "meta/" + elems[1]
+	}
+	return elems[0]
+}
+
+// metricsBody wraps a response body to count the bytes read from
+// it, calling Metrics.RequestDone when it is closed.
+type metricsBody struct {
+	io.ReadCloser
+	metrics Metrics
+	m       RequestMetrics
+	once    sync.Once
+}
+
+// Read implements io.Reader.Read.
+func (b *metricsBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	b.m.BytesReceived += int64(n)
+	return n, err
+}
+
+// Close implements io.Closer.Close.
+func (b *metricsBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.metrics.RequestDone(b.m)
+	})
+	return err
+}
+
+// recordMetrics arranges for the metrics of the given request to
+// be recorded, if the client has a Metrics, when the body of the
+// given response is closed or, if there is no response, immediately.
+func (c *Client) recordMetrics(req *http.Request, path string, start time.Time, retries int, resp *http.Response, err error) {
+	if c.params.Metrics == nil {
+		return
+	}
+	m := RequestMetrics{
+		Method:   req.Method,
+		Endpoint: endpointLabel(path),
+		Latency:  time.Since(start),
+		Retries:  retries,
+	}
+	if req.ContentLength > 0 {
+		m.BytesSent = req.ContentLength
+	}
+	if resp == nil {
+		m.Err = err
+		c.params.Metrics.RequestDone(m)
+		return
+	}
+	m.StatusCode = resp.StatusCode
+	resp.Body = &metricsBody{
+		ReadCloser: resp.Body,
+		metrics:    c.params.Metrics,
+		m:          m,
+	}
+}
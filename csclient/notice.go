@@ -0,0 +1,120 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeprecationNotice holds a notice sent by the charm store to say
+// that the API being used is deprecated or will be withdrawn.
+type DeprecationNotice struct {
+	// Message holds a human readable description of the notice.
+	Message string
+
+	// Sunset holds the time after which the API will no longer
+	// be available, or the zero time if it was not specified.
+	Sunset time.Time
+
+	// Link holds a URL with more information, such as
+	// migration instructions, if one was provided.
+	Link string
+}
+
+// defaultNoticeMessage holds the message used for a deprecation
+// notice when the charm store does not provide one.
+const defaultNoticeMessage = "the charm store API is deprecated"
+
+// warningPattern matches the warn-code and warn-text of a
+// Warning header with the "miscellaneous persistent warning"
+// code, which charm stores use for deprecation messages.
+var warningPattern = regexp.MustCompile(`^299 \S+ "((?:[^"\\]|\\.)*)"`)
+
+// linkPattern matches a Link header value with a
+// deprecation or successor-version relation.
+var linkPattern = regexp.MustCompile(`^<([^>]*)>.*;\s*rel="?(deprecation|successor-version)"?`)
+
+// deprecationNotice returns the deprecation notice held in the given
+// response headers, or nil if there is none. It follows the Deprecation
+// and Sunset HTTP headers, using a Warning header with code 299 for the
+// message and a Link header for more information.
+func deprecationNotice(h http.Header) *DeprecationNotice {
+	var n DeprecationNotice
+	deprecated := h.Get("Deprecation") != "" && h.Get("Deprecation") != "false"
+	if sunset := h.Get("Sunset"); sunset != "" {
+		if t, err := http.ParseTime(sunset); err == nil {
+			n.Sunset = t
+			deprecated = true
+		}
+	}
+	for _, w := range h.Values("Warning") {
+		if m := warningPattern.FindStringSubmatch(w); m != nil {
+			n.Message = strings.Replace(m[1], `\"`, `"`, -1)
+			deprecated = true
+			break
+		}
+	}
+	if !deprecated {
+		return nil
+	}
+	for _, v := range h.Values("Link") {
+		for _, link := range strings.Split(v, ",") {
+			if m := linkPattern.FindStringSubmatch(strings.TrimSpace(link)); m != nil {
+				n.Link = m[1]
+				break
+			}
+		}
+	}
+	if n.Message == "" {
+		n.Message = defaultNoticeMessage
+	}
+	return &n
+}
+
+// noticeTracker records the deprecation notices seen by a client
+// and any clients derived from it.
+type noticeTracker struct {
+	mu      sync.Mutex
+	notices []DeprecationNotice
+}
+
+// add records the given notice and reports whether it
+// has not been seen before.
+func (t *noticeTracker) add(n DeprecationNotice) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, seen := range t.notices {
+		if seen == n {
+			return false
+		}
+	}
+	t.notices = append(t.notices, n)
+	return true
+}
+
+// handleNotice records any deprecation notice in the given response,
+// calling the Notice function in the client parameters the first time
+// each distinct notice is seen.
+func (c *Client) handleNotice(resp *http.Response) {
+	n := deprecationNotice(resp.Header)
+	if n == nil || !c.notices.add(*n) {
+		return
+	}
+	if c.params.Notice != nil {
+		c.params.Notice(*n)
+	}
+}
+
+// Notices returns the distinct deprecation notices that the charm store
+// has sent in response to requests made by the client or any client
+// derived from it, in the order they were first seen.
+func (c *Client) Notices() []DeprecationNotice {
+	c.notices.mu.Lock()
+	defer c.notices.mu.Unlock()
+	return append([]DeprecationNotice(nil), c.notices.notices...)
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-macaroon-bakery/macaroon-bakery/v3/httpbakery"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// Option configures a client created by NewWithOptions.
+type Option func(*options)
+
+// options holds the configuration built up by a set of Options.
+type options struct {
+	params        Params
+	channel       params.Channel
+	header        http.Header
+	statsDisabled bool
+}
+
+// NewWithOptions returns a new client that talks to the charm store at
+// the given URL, configured with the given options. If url is empty,
+// the default charm store is used. It is an alternative to New that
+// allows configuration to be added without changing existing callers;
+// any setting that has no Option can be changed with WithParams.
+//
+// For example:
+//
+//	client := csclient.NewWithOptions(storeURL,
+//		csclient.WithChannel(params.EdgeChannel),
+//		csclient.WithRetryPolicy(&csclient.RetryPolicy{MaxAttempts: 3}),
+//	)
+func NewWithOptions(url string, opts ...Option) *Client {
+	o := options{
+		params: Params{
+			URL: url,
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	client := New(o.params)
+	if o.channel != params.NoChannel {
+		client.channel = o.channel
+	}
+	if o.header != nil {
+		client.SetHTTPHeader(o.header)
+	}
+	if o.statsDisabled {
+		client.DisableStats()
+	}
+	return client
+}
+
+// WithParams returns an option that calls f to modify the Params
+// used to create the client. It can be used to change any setting.
+func WithParams(f func(p *Params)) Option {
+	return func(o *options) {
+		f(&o.params)
+	}
+}
+
+// WithChannel returns an option that sets the channel used by
+// the client, as for Client.WithChannel.
+func WithChannel(channel params.Channel) Option {
+	return func(o *options) {
+		o.channel = channel
+	}
+}
+
+// WithHTTPHeader returns an option that sets HTTP headers to send on
+// each request, as for Client.SetHTTPHeader.
+func WithHTTPHeader(header http.Header) Option {
+	return func(o *options) {
+		o.header = header.Clone()
+	}
+}
+
+// WithStatsDisabled returns an option that stops download
+// stats being incremented, as for Client.DisableStats.
+func WithStatsDisabled() Option {
+	return func(o *options) {
+		o.statsDisabled = true
+	}
+}
+
+// WithBasicAuth returns an option that sets Params.User
+// and Params.Password.
+func WithBasicAuth(user, password string) Option {
+	return func(o *options) {
+		o.params.User = user
+		o.params.Password = password
+	}
+}
+
+// WithBearerToken returns an option that sets Params.BearerToken.
+func WithBearerToken(token string) Option {
+	return func(o *options) {
+		o.params.BearerToken = token
+	}
+}
+
+// WithBakeryClient returns an option that sets Params.BakeryClient.
+func WithBakeryClient(bclient *httpbakery.Client) Option {
+	return func(o *options) {
+		o.params.BakeryClient = bclient
+	}
+}
+
+// WithDischargeCache returns an option that sets Params.DischargeCache.
+func WithDischargeCache(cache *DischargeCache) Option {
+	return func(o *options) {
+		o.params.DischargeCache = cache
+	}
+}
+
+// WithTLSConfig returns an option that sets Params.TLSConfig.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.params.TLSConfig = config
+	}
+}
+
+// WithProxy returns an option that sets Params.Proxy.
+func WithProxy(proxy func(req *http.Request) (*url.URL, error)) Option {
+	return func(o *options) {
+		o.params.Proxy = proxy
+	}
+}
+
+// WithUserAgent returns an option that sets Params.UserAgentValue.
+func WithUserAgent(value string) Option {
+	return func(o *options) {
+		o.params.UserAgentValue = value
+	}
+}
+
+// WithRetryPolicy returns an option that sets Params.RetryPolicy.
+func WithRetryPolicy(policy *RetryPolicy) Option {
+	return func(o *options) {
+		o.params.RetryPolicy = policy
+	}
+}
+
+// WithCircuitBreaker returns an option that sets Params.CircuitBreaker.
+func WithCircuitBreaker(breaker *CircuitBreaker) Option {
+	return func(o *options) {
+		o.params.CircuitBreaker = breaker
+	}
+}
+
+// WithRateLimiter returns an option that sets Params.RateLimiter.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(o *options) {
+		o.params.RateLimiter = limiter
+	}
+}
+
+// WithRequestTimeout returns an option that sets Params.RequestTimeout.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.params.RequestTimeout = timeout
+	}
+}
+
+// WithTransferTimeout returns an option that sets Params.TransferTimeout.
+func WithTransferTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.params.TransferTimeout = timeout
+	}
+}
+
+// WithVerification returns an option that sets Params.VerifyArchives
+// and Params.VerifyResources, so that archive and resource downloads
+// are checked against the hash reported by the charm store.
+func WithVerification() Option {
+	return func(o *options) {
+		o.params.VerifyArchives = true
+		o.params.VerifyResources = true
+	}
+}
+
+// WithLogger returns an option that sets Params.Logger.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.params.Logger = logger
+	}
+}
+
+// WithMetrics returns an option that sets Params.Metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.params.Metrics = metrics
+	}
+}
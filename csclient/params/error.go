@@ -53,6 +53,16 @@ type Error struct {
 	Message string
 	Code    ErrorCode
 	Info    map[string]*Error `json:",omitempty"`
+
+	// StatusCode holds the HTTP status code of the response
+	// that the error was received in. It is set by the client
+	// and is not part of the response body.
+	StatusCode int `json:"-"`
+
+	// RequestId holds the id of the request that the error was
+	// received in response to. It is set by the client and is not
+	// part of the response body.
+	RequestId string `json:"-"`
 }
 
 // NewError returns a new *Error with the given error code
@@ -19,6 +19,11 @@ const (
 	// that will hold the content hash for archive GET responses.
 	ContentHashHeader = "Content-Sha384"
 
+	// ContentSha256Header specifies the header attribute that holds
+	// the SHA256 content hash of archive and resource GET responses
+	// when served by stores or proxies that expose it.
+	ContentSha256Header = "Content-Sha256"
+
 	// EntityIdHeader specifies the header attribute that will hold the
 	// id of the entity for archive GET responses.
 	EntityIdHeader = "Entity-Id"
@@ -139,6 +144,10 @@ type HashResponse struct {
 type ManifestFile struct {
 	Name string
 	Size int64
+
+	// Hash holds the hex-encoded SHA384 hash of the file.
+	// It is only set by charm stores that record file hashes.
+	Hash string `json:",omitempty"`
 }
 
 // ArchiveUploadTimeResponse holds the result of an id/meta/archive-upload-time
@@ -210,6 +219,15 @@ type DebugStatus struct {
 	Duration time.Duration
 }
 
+// DebugInfo holds the result of a debug/info GET request.
+type DebugInfo struct {
+	// GitCommit holds the git revision of the running server.
+	GitCommit string
+
+	// Version holds the version of the running server.
+	Version string
+}
+
 // EntityResult holds a the resolved entity ID along with any requested metadata.
 type EntityResult struct {
 	Id *charm.URL
@@ -329,6 +347,12 @@ type PublishResponse struct {
 	PromulgatedId *charm.URL `json:",omitempty"`
 }
 
+// UnpublishRequest holds the request of an id/unpublish PUT request.
+type UnpublishRequest struct {
+	// Channels holds the channels to withdraw the entity from.
+	Channels []Channel
+}
+
 // PublishedResponse holds the result of an id/meta/published GET request.
 type PublishedResponse struct {
 	// Channels holds an entry for each channel that the
@@ -559,3 +583,10 @@ type UploadInfoResponse struct {
 	// MaxParts holds the maximum number of parts.
 	MaxParts int
 }
+
+// ListUploadsResponse holds the response to a get /upload request.
+type ListUploadsResponse struct {
+	// Uploads holds an entry for each multipart upload
+	// that has been started but not yet completed or aborted.
+	Uploads []UploadInfoResponse
+}
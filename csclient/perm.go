@@ -0,0 +1,128 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"fmt"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// Permission names a kind of access to an entity
+// in a channel.
+type Permission string
+
+const (
+	// ReadPermission allows users to read an
+	// entity in a channel.
+	ReadPermission Permission = "read"
+
+	// WritePermission allows users to change an entity
+	// and to publish it to a channel.
+	WritePermission Permission = "write"
+)
+
+// Perms returns the users and groups allowed to read and write the
+// entity with the given id in the given channel. If channel is empty,
+// the client's channel is used.
+func (c *Client) Perms(id *charm.URL, channel params.Channel) (params.PermResponse, error) {
+	var result params.PermResponse
+	if err := c.permClient(channel).Get("/"+id.Path()+"/meta/perm", &result); err != nil {
+		return result, errgo.NoteMask(err, fmt.Sprintf("cannot get permissions for %s", id), isAPIError)
+	}
+	return result, nil
+}
+
+// AllPerms returns the permissions of the entity with
+// the given id in each channel, keyed by channel.
+func (c *Client) AllPerms(id *charm.URL) (map[params.Channel]params.PermResponse, error) {
+	var result params.AllPermsResponse
+	if err := c.Get("/"+id.Path()+"/allperms", &result); err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get permissions for %s", id), isAPIError)
+	}
+	return result.Perms, nil
+}
+
+// SetPerms replaces the permissions of the entity with the given id
+// in the given channel. If channel is empty, the client's channel is
+// used.
+func (c *Client) SetPerms(id *charm.URL, channel params.Channel, perms params.PermRequest) error {
+	if err := c.permClient(channel).Put("/"+id.Path()+"/meta/perm", perms); err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot set permissions for %s", id), isAPIError)
+	}
+	return nil
+}
+
+// Grant adds the given users or groups to those with the given
+// permission on the entity with the given id in the given channel,
+// leaving the other permissions unchanged. If channel is empty, the
+// client's channel is used.
+//
+// Note that the permissions are read and then written, so concurrent
+// changes to the same permission may be lost.
+func (c *Client) Grant(id *charm.URL, channel params.Channel, perm Permission, users ...string) error {
+	return c.changePerm(id, channel, perm, func(current []string) []string {
+		for _, u := range users {
+			if !containsString(current, u) {
+				current = append(current, u)
+			}
+		}
+		return current
+	})
+}
+
+// Revoke is like Grant except that it removes the given
+// users or groups from those with the given permission.
+func (c *Client) Revoke(id *charm.URL, channel params.Channel, perm Permission, users ...string) error {
+	return c.changePerm(id, channel, perm, func(current []string) []string {
+		result := make([]string, 0, len(current))
+		for _, u := range current {
+			if !containsString(users, u) {
+				result = append(result, u)
+			}
+		}
+		return result
+	})
+}
+
+// changePerm sets the given permission on the entity with the given id
+// to the result of calling change with its current value.
+func (c *Client) changePerm(id *charm.URL, channel params.Channel, perm Permission, change func([]string) []string) error {
+	switch perm {
+	case ReadPermission, WritePermission:
+	default:
+		return errgo.Newf("unknown permission %q", perm)
+	}
+	var current []string
+	client := c.permClient(channel)
+	path := "/" + id.Path() + "/meta/perm/" + string(perm)
+	if err := client.Get(path, &current); err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot get %s permission for %s", perm, id), isAPIError)
+	}
+	if err := client.Put(path, change(current)); err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot set %s permission for %s", perm, id), isAPIError)
+	}
+	return nil
+}
+
+// permClient returns the client to use for
+// permission requests in the given channel.
+func (c *Client) permClient(channel params.Channel) *Client {
+	if channel == params.NoChannel {
+		return c
+	}
+	return c.WithChannel(channel)
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
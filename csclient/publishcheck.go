@@ -0,0 +1,166 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// ResourceProblemKind describes why a resource
+// in a publish request is not valid.
+type ResourceProblemKind string
+
+const (
+	// ResourceNotDeclared is used when a resource is
+	// not declared in the charm's metadata.
+	ResourceNotDeclared ResourceProblemKind = "not declared by charm"
+
+	// ResourceRevisionNotFound is used when the requested
+	// revision of a resource does not exist.
+	ResourceRevisionNotFound ResourceProblemKind = "revision not found"
+
+	// ResourceNotSpecified is used when a resource declared
+	// by the charm has no revision in the publish request.
+	ResourceNotSpecified ResourceProblemKind = "revision not specified"
+)
+
+// ResourceProblem describes a problem with one
+// of the resources in a publish request.
+type ResourceProblem struct {
+	// Name holds the name of the resource.
+	Name string
+
+	// Revision holds the requested revision of the
+	// resource, or -1 if no revision was specified.
+	Revision int
+
+	// Kind holds the kind of problem found.
+	Kind ResourceProblemKind
+}
+
+// PublishReport holds the result of checking
+// a publish request with CheckPublish.
+type PublishReport struct {
+	// Id holds the id of the charm that would be published.
+	Id *charm.URL
+
+	// Problems holds any problems found, sorted by resource name.
+	Problems []ResourceProblem
+}
+
+// OK reports whether no problems were found.
+func (r *PublishReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// String returns a description of the problems found.
+func (r *PublishReport) String() string {
+	if r.OK() {
+		return fmt.Sprintf("%v: resources OK", r.Id)
+	}
+	problems := make([]string, len(r.Problems))
+	for i, p := range r.Problems {
+		if p.Revision < 0 {
+			problems[i] = fmt.Sprintf("%s: %s", p.Name, p.Kind)
+		} else {
+			problems[i] = fmt.Sprintf("%s/%d: %s", p.Name, p.Revision, p.Kind)
+		}
+	}
+	return fmt.Sprintf("%v: invalid resources (%s)", r.Id, strings.Join(problems, "; "))
+}
+
+// PublishCheckError is the error cause returned by Publish
+// when Params.CheckPublish is set and the check fails.
+type PublishCheckError struct {
+	Report *PublishReport
+}
+
+// Error implements error.Error.
+func (e *PublishCheckError) Error() string {
+	return "cannot publish " + e.Report.String()
+}
+
+// CheckPublish checks the resources that would be published with the
+// charm with the given id, without publishing anything. It verifies
+// that each resource in the map is declared by the charm and that the
+// given revision exists, and that every resource declared by the charm
+// has a revision in the map. Problems found are returned in the
+// report; an error is returned only if the check could not be made.
+func (c *Client) CheckPublish(id *charm.URL, resources map[string]int) (*PublishReport, error) {
+	report := &PublishReport{
+		Id: id,
+	}
+	if id.Series == "bundle" {
+		for name, rev := range resources {
+			report.Problems = append(report.Problems, ResourceProblem{
+				Name:     name,
+				Revision: rev,
+				Kind:     ResourceNotDeclared,
+			})
+		}
+		sortResourceProblems(report.Problems)
+		return report, nil
+	}
+	client := c.WithChannel(params.UnpublishedChannel)
+	declared, err := client.ListResources(id)
+	if err != nil {
+		return nil, errgo.Mask(err, isAPIError)
+	}
+	isDeclared := make(map[string]bool)
+	for _, r := range declared {
+		isDeclared[r.Name] = true
+		if _, ok := resources[r.Name]; !ok {
+			report.Problems = append(report.Problems, ResourceProblem{
+				Name:     r.Name,
+				Revision: -1,
+				Kind:     ResourceNotSpecified,
+			})
+		}
+	}
+	for name, rev := range resources {
+		if !isDeclared[name] {
+			report.Problems = append(report.Problems, ResourceProblem{
+				Name:     name,
+				Revision: rev,
+				Kind:     ResourceNotDeclared,
+			})
+			continue
+		}
+		if rev < 0 {
+			report.Problems = append(report.Problems, ResourceProblem{
+				Name:     name,
+				Revision: -1,
+				Kind:     ResourceNotSpecified,
+			})
+			continue
+		}
+		_, err := client.ResourceMeta(id, name, rev)
+		if errgo.Cause(err) == params.ErrNotFound {
+			report.Problems = append(report.Problems, ResourceProblem{
+				Name:     name,
+				Revision: rev,
+				Kind:     ResourceRevisionNotFound,
+			})
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err, isAPIError)
+		}
+	}
+	sortResourceProblems(report.Problems)
+	return report, nil
+}
+
+func sortResourceProblems(problems []ResourceProblem) {
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Name < problems[j].Name
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// RateLimiter limits the rate at which requests are made to the charm
+// store, so that bulk operations such as mirroring stay under the
+// store's throttling limits rather than failing intermittently with a
+// 429 (Too Many Requests) status.
+//
+// It allows bursts of up to Burst requests, and otherwise makes each
+// request wait so that no more than Rate requests are made each
+// second on average. Every attempt counts, including retries.
+//
+// A RateLimiter may be shared between several clients, so that they
+// are limited together, and is safe to use concurrently.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter that allows the given number of
+// requests each second, with bursts of up to the given size. If the
+// burst is less than one, it is treated as one.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		now:    time.Now,
+		tokens: float64(burst),
+	}
+}
+
+// wait waits until a request is allowed, or until the given context
+// is done, in which case it returns an error. It is OK to call wait
+// on a nil limiter.
+func (l *RateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	d := l.reserve()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return errgo.Notef(ctx.Err(), "cannot wait for rate limiter")
+	}
+}
+
+// reserve takes a token from the bucket and returns the
+// time to wait before the token may be used.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
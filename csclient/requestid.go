@@ -0,0 +1,121 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// RequestIdHeader holds the name of the HTTP header used to send
+// the id of the client operation that a request is part of, so that
+// charm store logs can be correlated with client failures.
+const RequestIdHeader = "X-Request-Id"
+
+// newRequestId returns a new random request id.
+func newRequestId() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Errorf("cannot generate request id: %v", err))
+	}
+	return fmt.Sprintf("%x", buf[:])
+}
+
+// WithRequestId returns a new client that sends the given request id
+// with every request, so that all the requests made with it can be
+// correlated as a single operation. If requestId is empty, a new id
+// is generated.
+//
+// By default, each operation performed by a client (for example each
+// call to UploadResource, however many requests it makes) is given
+// its own request id.
+func (c *Client) WithRequestId(requestId string) *Client {
+	if requestId == "" {
+		requestId = newRequestId()
+	}
+	client := c.clone()
+	client.requestId = requestId
+	return client
+}
+
+// RequestId returns the request id that the client sends
+// with its requests, or the empty string if it generates
+// a new one for each operation.
+func (c *Client) RequestId() string {
+	return c.requestId
+}
+
+// withOperationId returns a client to be used for an operation
+// that may make several requests. If the client does not have
+// a request id, the returned client has a new one.
+func (c *Client) withOperationId() *Client {
+	if c.requestId != "" {
+		return c
+	}
+	return c.WithRequestId("")
+}
+
+// requestIdError wraps an error returned from a request to the
+// charm store, recording the id of the request. Its message
+// and cause are those of the wrapped error.
+type requestIdError struct {
+	errgo.Err
+	requestId string
+}
+
+// withRequestId returns err annotated with the given request id. Error
+// responses from the charm store record the id themselves and are
+// returned unwrapped, so that callers can still check their type.
+func withRequestId(err error, requestId string) error {
+	switch e := err.(type) {
+	case *params.Error:
+		e.RequestId = requestId
+		return e
+	case *unexpectedStatusError:
+		e.RequestId = requestId
+		return e
+	}
+	e := &requestIdError{
+		requestId: requestId,
+	}
+	e.Underlying_ = err
+	if c, ok := err.(errgo.Causer); ok {
+		e.Cause_ = c.Cause()
+	} else {
+		e.Cause_ = err
+	}
+	e.SetLocation(1)
+	return e
+}
+
+// ErrorRequestId returns the id of the request that resulted
+// in the given error, or the empty string if the error did not
+// result from a request to the charm store.
+func ErrorRequestId(err error) string {
+	switch e := underlyingError(err, isRequestIdError).(type) {
+	case *requestIdError:
+		return e.requestId
+	case *params.Error:
+		return e.RequestId
+	case *unexpectedStatusError:
+		return e.RequestId
+	}
+	return ""
+}
+
+func isRequestIdError(err error) bool {
+	switch e := err.(type) {
+	case *requestIdError:
+		return true
+	case *params.Error:
+		return e.RequestId != ""
+	case *unexpectedStatusError:
+		return e.RequestId != ""
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// RetryPolicy specifies how the client retries requests that fail
+// because of a temporary problem, such as a network error or an
+// overloaded server.
+type RetryPolicy struct {
+	// MaxAttempts holds the maximum number of times a request will
+	// be tried, including the first attempt. If this is less than
+	// one, a request is tried once only.
+	MaxAttempts int
+
+	// Delay holds the time to wait before the first retry. Each
+	// subsequent delay is twice as long as the previous one.
+	Delay time.Duration
+
+	// MaxDelay holds the maximum time to wait between attempts.
+	// If this is zero, the delay is not capped.
+	MaxDelay time.Duration
+
+	// Jitter holds the fraction (between 0 and 1) of each delay that
+	// is randomized, so that many clients failing at once do not all
+	// retry at the same time.
+	Jitter float64
+
+	// Retryable reports whether a request that resulted in the given
+	// response or error should be retried. Exactly one of resp and
+	// err will be non-nil. If Retryable is nil, IsRetryableResponse
+	// is used.
+	Retryable func(resp *http.Response, err error) bool
+}
+
+// defaultUploadRetryPolicy holds the policy used for uploading the
+// parts of a multipart upload when no policy has been specified.
+// It retries immediately, as the client always did before retry
+// policies were configurable.
+var defaultUploadRetryPolicy = &RetryPolicy{
+	MaxAttempts: 10,
+}
+
+// IsRetryableResponse is the default classification used by
+// RetryPolicy. It reports that a request should be retried when it
+// failed with a network error or when the server responded with a
+// status that indicates a temporary condition. It is consistent
+// with IsRetryable.
+func IsRetryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return IsRetryable(err)
+	}
+	return isRetryableStatus(resp.StatusCode)
+}
+
+// IsRetryable reports whether an operation that failed with the given
+// error, as returned by a Client method, might succeed if it is tried
+// again. Errors caused by network failures, timeouts and server
+// responses with a 429, 502, 503 or 504 status are considered
+// retryable; errors caused by the request itself, such as those with a
+// 4xx status or a params.ErrNotFound cause, other server errors, and
+// requests canceled by the caller are not.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if code := ErrorStatusCode(err); code != 0 {
+		return isRetryableStatus(code)
+	}
+	if errgo.Cause(err) == params.ErrServiceUnavailable {
+		return true
+	}
+	if isAPIError(err) {
+		return false
+	}
+	return underlyingError(err, isCanceled) == nil
+}
+
+// isRetryableStatus reports whether a response with the given status
+// code indicates a temporary condition. Other 5xx statuses, such as
+// http.StatusInternalServerError, may be returned after a request has
+// had some effect, so they are not retried.
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isCanceled reports whether err was caused by
+// the caller canceling the request.
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// ErrorStatusCode returns the HTTP status code of the response that
+// resulted in the given error, or zero if the error did not result
+// from an error response from the charm store.
+func ErrorStatusCode(err error) int {
+	switch e := underlyingError(err, isStatusError).(type) {
+	case *params.Error:
+		return e.StatusCode
+	case *unexpectedStatusError:
+		return e.StatusCode
+	}
+	return 0
+}
+
+func isStatusError(err error) bool {
+	switch e := err.(type) {
+	case *params.Error:
+		return e.StatusCode != 0
+	case *unexpectedStatusError:
+		return true
+	}
+	return false
+}
+
+// attempts returns the maximum number of attempts allowed by the
+// policy. It is OK to call it on a nil policy.
+func (p *RetryPolicy) attempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// retryable reports whether the result of an attempt should be retried.
+func (p *RetryPolicy) retryable(resp *http.Response, err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(resp, err)
+	}
+	return IsRetryableResponse(resp, err)
+}
+
+// maxRetryDelay holds the longest delay returned by RetryPolicy.delay,
+// so that doubling the delay, and adding jitter to it, cannot overflow.
+const maxRetryDelay = time.Duration(math.MaxInt64 / 4)
+
+// delay returns the time to wait after the given attempt
+// (counting from 1) before trying again.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Delay
+	for i := 1; i < attempt && d > 0 && d < maxRetryDelay; i++ {
+		d *= 2
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	if p.Jitter > 0 && d > 0 {
+		jitter := time.Duration(math.Min(p.Jitter, 1) * float64(d))
+		d = d - jitter + time.Duration(rand.Int63n(int64(2*jitter)+1))
+	}
+	return d
+}
+
+// wait sleeps for the delay following the given attempt, returning
+// the delay. If the context is done first, it returns an error.
+func (p *RetryPolicy) wait(ctx context.Context, attempt int) (time.Duration, error) {
+	d := p.delay(attempt)
+	if d <= 0 {
+		return d, nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return d, nil
+	case <-ctx.Done():
+		return d, errgo.Notef(ctx.Err(), "cannot wait to retry request")
+	}
+}
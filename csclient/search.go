@@ -0,0 +1,166 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"net/url"
+	"strconv"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// defaultSearchPageSize holds the number of results requested
+// at a time when SearchParams.PageSize is zero.
+const defaultSearchPageSize = 100
+
+// SearchParams holds the parameters for a Client.Search request.
+type SearchParams struct {
+	// Text holds the text to search for. If it is empty,
+	// all entities matching the filters are returned.
+	Text string
+
+	// Filters holds filters to restrict the results, keyed by
+	// field, for example "series", "owner", "type" or "tags".
+	Filters map[string][]string
+
+	// Include holds the names of metadata to include
+	// in each result, for example "charm-metadata".
+	Include []string
+
+	// Sort holds the fields to sort the results by, for example
+	// "-downloads". If it is empty, the results are sorted by
+	// relevance.
+	Sort string
+
+	// PageSize holds the number of results to fetch
+	// in each request. If it is zero, 100 is used.
+	PageSize int
+}
+
+// Search returns an iterator over the entities in the charm store that
+// match the given parameters. Results are fetched from the charm store
+// a page at a time as the iterator advances, so arbitrarily many
+// results may be consumed with bounded memory. For example:
+//
+//	iter := client.Search(csclient.SearchParams{Text: "wordpress"})
+//	for iter.Next() {
+//		fmt.Println(iter.Entity().Id)
+//	}
+//	if err := iter.Err(); err != nil {
+//		return err
+//	}
+//
+// Note that results may be skipped or duplicated if entities are added
+// to or removed from the charm store while the iteration is in
+// progress.
+func (c *Client) Search(p SearchParams) *SearchIterator {
+	v := url.Values{}
+	if p.Text != "" {
+		v.Set("text", p.Text)
+	}
+	for field, values := range p.Filters {
+		for _, value := range values {
+			v.Add(field, value)
+		}
+	}
+	for _, include := range p.Include {
+		v.Add("include", include)
+	}
+	if p.Sort != "" {
+		v.Set("sort", p.Sort)
+	}
+	iter := &SearchIterator{
+		client:   c,
+		values:   v,
+		pageSize: p.PageSize,
+		total:    -1,
+	}
+	if iter.pageSize == 0 {
+		iter.pageSize = defaultSearchPageSize
+	}
+	if iter.pageSize < 0 {
+		iter.err = errgo.Newf("negative page size")
+	}
+	return iter
+}
+
+// SearchIterator iterates over the results of a search.
+// See Client.Search.
+type SearchIterator struct {
+	client   *Client
+	values   url.Values
+	pageSize int
+
+	// skip holds the number of results fetched so far.
+	skip int
+
+	// total holds the total number of results reported by the
+	// charm store, or -1 if no page has been fetched yet.
+	total int
+
+	// page holds the results fetched but not yet returned.
+	page []params.EntityResult
+
+	// done records that there are no more results to fetch.
+	done bool
+
+	entity params.EntityResult
+	err    error
+}
+
+// Next advances to the next result, which will then be available
+// through Entity. It returns false when there are no more results
+// or an error occurred, in which case Err will return it.
+func (iter *SearchIterator) Next() bool {
+	if iter.err != nil {
+		return false
+	}
+	if len(iter.page) == 0 && !iter.done {
+		iter.fetch()
+	}
+	if len(iter.page) == 0 {
+		return false
+	}
+	iter.entity, iter.page = iter.page[0], iter.page[1:]
+	return true
+}
+
+// fetch fetches the next page of results.
+func (iter *SearchIterator) fetch() {
+	v := make(url.Values)
+	for field, values := range iter.values {
+		v[field] = values
+	}
+	v.Set("skip", strconv.Itoa(iter.skip))
+	v.Set("limit", strconv.Itoa(iter.pageSize))
+	var resp params.SearchResponse
+	if err := iter.client.Get("/search?"+v.Encode(), &resp); err != nil {
+		iter.err = errgo.NoteMask(err, "cannot search", isAPIError)
+		return
+	}
+	iter.page = resp.Results
+	iter.total = resp.Total
+	iter.skip += len(resp.Results)
+	if len(resp.Results) < iter.pageSize || iter.skip >= resp.Total {
+		iter.done = true
+	}
+}
+
+// Entity returns the current result.
+func (iter *SearchIterator) Entity() params.EntityResult {
+	return iter.entity
+}
+
+// Total returns the total number of results reported by the charm
+// store, or -1 if Next has not yet been called.
+func (iter *SearchIterator) Total() int {
+	return iter.total
+}
+
+// Err returns any error encountered during iteration.
+func (iter *SearchIterator) Err() error {
+	return iter.err
+}
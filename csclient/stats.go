@@ -0,0 +1,122 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// StatsPeriod holds the period that counts are aggregated over
+// in the result of a stats counter request.
+type StatsPeriod string
+
+const (
+	StatsByDay  StatsPeriod = "day"
+	StatsByWeek StatsPeriod = "week"
+)
+
+// apiDateFormat holds the format of the dates used by the
+// stats counter and changes API endpoints.
+const apiDateFormat = "2006-01-02"
+
+// EntityStatsKey returns the key of the stats counter of the given kind
+// (for example params.StatsArchiveDownload) for the given entity. If the
+// id has no revision, the revision is omitted from the key, so the key
+// can be used as a prefix to count over all revisions.
+func EntityStatsKey(kind string, id *charm.URL) []string {
+	key := []string{kind, id.Series, id.Name, id.User}
+	if id.Revision != -1 {
+		key = append(key, strconv.Itoa(id.Revision))
+	}
+	return key
+}
+
+// DownloadStatsKey returns the key of the download counter for
+// the given entity. See EntityStatsKey for how the revision is treated.
+func DownloadStatsKey(id *charm.URL) []string {
+	return EntityStatsKey(params.StatsArchiveDownload, id)
+}
+
+// PromulgatedDownloadStatsKey returns the key of the download counter
+// for the given promulgated entity, which must not specify a user.
+func PromulgatedDownloadStatsKey(id *charm.URL) []string {
+	return EntityStatsKey(params.StatsArchiveDownloadPromulgated, id)
+}
+
+// CounterParams holds the parameters for a Client.Counter request.
+type CounterParams struct {
+	// Key holds the parts of the counter key.
+	Key []string
+
+	// Prefix specifies that all counters whose keys
+	// start with Key are counted.
+	Prefix bool
+
+	// List specifies that the counts for each key matching
+	// the prefix are returned separately rather than summed.
+	// It is only valid when Prefix is true.
+	List bool
+
+	// By specifies that counts are aggregated by the
+	// given period. If it is empty, the total count
+	// is returned.
+	By StatsPeriod
+
+	// Start and Stop restrict the counts to the given
+	// dates, inclusive. A zero time is ignored.
+	Start time.Time
+	Stop  time.Time
+}
+
+// Counter returns the counts from the stats counter described by p.
+func (c *Client) Counter(p CounterParams) ([]params.Statistic, error) {
+	if len(p.Key) == 0 {
+		return nil, errgo.New("no stats key specified")
+	}
+	if p.List && !p.Prefix {
+		return nil, errgo.New("cannot list stats without a key prefix")
+	}
+	path := "/stats/counter/" + strings.Join(p.Key, ":")
+	if p.Prefix {
+		path += ":*"
+	}
+	v := url.Values{}
+	if p.List {
+		v.Set("list", "1")
+	}
+	if p.By != "" {
+		v.Set("by", string(p.By))
+	}
+	if !p.Start.IsZero() {
+		v.Set("start", p.Start.Format(apiDateFormat))
+	}
+	if !p.Stop.IsZero() {
+		v.Set("stop", p.Stop.Format(apiDateFormat))
+	}
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+	var result []params.Statistic
+	if err := c.Get(path, &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get stats", isAPIError)
+	}
+	return result, nil
+}
+
+// Stats returns the download statistics for the given entity.
+func (c *Client) Stats(id *charm.URL) (*params.StatsResponse, error) {
+	var result params.StatsResponse
+	if err := c.Get("/"+id.Path()+"/meta/stats", &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get stats", isAPIError)
+	}
+	return &result, nil
+}
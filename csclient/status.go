@@ -0,0 +1,59 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// ServerStatus returns the results of the charm store's
+// status checks, keyed by check.
+func (c *Client) ServerStatus() (map[string]params.DebugStatus, error) {
+	var result map[string]params.DebugStatus
+	if err := c.Get("/debug/status", &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get server status", isAPIError)
+	}
+	return result, nil
+}
+
+// ServerInfo returns version information about the charm store.
+func (c *Client) ServerInfo() (*params.DebugInfo, error) {
+	var result params.DebugInfo
+	if err := c.Get("/debug/info", &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get server info", isAPIError)
+	}
+	return &result, nil
+}
+
+// CheckServer checks that the charm store is running, that it supports
+// the API version used by the client and that all its status checks
+// pass. It is useful for checking the configured store before starting
+// a long-running operation such as a large upload.
+func (c *Client) CheckServer() error {
+	status, err := c.ServerStatus()
+	if err != nil {
+		serr, _ := underlyingError(err, isUnexpectedStatusError).(*unexpectedStatusError)
+		if errgo.Cause(err) == params.ErrNotFound || (serr != nil && serr.StatusCode == http.StatusNotFound) {
+			return errgo.Notef(err, "charm store at %q does not support API version %s", c.params.URL, apiVersion)
+		}
+		return errgo.Mask(err, isAPIError)
+	}
+	var failed []string
+	for _, check := range status {
+		if !check.Passed {
+			failed = append(failed, check.Name+": "+check.Value)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errgo.Newf("charm store status checks failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
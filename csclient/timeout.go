@@ -0,0 +1,71 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WithTimeout returns a new client that is identical to c except that
+// each of its requests, whatever the endpoint, must complete within
+// the given duration, overriding Params.RequestTimeout and
+// Params.TransferTimeout. If timeout is zero, requests made by the
+// returned client are not limited.
+//
+// For example, to download an archive with a short timeout:
+//
+//	r, id, hash, size, err := client.WithTimeout(time.Minute).GetArchive(id)
+func (c *Client) WithTimeout(timeout time.Duration) *Client {
+	client := c.clone()
+	client.timeout = &timeout
+	return client
+}
+
+// requestTimeout returns the timeout to use for a
+// request to the given API path, or zero if there is none.
+func (c *Client) requestTimeout(path string) time.Duration {
+	if c.timeout != nil {
+		return *c.timeout
+	}
+	if isTransfer(path) {
+		return c.params.TransferTimeout
+	}
+	return c.params.RequestTimeout
+}
+
+// isTransfer reports whether the given API path refers to an
+// endpoint used to transfer archives or resources, which
+// may take much longer than other requests.
+func isTransfer(path string) bool {
+	switch endpointLabel(path) {
+	case "archive", "resource", "upload":
+		return true
+	}
+	return false
+}
+
+// withTimeout returns a copy of the given request that is canceled
+// after the given duration, and a function that releases resources
+// associated with the timeout.
+func withTimeout(req *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
+
+// cancelBody wraps a response body so that
+// the request's context is canceled when it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer.Close.
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// HashMismatchError is the error cause returned when the data
+// read from the charm store does not match the hash or size
+// that the charm store reported for it.
+type HashMismatchError struct {
+	// Id holds the id of the entity that was being read.
+	Id *charm.URL
+
+	// Resource holds the name of the resource that was
+	// being read, or is empty if an archive was being read.
+	Resource string
+
+	// HashAlgorithm holds the algorithm used to produce the
+	// hashes below. The zero value means SHA384.
+	HashAlgorithm HashAlgorithm
+
+	// ExpectedHash and ActualHash hold the hex-encoded
+	// hash reported by the store and the hash
+	// of the data actually read.
+	ExpectedHash string
+	ActualHash   string
+
+	// ExpectedSize holds the size reported by the store,
+	// or -1 if the size was not known.
+	ExpectedSize int64
+
+	// BytesRead holds the number of bytes actually read.
+	BytesRead int64
+
+	// Proxied holds whether the response went through
+	// an HTTP proxy.
+	Proxied bool
+}
+
+// Error implements error.Error.
+func (e *HashMismatchError) Error() string {
+	what := "archive"
+	if e.Resource != "" {
+		what = fmt.Sprintf("resource %q", e.Resource)
+	}
+	mismatch := "hash"
+	if e.ExpectedSize >= 0 && e.ExpectedSize != e.BytesRead {
+		mismatch = "size"
+	}
+	expected := fmt.Sprintf("%d bytes with hash %s", e.ExpectedSize, e.ExpectedHash)
+	if e.ExpectedSize < 0 {
+		expected = "hash " + e.ExpectedHash
+	}
+	msg := fmt.Sprintf("%s mismatch reading %s of %q (expected %s, got %d bytes with hash %s", mismatch, what, e.Id, expected, e.BytesRead, e.ActualHash)
+	if e.Proxied {
+		msg += ", response was proxied"
+	}
+	return msg + "); network corruption?"
+}
+
+// isProxied reports whether the given response headers
+// show that the response passed through an HTTP proxy.
+func isProxied(h http.Header) bool {
+	for _, key := range []string{"Via", "X-Cache", "X-Forwarded-For", "Forwarded"} {
+		if h.Get(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// copyVerified copies from r to w, checking that the data matches
+// the expected hash and size (the size is not checked if it is negative).
+// If the data does not match, an error with a *HashMismatchError
+// cause is returned; the error is otherwise filled out from mismatch.
+func copyVerified(w io.Writer, r io.Reader, mismatch HashMismatchError) (int64, error) {
+	hash := mismatch.HashAlgorithm.newHash()
+	n, err := io.Copy(io.MultiWriter(hash, w), r)
+	if err != nil {
+		return n, errgo.Mask(err)
+	}
+	actualHash := fmt.Sprintf("%x", hash.Sum(nil))
+	if (mismatch.ExpectedSize >= 0 && n != mismatch.ExpectedSize) || actualHash != mismatch.ExpectedHash {
+		mismatch.ActualHash = actualHash
+		mismatch.BytesRead = n
+		return n, &mismatch
+	}
+	return n, nil
+}
+
+// verifyingReader implements io.ReadCloser by reading from another
+// reader and checking that the data read matches an expected
+// hash and size by the time the end of the data is reached.
+type verifyingReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	n        int64
+	mismatch HashMismatchError
+	err      error
+}
+
+// newVerifyingReader returns a reader that reads from r, returning
+// an error with a *HashMismatchError cause instead of io.EOF if the
+// data does not match the expected hash and size held in mismatch.
+// If the expected size is not negative, reading more data than
+// expected also results in an error.
+func newVerifyingReader(r io.ReadCloser, mismatch HashMismatchError) io.ReadCloser {
+	return &verifyingReader{
+		ReadCloser: r,
+		hash:       mismatch.HashAlgorithm.newHash(),
+		mismatch:   mismatch,
+	}
+}
+
+// Read implements io.Reader.Read.
+func (r *verifyingReader) Read(buf []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ReadCloser.Read(buf)
+	r.hash.Write(buf[:n])
+	r.n += int64(n)
+	tooLong := r.mismatch.ExpectedSize >= 0 && r.n > r.mismatch.ExpectedSize
+	if err == io.EOF || tooLong {
+		actualHash := fmt.Sprintf("%x", r.hash.Sum(nil))
+		if tooLong || (r.mismatch.ExpectedSize >= 0 && r.n != r.mismatch.ExpectedSize) || actualHash != r.mismatch.ExpectedHash {
+			r.mismatch.ActualHash = actualHash
+			r.mismatch.BytesRead = r.n
+			err = &r.mismatch
+		}
+	}
+	r.err = err
+	return n, err
+}
+
+// ArchiveData holds information about a charm or bundle archive
+// retrieved from the charm store. It must be closed after use.
+type ArchiveData struct {
+	io.ReadCloser
+
+	// Id holds the fully qualified id of the entity.
+	Id *charm.URL
+
+	// Hash holds the hex-encoded hash of the archive.
+	Hash string
+
+	// HashAlgorithm holds the algorithm used to produce Hash.
+	// The zero value means SHA384.
+	HashAlgorithm HashAlgorithm
+
+	// Size holds the size of the archive, or -1 if the
+	// charm store did not report it.
+	Size int64
+
+	// Proxied holds whether the archive is being
+	// retrieved through an HTTP proxy.
+	Proxied bool
+}
+
+// CopyVerified copies the archive data to w, checking that it
+// matches the expected hash and size. If it does not, an error
+// with a *HashMismatchError cause is returned.
+func (a *ArchiveData) CopyVerified(w io.Writer) (int64, error) {
+	return copyVerified(w, a.ReadCloser, HashMismatchError{
+		Id:            a.Id,
+		HashAlgorithm: a.HashAlgorithm,
+		ExpectedHash:  a.Hash,
+		ExpectedSize:  a.Size,
+		Proxied:       a.Proxied,
+	})
+}
+
+// VerifiedReader returns a reader that reads the archive data and
+// checks that it matches the expected hash and size, returning an
+// error with a *HashMismatchError cause instead of io.EOF if it does
+// not. Closing the returned reader closes the archive data.
+func (a *ArchiveData) VerifiedReader() io.ReadCloser {
+	return newVerifyingReader(a.ReadCloser, HashMismatchError{
+		Id:            a.Id,
+		HashAlgorithm: a.HashAlgorithm,
+		ExpectedHash:  a.Hash,
+		ExpectedSize:  a.Size,
+		Proxied:       a.Proxied,
+	})
+}
+
+// CopyVerified copies the resource data to w, checking that it
+// matches the expected hash and size. If it does not, an error
+// with a *HashMismatchError cause is returned.
+func (r ResourceData) CopyVerified(w io.Writer) (int64, error) {
+	return copyVerified(w, r.ReadCloser, HashMismatchError{
+		Id:            r.Id,
+		Resource:      r.Name,
+		HashAlgorithm: r.HashAlgorithm,
+		ExpectedHash:  r.Hash,
+		ExpectedSize:  r.Size,
+		Proxied:       r.Proxied,
+	})
+}
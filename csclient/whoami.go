@@ -0,0 +1,68 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient // import "github.com/juju/charmrepo/v7/csclient"
+
+import (
+	"sync"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// whoAmICache holds the most recent successful WhoAmI response.
+// It is shared by a client and the clients derived from it, which
+// use the same credentials.
+type whoAmICache struct {
+	mu sync.Mutex
+
+	// settings holds the settings of the client that made the
+	// request. The response is only used by clients with the same
+	// settings, as the settings may hold authorization headers.
+	settings *clientSettings
+	resp     *params.WhoAmIResponse
+}
+
+// get returns the cached response for a client with the given
+// settings, or nil if there is none.
+func (c *whoAmICache) get(settings *clientSettings) *params.WhoAmIResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resp == nil || c.settings != settings {
+		return nil
+	}
+	return copyWhoAmIResponse(c.resp)
+}
+
+// set caches the response returned to a client
+// with the given settings.
+func (c *whoAmICache) set(settings *clientSettings, resp *params.WhoAmIResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settings = settings
+	c.resp = copyWhoAmIResponse(resp)
+}
+
+// invalidate removes any cached response.
+func (c *whoAmICache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settings = nil
+	c.resp = nil
+}
+
+// copyWhoAmIResponse returns a copy of resp that
+// does not share its groups slice.
+func copyWhoAmIResponse(resp *params.WhoAmIResponse) *params.WhoAmIResponse {
+	resp1 := *resp
+	resp1.Groups = append([]string(nil), resp.Groups...)
+	return &resp1
+}
+
+// InvalidateWhoAmI discards the response cached by WhoAmI, so that
+// the next call asks the charm store again. It should be called when
+// the credentials used by the client change other than by calling
+// Login, Logout or SetHTTPHeader, for example when the bakery client's
+// cookies are changed.
+func (c *Client) InvalidateWhoAmI() {
+	c.whoami.invalidate()
+}
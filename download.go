@@ -0,0 +1,226 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// downloadGroup shares the transfer of an archive between concurrent
+// requests for it. Requests are matched by the id and hash that the
+// charm store reports for the archive, so requests that resolve to the
+// same archive share a transfer even if they used different URLs.
+type downloadGroup struct {
+	mu        sync.Mutex
+	downloads map[string]*download
+}
+
+// download represents a transfer of an archive
+// into a temporary file.
+type download struct {
+	// done is closed when the transfer has completed.
+	done chan struct{}
+
+	// data holds the information on the transferred archive,
+	// without its reader, path holds the path of the temporary
+	// file holding the archive, and err holds any error from the
+	// transfer. They are set before done is closed.
+	data *csclient.ArchiveData
+	path string
+	err  error
+
+	// refs holds the number of requests using the
+	// download. It is guarded by downloadGroup.mu.
+	refs int
+}
+
+func newDownloadGroup() *downloadGroup {
+	return &downloadGroup{
+		downloads: make(map[string]*download),
+	}
+}
+
+// writeArchive retrieves the archive of the entity with the given id
+// using the given client and writes it to w, returning the fully
+// qualified id of the entity. In any case the data written is checked
+// against the hash and size reported by the charm store. The started
+// function is called with the fully qualified id once the transfer has
+// started.
+//
+// The id and hash of the archive are retrieved with a metadata request
+// before the archive itself. If the archive is held in the given cache,
+// the cached archive is written without transferring it from the charm
+// store; otherwise it is added to the cache once it has been verified.
+// If another call is already transferring the same archive, its
+// transfer is used instead of making another.
+//
+// It is OK to call writeArchive on a nil downloadGroup,
+// in which case transfers are not shared, or with a nil cache.
+func (g *downloadGroup) writeArchive(client *csclient.Client, cache *archiveCache, id *charm.URL, w io.Writer, started func(id *charm.URL)) (*charm.URL, error) {
+	if g == nil && cache == nil {
+		data, err := client.GetArchiveData(id)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		defer data.Close()
+		started(data.Id)
+		if err := copyArchiveData(data, w); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		return data.Id, nil
+	}
+	info, err := archiveInfo(client, id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	started(info.Id)
+	if f := cache.open(info); f != nil {
+		defer f.Close()
+		if err := copyVerifiedFile(info, f, w); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		return info.Id, nil
+	}
+	if g == nil {
+		data, err := client.GetArchiveData(info.Id)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		defer data.Close()
+		if err := cache.copy(data, info, w); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		return data.Id, nil
+	}
+	key := info.Id.String() + " " + info.Hash
+	d, leader := g.join(key)
+	defer g.release(d)
+	if leader {
+		d.data, d.path, d.err = transfer(client, info, cache)
+		g.finish(key, d)
+	} else {
+		<-d.done
+	}
+	if d.err != nil {
+		return nil, errgo.Mask(d.err, errgo.Any)
+	}
+	f, err := os.Open(d.path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer f.Close()
+	if err := copyVerifiedFile(d.data, f, w); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return d.data.Id, nil
+}
+
+// archiveInfo returns information on the archive of the entity with
+// the given id, retrieved with a metadata request. The returned data
+// has no reader.
+func archiveInfo(client *csclient.Client, id *charm.URL) (*csclient.ArchiveData, error) {
+	var result struct {
+		Hash        params.HashResponse
+		ArchiveSize params.ArchiveSizeResponse
+	}
+	eid, err := client.Meta(id, &result)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot get archive", errgo.Any)
+	}
+	return &csclient.ArchiveData{
+		Id:            eid,
+		Hash:          result.Hash.Sum,
+		HashAlgorithm: csclient.SHA384,
+		Size:          result.ArchiveSize.Size,
+	}, nil
+}
+
+// join returns the download for the given key,
+// and whether the caller should start it.
+func (g *downloadGroup) join(key string) (d *download, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	d, ok := g.downloads[key]
+	if !ok {
+		d = &download{
+			done: make(chan struct{}),
+		}
+		g.downloads[key] = d
+	}
+	d.refs++
+	return d, !ok
+}
+
+// finish marks the given download as complete, so that
+// later requests for the archive start a new transfer.
+func (g *downloadGroup) finish(key string, d *download) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.downloads, key)
+	close(d.done)
+}
+
+// release records that a request has finished with the given
+// download, removing its temporary file when it is no longer needed.
+func (g *downloadGroup) release(d *download) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	d.refs--
+	if d.refs == 0 && d.path != "" {
+		os.Remove(d.path)
+	}
+}
+
+// transfer retrieves the archive described by the given information
+// into a temporary file, returning the information on the archive as
+// reported when it was retrieved and the path of the file, and adds it
+// to the given cache.
+func transfer(client *csclient.Client, info *csclient.ArchiveData, cache *archiveCache) (*csclient.ArchiveData, string, error) {
+	data, err := client.GetArchiveData(info.Id)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Any)
+	}
+	defer data.Close()
+	f, err := ioutil.TempFile("", "charmrepo-download")
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	defer f.Close()
+	if err := cache.copy(data, info, f); err != nil {
+		os.Remove(f.Name())
+		return nil, "", errgo.Mask(err, errgo.Any)
+	}
+	result := *data
+	result.ReadCloser = nil
+	return &result, f.Name(), nil
+}
+
+// copyVerifiedFile copies the archive in the given file to w, checking
+// that it matches the hash and size in the given information.
+func copyVerifiedFile(info *csclient.ArchiveData, f *os.File, w io.Writer) error {
+	data := *info
+	data.ReadCloser = f
+	return copyArchiveData(&data, w)
+}
+
+// copyArchiveData copies the given archive data to w,
+// checking that it matches the expected hash and size.
+func copyArchiveData(data *csclient.ArchiveData, w io.Writer) error {
+	if _, err := data.CopyVerified(w); err != nil {
+		if _, ok := err.(*csclient.HashMismatchError); ok {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return errgo.Notef(err, "cannot read entity archive")
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7"
+)
+
+type downloadSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&downloadSuite{})
+
+func (s *downloadSuite) TestConcurrentGetsShareTransfer(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/xenial/wordpress-1")
+
+	// The archive body is held back until both requests have
+	// found out which archive they need, so the second joins the
+	// transfer made for the first.
+	store.setBeforeArchiveBody(func(req *http.Request) {
+		for deadline := time.Now().Add(5 * time.Second); store.metaRequestCount() < 2; {
+			if time.Now().After(deadline) {
+				c.Errorf("second request not made")
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	dir := c.MkDir()
+	var wg sync.WaitGroup
+	for i, url := range []string{"cs:~bob/wordpress", "cs:~bob/xenial/wordpress-1"} {
+		i, url := i, url
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := filepath.Join(dir, fmt.Sprintf("wordpress-%d.charm", i))
+			_, err := repo.Get(charm.MustParseURL(url), path)
+			c.Check(err, gc.IsNil)
+			data, err := ioutil.ReadFile(path)
+			c.Check(err, gc.IsNil)
+			c.Check(data, jc.DeepEquals, e.archive)
+		}()
+	}
+	wg.Wait()
+	c.Assert(store.downloads, gc.HasLen, 1)
+
+	// The temporary file is removed after the transfer, and later
+	// calls make a new transfer.
+	store.setBeforeArchiveBody(nil)
+	_, err := repo.Get(charm.MustParseURL("cs:~bob/wordpress"), filepath.Join(dir, "again"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.downloads, gc.HasLen, 2)
+}
+
+func (s *downloadSuite) TestGetMany(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	var archives [][]byte
+	for _, id := range []string{"cs:~bob/xenial/mysql-1", "cs:~bob/xenial/wordpress-2", "cs:~bob/xenial/haproxy-3"} {
+		archives = append(archives, store.addCharm(id).archive)
+	}
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	store.setBeforeArchiveBody(func(req *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	dir := c.MkDir()
+	dests := make(map[*charm.URL]string)
+	for _, name := range []string{"mysql", "wordpress", "haproxy", "nothere"} {
+		dests[charm.MustParseURL("cs:~bob/xenial/"+name)] = filepath.Join(dir, name+".charm")
+	}
+	var progress []charmrepo.GetManyProgress
+	results := repo.GetMany(dests, charmrepo.GetManyParams{
+		Concurrency: 2,
+		Progress: func(p charmrepo.GetManyProgress) {
+			progress = append(progress, p)
+		},
+	})
+	c.Assert(results, gc.HasLen, 4)
+	for i, name := range []string{"haproxy", "mysql", "nothere", "wordpress"} {
+		c.Assert(results[i].URL.String(), gc.Equals, "cs:~bob/xenial/"+name)
+		c.Assert(results[i].Path, gc.Equals, filepath.Join(dir, name+".charm"))
+	}
+	c.Assert(results[2].Err, gc.ErrorMatches, `cannot retrieve "cs:~bob/xenial/nothere": charm not found`)
+	for i, archive := range [][]byte{archives[2], archives[0], nil, archives[1]} {
+		if archive == nil {
+			continue
+		}
+		c.Assert(results[i].Err, gc.IsNil)
+		data, err := ioutil.ReadFile(results[i].Path)
+		c.Assert(err, gc.IsNil)
+		c.Assert(data, jc.DeepEquals, archive)
+	}
+	c.Assert(maxActive <= 2, jc.IsTrue, gc.Commentf("%d transfers at once", maxActive))
+
+	c.Assert(progress, gc.HasLen, 4)
+	for i, p := range progress {
+		c.Assert(p.Completed, gc.Equals, i+1)
+		c.Assert(p.Total, gc.Equals, 4)
+	}
+}
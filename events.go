@@ -0,0 +1,102 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"fmt"
+
+	"github.com/juju/charm/v9"
+)
+
+// EventKind identifies a step in retrieving a charm or bundle.
+type EventKind string
+
+const (
+	// EventResolving is sent when a URL is about to be resolved.
+	EventResolving EventKind = "resolving"
+
+	// EventResolved is sent when a URL has been resolved.
+	EventResolved EventKind = "resolved"
+
+	// EventDownloading is sent when the archive of an
+	// entity has started to be transferred.
+	EventDownloading EventKind = "downloading"
+
+	// EventVerified is sent when the archive of an entity has
+	// been transferred and found to match its expected hash.
+	EventVerified EventKind = "verified"
+
+	// EventFailed is sent when resolving a URL or
+	// transferring an archive has failed.
+	EventFailed EventKind = "failed"
+)
+
+// Event describes progress made by a CharmStore. Events are sent to
+// the function registered with CharmStore.WithEventHandler. Because
+// bundle operations such as LockBundle and DiffBundles resolve charms
+// through the repository they are given, they produce events for
+// each charm in the bundle.
+type Event struct {
+	// Kind holds the kind of event.
+	Kind EventKind
+
+	// URL holds the URL being resolved or retrieved.
+	URL *charm.URL
+
+	// Id holds the fully qualified id of the entity. It is
+	// nil for EventResolving and for failed resolutions.
+	Id *charm.URL
+
+	// Resource holds the name of the resource being retrieved, for
+	// events sent when retrieving the resources of a charm with
+	// GetWithResources. It is empty for other events.
+	Resource string
+
+	// Err holds the error for EventFailed.
+	Err error
+}
+
+// String returns a human readable description of the event.
+func (e Event) String() string {
+	if e.Resource != "" {
+		switch e.Kind {
+		case EventDownloading:
+			return fmt.Sprintf("downloading resource %s of %v", e.Resource, e.Id)
+		case EventVerified:
+			return fmt.Sprintf("verified resource %s of %v", e.Resource, e.Id)
+		case EventFailed:
+			return fmt.Sprintf("failed resource %s of %v: %v", e.Resource, e.Id, e.Err)
+		}
+	}
+	switch e.Kind {
+	case EventResolving:
+		return fmt.Sprintf("resolving %v", e.URL)
+	case EventResolved:
+		return fmt.Sprintf("resolved %v to %v", e.URL, e.Id)
+	case EventDownloading:
+		return fmt.Sprintf("downloading %v", e.Id)
+	case EventVerified:
+		return fmt.Sprintf("verified %v", e.Id)
+	case EventFailed:
+		return fmt.Sprintf("failed %v: %v", e.URL, e.Err)
+	}
+	return fmt.Sprintf("%s %v", e.Kind, e.URL)
+}
+
+// WithEventHandler returns a repository Interface that calls f with
+// an event for each step taken when resolving charm URLs and
+// retrieving archives. The function may be called concurrently
+// if the repository is used concurrently.
+func (s *CharmStore) WithEventHandler(f func(Event)) *CharmStore {
+	newRepo := *s
+	newRepo.eventHandler = f
+	return &newRepo
+}
+
+// sendEvent sends the given event to the event handler, if any.
+func (s *CharmStore) sendEvent(e Event) {
+	if s.eventHandler != nil {
+		s.eventHandler(e)
+	}
+}
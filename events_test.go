@@ -0,0 +1,89 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7"
+)
+
+type eventsSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&eventsSuite{})
+
+// eventRecorder records the descriptions of events it is sent.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *eventRecorder) handle(e charmrepo.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e.String())
+}
+
+func (s *eventsSuite) TestEvents(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/xenial/wordpress-1")
+
+	var rec eventRecorder
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	}).WithEventHandler(rec.handle)
+
+	id, _, err := repo.Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	_, err = repo.Get(id, filepath.Join(c.MkDir(), "wordpress.charm"))
+	c.Assert(err, gc.IsNil)
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.NotNil)
+	c.Assert(rec.events, jc.DeepEquals, []string{
+		"resolving cs:~bob/wordpress",
+		"resolved cs:~bob/wordpress to cs:~bob/xenial/wordpress-1",
+		"downloading cs:~bob/xenial/wordpress-1",
+		"verified cs:~bob/xenial/wordpress-1",
+		"resolving cs:~bob/mysql",
+		`failed cs:~bob/mysql: cannot resolve URL "cs:~bob/mysql": charm or bundle not found`,
+	})
+}
+
+func (s *eventsSuite) TestLockBundleEvents(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/xenial/wordpress-1")
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+	store.addCharm("cs:~bob/xenial/haproxy-2")
+
+	var rec eventRecorder
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	_, err := charmrepo.LockBundle(repo.WithEventHandler(rec.handle), readBundleData(c, oldDiffBundle))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rec.events, jc.SameContents, []string{
+		"resolving cs:~bob/xenial/wordpress-1",
+		"resolved cs:~bob/xenial/wordpress-1 to cs:~bob/xenial/wordpress-1",
+		"resolving cs:~bob/mysql-5",
+		"resolved cs:~bob/mysql-5 to cs:~bob/mysql-5",
+		"resolving cs:~bob/xenial/haproxy",
+		"resolved cs:~bob/xenial/haproxy to cs:~bob/xenial/haproxy-2",
+	})
+
+	// The original repository sends no events.
+	rec.events = nil
+	_, err = charmrepo.LockBundle(repo, readBundleData(c, oldDiffBundle))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rec.events, gc.HasLen, 0)
+}
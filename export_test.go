@@ -3,4 +3,35 @@
 
 package charmrepo // import "github.com/juju/charmrepo/v7"
 
+import (
+	"net/http"
+	"time"
+)
+
 var SortChannels = sortChannels
+
+func SetSeriesCacheNow(c *SeriesCache, now func() time.Time) {
+	c.now = now
+}
+
+func SetNotFoundCacheNow(s *CharmStore, now func() time.Time) {
+	s.notFound.now = now
+}
+
+func SignS3Request(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	s := &s3Signer{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		region:    region,
+		now: func() time.Time {
+			return now
+		},
+	}
+	s.sign(req)
+}
+
+func UnregisterRepository(schema string) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	delete(factories, schema)
+}
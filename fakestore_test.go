@@ -0,0 +1,285 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/juju/charm/v9"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
+)
+
+// fakeStore implements enough of the charm store API
+// to resolve entities and download their archives.
+type fakeStore struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	entities     []*fakeEntity
+	downloads    []string
+	metaRequests int
+
+	// resolveRequests holds the number of
+	// requests for entities, found or not.
+	resolveRequests int
+
+	// beforeArchiveBody, if non-nil, is called after the
+	// headers of an archive response have been sent.
+	// It should be set with setBeforeArchiveBody.
+	beforeArchiveBody func(req *http.Request)
+}
+
+type fakeEntity struct {
+	id              *charm.URL
+	supportedSeries []string
+	archive         []byte
+
+	// private holds whether the entity is omitted from
+	// bulk metadata requests, which ignore authorization.
+	private bool
+
+	// resources holds the metadata of the entity's resources,
+	// and resourceContent holds their content keyed by name.
+	resources       []params.Resource
+	resourceContent map[string][]byte
+}
+
+func newFakeStore() *fakeStore {
+	s := &fakeStore{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// setBeforeArchiveBody sets the function called after the headers of
+// an archive response have been sent. It is safe to call while
+// requests are being served.
+func (s *fakeStore) setBeforeArchiveBody(f func(req *http.Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beforeArchiveBody = f
+}
+
+// metaRequestCount returns the number of
+// metadata requests made so far.
+func (s *fakeStore) metaRequestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metaRequests
+}
+
+// addCharm adds a charm with the given id to the store. If the id has
+// no series, the charm supports the given series.
+func (s *fakeStore) addCharm(id string, series ...string) *fakeEntity {
+	curl := charm.MustParseURL(id)
+	meta := &charm.Meta{
+		Name:    curl.Name,
+		Summary: "test charm",
+		Series:  series,
+	}
+	if len(series) == 0 {
+		series = []string{curl.Series}
+	}
+	e := &fakeEntity{
+		id:              curl,
+		supportedSeries: series,
+		archive:         charmtesting.NewCharmMeta(meta).ArchiveBytes(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entities = append(s.entities, e)
+	return e
+}
+
+// addResource adds a file resource with the given name and content
+// to the given entity.
+func (s *fakeStore) addResource(e *fakeEntity, name string, content []byte) params.Resource {
+	sum := sha512.Sum384(content)
+	res := params.Resource{
+		Name:        name,
+		Type:        "file",
+		Path:        name + ".txt",
+		Fingerprint: sum[:],
+		Size:        int64(len(content)),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.resources = append(e.resources, res)
+	if e.resourceContent == nil {
+		e.resourceContent = make(map[string][]byte)
+	}
+	e.resourceContent[name] = content
+	return res
+}
+
+// resolve returns the entity that the given reference refers to.
+func (s *fakeStore) resolve(ref *charm.URL) *fakeEntity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found *fakeEntity
+	for _, e := range s.entities {
+		if e.id.Name != ref.Name || e.id.User != ref.User {
+			continue
+		}
+		if ref.Series != "" && e.id.Series != ref.Series && !contains(e.supportedSeries, ref.Series) {
+			continue
+		}
+		if ref.Revision != -1 && e.id.Revision != ref.Revision {
+			continue
+		}
+		if found == nil || e.id.Revision > found.id.Revision {
+			found = e
+		}
+	}
+	return found
+}
+
+func (s *fakeStore) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v5/")
+	if path == "meta/any" {
+		s.serveBulkMeta(w, req)
+		return
+	}
+	var idPath, endpoint string
+	if i := strings.Index(path, "/meta/"); i >= 0 {
+		idPath, endpoint = path[:i], path[i+1:]
+	} else if i := strings.Index(path, "/resource/"); i >= 0 {
+		idPath, endpoint = path[:i], path[i+1:]
+	} else if i := strings.Index(path, "/archive"); i >= 0 {
+		idPath, endpoint = path[:i], path[i+1:]
+	}
+	ref, err := charm.ParseURL("cs:" + idPath)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, params.ErrBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.resolveRequests++
+	s.mu.Unlock()
+	e := s.resolve(ref)
+	if e == nil {
+		writeError(w, http.StatusNotFound, params.ErrNotFound, "no matching charm or bundle for "+ref.String())
+		return
+	}
+	switch endpoint {
+	case "meta/any":
+		s.mu.Lock()
+		s.metaRequests++
+		s.mu.Unlock()
+		writeJSON(w, e.metaAny())
+	case "archive":
+		s.mu.Lock()
+		s.downloads = append(s.downloads, e.id.String())
+		beforeArchiveBody := s.beforeArchiveBody
+		s.mu.Unlock()
+		w.Header().Set(params.EntityIdHeader, e.id.String())
+		w.Header().Set(params.ContentHashHeader, fmt.Sprintf("%x", sha512.Sum384(e.archive)))
+		w.Header().Set("Content-Length", fmt.Sprint(len(e.archive)))
+		if beforeArchiveBody != nil {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			beforeArchiveBody(req)
+		}
+		w.Write(e.archive)
+	case "meta/resources":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, e.resources)
+	default:
+		if strings.HasPrefix(endpoint, "meta/resources/") || strings.HasPrefix(endpoint, "resource/") {
+			s.serveResource(w, e, endpoint)
+			return
+		}
+		writeError(w, http.StatusNotFound, params.ErrNotFound, "not found")
+	}
+}
+
+// serveResource serves the metadata or content of one of the
+// resources of the given entity. Resources have a single revision.
+func (s *fakeStore) serveResource(w http.ResponseWriter, e *fakeEntity, endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts := strings.Split(endpoint, "/")
+	name := parts[len(parts)-1]
+	if len(parts) == 4 || (len(parts) == 3 && parts[0] == "resource") {
+		name = parts[len(parts)-2]
+	}
+	for _, res := range e.resources {
+		if res.Name != name {
+			continue
+		}
+		if parts[0] == "meta" {
+			writeJSON(w, res)
+			return
+		}
+		w.Header().Set(params.ContentHashHeader, fmt.Sprintf("%x", res.Fingerprint))
+		w.Header().Set("Content-Length", fmt.Sprint(len(e.resourceContent[name])))
+		w.Write(e.resourceContent[name])
+		return
+	}
+	writeError(w, http.StatusNotFound, params.ErrNotFound, "resource not found")
+}
+
+// serveBulkMeta serves a meta/any request for several entities.
+func (s *fakeStore) serveBulkMeta(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.metaRequests++
+	s.mu.Unlock()
+	resp := make(map[string]params.MetaAnyResponse)
+	for _, id := range req.URL.Query()["id"] {
+		ref, err := charm.ParseURL(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, params.ErrBadRequest, err.Error())
+			return
+		}
+		if e := s.resolve(ref); e != nil && !e.private {
+			resp[id] = e.metaAny()
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// metaAny returns the meta/any response for the entity.
+func (e *fakeEntity) metaAny() params.MetaAnyResponse {
+	return params.MetaAnyResponse{
+		Id: e.id,
+		Meta: map[string]interface{}{
+			"id":               params.IdResponse{Id: e.id, Name: e.id.Name, Revision: e.id.Revision},
+			"supported-series": params.SupportedSeriesResponse{SupportedSeries: e.supportedSeries},
+			"published":        params.PublishedResponse{Info: []params.PublishedInfo{{Channel: params.StableChannel, Current: true}}},
+			"hash":             params.HashResponse{Sum: fmt.Sprintf("%x", sha512.Sum384(e.archive))},
+			"archive-size":     params.ArchiveSizeResponse{Size: int64(len(e.archive))},
+		},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(val)
+}
+
+func writeError(w http.ResponseWriter, status int, code params.ErrorCode, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(params.Error{
+		Code:    code,
+		Message: msg,
+	})
+}
+
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
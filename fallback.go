@@ -0,0 +1,154 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// FallbackSource holds a repository used by a FallbackRepo.
+type FallbackSource struct {
+	// Name holds the name of the repository, such as "cache"
+	// or "mirror", used to identify it in errors.
+	Name string
+
+	// Repo holds the repository.
+	Repo Interface
+}
+
+// FallbackRepo is a repository Interface that tries each of a sequence
+// of repositories in turn, such as a local archive directory, then an
+// internal mirror, then a public charm store, and uses the first that
+// succeeds. This allows the same code to work whether or not the
+// public store is reachable.
+//
+// Note that each operation falls back independently, so an entity
+// resolved by one repository may be fetched from another that holds
+// the same revision.
+type FallbackRepo struct {
+	sources []FallbackSource
+}
+
+var _ Interface = (*FallbackRepo)(nil)
+
+// NewFallbackRepo returns a repository that tries
+// the given repositories in order.
+func NewFallbackRepo(sources ...FallbackSource) *FallbackRepo {
+	return &FallbackRepo{
+		sources: sources,
+	}
+}
+
+// Resolve implements Interface.Resolve. If no repository
+// can resolve ref, the returned error is a *FallbackError.
+func (r *FallbackRepo) Resolve(ref *charm.URL) (*charm.URL, []string, error) {
+	var (
+		id     *charm.URL
+		series []string
+	)
+	if err := r.try(func(repo Interface) error {
+		var err error
+		id, series, err = repo.Resolve(ref)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+	return id, series, nil
+}
+
+// Get implements Interface.Get. If no repository can
+// provide the charm, the returned error is a *FallbackError.
+func (r *FallbackRepo) Get(curl *charm.URL, archivePath string) (*charm.CharmArchive, error) {
+	var ch *charm.CharmArchive
+	if err := r.try(func(repo Interface) error {
+		var err error
+		ch, err = repo.Get(curl, archivePath)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// GetBundle implements Interface.GetBundle. If no repository
+// can provide the bundle, the returned error is a *FallbackError.
+func (r *FallbackRepo) GetBundle(curl *charm.URL, archivePath string) (charm.Bundle, error) {
+	var b charm.Bundle
+	if err := r.try(func(repo Interface) error {
+		var err error
+		b, err = repo.GetBundle(curl, archivePath)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// try calls f with each repository in turn until it succeeds,
+// returning a *FallbackError if it never does.
+func (r *FallbackRepo) try(f func(repo Interface) error) *FallbackError {
+	ferr := &FallbackError{}
+	for _, src := range r.sources {
+		err := f(src.Repo)
+		if err == nil {
+			return nil
+		}
+		logger.Debugf("repository %s failed: %v", src.Name, err)
+		ferr.Errors = append(ferr.Errors, FallbackSourceError{
+			Source: src.Name,
+			Err:    err,
+		})
+	}
+	return ferr
+}
+
+// FallbackError is the error returned by a FallbackRepo
+// when none of its repositories succeeds.
+type FallbackError struct {
+	// Errors holds the error returned by each
+	// repository, in the order they were tried.
+	Errors []FallbackSourceError
+}
+
+// FallbackSourceError holds the error returned
+// by a repository used by a FallbackRepo.
+type FallbackSourceError struct {
+	// Source holds the name of the repository.
+	Source string
+
+	// Err holds the error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *FallbackError) Error() string {
+	if len(e.Errors) == 0 {
+		return "no repositories to try"
+	}
+	msgs := make([]string, len(e.Errors))
+	for i, serr := range e.Errors {
+		msgs[i] = serr.Source + ": " + serr.Err.Error()
+	}
+	return "all repositories failed: " + strings.Join(msgs, "; ")
+}
+
+// Cause implements errgo.Causer. It returns params.ErrNotFound when
+// every repository failed because the entity was not found, so that
+// callers can check for that case as with any other repository.
+func (e *FallbackError) Cause() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	for _, serr := range e.Errors {
+		if errgo.Cause(serr.Err) != params.ErrNotFound {
+			return nil
+		}
+	}
+	return params.ErrNotFound
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient/params"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
+)
+
+type fallbackRepoSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&fallbackRepoSuite{})
+
+// offlineRepo is a repository that always fails.
+type offlineRepo struct{}
+
+func (offlineRepo) Get(*charm.URL, string) (*charm.CharmArchive, error) {
+	return nil, errgo.New("store offline")
+}
+
+func (offlineRepo) GetBundle(*charm.URL, string) (charm.Bundle, error) {
+	return nil, errgo.New("store offline")
+}
+
+func (offlineRepo) Resolve(*charm.URL) (*charm.URL, []string, error) {
+	return nil, nil, errgo.New("store offline")
+}
+
+func (s *fallbackRepoSuite) TestFallback(c *gc.C) {
+	charmPath := filepath.Join(c.MkDir(), "wordpress.charm")
+	err := ioutil.WriteFile(charmPath, charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "test charm",
+		Series:  []string{"focal"},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	cache, err := charmrepo.NewArchiveDir(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	mirror, err := charmrepo.NewArchiveDir(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	err = mirror.Add(charm.MustParseURL("cs:~bob/wordpress-2"), charmPath)
+	c.Assert(err, gc.IsNil)
+
+	repo := charmrepo.NewFallbackRepo(
+		charmrepo.FallbackSource{Name: "store", Repo: offlineRepo{}},
+		charmrepo.FallbackSource{Name: "cache", Repo: cache},
+		charmrepo.FallbackSource{Name: "mirror", Repo: mirror},
+	)
+	id, series, err := repo.Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/wordpress-2")
+	c.Assert(series, jc.DeepEquals, []string{"focal"})
+
+	ch, err := repo.Get(id, filepath.Join(c.MkDir(), "wordpress.charm"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ch.Meta().Name, gc.Equals, "wordpress")
+
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.ErrorMatches, `all repositories failed: store: store offline; cache: cannot resolve URL "cs:~bob/mysql": charm or bundle not found; mirror: cannot resolve URL "cs:~bob/mysql": charm or bundle not found`)
+	ferr, ok := err.(*charmrepo.FallbackError)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(ferr.Errors, gc.HasLen, 3)
+	c.Assert(ferr.Errors[0].Source, gc.Equals, "store")
+	// Not all repositories reported that the charm was not found.
+	c.Assert(errgo.Cause(err), gc.Equals, err)
+
+	repo = charmrepo.NewFallbackRepo(
+		charmrepo.FallbackSource{Name: "cache", Repo: cache},
+		charmrepo.FallbackSource{Name: "mirror", Repo: mirror},
+	)
+	_, err = repo.GetBundle(charm.MustParseURL("cs:bundle/wordpress-simple-1"), filepath.Join(c.MkDir(), "bundle"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, _, err = charmrepo.NewFallbackRepo().Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `no repositories to try`)
+}
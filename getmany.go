@@ -0,0 +1,125 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// defaultGetConcurrency holds the default number of
+// archives retrieved at once by CharmStore.GetMany.
+const defaultGetConcurrency = 4
+
+// GetManyParams holds the parameters for CharmStore.GetMany.
+type GetManyParams struct {
+	// Concurrency holds the maximum number of archives
+	// retrieved at once. If it is zero, a default is used.
+	Concurrency int
+
+	// Progress, if non-nil, is called with the overall progress
+	// each time an archive has been retrieved or has failed.
+	// Calls are not made concurrently.
+	Progress func(GetManyProgress)
+}
+
+// GetManyProgress holds the progress made by CharmStore.GetMany.
+type GetManyProgress struct {
+	// Result holds the result for the archive
+	// that has just been retrieved or has failed.
+	Result GetResult
+
+	// Completed holds the number of archives retrieved
+	// or failed so far, and Total holds the number
+	// of archives to retrieve.
+	Completed int
+	Total     int
+}
+
+// GetResult holds the result of retrieving a single archive.
+type GetResult struct {
+	// URL holds the URL of the charm or bundle.
+	URL *charm.URL
+
+	// Path holds the path that the archive was written to.
+	Path string
+
+	// Err holds any error encountered when
+	// retrieving or reading the archive.
+	Err error
+}
+
+// GetMany retrieves the archives of several charms and bundles
+// concurrently, writing each to the path it is mapped to in dests, as
+// Get and GetBundle do. This is useful when deploying a bundle, for
+// example. The results are returned in order of URL.
+//
+// Archives shared by several URLs are transferred only once. An error
+// retrieving one archive does not affect the others; it is recorded
+// in the archive's result.
+func (s *CharmStore) GetMany(dests map[*charm.URL]string, p GetManyParams) []GetResult {
+	if p.Concurrency <= 0 {
+		p.Concurrency = defaultGetConcurrency
+	}
+	results := make([]GetResult, 0, len(dests))
+	for curl, path := range dests {
+		results = append(results, GetResult{
+			URL:  curl,
+			Path: path,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].URL.String() < results[j].URL.String()
+	})
+
+	var (
+		mu        sync.Mutex
+		completed int
+	)
+	toGet := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < p.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range toGet {
+				result := &results[i]
+				result.Err = s.getArchiveFile(result.URL, result.Path)
+				if p.Progress == nil {
+					continue
+				}
+				mu.Lock()
+				completed++
+				p.Progress(GetManyProgress{
+					Result:    *result,
+					Completed: completed,
+					Total:     len(results),
+				})
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range results {
+		toGet <- i
+	}
+	close(toGet)
+	wg.Wait()
+	return results
+}
+
+// getArchiveFile retrieves the archive of the charm or bundle
+// with the given URL into the given file, checking that it
+// can be read.
+func (s *CharmStore) getArchiveFile(curl *charm.URL, archivePath string) error {
+	var err error
+	if curl.Series == "bundle" {
+		_, err = s.GetBundle(curl, archivePath)
+	} else {
+		_, err = s.Get(curl, archivePath)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
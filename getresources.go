@@ -0,0 +1,184 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// GetWithResourcesParams holds the parameters
+// for CharmStore.GetWithResources.
+type GetWithResourcesParams struct {
+	// Dir holds the directory to write the charm archive and
+	// resources to. It is created if needed.
+	Dir string
+
+	// Channel holds the preferred channel to resolve the charm in.
+	// The resource revisions published in the channel that the
+	// charm is resolved in are retrieved.
+	Channel params.Channel
+
+	// Resources holds the names of the resources to retrieve.
+	// If it is nil, all the resources of the charm are retrieved.
+	Resources []string
+}
+
+// FetchManifest records the charm and resources
+// retrieved by CharmStore.GetWithResources.
+type FetchManifest struct {
+	// Charm holds the fully qualified id of the charm.
+	Charm *charm.URL `yaml:"charm" json:"charm"`
+
+	// Channel holds the channel the charm was resolved in.
+	Channel params.Channel `yaml:"channel" json:"channel"`
+
+	// File holds the path of the charm archive,
+	// relative to the directory.
+	File string `yaml:"file" json:"file"`
+
+	// Resources holds the resources that were
+	// retrieved, in the order of the charm store.
+	Resources []FetchedResource `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+// FetchedResource records a resource
+// retrieved by CharmStore.GetWithResources.
+type FetchedResource struct {
+	// Name holds the name of the resource.
+	Name string `yaml:"name" json:"name"`
+
+	// Revision holds the revision of the resource.
+	Revision int `yaml:"revision" json:"revision"`
+
+	// Fingerprint holds the hex-encoded SHA384
+	// fingerprint of the resource content.
+	Fingerprint string `yaml:"fingerprint" json:"fingerprint"`
+
+	// Size holds the size of the resource content.
+	Size int64 `yaml:"size" json:"size"`
+
+	// File holds the path of the resource content,
+	// relative to the directory.
+	File string `yaml:"file" json:"file"`
+}
+
+// GetWithResources resolves the given charm URL in the given channel
+// and retrieves its archive and resources into a directory, returning
+// a manifest of what was retrieved. The archive is written to a file
+// named after the charm's name and revision, and each resource to a
+// file named by its path in the charm metadata, within a directory
+// named after the resource under the "resources" directory. The
+// archive and resources are verified as they are retrieved, and
+// progress is reported to the event handler registered with
+// WithEventHandler; resource events have their Resource field set.
+func (s *CharmStore) GetWithResources(curl *charm.URL, p GetWithResourcesParams) (*FetchManifest, error) {
+	if curl.Series == "bundle" {
+		return nil, errgo.Newf("expected a charm URL, got bundle URL %q", curl)
+	}
+	id, channel, _, err := s.ResolveWithPreferredChannel(curl, p.Channel)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if err := os.MkdirAll(p.Dir, 0755); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	manifest := &FetchManifest{
+		Charm:   id,
+		Channel: channel,
+		File:    fmt.Sprintf("%s-%d.charm", id.Name, id.Revision),
+	}
+	if err := s.getToFile(id, filepath.Join(p.Dir, manifest.File)); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	apiResources, err := s.client.WithChannel(channel).ListResources(id)
+	if err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot list resources of %q", id), errgo.Any)
+	}
+	if p.Resources != nil {
+		known := make(map[string]bool)
+		for _, apiRes := range apiResources {
+			known[apiRes.Name] = true
+		}
+		for _, name := range p.Resources {
+			if !known[name] {
+				return nil, errgo.Newf("charm %q has no resource %q", id, name)
+			}
+		}
+	}
+	for _, apiRes := range apiResources {
+		if p.Resources != nil && !containsString(p.Resources, apiRes.Name) {
+			continue
+		}
+		fetched, err := s.getResourceToDir(id, apiRes.Name, apiRes.Revision, p.Dir)
+		if err != nil {
+			s.sendEvent(Event{
+				Kind:     EventFailed,
+				URL:      id,
+				Id:       id,
+				Resource: apiRes.Name,
+				Err:      err,
+			})
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		manifest.Resources = append(manifest.Resources, fetched)
+	}
+	return manifest, nil
+}
+
+// getResourceToDir retrieves the given revision of the named resource
+// of the charm with the given id into the given directory.
+func (s *CharmStore) getResourceToDir(id *charm.URL, name string, revision int, dir string) (FetchedResource, error) {
+	res, r, err := s.GetResource(id, name, revision)
+	if err != nil {
+		return FetchedResource{}, errgo.Mask(err, errgo.Any)
+	}
+	defer r.Close()
+	s.sendEvent(Event{
+		Kind:     EventDownloading,
+		URL:      id,
+		Id:       id,
+		Resource: name,
+	})
+	path := res.Path
+	if res.Type == resource.TypeContainerImage || path == "" {
+		path = name
+	}
+	fetched := FetchedResource{
+		Name:        name,
+		Revision:    res.Revision,
+		Fingerprint: res.Fingerprint.String(),
+		Size:        res.Size,
+		File:        filepath.Join("resources", name, filepath.Base(path)),
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "resources", name), 0755); err != nil {
+		return FetchedResource{}, errgo.Mask(err)
+	}
+	sink, err := NewFileArchiveSink(filepath.Join(dir, fetched.File))
+	if err != nil {
+		return FetchedResource{}, errgo.Mask(err)
+	}
+	if _, err := io.Copy(&offsetWriter{w: sink}, r); err != nil {
+		sink.Abort()
+		return FetchedResource{}, errgo.NoteMask(err, fmt.Sprintf("cannot retrieve resource %q of %q", name, id), errgo.Any)
+	}
+	if err := sink.Commit(); err != nil {
+		return FetchedResource{}, errgo.Notef(err, "cannot commit resource %q", name)
+	}
+	s.sendEvent(Event{
+		Kind:     EventVerified,
+		URL:      id,
+		Id:       id,
+		Resource: name,
+	})
+	return fetched, nil
+}
@@ -7,6 +7,7 @@ require (
 	github.com/juju/charm/v9 v9.0.0
 	github.com/juju/errors v1.0.0
 	github.com/juju/loggo v1.0.0
+	github.com/juju/mgo/v3 v3.0.2
 	github.com/juju/testing v1.0.1
 	github.com/juju/utils/v3 v3.0.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
@@ -26,7 +27,6 @@ require (
 	github.com/juju/gojsonreference v0.0.0-20150204194633-f0d24ac5ee33 // indirect
 	github.com/juju/gojsonschema v1.0.0 // indirect
 	github.com/juju/mgo/v2 v2.0.2 // indirect
-	github.com/juju/mgo/v3 v3.0.2 // indirect
 	github.com/juju/names/v4 v4.0.0 // indirect
 	github.com/juju/os/v2 v2.2.3 // indirect
 	github.com/juju/retry v1.0.0 // indirect
@@ -0,0 +1,86 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// InferRepositoryParams holds the parameters used by InferRepository
+// to create the repository for a charm or bundle URL.
+type InferRepositoryParams struct {
+	// CharmStore holds the parameters used for "cs:" URLs.
+	CharmStore NewCharmStoreParams
+
+	// CharmHub holds the parameters used for "ch:" URLs.
+	CharmHub NewCharmHubParams
+}
+
+// RepositoryFactory returns the repository to use
+// for the given charm or bundle URL.
+type RepositoryFactory func(ref *charm.URL) (Interface, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]RepositoryFactory)
+)
+
+// RegisterRepository registers the factory used by InferRepository for
+// URLs with the given schema. It panics if the schema is "cs" or "ch",
+// which are built in, or if a factory is already registered for it.
+func RegisterRepository(schema string, f RepositoryFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if schema == charm.CharmStore.String() || schema == charm.CharmHub.String() {
+		panic(fmt.Sprintf("cannot register repository for built-in schema %q", schema))
+	}
+	if _, ok := factories[schema]; ok {
+		panic(fmt.Sprintf("repository already registered for schema %q", schema))
+	}
+	factories[schema] = f
+}
+
+// InferRepository returns the repository to use for the given charm or
+// bundle URL, based on its schema: "cs:" URLs use the charm store and
+// "ch:" URLs use Charmhub, created with the given parameters, and
+// other schemas use the factory registered with RegisterRepository.
+// If there is no repository for the schema, an error with an
+// *UnsupportedSchemeError cause is returned.
+func InferRepository(ref *charm.URL, p InferRepositoryParams) (Interface, error) {
+	switch ref.Schema {
+	case charm.CharmStore.String():
+		return NewCharmStore(p.CharmStore), nil
+	case charm.CharmHub.String():
+		return NewCharmHub(p.CharmHub), nil
+	}
+	factoriesMu.Lock()
+	f, ok := factories[ref.Schema]
+	factoriesMu.Unlock()
+	if !ok {
+		return nil, &UnsupportedSchemeError{
+			Schema: ref.Schema,
+		}
+	}
+	repo, err := f(ref)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create %s repository", ref.Schema)
+	}
+	return repo, nil
+}
+
+// UnsupportedSchemeError is the cause of the error returned by
+// InferRepository when there is no repository for a URL schema.
+type UnsupportedSchemeError struct {
+	// Schema holds the unsupported schema.
+	Schema string
+}
+
+// Error implements the error interface.
+func (e *UnsupportedSchemeError) Error() string {
+	return fmt.Sprintf("unsupported charm URL schema %q", e.Schema)
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+)
+
+type inferRepositorySuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&inferRepositorySuite{})
+
+func (s *inferRepositorySuite) TestBuiltInSchemas(c *gc.C) {
+	repo, err := charmrepo.InferRepository(charm.MustParseURL("cs:wordpress"), charmrepo.InferRepositoryParams{
+		CharmStore: charmrepo.NewCharmStoreParams{
+			URL: "https://api.example.com/charmstore",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(repo.(*charmrepo.CharmStore).URL(), gc.Equals, "https://api.example.com/charmstore")
+
+	repo, err = charmrepo.InferRepository(charm.MustParseURL("ch:wordpress"), charmrepo.InferRepositoryParams{})
+	c.Assert(err, gc.IsNil)
+	_, ok := repo.(*charmrepo.CharmHub)
+	c.Assert(ok, jc.IsTrue)
+
+	_, err = charmrepo.InferRepository(charm.MustParseURL("local:focal/wordpress"), charmrepo.InferRepositoryParams{})
+	c.Assert(err, gc.ErrorMatches, `unsupported charm URL schema "local"`)
+	c.Assert(errgo.Cause(err), jc.DeepEquals, &charmrepo.UnsupportedSchemeError{
+		Schema: "local",
+	})
+}
+
+func (s *inferRepositorySuite) TestRegisterRepository(c *gc.C) {
+	dir, err := charmrepo.NewArchiveDir(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	charmrepo.RegisterRepository("local", func(ref *charm.URL) (charmrepo.Interface, error) {
+		if ref.Name == "bad" {
+			return nil, errgo.New("bad name")
+		}
+		return dir, nil
+	})
+	defer charmrepo.UnregisterRepository("local")
+
+	repo, err := charmrepo.InferRepository(charm.MustParseURL("local:focal/wordpress"), charmrepo.InferRepositoryParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(repo, gc.Equals, dir)
+
+	_, err = charmrepo.InferRepository(charm.MustParseURL("local:focal/bad"), charmrepo.InferRepositoryParams{})
+	c.Assert(err, gc.ErrorMatches, `cannot create local repository: bad name`)
+
+	c.Assert(func() {
+		charmrepo.RegisterRepository("local", nil)
+	}, gc.PanicMatches, `repository already registered for schema "local"`)
+	c.Assert(func() {
+		charmrepo.RegisterRepository("ch", nil)
+	}, gc.PanicMatches, `cannot register repository for built-in schema "ch"`)
+}
@@ -0,0 +1,38 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build !windows
+// +build !windows
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"os"
+	"syscall"
+
+	"gopkg.in/errgo.v1"
+)
+
+// lockDir acquires an exclusive lock on the given directory, waiting
+// until any other process holding it releases it, and returns a
+// function that releases the lock. Some network file systems, such as
+// NFS mounts without a lock manager, do not support locking; on those
+// the directory is used without a lock, as on Windows.
+func lockDir(dir string) (unlock func(), err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		if err == syscall.ENOLCK || err == syscall.EOPNOTSUPP || err == syscall.ENOTSUP {
+			logger.Warningf("cannot lock %q, continuing without a lock: %v", dir, err)
+			return func() {}, nil
+		}
+		return nil, errgo.Notef(err, "cannot lock %q", dir)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
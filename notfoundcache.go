@@ -0,0 +1,94 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/charm/v9"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// notFoundCache records the charm URLs that could not be resolved
+// because no matching entity exists, so that resolving them again
+// fails without asking the charm store until the entries expire.
+// Unlike a SeriesCache, it is never shared with other charm stores,
+// so the scope of its keys is always empty.
+type notFoundCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	expires map[resolveKey]time.Time
+}
+
+// newNotFoundCache returns a cache that holds each entry for the
+// given duration, or nil if the duration is not positive.
+func newNotFoundCache(ttl time.Duration) *notFoundCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &notFoundCache{
+		ttl:     ttl,
+		now:     time.Now,
+		expires: make(map[resolveKey]time.Time),
+	}
+}
+
+// contains reports whether ref was recently found not to exist in the
+// given channel. It is OK to call contains on a nil cache.
+func (c *notFoundCache) contains(ref *charm.URL, channel params.Channel) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := resolveKey{ref: ref.String(), channel: channel}
+	expires, ok := c.expires[key]
+	if ok && !c.now().Before(expires) {
+		delete(c.expires, key)
+		return false
+	}
+	return ok
+}
+
+// add records that ref does not exist in the given channel.
+// It is OK to call add on a nil cache.
+func (c *notFoundCache) add(ref *charm.URL, channel params.Channel) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for key, expires := range c.expires {
+		if !now.Before(expires) {
+			delete(c.expires, key)
+		}
+	}
+	c.expires[resolveKey{ref: ref.String(), channel: channel}] = now.Add(c.ttl)
+}
+
+// remove removes any record that ref does not exist in the
+// given channel. It is OK to call remove on a nil cache.
+func (c *notFoundCache) remove(ref *charm.URL, channel params.Channel) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.expires, resolveKey{ref: ref.String(), channel: channel})
+}
+
+// BypassNotFoundCache returns a repository Interface that always asks
+// the charm store when resolving charm URLs, even if they were recently
+// found not to exist (see NewCharmStoreParams.NotFoundCacheTTL). The
+// results are still recorded in the cache shared with s.
+func (s *CharmStore) BypassNotFoundCache() *CharmStore {
+	newRepo := *s
+	newRepo.bypassNotFound = true
+	return &newRepo
+}
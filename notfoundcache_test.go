@@ -0,0 +1,82 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"time"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+type notFoundCacheSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&notFoundCacheSuite{})
+
+func (s *notFoundCacheSuite) TestResolveNotFoundCached(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL:              store.URL,
+		NotFoundCacheTTL: time.Minute,
+	})
+	charmrepo.SetNotFoundCacheNow(repo, func() time.Time {
+		return now
+	})
+	ref := charm.MustParseURL("cs:~bob/mysql")
+	for i := 0; i < 3; i++ {
+		_, _, err := repo.Resolve(ref)
+		c.Assert(err, gc.ErrorMatches, `cannot resolve URL "cs:~bob/mysql": charm or bundle not found`)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	}
+	c.Assert(store.metaRequests, gc.Equals, 0)
+	c.Assert(store.resolveRequests, gc.Equals, 1)
+
+	// Other channels are not affected.
+	_, _, _, err := repo.ResolveWithPreferredChannel(ref, params.EdgeChannel)
+	c.Assert(err, gc.ErrorMatches, `cannot resolve URL "cs:~bob/mysql": charm or bundle not found`)
+	c.Assert(store.resolveRequests, gc.Equals, 2)
+
+	// The cache can be bypassed, and a successful
+	// resolution removes the entry.
+	store.addCharm("cs:~bob/xenial/mysql-5")
+	_, _, err = repo.Resolve(ref)
+	c.Assert(err, gc.ErrorMatches, `cannot resolve URL "cs:~bob/mysql": charm or bundle not found`)
+	id, _, err := repo.BypassNotFoundCache().Resolve(ref)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/xenial/mysql-5")
+	_, _, err = repo.Resolve(ref)
+	c.Assert(err, gc.IsNil)
+
+	// Entries expire.
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.NotNil)
+	requests := store.resolveRequests
+	now = now.Add(time.Minute)
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.NotNil)
+	c.Assert(store.resolveRequests, gc.Equals, requests+1)
+}
+
+func (s *notFoundCacheSuite) TestNotFoundNotCachedByDefault(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	for i := 0; i < 2; i++ {
+		_, _, err := repo.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	}
+	c.Assert(store.resolveRequests, gc.Equals, 2)
+}
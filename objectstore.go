@@ -0,0 +1,232 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// NewObjectStoreParams holds parameters for instantiating
+// a new ObjectStore.
+type NewObjectStoreParams struct {
+	// URL holds the URL of the bucket, in path style, for example
+	// "https://s3.eu-west-1.amazonaws.com/mybucket" or
+	// "http://minio.internal:9000/charms". It may include a
+	// path within the bucket.
+	URL string
+
+	// HTTPClient holds the client used to make requests.
+	// If it is nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// AccessKey and SecretKey hold the credentials used to sign
+	// requests. If AccessKey is empty, requests are not signed,
+	// which is suitable for public buckets.
+	AccessKey string
+	SecretKey string
+
+	// SessionToken holds the session token to send
+	// with temporary credentials.
+	SessionToken string
+
+	// Region holds the region of the bucket. If it is empty,
+	// "us-east-1" is used, which is also what MinIO expects
+	// by default.
+	Region string
+}
+
+// ObjectStore is a repository Interface that serves charms and bundles
+// from archives held in an S3-compatible bucket, such as one served by
+// Amazon S3 or MinIO. The bucket is laid out in the same way as the
+// directory of an ArchiveDir: it holds the archives and an index object,
+// named by ArchiveIndexFile, that records the URL of each archive. A
+// bucket can be populated by uploading a directory created with
+// ArchiveDir.Add.
+//
+// The index is read when it is first needed, and again after
+// ReloadIndex is called.
+type ObjectStore struct {
+	url    string
+	client *http.Client
+	signer *s3Signer
+	index  *remoteArchiveIndex
+}
+
+var _ Interface = (*ObjectStore)(nil)
+
+// NewObjectStore returns a repository that serves
+// archives from an S3-compatible bucket.
+func NewObjectStore(p NewObjectStoreParams) *ObjectStore {
+	if p.HTTPClient == nil {
+		p.HTTPClient = http.DefaultClient
+	}
+	if p.Region == "" {
+		p.Region = "us-east-1"
+	}
+	s := &ObjectStore{
+		url:    strings.TrimSuffix(p.URL, "/"),
+		client: p.HTTPClient,
+	}
+	s.index = &remoteArchiveIndex{
+		name:      ArchiveIndexFile,
+		unmarshal: yaml.Unmarshal,
+		get:       s.get,
+	}
+	if p.AccessKey != "" {
+		s.signer = &s3Signer{
+			accessKey:    p.AccessKey,
+			secretKey:    p.SecretKey,
+			sessionToken: p.SessionToken,
+			region:       p.Region,
+			now:          time.Now,
+		}
+	}
+	return s
+}
+
+// ReloadIndex discards the index read from the bucket,
+// so that it is read again when next needed.
+func (s *ObjectStore) ReloadIndex() {
+	s.index.reload()
+}
+
+// Resolve implements Interface.Resolve.
+func (s *ObjectStore) Resolve(ref *charm.URL) (*charm.URL, []string, error) {
+	e, err := s.index.resolve(ref)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return e.id, e.supportedSeries(), nil
+}
+
+// Get implements Interface.Get.
+func (s *ObjectStore) Get(curl *charm.URL, archivePath string) (*charm.CharmArchive, error) {
+	if curl.Series == "bundle" {
+		return nil, errgo.Newf("expected a charm URL, got bundle URL %q", curl)
+	}
+	if err := s.index.getToFile(curl, archivePath); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return charm.ReadCharmArchive(archivePath)
+}
+
+// GetBundle implements Interface.GetBundle.
+func (s *ObjectStore) GetBundle(curl *charm.URL, archivePath string) (charm.Bundle, error) {
+	if curl.Series != "bundle" {
+		return nil, errgo.Newf("expected a bundle URL, got charm URL %q", curl)
+	}
+	if err := s.index.getToFile(curl, archivePath); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return charm.ReadBundleArchive(archivePath)
+}
+
+// get gets the object with the given name from the bucket. The
+// response body must be closed after use.
+func (s *ObjectStore) get(name string) (*http.Response, error) {
+	u := s.url + "/" + (&url.URL{Path: name}).EscapedPath()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if s.signer != nil {
+		s.signer.sign(req)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errgo.Newf("unexpected response status %q for %q", resp.Status, name)
+	}
+	return resp, nil
+}
+
+// emptyPayloadHash holds the hex-encoded SHA256 hash of an empty payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Signer signs requests with AWS Signature Version 4.
+type s3Signer struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+	now          func() time.Time
+}
+
+// sign signs the given request, which must have no body. All the
+// headers already set on the request are included in the signature.
+func (s *s3Signer) sign(req *http.Request) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := fmt.Sprintf("%x", hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,236 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// ArchiveFormat specifies the format of a packed charm or bundle archive.
+type ArchiveFormat string
+
+const (
+	// FormatZip specifies a zip archive, as used by the charm store.
+	FormatZip ArchiveFormat = "zip"
+
+	// FormatTarGz specifies a gzip-compressed tar archive.
+	FormatTarGz ArchiveFormat = "tar.gz"
+)
+
+// PackResult holds information about an archive written by Pack.
+type PackResult struct {
+	// Format holds the format of the archive.
+	Format ArchiveFormat
+
+	// Size holds the size of the archive in bytes.
+	Size int64
+
+	// Hash and Hash256 hold the hex-encoded SHA384 and
+	// SHA256 hashes of the archive.
+	Hash    string
+	Hash256 string
+
+	// ContentHash holds a hex-encoded SHA384 hash of the names,
+	// modes and contents of the files in the archive. Unlike Hash,
+	// it is the same whatever format the directory was packed in.
+	ContentHash string
+}
+
+// Pack writes an archive of the charm or bundle directory at the
+// given path to w in the given format, and returns information
+// about the archive written. The directory is validated by reading
+// it as a charm or bundle first. The same files are included in the
+// archive whatever the format, and the archive is reproducible: packing
+// the same directory again produces an identical archive.
+func Pack(path string, format ArchiveFormat, w io.Writer) (*PackResult, error) {
+	if format != FormatZip && format != FormatTarGz {
+		return nil, errgo.Newf("unknown archive format %q", format)
+	}
+	dir, err := readEntityDir(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Always make the zip archive first, so that
+	// both formats hold exactly the same files.
+	f, err := ioutil.TempFile("", "charmrepo-pack")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := dir.ArchiveTo(f); err != nil {
+		return nil, errgo.Notef(err, "cannot archive %q", path)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	files := append([]*zip.File(nil), zr.File...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	contentHash, err := filesContentHash(files)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	hash := sha512.New384()
+	hash256 := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(w, hash, hash256)}
+	switch format {
+	case FormatZip:
+		if _, err := io.Copy(cw, io.NewSectionReader(f, 0, size)); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	case FormatTarGz:
+		if err := writeTarGz(cw, files); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return &PackResult{
+		Format:      format,
+		Size:        cw.n,
+		Hash:        fmt.Sprintf("%x", hash.Sum(nil)),
+		Hash256:     fmt.Sprintf("%x", hash256.Sum(nil)),
+		ContentHash: contentHash,
+	}, nil
+}
+
+// PackToFile is like Pack except that it writes the archive to a file
+// with the given path, which is replaced only if packing succeeds.
+func PackToFile(path string, format ArchiveFormat, archivePath string) (*PackResult, error) {
+	sink, err := NewFileArchiveSink(archivePath)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result, err := Pack(path, format, &offsetWriter{w: sink})
+	if err != nil {
+		sink.Abort()
+		return nil, errgo.Mask(err)
+	}
+	if err := sink.Commit(); err != nil {
+		return nil, errgo.Notef(err, "cannot commit archive")
+	}
+	return result, nil
+}
+
+// entityDir is implemented by charm.CharmDir and charm.BundleDir.
+type entityDir interface {
+	ArchiveTo(w io.Writer) error
+}
+
+// readEntityDir reads the charm or bundle directory at the given path.
+func readEntityDir(path string) (entityDir, error) {
+	if _, err := os.Stat(filepath.Join(path, "bundle.yaml")); err == nil {
+		dir, err := charm.ReadBundleDir(path)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read bundle directory")
+		}
+		return dir, nil
+	}
+	dir, err := charm.ReadCharmDir(path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read charm directory")
+	}
+	return dir, nil
+}
+
+// filesContentHash returns the content hash, as described in
+// PackResult, of the given zip files, which must be sorted by name.
+func filesContentHash(files []*zip.File) (string, error) {
+	h := sha512.New384()
+	for _, zf := range files {
+		fmt.Fprintf(h, "%s\x00%o\x00", zf.Name, zf.Mode())
+		if err := copyZipFile(h, zf); err != nil {
+			return "", errgo.Mask(err)
+		}
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// writeTarGz writes the given zip files, which must be sorted by
+// name, to w as a tar.gz archive. All metadata that is not held in
+// the zip archive is left zero so that the output is reproducible.
+func writeTarGz(w io.Writer, files []*zip.File) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	for _, zf := range files {
+		mode := zf.Mode()
+		hdr := &tar.Header{
+			Name:    zf.Name,
+			Mode:    int64(mode.Perm()),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		switch {
+		case mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+		case mode&os.ModeSymlink != 0:
+			var target bytes.Buffer
+			if err := copyZipFile(&target, zf); err != nil {
+				return errgo.Mask(err)
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = target.String()
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(zf.UncompressedSize64)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errgo.Mask(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err := copyZipFile(tw, zf); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(gzw.Close())
+}
+
+// copyZipFile copies the contents of the given zip file to w.
+func copyZipFile(w io.Writer, zf *zip.File) error {
+	r, err := zf.Open()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return errgo.Mask(err)
+}
+
+// countingWriter is an io.Writer that counts the bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
+)
+
+type packSuite struct {
+	jujutesting.IsolationSuite
+	repo *charmtesting.Repo
+}
+
+var _ = gc.Suite(&packSuite{})
+
+func (s *packSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	repo, err := charmtesting.GenerateRepo(c.MkDir(), strings.NewReader(bulkImportManifest), "xenial")
+	c.Assert(err, gc.IsNil)
+	s.repo = repo
+}
+
+func (s *packSuite) TestPackFormats(c *gc.C) {
+	dir := s.repo.CharmDirPath("wordpress")
+
+	var zipData bytes.Buffer
+	zipResult, err := charmrepo.Pack(dir, charmrepo.FormatZip, &zipData)
+	c.Assert(err, gc.IsNil)
+	checkPackResult(c, zipResult, charmrepo.FormatZip, zipData.Bytes())
+	_, err = charm.ReadCharmArchiveBytes(zipData.Bytes())
+	c.Assert(err, gc.IsNil)
+
+	var tgzData bytes.Buffer
+	tgzResult, err := charmrepo.Pack(dir, charmrepo.FormatTarGz, &tgzData)
+	c.Assert(err, gc.IsNil)
+	checkPackResult(c, tgzResult, charmrepo.FormatTarGz, tgzData.Bytes())
+
+	// Both archives hold the same files.
+	c.Assert(tgzResult.ContentHash, gc.Equals, zipResult.ContentHash)
+	c.Assert(tarGzFiles(c, tgzData.Bytes()), jc.DeepEquals, zipFiles(c, zipData.Bytes()))
+
+	// Packing again produces identical archives.
+	var tgzData1 bytes.Buffer
+	tgzResult1, err := charmrepo.Pack(dir, charmrepo.FormatTarGz, &tgzData1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(tgzResult1, jc.DeepEquals, tgzResult)
+	c.Assert(tgzData1.Bytes(), jc.DeepEquals, tgzData.Bytes())
+}
+
+func (s *packSuite) TestPackBundleToFile(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "bundle.zip")
+	result, err := charmrepo.PackToFile(s.repo.BundleDirPath("wordpress-simple"), charmrepo.FormatZip, path)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	checkPackResult(c, result, charmrepo.FormatZip, data)
+	_, err = charm.ReadBundleArchiveBytes(data)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *packSuite) TestPackErrors(c *gc.C) {
+	_, err := charmrepo.Pack(s.repo.CharmDirPath("wordpress"), "rar", ioutil.Discard)
+	c.Assert(err, gc.ErrorMatches, `unknown archive format "rar"`)
+
+	_, err = charmrepo.Pack(c.MkDir(), charmrepo.FormatZip, ioutil.Discard)
+	c.Assert(err, gc.ErrorMatches, `cannot read charm directory: .*`)
+
+	path := filepath.Join(c.MkDir(), "charm.zip")
+	_, err = charmrepo.PackToFile(c.MkDir(), charmrepo.FormatZip, path)
+	c.Assert(err, gc.ErrorMatches, `cannot read charm directory: .*`)
+	c.Assert(path, jc.DoesNotExist)
+}
+
+func checkPackResult(c *gc.C, result *charmrepo.PackResult, format charmrepo.ArchiveFormat, data []byte) {
+	c.Assert(result.Format, gc.Equals, format)
+	c.Assert(result.Size, gc.Equals, int64(len(data)))
+	c.Assert(result.Hash, gc.Equals, fmt.Sprintf("%x", sha512.Sum384(data)))
+	c.Assert(result.Hash256, gc.Equals, fmt.Sprintf("%x", sha256.Sum256(data)))
+	c.Assert(result.ContentHash, gc.Not(gc.Equals), "")
+}
+
+// zipFiles returns the names and contents of the files in a zip archive.
+func zipFiles(c *gc.C, data []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, gc.IsNil)
+	files := make(map[string]string)
+	for _, zf := range zr.File {
+		r, err := zf.Open()
+		c.Assert(err, gc.IsNil)
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		c.Assert(err, gc.IsNil)
+		files[fmt.Sprintf("%s %v", zf.Name, zf.Mode())] = string(content)
+	}
+	return files
+}
+
+// tarGzFiles returns the names and contents of the files in a tar.gz
+// archive, checking that they are sorted by name.
+func tarGzFiles(c *gc.C, data []byte) map[string]string {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	tr := tar.NewReader(gzr)
+	files := make(map[string]string)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, gc.IsNil)
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, gc.IsNil)
+		files[fmt.Sprintf("%s %v", hdr.Name, hdr.FileInfo().Mode())] = string(content)
+		names = append(names, hdr.Name)
+	}
+	c.Assert(sort.StringsAreSorted(names), jc.IsTrue)
+	return files
+}
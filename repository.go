@@ -0,0 +1,234 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// Repository is a store-neutral interface to a repository of charms and
+// bundles. Unlike Interface, it does not depend on the URL conventions
+// of a particular store, so code written against it can use either the
+// legacy charm store or Charmhub. Use NewCharmStoreRepository or
+// NewCharmHubRepository to obtain one.
+type Repository interface {
+	// Resolve resolves the charm or bundle with the given name in
+	// the given channel, in "[track/]risk" form, to a specific
+	// revision that runs on the given base. If the entity is not
+	// found, an error with a params.ErrNotFound cause is returned.
+	Resolve(name, channel string, base Base) (*ResolvedEntity, error)
+
+	// Download writes the archive of the charm or bundle with
+	// the given resolved URL to a file with the given path.
+	// Note that the path's parent directory must already exist.
+	Download(id *charm.URL, archivePath string) error
+
+	// ListResources returns the resources of the charm
+	// with the given resolved URL.
+	ListResources(id *charm.URL) ([]resource.Resource, error)
+}
+
+// Base identifies an operating system and architecture
+// that a charm runs on.
+type Base struct {
+	// Name holds the name of the operating system, such as "ubuntu".
+	Name string
+
+	// Channel holds the version of the operating system,
+	// such as "22.04".
+	Channel string
+
+	// Architecture holds the architecture, such as "amd64".
+	Architecture string
+}
+
+// ResolvedEntity holds the result of resolving a charm
+// or bundle with Repository.Resolve.
+type ResolvedEntity struct {
+	// URL holds the URL that identifies the revision,
+	// which can be passed to Download and ListResources.
+	URL *charm.URL
+
+	// Channel holds the channel that the revision was found in.
+	Channel string
+
+	// Bases holds the bases that the revision runs on.
+	Bases []Base
+}
+
+// NewCharmStoreRepository returns a Repository that uses
+// the given charm store repository.
+func NewCharmStoreRepository(s *CharmStore) Repository {
+	return charmStoreRepository{s}
+}
+
+type charmStoreRepository struct {
+	s *CharmStore
+}
+
+// Resolve implements Repository.Resolve.
+func (r charmStoreRepository) Resolve(name, channel string, base Base) (*ResolvedEntity, error) {
+	ref, err := charm.ParseURL(charm.CharmStore.Prefix(name))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// The charm store has no tracks, so only the risk is used.
+	risk := parseCharmHubChannel(channel).risk
+	id, resolvedChannel, supportedSeries, err := r.s.ResolveForBase(ref, params.Channel(risk), base)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if id.Series != "" && id.Series != "bundle" {
+		supportedSeries = []string{id.Series}
+	}
+	return &ResolvedEntity{
+		URL:     id,
+		Channel: string(resolvedChannel),
+		Bases:   seriesBases(supportedSeries, base.Architecture),
+	}, nil
+}
+
+// Download implements Repository.Download.
+func (r charmStoreRepository) Download(id *charm.URL, archivePath string) error {
+	return errgo.Mask(r.s.getToFile(id, archivePath), errgo.Any)
+}
+
+// ListResources implements Repository.ListResources.
+func (r charmStoreRepository) ListResources(id *charm.URL) ([]resource.Resource, error) {
+	results, err := r.s.ListResources([]*charm.URL{id})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if err := results[0].Err; err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return results[0].Resources, nil
+}
+
+// NewCharmHubRepository returns a Repository that uses
+// the given Charmhub repository.
+func NewCharmHubRepository(h *CharmHub) Repository {
+	return charmHubRepository{h}
+}
+
+type charmHubRepository struct {
+	h *CharmHub
+}
+
+// Resolve implements Repository.Resolve.
+func (r charmHubRepository) Resolve(name, channel string, base Base) (*ResolvedEntity, error) {
+	ref, err := baseURL(name, base)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	h := *r.h
+	if channel != "" {
+		h.channel = parseCharmHubChannel(channel)
+	}
+	id, supportedSeries, err := h.Resolve(ref)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return &ResolvedEntity{
+		URL:     id,
+		Channel: h.channel.String(),
+		Bases:   seriesBases(supportedSeries, id.Architecture),
+	}, nil
+}
+
+// Download implements Repository.Download.
+func (r charmHubRepository) Download(id *charm.URL, archivePath string) error {
+	return errgo.Mask(r.h.getToFile(id, archivePath), errgo.Any)
+}
+
+// ListResources implements Repository.ListResources. The URL
+// must specify a series and a revision, as do the URLs returned
+// by Resolve for a base.
+func (r charmHubRepository) ListResources(id *charm.URL) ([]resource.Resource, error) {
+	if id.Series == "" || id.Revision < 0 {
+		return nil, errgo.Newf("cannot list resources of %q: URL must specify a series and revision", id)
+	}
+	rev, err := r.h.refresh(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	resources := make([]resource.Resource, len(rev.Resources))
+	for i, chRes := range rev.Resources {
+		res, err := chRes.resource()
+		if err != nil {
+			return nil, errgo.Notef(err, "bad resource %q of %q", chRes.Name, id)
+		}
+		resources[i] = res
+	}
+	return resources, nil
+}
+
+// resource returns the resource as a charm resource.
+func (r CharmHubResource) resource() (resource.Resource, error) {
+	rtype, err := resource.ParseType(r.Type)
+	if err != nil {
+		return resource.Resource{}, errgo.Mask(err)
+	}
+	var fp resource.Fingerprint
+	if r.Download.HashSHA384 != "" {
+		fp, err = resource.ParseFingerprint(r.Download.HashSHA384)
+		if err != nil {
+			return resource.Resource{}, errgo.Mask(err)
+		}
+	}
+	res := resource.Resource{
+		Meta: resource.Meta{
+			Name:        r.Name,
+			Type:        rtype,
+			Path:        r.Path,
+			Description: r.Description,
+		},
+		Origin:      resource.OriginStore,
+		Revision:    r.Revision,
+		Fingerprint: fp,
+		Size:        r.Download.Size,
+	}
+	if err := res.Validate(); err != nil {
+		return resource.Resource{}, errgo.Mask(err)
+	}
+	return res, nil
+}
+
+// baseURL returns a Charmhub URL referring to the entity
+// with the given name that runs on the given base.
+func baseURL(name string, base Base) (*charm.URL, error) {
+	ref, err := charm.ParseURL(charm.CharmHub.Prefix(name))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ref.Architecture = base.Architecture
+	if base.Name == "" {
+		return ref, nil
+	}
+	series := baseSeries(base.Name, base.Channel)
+	if series == "" {
+		return nil, errgo.Newf("unknown base %s/%s", base.Name, base.Channel)
+	}
+	return ref.WithSeries(series), nil
+}
+
+// seriesBases returns the bases for the given series.
+// Unknown series, including the bundle series, are ignored.
+func seriesBases(series []string, arch string) []Base {
+	var bases []Base
+	for _, s := range series {
+		if name, channel, ok := seriesBase(s); ok {
+			bases = append(bases, Base{
+				Name:         name,
+				Channel:      channel,
+				Architecture: arch,
+			})
+		}
+	}
+	return bases
+}
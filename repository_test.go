@@ -0,0 +1,75 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+type repositorySuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&repositorySuite{})
+
+func (s *repositorySuite) TestCharmStoreRepository(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+	store.addResource(e, "data", []byte("some data"))
+
+	repo := charmrepo.NewCharmStoreRepository(charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	}))
+	entity, err := repo.Resolve("~bob/mysql", "stable", charmrepo.Base{
+		Name:         "ubuntu",
+		Channel:      "18.04",
+		Architecture: "amd64",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.URL.String(), gc.Equals, "cs:~bob/mysql-5")
+	c.Assert(entity.Channel, gc.Equals, "stable")
+	c.Assert(entity.Bases, jc.DeepEquals, []charmrepo.Base{{
+		Name:         "ubuntu",
+		Channel:      "16.04",
+		Architecture: "amd64",
+	}, {
+		Name:         "ubuntu",
+		Channel:      "18.04",
+		Architecture: "amd64",
+	}})
+
+	path := filepath.Join(c.MkDir(), "mysql.charm")
+	err = repo.Download(entity.URL, path)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, e.archive)
+
+	resources, err := repo.ListResources(entity.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 1)
+	c.Assert(resources[0].Name, gc.Equals, "data")
+
+	_, err = repo.Resolve("~bob/mysql", "", charmrepo.Base{
+		Name:    "ubuntu",
+		Channel: "22.04",
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, err = repo.Resolve("~bob/mysql", "", charmrepo.Base{
+		Name:    "windows",
+		Channel: "10",
+	})
+	c.Assert(err, gc.ErrorMatches, `unknown base windows/10`)
+}
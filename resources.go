@@ -0,0 +1,155 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// ListResources returns the resources of each of the given charms,
+// in the same order. An error retrieving the resources of a charm is
+// held in the Err field of its result; the returned error is only
+// non-nil if the charm store does not support resources.
+func (s *CharmStore) ListResources(curls []*charm.URL) ([]ResourceResult, error) {
+	results := make([]ResourceResult, len(curls))
+	for i, curl := range curls {
+		apiResources, err := s.client.ListResources(curl)
+		if err != nil {
+			if errgo.Cause(err) == csclient.ErrNotSupported {
+				return nil, errgo.Mask(err, errgo.Is(csclient.ErrNotSupported))
+			}
+			results[i].Err = errgo.Mask(err, errgo.Any)
+			continue
+		}
+		resources := make([]resource.Resource, len(apiResources))
+		for j, apiRes := range apiResources {
+			res, err := params.API2Resource(apiRes)
+			if err != nil {
+				results[i].Err = errgo.Notef(err, "bad resource %q of %q", apiRes.Name, curl)
+				break
+			}
+			resources[j] = res
+		}
+		if results[i].Err == nil {
+			results[i].Resources = resources
+		}
+	}
+	return results, nil
+}
+
+// ResourceInfo returns the metadata for the resource with the given
+// name and revision attached to the given charm. If the revision is
+// negative, the resource published in the client's channel is returned.
+func (s *CharmStore) ResourceInfo(curl *charm.URL, name string, revision int) (resource.Resource, error) {
+	apiRes, err := s.client.ResourceMeta(curl, name, revision)
+	if err != nil {
+		return resource.Resource{}, errgo.Mask(err, errgo.Any)
+	}
+	res, err := params.API2Resource(apiRes)
+	if err != nil {
+		return resource.Resource{}, errgo.Notef(err, "bad resource %q of %q", name, curl)
+	}
+	return res, nil
+}
+
+// GetResource returns the metadata for the resource with the given
+// name and revision attached to the given charm, as for ResourceInfo,
+// and a reader for its content. If the content does not match the
+// fingerprint and size in the metadata, reading it fails with a
+// *csclient.HashMismatchError cause. The reader must be closed after
+// use.
+func (s *CharmStore) GetResource(curl *charm.URL, name string, revision int) (resource.Resource, io.ReadCloser, error) {
+	res, err := s.ResourceInfo(curl, name, revision)
+	if err != nil {
+		return resource.Resource{}, nil, errgo.Mask(err, errgo.Any)
+	}
+	data, err := s.client.GetResource(curl, name, res.Revision)
+	if err != nil {
+		return resource.Resource{}, nil, errgo.Mask(err, errgo.Any)
+	}
+	if data.HashAlgorithm == "" || data.HashAlgorithm == csclient.SHA384 {
+		if data.Hash != res.Fingerprint.String() {
+			data.Close()
+			return resource.Resource{}, nil, errgo.Newf("fingerprint mismatch for resource %q of %q (metadata has %s, content has %s)", name, curl, res.Fingerprint, data.Hash)
+		}
+	}
+	return res, &fingerprintReader{
+		ReadCloser: data.ReadCloser,
+		hash:       resource.NewFingerprintHash(),
+		mismatch: csclient.HashMismatchError{
+			Id:           curl,
+			Resource:     name,
+			ExpectedHash: res.Fingerprint.String(),
+			ExpectedSize: res.Size,
+			Proxied:      data.Proxied,
+		},
+	}, nil
+}
+
+// UploadResource uploads the content of the given resource, attached
+// to the given charm, and returns the revision of the new resource. The
+// content is read from the given reader, which must hold res.Size
+// bytes matching res.Fingerprint.
+func (s *CharmStore) UploadResource(curl *charm.URL, res resource.Resource, content io.ReaderAt) (revision int, err error) {
+	if err := res.Validate(); err != nil {
+		return -1, errgo.Notef(err, "invalid resource")
+	}
+	fp, err := resource.GenerateFingerprint(io.NewSectionReader(content, 0, res.Size))
+	if err != nil {
+		return -1, errgo.Notef(err, "cannot read resource %q", res.Name)
+	}
+	if fp.String() != res.Fingerprint.String() {
+		return -1, errgo.Newf("content of resource %q does not match its fingerprint", res.Name)
+	}
+	revision, err = s.client.UploadResource(curl, res.Name, res.Path, content, res.Size, nil)
+	if err != nil {
+		return -1, errgo.Mask(err, errgo.Any)
+	}
+	return revision, nil
+}
+
+// Publish publishes the charm or bundle with the given id to the given
+// channels, along with the given resource revisions, keyed by resource
+// name.
+func (s *CharmStore) Publish(curl *charm.URL, channels []params.Channel, resources map[string]int) error {
+	if err := s.client.Publish(curl, channels, resources); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return nil
+}
+
+// fingerprintReader implements io.ReadCloser by reading resource
+// content from another reader and checking that it matches the
+// expected fingerprint and size by the time the end is reached.
+type fingerprintReader struct {
+	io.ReadCloser
+	hash     *resource.FingerprintHash
+	n        int64
+	mismatch csclient.HashMismatchError
+}
+
+// Read implements io.Reader.Read.
+func (r *fingerprintReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	r.hash.Write(buf[:n])
+	r.n += int64(n)
+	if err == io.EOF {
+		actualHash := fmt.Sprintf("%x", r.hash.Sum(nil))
+		if r.n != r.mismatch.ExpectedSize || actualHash != r.mismatch.ExpectedHash {
+			mismatch := r.mismatch
+			mismatch.ActualHash = actualHash
+			mismatch.BytesRead = r.n
+			err = &mismatch
+		}
+	}
+	return n, err
+}
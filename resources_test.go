@@ -0,0 +1,189 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+type resourcesSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&resourcesSuite{})
+
+func (s *resourcesSuite) TestListResources(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/xenial/wordpress-1")
+	apiRes := store.addResource(e, "data", []byte("some data"))
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	results, err := repo.ListResources([]*charm.URL{
+		charm.MustParseURL("cs:~bob/xenial/wordpress-1"),
+		charm.MustParseURL("cs:~bob/xenial/nothere-1"),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(results, gc.HasLen, 2)
+	c.Assert(results[0].Err, gc.IsNil)
+	expect, err := params.API2Resource(apiRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(results[0].Resources, jc.DeepEquals, []resource.Resource{expect})
+	c.Assert(results[1].Resources, gc.IsNil)
+	c.Assert(errgo.Cause(results[1].Err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *resourcesSuite) TestGetResource(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/xenial/wordpress-1")
+	store.addResource(e, "data", []byte("some data"))
+	id := charm.MustParseURL("cs:~bob/xenial/wordpress-1")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	info, err := repo.ResourceInfo(id, "data", -1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Name, gc.Equals, "data")
+	c.Assert(info.Type, gc.Equals, resource.TypeFile)
+	c.Assert(info.Path, gc.Equals, "data.txt")
+
+	res, r, err := repo.GetResource(id, "data", -1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res, jc.DeepEquals, info)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "some data")
+
+	// Content that does not match the fingerprint is rejected.
+	e.resourceContent["data"] = []byte("bad data!")
+	_, r, err = repo.GetResource(id, "data", -1)
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.ErrorMatches, `hash mismatch reading resource "data" of "cs:~bob/xenial/wordpress-1" .*`)
+	_, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, jc.IsTrue)
+
+	_, _, err = repo.GetResource(id, "other", -1)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *resourcesSuite) TestUploadResourceFingerprintMismatch(c *gc.C) {
+	fp, err := resource.GenerateFingerprint(bytes.NewReader([]byte("some data")))
+	c.Assert(err, gc.IsNil)
+	res := resource.Resource{
+		Meta: resource.Meta{
+			Name: "data",
+			Type: resource.TypeFile,
+			Path: "data.txt",
+		},
+		Origin:      resource.OriginUpload,
+		Fingerprint: fp,
+		Size:        9,
+	}
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: "http://0.1.2.3",
+	})
+	_, err = repo.UploadResource(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), res, bytes.NewReader([]byte("bad data!")))
+	c.Assert(err, gc.ErrorMatches, `content of resource "data" does not match its fingerprint`)
+}
+
+func (s *resourcesSuite) TestGetWithResources(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/xenial/wordpress-1")
+	store.addResource(e, "data", []byte("some data"))
+	store.addResource(e, "theme", []byte("dark"))
+	e.resources[1].Revision = 3
+
+	var events []string
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	}).WithEventHandler(func(e charmrepo.Event) {
+		events = append(events, e.String())
+	})
+	dir := filepath.Join(c.MkDir(), "fetched")
+	manifest, err := repo.GetWithResources(charm.MustParseURL("cs:~bob/wordpress"), charmrepo.GetWithResourcesParams{
+		Dir:     dir,
+		Channel: params.StableChannel,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(manifest, jc.DeepEquals, &charmrepo.FetchManifest{
+		Charm:   charm.MustParseURL("cs:~bob/xenial/wordpress-1"),
+		Channel: params.StableChannel,
+		File:    "wordpress-1.charm",
+		Resources: []charmrepo.FetchedResource{{
+			Name:        "data",
+			Fingerprint: fmt.Sprintf("%x", sha512.Sum384([]byte("some data"))),
+			Size:        9,
+			File:        filepath.Join("resources", "data", "data.txt"),
+		}, {
+			Name:        "theme",
+			Revision:    3,
+			Fingerprint: fmt.Sprintf("%x", sha512.Sum384([]byte("dark"))),
+			Size:        4,
+			File:        filepath.Join("resources", "theme", "theme.txt"),
+		}},
+	})
+	data, err := ioutil.ReadFile(filepath.Join(dir, "wordpress-1.charm"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, e.archive)
+	data, err = ioutil.ReadFile(filepath.Join(dir, "resources", "theme", "theme.txt"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "dark")
+	c.Assert(events, jc.DeepEquals, []string{
+		"resolving cs:~bob/wordpress",
+		"resolved cs:~bob/wordpress to cs:~bob/xenial/wordpress-1",
+		"downloading cs:~bob/xenial/wordpress-1",
+		"verified cs:~bob/xenial/wordpress-1",
+		"downloading resource data of cs:~bob/xenial/wordpress-1",
+		"verified resource data of cs:~bob/xenial/wordpress-1",
+		"downloading resource theme of cs:~bob/xenial/wordpress-1",
+		"verified resource theme of cs:~bob/xenial/wordpress-1",
+	})
+
+	// Only the selected resources are retrieved.
+	manifest, err = repo.GetWithResources(charm.MustParseURL("cs:~bob/wordpress"), charmrepo.GetWithResourcesParams{
+		Dir:       c.MkDir(),
+		Resources: []string{"theme"},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(manifest.Resources, gc.HasLen, 1)
+	c.Assert(manifest.Resources[0].Name, gc.Equals, "theme")
+
+	_, err = repo.GetWithResources(charm.MustParseURL("cs:~bob/wordpress"), charmrepo.GetWithResourcesParams{
+		Dir:       c.MkDir(),
+		Resources: []string{"logo"},
+	})
+	c.Assert(err, gc.ErrorMatches, `charm "cs:~bob/xenial/wordpress-1" has no resource "logo"`)
+
+	// Corrupt resource content is rejected.
+	e.resourceContent["theme"] = []byte("pink")
+	_, err = repo.GetWithResources(charm.MustParseURL("cs:~bob/wordpress"), charmrepo.GetWithResourcesParams{
+		Dir:       c.MkDir(),
+		Resources: []string{"theme"},
+	})
+	_, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, jc.IsTrue, gc.Commentf("error %v", err))
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// SeriesNotSupportedError is the error cause returned by GetForSeries
+// when the charm does not support the requested series.
+type SeriesNotSupportedError struct {
+	// URL holds the resolved URL of the charm.
+	URL *charm.URL
+
+	// Series holds the series that was requested.
+	Series string
+
+	// SupportedSeries holds the series that the charm supports.
+	SupportedSeries []string
+}
+
+// Error implements error.Error.
+func (e *SeriesNotSupportedError) Error() string {
+	if len(e.SupportedSeries) == 0 {
+		return fmt.Sprintf("charm %q does not support series %q", e.URL, e.Series)
+	}
+	return fmt.Sprintf("charm %q does not support series %q (supported series: %s)", e.URL, e.Series, strings.Join(e.SupportedSeries, " "))
+}
+
+// GetForSeries is like Get except that it first resolves curl, which
+// need not specify a series, and checks that the resolved charm
+// supports the given series. If it does not, an error with a
+// *SeriesNotSupportedError cause is returned. Otherwise the charm is
+// retrieved and returned along with its resolved URL, which always
+// holds the given series.
+func (s *CharmStore) GetForSeries(curl *charm.URL, series, archivePath string) (*charm.CharmArchive, *charm.URL, error) {
+	if curl.Series == "bundle" {
+		return nil, nil, errgo.Newf("expected a charm URL, got bundle URL %q", curl)
+	}
+	if series == "" {
+		return nil, nil, errgo.Newf("no series specified for %q", curl)
+	}
+	id, supportedSeries, err := s.Resolve(curl)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	if id.Series != "" {
+		supportedSeries = []string{id.Series}
+	}
+	if !containsString(supportedSeries, series) {
+		return nil, nil, errgo.WithCausef(nil, &SeriesNotSupportedError{
+			URL:             id,
+			Series:          series,
+			SupportedSeries: supportedSeries,
+		}, "")
+	}
+	ch, err := s.Get(id, archivePath)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	return ch, id.WithSeries(series), nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
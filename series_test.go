@@ -0,0 +1,53 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"path/filepath"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+)
+
+type seriesSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&seriesSuite{})
+
+func (s *seriesSuite) TestGetForSeries(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+	store.addCharm("cs:~bob/trusty/wordpress-2")
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	dir := c.MkDir()
+
+	ch, id, err := repo.GetForSeries(charm.MustParseURL("cs:~bob/mysql"), "bionic", filepath.Join(dir, "mysql.charm"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/bionic/mysql-5")
+	c.Assert(ch.Meta().Name, gc.Equals, "mysql")
+
+	_, _, err = repo.GetForSeries(charm.MustParseURL("cs:~bob/mysql"), "trusty", filepath.Join(dir, "mysql.charm"))
+	c.Assert(err, gc.ErrorMatches, `charm "cs:~bob/mysql-5" does not support series "trusty" \(supported series: xenial bionic\)`)
+	c.Assert(errgo.Cause(err), jc.DeepEquals, &charmrepo.SeriesNotSupportedError{
+		URL:             charm.MustParseURL("cs:~bob/mysql-5"),
+		Series:          "trusty",
+		SupportedSeries: []string{"xenial", "bionic"},
+	})
+
+	_, _, err = repo.GetForSeries(charm.MustParseURL("cs:~bob/wordpress"), "xenial", filepath.Join(dir, "wordpress.charm"))
+	c.Assert(err, gc.ErrorMatches, `charm "cs:~bob/trusty/wordpress-2" does not support series "xenial" \(supported series: trusty\)`)
+	c.Assert(store.downloads, jc.DeepEquals, []string{"cs:~bob/mysql-5"})
+
+	_, _, err = repo.GetForSeries(charm.MustParseURL("cs:~bob/bundle/wordpress-simple"), "xenial", filepath.Join(dir, "bundle"))
+	c.Assert(err, gc.ErrorMatches, `expected a charm URL, got bundle URL "cs:~bob/bundle/wordpress-simple"`)
+}
@@ -0,0 +1,192 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/charm/v9"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// SeriesCache holds the results of resolving charm URLs, including
+// the series supported by each resolved charm, for a limited time.
+// When a CharmStore has a SeriesCache, Resolve uses it to avoid
+// resolving the same URL more than once, which is useful when the
+// same charm is used by many applications in a bundle.
+//
+// A SeriesCache may be shared by several repositories. Results are
+// kept separately for each charm store URL and, as private charms
+// resolve differently for different users, for each user that the
+// repository authenticates as with basic authentication (see
+// csclient.Client.User). Repositories that authenticate in other
+// ways, such as with macaroons, cannot be told apart, so they should
+// only share a cache when they authenticate as the same user.
+//
+// A SeriesCache is safe to use concurrently.
+type SeriesCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu       sync.Mutex
+	resolved map[resolveKey]resolveEntry
+	series   map[seriesKey]seriesEntry
+}
+
+// cacheScope identifies the charm store, and the user
+// authenticated with it, that a SeriesCache entry is for.
+type cacheScope struct {
+	store string
+	user  string
+}
+
+// resolveKey holds the key of a resolved URL in a SeriesCache.
+type resolveKey struct {
+	scope   cacheScope
+	ref     string
+	channel params.Channel
+}
+
+// seriesKey holds the key of the supported series of a charm in a
+// SeriesCache. The series of a charm do not depend on the user.
+type seriesKey struct {
+	store string
+	id    string
+}
+
+type resolveEntry struct {
+	result  ResolveResult
+	expires time.Time
+}
+
+type seriesEntry struct {
+	series  []string
+	expires time.Time
+}
+
+// NewSeriesCache returns a new cache that holds
+// each entry for the given duration.
+func NewSeriesCache(ttl time.Duration) *SeriesCache {
+	return &SeriesCache{
+		ttl:      ttl,
+		now:      time.Now,
+		resolved: make(map[resolveKey]resolveEntry),
+		series:   make(map[seriesKey]seriesEntry),
+	}
+}
+
+// supportedSeries returns the series supported by the charm with the
+// given fully qualified id in the charm store with the given URL, as
+// reported when it was resolved. It reports whether the charm was
+// found in the cache.
+func (c *SeriesCache) supportedSeries(store string, id *charm.URL) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := seriesKey{store, id.String()}
+	e, ok := c.series[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.series, key)
+		return nil, false
+	}
+	return append([]string(nil), e.series...), true
+}
+
+// getResolved returns the cached result of resolving ref in the given
+// channel with the given scope. It is OK to call getResolved on a nil
+// cache.
+func (c *SeriesCache) getResolved(scope cacheScope, ref *charm.URL, channel params.Channel) (ResolveResult, bool) {
+	if c == nil {
+		return ResolveResult{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := resolveKey{scope, ref.String(), channel}
+	e, ok := c.resolved[key]
+	if !ok {
+		return ResolveResult{}, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.resolved, key)
+		return ResolveResult{}, false
+	}
+	return e.result.copy(), true
+}
+
+// addResolved records the result of resolving ref in the given
+// channel with the given scope. It is OK to call addResolved on a nil
+// cache.
+func (c *SeriesCache) addResolved(scope cacheScope, ref *charm.URL, channel params.Channel, r ResolveResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.removeExpired(now)
+	expires := now.Add(c.ttl)
+	r = r.copy()
+	c.resolved[resolveKey{scope, ref.String(), channel}] = resolveEntry{
+		result:  r,
+		expires: expires,
+	}
+	c.series[seriesKey{scope.store, r.URL.String()}] = seriesEntry{
+		series:  r.SupportedSeries,
+		expires: expires,
+	}
+}
+
+// removeExpired removes all the entries that have expired
+// at the given time. Called with c.mu held.
+func (c *SeriesCache) removeExpired(now time.Time) {
+	for key, e := range c.resolved {
+		if !now.Before(e.expires) {
+			delete(c.resolved, key)
+		}
+	}
+	for key, e := range c.series {
+		if !now.Before(e.expires) {
+			delete(c.series, key)
+		}
+	}
+}
+
+// WithSeriesCache returns a repository Interface that uses the given
+// cache when resolving charm URLs.
+func (s *CharmStore) WithSeriesCache(cache *SeriesCache) *CharmStore {
+	newRepo := *s
+	newRepo.seriesCache = cache
+	return &newRepo
+}
+
+// SeriesCache returns the cache used when resolving
+// charm URLs, or nil if there is none.
+func (s *CharmStore) SeriesCache() *SeriesCache {
+	return s.seriesCache
+}
+
+// CachedSupportedSeries returns the series supported by the charm with
+// the given fully qualified id, as reported when it was resolved by a
+// repository using the same charm store and SeriesCache. It reports
+// whether the charm was found in the cache; it is never found if the
+// repository has no SeriesCache.
+func (s *CharmStore) CachedSupportedSeries(id *charm.URL) ([]string, bool) {
+	if s.seriesCache == nil {
+		return nil, false
+	}
+	return s.seriesCache.supportedSeries(s.client.ServerURL(), id)
+}
+
+// cacheScope returns the scope of the
+// repository's SeriesCache entries.
+func (s *CharmStore) cacheScope() cacheScope {
+	return cacheScope{
+		store: s.client.ServerURL(),
+		user:  s.client.User(),
+	}
+}
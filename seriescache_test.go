@@ -0,0 +1,170 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"time"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+type seriesCacheSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&seriesCacheSuite{})
+
+func (s *seriesCacheSuite) TestResolveUsesCache(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := charmrepo.NewSeriesCache(time.Minute)
+	charmrepo.SetSeriesCacheNow(cache, func() time.Time {
+		return now
+	})
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	}).WithSeriesCache(cache)
+	c.Assert(repo.SeriesCache(), gc.Equals, cache)
+
+	_, ok := repo.CachedSupportedSeries(charm.MustParseURL("cs:~bob/mysql-5"))
+	c.Assert(ok, jc.IsFalse)
+
+	for i := 0; i < 3; i++ {
+		id, channel, series, err := repo.ResolveWithPreferredChannel(charm.MustParseURL("cs:~bob/mysql"), params.NoChannel)
+		c.Assert(err, gc.IsNil)
+		c.Assert(id.String(), gc.Equals, "cs:~bob/mysql-5")
+		c.Assert(channel, gc.Equals, params.StableChannel)
+		c.Assert(series, jc.DeepEquals, []string{"xenial", "bionic"})
+	}
+	c.Assert(store.metaRequests, gc.Equals, 1)
+
+	series, ok := repo.CachedSupportedSeries(charm.MustParseURL("cs:~bob/mysql-5"))
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(series, jc.DeepEquals, []string{"xenial", "bionic"})
+
+	// Resolving in another channel is not answered from the cache.
+	_, _, _, err := repo.ResolveWithPreferredChannel(charm.MustParseURL("cs:~bob/mysql"), params.EdgeChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.metaRequests, gc.Equals, 2)
+
+	// When the entries expire, the charm is resolved again.
+	now = now.Add(time.Minute)
+	_, ok = repo.CachedSupportedSeries(charm.MustParseURL("cs:~bob/mysql-5"))
+	c.Assert(ok, jc.IsFalse)
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.metaRequests, gc.Equals, 3)
+}
+
+func (s *seriesCacheSuite) TestResolveCacheTTL(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL:             store.URL,
+		ResolveCacheTTL: time.Minute,
+	})
+	c.Assert(repo.SeriesCache(), gc.NotNil)
+	for i := 0; i < 2; i++ {
+		_, _, err := repo.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(store.metaRequests, gc.Equals, 1)
+
+	// When the resolved URLs expire, they are resolved again.
+	now := time.Now().Add(time.Minute)
+	charmrepo.SetSeriesCacheNow(repo.SeriesCache(), func() time.Time {
+		return now
+	})
+	_, _, err := repo.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(store.metaRequests, gc.Equals, 2)
+
+	// By default there is no cache.
+	repo = charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	c.Assert(repo.SeriesCache(), gc.IsNil)
+}
+
+func (s *seriesCacheSuite) TestResolveErrorNotCached(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+
+	cache := charmrepo.NewSeriesCache(time.Minute)
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	}).WithSeriesCache(cache)
+	_, _, err := repo.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.ErrorMatches, `cannot resolve URL "cs:~bob/mysql": charm or bundle not found`)
+
+	store.addCharm("cs:~bob/xenial/mysql-5")
+	id, _, err := repo.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/xenial/mysql-5")
+}
+
+func (s *seriesCacheSuite) TestCacheSharedBetweenStores(c *gc.C) {
+	store1 := newFakeStore()
+	defer store1.Close()
+	store1.addCharm("cs:~bob/mysql-5", "xenial")
+	store2 := newFakeStore()
+	defer store2.Close()
+	store2.addCharm("cs:~bob/mysql-7", "bionic")
+
+	cache := charmrepo.NewSeriesCache(time.Minute)
+	repo1 := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store1.URL,
+	}).WithSeriesCache(cache)
+	repo2 := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store2.URL,
+	}).WithSeriesCache(cache)
+
+	// Each store resolves the same URL to its own charm.
+	id, series, err := repo1.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/mysql-5")
+	c.Assert(series, jc.DeepEquals, []string{"xenial"})
+	id, series, err = repo2.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/mysql-7")
+	c.Assert(series, jc.DeepEquals, []string{"bionic"})
+	c.Assert(store1.metaRequests, gc.Equals, 1)
+	c.Assert(store2.metaRequests, gc.Equals, 1)
+
+	_, ok := repo2.CachedSupportedSeries(charm.MustParseURL("cs:~bob/mysql-5"))
+	c.Assert(ok, jc.IsFalse)
+	series, ok = repo1.CachedSupportedSeries(charm.MustParseURL("cs:~bob/mysql-5"))
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(series, jc.DeepEquals, []string{"xenial"})
+
+	// Repositories using the same store as different users
+	// do not share resolved URLs.
+	repo3 := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL:      store1.URL,
+		User:     "alice",
+		Password: "secret",
+	}).WithSeriesCache(cache)
+	_, _, err = repo3.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(store1.metaRequests, gc.Equals, 2)
+
+	// Repositories using the same store as the same user do.
+	repo4 := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store1.URL,
+	}).WithSeriesCache(cache)
+	_, _, err = repo4.Resolve(charm.MustParseURL("cs:~bob/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(store1.metaRequests, gc.Equals, 2)
+}
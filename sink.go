@@ -0,0 +1,205 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// ArchiveSink represents a destination for a charm or bundle
+// archive retrieved from a repository.
+//
+// The archive data is written with WriteAt. When all of the data has
+// been written and verified, Commit is called; if the archive cannot
+// be retrieved or verified, Abort is called instead. Exactly one of
+// Commit or Abort is called.
+type ArchiveSink interface {
+	io.WriterAt
+
+	// Commit makes the archive available at its destination.
+	Commit() error
+
+	// Abort discards any data written.
+	Abort() error
+}
+
+// FileArchiveSink is an ArchiveSink that writes the archive
+// to a file. The data is written to a temporary file in the
+// same directory, which is renamed when the sink is committed,
+// so that the file is never seen partially written.
+type FileArchiveSink struct {
+	path string
+	file *os.File
+}
+
+var _ ArchiveSink = (*FileArchiveSink)(nil)
+
+// NewFileArchiveSink returns a sink that writes to a file with the
+// given path. Note that the path's parent directory must already exist.
+//
+// A new file is created with the usual permissions (0666 less the
+// umask); a file that is replaced keeps its permissions.
+func NewFileArchiveSink(path string) (*FileArchiveSink, error) {
+	file, err := createTempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &FileArchiveSink{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Path returns the path of the file that the archive is written to.
+func (s *FileArchiveSink) Path() string {
+	return s.path
+}
+
+// WriteAt implements io.WriterAt.
+func (s *FileArchiveSink) WriteAt(p []byte, off int64) (int, error) {
+	return s.file.WriteAt(p, off)
+}
+
+// Commit implements ArchiveSink.Commit by renaming
+// the temporary file to its final path.
+func (s *FileArchiveSink) Commit() error {
+	if err := s.file.Close(); err != nil {
+		os.Remove(s.file.Name())
+		return errgo.Mask(err)
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		if err := os.Chmod(s.file.Name(), info.Mode().Perm()); err != nil {
+			os.Remove(s.file.Name())
+			return errgo.Mask(err)
+		}
+	}
+	if err := os.Rename(s.file.Name(), s.path); err != nil {
+		os.Remove(s.file.Name())
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Abort implements ArchiveSink.Abort by removing the temporary file.
+func (s *FileArchiveSink) Abort() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// createTempFile creates a new file in the given directory with a name
+// starting with the given prefix. Unlike ioutil.TempFile, which always
+// uses mode 0600, the file is created with mode 0666 less the umask, as
+// it will be renamed to a file that should be readable like any other.
+func createTempFile(dir, prefix string) (*os.File, error) {
+	var suffix [8]byte
+	for i := 0; ; i++ {
+		if _, err := rand.Read(suffix[:]); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		name := filepath.Join(dir, prefix+hex.EncodeToString(suffix[:]))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return f, nil
+	}
+}
+
+// MemoryArchiveSink is an ArchiveSink that holds the archive in memory.
+type MemoryArchiveSink struct {
+	mu        sync.Mutex
+	data      []byte
+	committed bool
+}
+
+var _ ArchiveSink = (*MemoryArchiveSink)(nil)
+
+// WriteAt implements io.WriterAt.
+func (s *MemoryArchiveSink) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < 0 {
+		return 0, errgo.Newf("negative offset")
+	}
+	if end := off + int64(len(p)); end > int64(len(s.data)) {
+		s.data = append(s.data, make([]byte, end-int64(len(s.data)))...)
+	}
+	return copy(s.data[off:], p), nil
+}
+
+// Commit implements ArchiveSink.Commit.
+func (s *MemoryArchiveSink) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed = true
+	return nil
+}
+
+// Abort implements ArchiveSink.Abort.
+func (s *MemoryArchiveSink) Abort() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = nil
+	return nil
+}
+
+// Bytes returns the archive data. It returns nil
+// if the sink has not been committed.
+func (s *MemoryArchiveSink) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.committed {
+		return nil
+	}
+	return s.data
+}
+
+// offsetWriter implements io.Writer by writing
+// sequentially to an io.WriterAt.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+// Write implements io.Writer.
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// GetToSink retrieves the archive of the charm or bundle referenced by
+// curl and writes it to the given sink, committing the sink once the
+// archive has been verified or aborting it if there was an error.
+func (s *CharmStore) GetToSink(curl *charm.URL, sink ArchiveSink) error {
+	if err := s.getArchive(curl, &offsetWriter{w: sink}); err != nil {
+		sink.Abort()
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := sink.Commit(); err != nil {
+		return errgo.Notef(err, "cannot commit archive")
+	}
+	return nil
+}
+
+// getToFile retrieves the archive of the charm or
+// bundle referenced by curl into the given file.
+func (s *CharmStore) getToFile(curl *charm.URL, archivePath string) error {
+	sink, err := NewFileArchiveSink(archivePath)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.GetToSink(curl, sink), errgo.Any)
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7"
+)
+
+type sinkSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&sinkSuite{})
+
+func (s *sinkSuite) TestGetToMemorySink(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/xenial/wordpress-1")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	var sink charmrepo.MemoryArchiveSink
+	err := repo.GetToSink(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), &sink)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sink.Bytes(), jc.DeepEquals, e.archive)
+}
+
+func (s *sinkSuite) TestGetToFileSink(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	e := store.addCharm("cs:~bob/xenial/wordpress-1")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	dir := c.MkDir()
+	path := filepath.Join(dir, "wordpress.charm")
+	sink, err := charmrepo.NewFileArchiveSink(path)
+	c.Assert(err, gc.IsNil)
+	err = repo.GetToSink(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), sink)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, jc.DeepEquals, e.archive)
+
+	// No temporary files are left behind.
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 1)
+}
+
+func (s *sinkSuite) TestFileArchiveSinkMode(c *gc.C) {
+	if runtime.GOOS == "windows" {
+		c.Skip("file permissions are not supported on windows")
+	}
+	dir := c.MkDir()
+	// Find the mode that new files are created with.
+	f, err := os.OpenFile(filepath.Join(dir, "probe"), os.O_CREATE|os.O_WRONLY, 0666)
+	c.Assert(err, gc.IsNil)
+	f.Close()
+	probe, err := os.Stat(f.Name())
+	c.Assert(err, gc.IsNil)
+
+	path := filepath.Join(dir, "archive")
+	sink, err := charmrepo.NewFileArchiveSink(path)
+	c.Assert(err, gc.IsNil)
+	_, err = sink.WriteAt([]byte("data"), 0)
+	c.Assert(err, gc.IsNil)
+	err = sink.Commit()
+	c.Assert(err, gc.IsNil)
+	info, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, probe.Mode().Perm())
+
+	// A replaced file keeps its mode.
+	err = os.Chmod(path, 0640)
+	c.Assert(err, gc.IsNil)
+	sink, err = charmrepo.NewFileArchiveSink(path)
+	c.Assert(err, gc.IsNil)
+	err = sink.Commit()
+	c.Assert(err, gc.IsNil)
+	info, err = os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0640))
+}
+
+func (s *sinkSuite) TestGetToSinkAbortsOnError(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	dir := c.MkDir()
+	sink, err := charmrepo.NewFileArchiveSink(filepath.Join(dir, "wordpress.charm"))
+	c.Assert(err, gc.IsNil)
+	err = repo.GetToSink(charm.MustParseURL("cs:~bob/xenial/wordpress-1"), sink)
+	c.Assert(err, gc.ErrorMatches, `cannot retrieve "cs:~bob/xenial/wordpress-1": charm not found`)
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 0)
+}
+
+func (s *sinkSuite) TestMemoryArchiveSinkAbort(c *gc.C) {
+	var sink charmrepo.MemoryArchiveSink
+	_, err := sink.WriteAt([]byte("world"), 6)
+	c.Assert(err, gc.IsNil)
+	_, err = sink.WriteAt([]byte("hello "), 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sink.Bytes(), gc.IsNil)
+	err = sink.Commit()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(sink.Bytes()), gc.Equals, "hello world")
+	err = sink.Abort()
+	c.Assert(err, gc.IsNil)
+	c.Assert(sink.Bytes(), gc.HasLen, 0)
+}
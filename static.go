@@ -0,0 +1,216 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// StaticIndexFile holds the name of the index file
+// of a static repository.
+const StaticIndexFile = "index.json"
+
+// NewStaticRepoParams holds parameters for instantiating
+// a new StaticRepo.
+type NewStaticRepoParams struct {
+	// URL holds the URL of the directory holding
+	// the index file and the archives.
+	URL string
+
+	// HTTPClient holds the client used to make requests.
+	// If it is nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// StaticRepo is a repository Interface that serves charms and bundles
+// from a static repository: a directory served by any web server that
+// holds the archives and a JSON index file, named by StaticIndexFile,
+// that records the URL, file name and SHA384 hash of each archive:
+//
+//	{
+//		"entries": [{
+//			"url": "cs:~bob/wordpress-3",
+//			"file": "bob-wordpress-3.charm",
+//			"hash": "<hex-encoded SHA384 hash>",
+//			"supported-series": ["focal", "jammy"]
+//		}]
+//	}
+//
+// The file names are relative to the index file. URLs are resolved in
+// the same way as by the charm store, and every downloaded archive is
+// verified against its hash. A static repository can be created from
+// an ArchiveDir with WriteStaticIndex.
+//
+// The index is read when it is first needed, and again after
+// ReloadIndex is called.
+type StaticRepo struct {
+	url    string
+	client *http.Client
+	index  *remoteArchiveIndex
+}
+
+var _ Interface = (*StaticRepo)(nil)
+
+// NewStaticRepo returns a repository that serves archives
+// from the static repository at the given URL.
+func NewStaticRepo(p NewStaticRepoParams) *StaticRepo {
+	if p.HTTPClient == nil {
+		p.HTTPClient = http.DefaultClient
+	}
+	r := &StaticRepo{
+		url:    strings.TrimSuffix(p.URL, "/"),
+		client: p.HTTPClient,
+	}
+	r.index = &remoteArchiveIndex{
+		name:        StaticIndexFile,
+		unmarshal:   json.Unmarshal,
+		get:         r.get,
+		requireHash: true,
+	}
+	return r
+}
+
+// ReloadIndex discards the index read from the repository,
+// so that it is read again when next needed.
+func (r *StaticRepo) ReloadIndex() {
+	r.index.reload()
+}
+
+// Resolve implements Interface.Resolve.
+func (r *StaticRepo) Resolve(ref *charm.URL) (*charm.URL, []string, error) {
+	e, err := r.index.resolve(ref)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return e.id, e.supportedSeries(), nil
+}
+
+// Get implements Interface.Get.
+func (r *StaticRepo) Get(curl *charm.URL, archivePath string) (*charm.CharmArchive, error) {
+	if curl.Series == "bundle" {
+		return nil, errgo.Newf("expected a charm URL, got bundle URL %q", curl)
+	}
+	if err := r.index.getToFile(curl, archivePath); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return charm.ReadCharmArchive(archivePath)
+}
+
+// GetBundle implements Interface.GetBundle.
+func (r *StaticRepo) GetBundle(curl *charm.URL, archivePath string) (charm.Bundle, error) {
+	if curl.Series != "bundle" {
+		return nil, errgo.Newf("expected a bundle URL, got charm URL %q", curl)
+	}
+	if err := r.index.getToFile(curl, archivePath); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return charm.ReadBundleArchive(archivePath)
+}
+
+// get gets the file with the given name from the repository.
+// The response body must be closed after use.
+func (r *StaticRepo) get(name string) (*http.Response, error) {
+	u := r.url + "/" + (&url.URL{Path: name}).EscapedPath()
+	resp, err := r.client.Get(u)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errgo.Newf("unexpected response status %q for %q", resp.Status, name)
+	}
+	return resp, nil
+}
+
+// remoteArchiveIndex holds an archive index that is read
+// from a server when it is first needed.
+type remoteArchiveIndex struct {
+	// name holds the name of the index file.
+	name string
+
+	// unmarshal holds the function used to decode the index file.
+	unmarshal func([]byte, interface{}) error
+
+	// get gets the file with the given name from the server.
+	get func(name string) (*http.Response, error)
+
+	// requireHash holds whether every entry in the
+	// index must record the hash of its archive.
+	requireHash bool
+
+	mu    sync.Mutex
+	index *archiveIndex
+}
+
+// reload discards the index, so that it is read again when next needed.
+func (r *remoteArchiveIndex) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.index = nil
+}
+
+// resolve returns the index entry that ref refers to,
+// reading the index if needed.
+func (r *remoteArchiveIndex) resolve(ref *charm.URL) (archiveIndexEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index == nil {
+		index, err := r.read()
+		if err != nil {
+			return archiveIndexEntry{}, errgo.Mask(err)
+		}
+		r.index = index
+	}
+	return r.index.resolve(ref)
+}
+
+// read reads the index file from the server.
+func (r *remoteArchiveIndex) read() (*archiveIndex, error) {
+	resp, err := r.get(r.name)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive index")
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive index")
+	}
+	var index archiveIndex
+	if err := index.parse(data, r.unmarshal); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if r.requireHash {
+		for _, e := range index.Entries {
+			if e.Hash == "" {
+				return nil, errgo.Newf("no hash for %q in archive index", e.URL)
+			}
+		}
+	}
+	return &index, nil
+}
+
+// getToFile copies the archive of the charm or bundle
+// referenced by curl into the given file.
+func (r *remoteArchiveIndex) getToFile(curl *charm.URL, archivePath string) error {
+	e, err := r.resolve(curl)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	resp, err := r.get(e.File)
+	if err != nil {
+		return errgo.Notef(err, "cannot get archive for %q", e.id)
+	}
+	defer resp.Body.Close()
+	return errgo.Mask(writeIndexedArchive(e, resp.Body, resp.ContentLength, archivePath), errgo.Any)
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient"
+	"github.com/juju/charmrepo/v7/csclient/params"
+	charmtesting "github.com/juju/charmrepo/v7/testing"
+)
+
+type staticRepoSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&staticRepoSuite{})
+
+func (s *staticRepoSuite) TestGet(c *gc.C) {
+	charmPath := filepath.Join(c.MkDir(), "wordpress.charm")
+	err := ioutil.WriteFile(charmPath, charmtesting.NewCharmMeta(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "test charm",
+		Series:  []string{"focal", "jammy"},
+	}).ArchiveBytes(), 0644)
+	c.Assert(err, gc.IsNil)
+	bundlePath := filepath.Join(c.MkDir(), "wordpress-simple.bundle")
+	writeArchive(c, bundlePath, TestCharms.BundleDir("wordpress-simple"))
+
+	dir, err := charmrepo.NewArchiveDir(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	err = dir.Add(charm.MustParseURL("cs:~bob/wordpress-3"), charmPath)
+	c.Assert(err, gc.IsNil)
+	err = dir.Add(charm.MustParseURL("cs:bundle/wordpress-simple-1"), bundlePath)
+	c.Assert(err, gc.IsNil)
+	err = dir.WriteStaticIndex()
+	c.Assert(err, gc.IsNil)
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir.Dir())))
+	defer srv.Close()
+	repo := charmrepo.NewStaticRepo(charmrepo.NewStaticRepoParams{
+		URL: srv.URL,
+	})
+	id, series, err := repo.Resolve(charm.MustParseURL("cs:~bob/jammy/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/wordpress-3")
+	c.Assert(series, jc.DeepEquals, []string{"focal", "jammy"})
+
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/xenial/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot resolve URL "cs:~bob/xenial/wordpress": charm not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	ch, err := repo.Get(id, filepath.Join(c.MkDir(), "wordpress.charm"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ch.Meta().Name, gc.Equals, "wordpress")
+
+	b, err := repo.GetBundle(charm.MustParseURL("cs:bundle/wordpress-simple"), filepath.Join(c.MkDir(), "bundle"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(b.Data().Applications, gc.HasLen, 2)
+
+	// Archives that do not match the index are rejected.
+	err = ioutil.WriteFile(filepath.Join(dir.Dir(), "~bob_wordpress-3.charm"), []byte("bad"), 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = repo.Get(id, filepath.Join(c.MkDir(), "wordpress.charm"))
+	_, ok := errgo.Cause(err).(*csclient.HashMismatchError)
+	c.Assert(ok, jc.IsTrue, gc.Commentf("error %v", err))
+}
+
+func (s *staticRepoSuite) TestIndexWithoutHash(c *gc.C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, charmrepo.StaticIndexFile), []byte(`{
+		"entries": [{"url": "cs:~bob/wordpress-3", "file": "bob-wordpress-3.charm"}]
+	}`), 0644)
+	c.Assert(err, gc.IsNil)
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+	repo := charmrepo.NewStaticRepo(charmrepo.NewStaticRepoParams{
+		URL: srv.URL + "/",
+	})
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `no hash for "cs:~bob/wordpress-3" in archive index`)
+
+	repo = charmrepo.NewStaticRepo(charmrepo.NewStaticRepoParams{
+		URL: srv.URL + "/nothere",
+	})
+	_, _, err = repo.Resolve(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot read archive index: unexpected response status "404 Not Found" for "index.json"`)
+}
@@ -0,0 +1,204 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package testing // import "github.com/juju/charmrepo/v7/testing"
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// RepoManifest describes the contents of a testing charm repository.
+// It is usually read from YAML with ReadRepoManifest, for example:
+//
+//	charms:
+//	- name: wordpress
+//	  series: [quantal, xenial]
+//	  revision: 3
+//	  resources:
+//	    data:
+//	      type: file
+//	      filename: data.zip
+//	bundles:
+//	- name: wordpress-simple
+//	  applications:
+//	    wordpress:
+//	      charm: wordpress
+//	      num_units: 1
+type RepoManifest struct {
+	Charms  []CharmManifest  `yaml:"charms"`
+	Bundles []BundleManifest `yaml:"bundles"`
+}
+
+// CharmManifest describes a charm in a RepoManifest.
+type CharmManifest struct {
+	// Name holds the name of the charm.
+	Name string `yaml:"name"`
+
+	// Series holds the series directories that the
+	// charm is created in.
+	Series []string `yaml:"series"`
+
+	// Revision holds the revision of the charm.
+	Revision int `yaml:"revision"`
+
+	// Summary holds the summary of the charm. If it
+	// is empty, a summary is made up from the name.
+	Summary string `yaml:"summary"`
+
+	// Provides and Requires map relation names to interfaces.
+	Provides map[string]string `yaml:"provides"`
+	Requires map[string]string `yaml:"requires"`
+
+	// Resources holds the resources declared by the charm.
+	Resources map[string]ResourceManifest `yaml:"resources"`
+}
+
+// ResourceManifest describes a resource declared by a charm
+// in a RepoManifest.
+type ResourceManifest struct {
+	Type        string `yaml:"type"`
+	Filename    string `yaml:"filename,omitempty"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// BundleManifest describes a bundle in a RepoManifest.
+type BundleManifest struct {
+	// Name holds the name of the bundle.
+	Name string `yaml:"name"`
+
+	// Applications holds the applications in the bundle.
+	Applications map[string]ApplicationManifest `yaml:"applications"`
+
+	// Relations holds the relations between the applications.
+	Relations [][]string `yaml:"relations,omitempty"`
+}
+
+// ApplicationManifest describes an application in a BundleManifest.
+type ApplicationManifest struct {
+	Charm    string `yaml:"charm"`
+	NumUnits int    `yaml:"num_units"`
+}
+
+// ReadRepoManifest reads a RepoManifest in YAML format from r.
+func ReadRepoManifest(r io.Reader) (*RepoManifest, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var m RepoManifest
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, errgo.Notef(err, "cannot parse repository manifest")
+	}
+	return &m, nil
+}
+
+// Write creates a charm repository described by the manifest
+// in the directory dir, which is created if needed. Charms are
+// written to a directory for each of their series and bundles to
+// the "bundle" directory.
+func (m *RepoManifest) Write(dir string) error {
+	for _, ch := range m.Charms {
+		if len(ch.Series) == 0 {
+			return errgo.Newf("no series specified for charm %q", ch.Name)
+		}
+		for _, series := range ch.Series {
+			if err := writeCharm(filepath.Join(dir, series, ch.Name), ch); err != nil {
+				return errgo.Notef(err, "cannot write charm %q", ch.Name)
+			}
+		}
+	}
+	for _, b := range m.Bundles {
+		if err := writeBundle(filepath.Join(dir, "bundle", b.Name), b); err != nil {
+			return errgo.Notef(err, "cannot write bundle %q", b.Name)
+		}
+	}
+	return nil
+}
+
+// GenerateRepo creates the charm repository described by the given
+// YAML manifest in dir and returns a Repo rooted there, using
+// defaultSeries as the default series.
+func GenerateRepo(dir string, manifest io.Reader, defaultSeries string) (*Repo, error) {
+	m, err := ReadRepoManifest(manifest)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := m.Write(dir); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &Repo{
+		path:          dir,
+		defaultSeries: defaultSeries,
+	}, nil
+}
+
+func writeCharm(dir string, ch CharmManifest) error {
+	summary := ch.Summary
+	if summary == "" {
+		summary = fmt.Sprintf("The %s charm", ch.Name)
+	}
+	meta := yaml.MapSlice{
+		{Key: "name", Value: ch.Name},
+		{Key: "summary", Value: summary},
+		{Key: "description", Value: summary},
+	}
+	if len(ch.Provides) > 0 {
+		meta = append(meta, yaml.MapItem{Key: "provides", Value: ch.Provides})
+	}
+	if len(ch.Requires) > 0 {
+		meta = append(meta, yaml.MapItem{Key: "requires", Value: ch.Requires})
+	}
+	if len(ch.Resources) > 0 {
+		meta = append(meta, yaml.MapItem{Key: "resources", Value: ch.Resources})
+	}
+	metaData, err := yaml.Marshal(meta)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return writeFiles(dir, []generatedFile{
+		{"metadata.yaml", metaData, 0644},
+		{"revision", []byte(strconv.Itoa(ch.Revision) + "\n"), 0644},
+		{"hooks/install", []byte("#!/bin/sh\n"), 0755},
+	})
+}
+
+func writeBundle(dir string, b BundleManifest) error {
+	data, err := yaml.Marshal(struct {
+		Applications map[string]ApplicationManifest `yaml:"applications"`
+		Relations    [][]string                     `yaml:"relations,omitempty"`
+	}{b.Applications, b.Relations})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return writeFiles(dir, []generatedFile{
+		{"bundle.yaml", data, 0644},
+		{"README.md", []byte("A generated bundle\n"), 0644},
+	})
+}
+
+type generatedFile struct {
+	path string
+	data []byte
+	perm os.FileMode
+}
+
+func writeFiles(dir string, files []generatedFile) error {
+	for _, f := range files {
+		path := filepath.Join(dir, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := ioutil.WriteFile(path, f.data, f.perm); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
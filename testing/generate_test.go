@@ -0,0 +1,70 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package testing_test // import "github.com/juju/charmrepo/v7/testing"
+
+import (
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/charmrepo/v7/testing"
+)
+
+var _ = gc.Suite(&generateSuite{})
+
+type generateSuite struct{}
+
+const testRepoManifest = `
+charms:
+- name: wordpress
+  series: [quantal, xenial]
+  revision: 3
+  requires:
+    db: mysql
+  resources:
+    data:
+      type: file
+      filename: data.zip
+- name: mysql
+  series: [quantal]
+  provides:
+    server: mysql
+bundles:
+- name: wordpress-simple
+  applications:
+    wordpress:
+      charm: wordpress
+      num_units: 1
+    mysql:
+      charm: mysql
+      num_units: 1
+  relations:
+  - ["wordpress:db", "mysql:server"]
+`
+
+func (*generateSuite) TestGenerateRepo(c *gc.C) {
+	repo, err := testing.GenerateRepo(c.MkDir(), strings.NewReader(testRepoManifest), "quantal")
+	c.Assert(err, jc.ErrorIsNil)
+
+	ch := repo.CharmDir("wordpress")
+	c.Assert(ch.Meta().Name, gc.Equals, "wordpress")
+	c.Assert(ch.Revision(), gc.Equals, 3)
+	c.Assert(ch.Meta().Requires["db"].Interface, gc.Equals, "mysql")
+	c.Assert(ch.Meta().Resources["data"].Path, gc.Equals, "data.zip")
+
+	c.Assert(repo.CharmDir("mysql").Meta().Provides["server"].Interface, gc.Equals, "mysql")
+
+	b := repo.BundleDir("wordpress-simple")
+	c.Assert(b.Data().Applications, gc.HasLen, 2)
+	c.Assert(b.Data().Relations, jc.DeepEquals, [][]string{{"wordpress:db", "mysql:server"}})
+}
+
+func (*generateSuite) TestGenerateRepoBadManifest(c *gc.C) {
+	_, err := testing.GenerateRepo(c.MkDir(), strings.NewReader("charms: [{name: foo, unknown: 1}]"), "quantal")
+	c.Assert(err, gc.ErrorMatches, `cannot parse repository manifest: (.|\n)*field unknown not found(.|\n)*`)
+
+	_, err = testing.GenerateRepo(c.MkDir(), strings.NewReader("charms: [{name: foo}]"), "quantal")
+	c.Assert(err, gc.ErrorMatches, `no series specified for charm "foo"`)
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo // import "github.com/juju/charmrepo/v7"
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+// Default concurrency used by CharmStore.Upgrade.
+const (
+	defaultResolveConcurrency  = 10
+	defaultDownloadConcurrency = 4
+)
+
+// UpgradeCharm identifies a deployed charm that
+// may need to be upgraded.
+type UpgradeCharm struct {
+	// URL holds the URL of the currently deployed charm,
+	// including its revision.
+	URL *charm.URL
+
+	// Channel holds the channel to look for new revisions in.
+	// If this is empty, the channel of the charm store
+	// client is used.
+	Channel params.Channel
+}
+
+// UpgradeParams holds the parameters for CharmStore.Upgrade.
+type UpgradeParams struct {
+	// Charms holds the charms to check for upgrades.
+	Charms []UpgradeCharm
+
+	// Dir holds the directory that downloaded
+	// archives are written to. It must already exist.
+	Dir string
+
+	// ResolveConcurrency holds the maximum number of
+	// resolve requests made at once. If this is zero,
+	// a default is used.
+	ResolveConcurrency int
+
+	// DownloadConcurrency holds the maximum number of
+	// archives that are downloaded at once. It also
+	// bounds the number of resolved charms waiting to be
+	// downloaded, so resolution does not run far ahead
+	// of the downloads. If this is zero, a default is used.
+	DownloadConcurrency int
+}
+
+// UpgradeResult holds the result of checking a single
+// charm for an upgrade.
+type UpgradeResult struct {
+	// URL holds the URL of the deployed charm.
+	URL *charm.URL
+
+	// Latest holds the URL of the latest revision
+	// of the charm in the requested channel.
+	Latest *charm.URL
+
+	// Channel holds the channel that the charm was resolved in.
+	Channel params.Channel
+
+	// Archive holds the downloaded archive of the latest
+	// revision, or nil if the deployed charm is already
+	// the latest revision.
+	Archive *charm.CharmArchive
+
+	// Err holds any error encountered when resolving
+	// or downloading the charm.
+	Err error
+}
+
+// NeedsUpgrade reports whether a newer revision of the
+// charm is available.
+func (r UpgradeResult) NeedsUpgrade() bool {
+	return r.Latest != nil && r.Latest.Revision != r.URL.Revision
+}
+
+// Upgrade resolves the latest revision of each of the given charms
+// and downloads the archives of those that need upgrading, returning
+// a result for each charm in the same order.
+//
+// Resolution and downloads are pipelined: charms are downloaded as soon
+// as they have been resolved, while other charms are still being resolved.
+// A charm that appears more than once is only downloaded once.
+func (s *CharmStore) Upgrade(p UpgradeParams) []UpgradeResult {
+	if p.ResolveConcurrency <= 0 {
+		p.ResolveConcurrency = defaultResolveConcurrency
+	}
+	if p.DownloadConcurrency <= 0 {
+		p.DownloadConcurrency = defaultDownloadConcurrency
+	}
+	results := make([]UpgradeResult, len(p.Charms))
+	toResolve := make(chan int)
+	toDownload := make(chan int, p.DownloadConcurrency)
+
+	// Resolve the charms.
+	var resolveWG sync.WaitGroup
+	for i := 0; i < p.ResolveConcurrency; i++ {
+		resolveWG.Add(1)
+		go func() {
+			defer resolveWG.Done()
+			for i := range toResolve {
+				if s.resolveUpgrade(&results[i], p.Charms[i]) {
+					toDownload <- i
+				}
+			}
+		}()
+	}
+
+	// Download the archives.
+	d := &upgradeDownloader{
+		store:     s,
+		dir:       p.Dir,
+		downloads: make(map[string]*upgradeDownload),
+	}
+	var downloadWG sync.WaitGroup
+	for i := 0; i < p.DownloadConcurrency; i++ {
+		downloadWG.Add(1)
+		go func() {
+			defer downloadWG.Done()
+			for i := range toDownload {
+				results[i].Archive, results[i].Err = d.get(results[i].Latest)
+			}
+		}()
+	}
+
+	for i := range p.Charms {
+		toResolve <- i
+	}
+	close(toResolve)
+	resolveWG.Wait()
+	close(toDownload)
+	downloadWG.Wait()
+	return results
+}
+
+// resolveUpgrade resolves the latest revision of the given charm,
+// filling out the given result. It reports whether the latest
+// revision should be downloaded.
+func (s *CharmStore) resolveUpgrade(result *UpgradeResult, ch UpgradeCharm) bool {
+	result.URL = ch.URL
+	latest, channel, _, err := s.ResolveWithPreferredChannel(ch.URL.WithRevision(-1), ch.Channel)
+	if err != nil {
+		result.Err = errgo.Mask(err, errgo.Any)
+		return false
+	}
+	if latest.Series == "" {
+		// A multi-series charm: keep the deployed series.
+		latest = latest.WithSeries(ch.URL.Series)
+	}
+	result.Latest = latest
+	result.Channel = channel
+	return result.NeedsUpgrade()
+}
+
+// upgradeDownloader downloads charm archives,
+// making sure that each is downloaded only once.
+type upgradeDownloader struct {
+	store *CharmStore
+	dir   string
+
+	mu        sync.Mutex
+	downloads map[string]*upgradeDownload
+}
+
+type upgradeDownload struct {
+	done    chan struct{}
+	archive *charm.CharmArchive
+	err     error
+}
+
+// get returns the archive for the given charm,
+// downloading it if that has not already been done.
+func (d *upgradeDownloader) get(curl *charm.URL) (*charm.CharmArchive, error) {
+	key := curl.String()
+	d.mu.Lock()
+	dl, ok := d.downloads[key]
+	if !ok {
+		dl = &upgradeDownload{
+			done: make(chan struct{}),
+		}
+		d.downloads[key] = dl
+	}
+	d.mu.Unlock()
+	if ok {
+		<-dl.done
+		return dl.archive, dl.err
+	}
+	path := filepath.Join(d.dir, strings.Replace(curl.Path(), "/", "_", -1)+".charm")
+	dl.archive, dl.err = d.store.Get(curl, path)
+	if dl.err != nil {
+		dl.err = errgo.Mask(dl.err, errgo.Any)
+	}
+	close(dl.done)
+	return dl.archive, dl.err
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package charmrepo_test
+
+import (
+	"sort"
+
+	"github.com/juju/charm/v9"
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmrepo/v7"
+	"github.com/juju/charmrepo/v7/csclient/params"
+)
+
+type upgradeSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&upgradeSuite{})
+
+func (s *upgradeSuite) TestUpgrade(c *gc.C) {
+	store := newFakeStore()
+	defer store.Close()
+	store.addCharm("cs:~bob/xenial/wordpress-1")
+	store.addCharm("cs:~bob/xenial/wordpress-3")
+	store.addCharm("cs:~bob/mysql-5", "xenial", "bionic")
+
+	repo := charmrepo.NewCharmStore(charmrepo.NewCharmStoreParams{
+		URL: store.URL,
+	})
+	results := repo.Upgrade(charmrepo.UpgradeParams{
+		Charms: []charmrepo.UpgradeCharm{{
+			URL: charm.MustParseURL("cs:~bob/xenial/wordpress-1"),
+		}, {
+			URL: charm.MustParseURL("cs:~bob/bionic/mysql-5"),
+		}, {
+			URL: charm.MustParseURL("cs:~bob/xenial/wordpress-2"),
+		}, {
+			URL: charm.MustParseURL("cs:~bob/xenial/missing-2"),
+		}},
+		Dir:                 c.MkDir(),
+		ResolveConcurrency:  2,
+		DownloadConcurrency: 1,
+	})
+	c.Assert(results, gc.HasLen, 4)
+
+	c.Assert(results[0].Err, jc.ErrorIsNil)
+	c.Assert(results[0].NeedsUpgrade(), jc.IsTrue)
+	c.Assert(results[0].Latest.String(), gc.Equals, "cs:~bob/xenial/wordpress-3")
+	c.Assert(results[0].Channel, gc.Equals, params.StableChannel)
+	c.Assert(results[0].Archive.Meta().Name, gc.Equals, "wordpress")
+
+	c.Assert(results[1].Err, jc.ErrorIsNil)
+	c.Assert(results[1].NeedsUpgrade(), jc.IsFalse)
+	c.Assert(results[1].Latest.String(), gc.Equals, "cs:~bob/bionic/mysql-5")
+	c.Assert(results[1].Archive, gc.IsNil)
+
+	c.Assert(results[2].Err, jc.ErrorIsNil)
+	c.Assert(results[2].Archive, gc.Equals, results[0].Archive)
+
+	c.Assert(errgo.Cause(results[3].Err), gc.Equals, params.ErrNotFound)
+
+	// Each archive is downloaded only once.
+	sort.Strings(store.downloads)
+	c.Assert(store.downloads, jc.DeepEquals, []string{"cs:~bob/xenial/wordpress-3"})
+}